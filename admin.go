@@ -0,0 +1,226 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const adminUsage = "Usage:\n" +
+	"  yagi admin purge sessions --older-than <age> [--dry-run]\n" +
+	"  yagi admin purge memory [--user @user] --prefix <prefix> [--dry-run]\n" +
+	"  yagi admin purge guild <guild ID> [--dry-run]\n" +
+	"Ages accept Go durations plus d (days) and w (weeks), e.g. 90d."
+
+type adminCommands struct {
+	admins  map[string]bool
+	store   *sessionStore
+	mem     *memoryStore
+	dataDir string
+	blobs   storage.Blobs
+	vectors storage.VectorStore
+	guilds  *guildStore
+}
+
+func parseAdmins(s string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, id := range parseIDList(s) {
+		admins[id] = true
+	}
+	return admins
+}
+
+// parseIDList splits a comma-separated list of IDs, skipping blanks.
+func parseIDList(s string) []string {
+	var ids []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (a *adminCommands) isAdmin(userID string) bool {
+	return a.admins[userID]
+}
+
+// handle runs an admin command and returns the reply text. args excludes the
+// leading "yagi admin" words.
+func (a *adminCommands) handle(args []string) string {
+	if len(args) < 2 || args[0] != "purge" {
+		return adminUsage
+	}
+	switch args[1] {
+	case "sessions":
+		return a.purgeSessions(args[2:])
+	case "memory":
+		return a.purgeMemory(args[2:])
+	case "guild":
+		return a.purgeGuild(args[2:])
+	}
+	return adminUsage
+}
+
+func (a *adminCommands) purgeSessions(args []string) string {
+	fs := flag.NewFlagSet("purge sessions", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	olderThan := fs.String("older-than", "", "Purge sessions not updated within this age")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be purged")
+	if err := fs.Parse(args); err != nil {
+		return err.Error() + "\n" + adminUsage
+	}
+	if *olderThan == "" {
+		return "--older-than is required\n" + adminUsage
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		return err.Error()
+	}
+
+	purged, err := a.store.purge(time.Now().Add(-age), *dryRun)
+	var sb strings.Builder
+	if *dryRun {
+		fmt.Fprintf(&sb, "[dry-run] %d session(s) would be purged", len(purged))
+	} else {
+		fmt.Fprintf(&sb, "%d session(s) purged", len(purged))
+	}
+	for _, id := range purged {
+		sb.WriteString("\n- ")
+		sb.WriteString(id)
+	}
+	if err != nil {
+		sb.WriteString("\nError: ")
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+func (a *adminCommands) purgeMemory(args []string) string {
+	fs := flag.NewFlagSet("purge memory", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	user := fs.String("user", "", "Only purge memory of this user (mention or ID)")
+	prefix := fs.String("prefix", "", "Purge keys starting with this prefix")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be purged")
+	if err := fs.Parse(args); err != nil {
+		return err.Error() + "\n" + adminUsage
+	}
+	if *prefix == "" {
+		return "--prefix is required\n" + adminUsage
+	}
+
+	purged, err := a.mem.purge(parseUserMention(*user), *prefix, *dryRun)
+	users := make([]string, 0, len(purged))
+	total := 0
+	for u, keys := range purged {
+		users = append(users, u)
+		total += len(keys)
+	}
+	sort.Strings(users)
+
+	var sb strings.Builder
+	if *dryRun {
+		fmt.Fprintf(&sb, "[dry-run] %d memory entries would be purged", total)
+	} else {
+		fmt.Fprintf(&sb, "%d memory entries purged", total)
+	}
+	for _, u := range users {
+		fmt.Fprintf(&sb, "\n- %s: %s", u, strings.Join(purged[u], ", "))
+	}
+	if err != nil {
+		sb.WriteString("\nError: ")
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// purgeGuild deletes everything stored in a guild's namespace: its
+// settings, the conversations and topic archives held there, memory scoped
+// to the guild or its channels, and their embeddings.
+func (a *adminCommands) purgeGuild(args []string) string {
+	fs := flag.NewFlagSet("purge guild", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry-run", false, "Only count what would be purged")
+	// Accept the flag after the guild ID as well.
+	var guildID string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		guildID, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return err.Error() + "\n" + adminUsage
+	}
+	if guildID == "" && fs.NArg() > 0 {
+		guildID = fs.Arg(0)
+	}
+	if _, err := strconv.ParseUint(guildID, 10, 64); err != nil {
+		return "A numeric guild ID is required\n" + adminUsage
+	}
+	ns := storage.Namespace(guildID)
+
+	keys, err := a.blobs.List(ns)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	files := 0
+	filepath.WalkDir(filepath.Join(a.dataDir, filepath.FromSlash(ns)), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files++
+		}
+		return nil
+	})
+	if *dryRun {
+		return fmt.Sprintf("[dry-run] guild %s: %d stored document(s) and %d file(s) would be purged", guildID, len(keys), files)
+	}
+
+	a.store.evict(ns)
+	if _, err := storage.DeleteNamespace(a.blobs, ns); err != nil {
+		return "Error: " + err.Error()
+	}
+	if err := a.vectors.DropNamespace(ns); err != nil {
+		return "Error: " + err.Error()
+	}
+	if err := a.guilds.forget(guildID); err != nil {
+		return "Error: " + err.Error()
+	}
+	if err := os.RemoveAll(filepath.Join(a.dataDir, filepath.FromSlash(ns))); err != nil {
+		return "Error: " + err.Error()
+	}
+	return fmt.Sprintf("Guild %s purged: %d stored document(s) and %d file(s)", guildID, len(keys), files)
+}
+
+// parseAge is like time.ParseDuration but also accepts a single "d" (day) or
+// "w" (week) unit, as in "90d".
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid age: %s", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age: %s", s)
+	}
+	return d, nil
+}
+
+// parseUserMention extracts the user ID from "<@id>" or "<@!id>", returning
+// the input unchanged if it is not a mention.
+func parseUserMention(s string) string {
+	if strings.HasPrefix(s, "<@") && strings.HasSuffix(s, ">") {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "<@"), ">")
+		s = strings.TrimPrefix(s, "!")
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// analyticsEvent is one handled message. It deliberately carries no user,
+// channel or guild identifiers, and the timestamp is truncated to the hour.
+type analyticsEvent struct {
+	Hour      string   `json:"hour"`
+	Model     string   `json:"model"`
+	LatencyMs int64    `json:"latency_ms"`
+	Tools     []string `json:"tools,omitempty"`
+}
+
+// analyticsLog appends anonymized usage events to <data>/analytics/events.jsonl.
+// A nil *analyticsLog is valid and records nothing, so callers need not check
+// whether analytics are enabled.
+type analyticsLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newAnalyticsLog(dataDir string) *analyticsLog {
+	return &analyticsLog{path: filepath.Join(dataDir, "analytics", "events.jsonl")}
+}
+
+func (a *analyticsLog) record(model string, latency time.Duration, tools []string) {
+	if a == nil {
+		return
+	}
+	ev := analyticsEvent{
+		Hour:      time.Now().UTC().Truncate(time.Hour).Format(time.RFC3339),
+		Model:     model,
+		LatencyMs: latency.Milliseconds(),
+		Tools:     tools,
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return
+	}
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(b, '\n'))
+}
+
+type hourCount struct {
+	Hour  string `json:"hour"`
+	Count int    `json:"count"`
+}
+
+type analyticsReport struct {
+	GeneratedAt string           `json:"generated_at"`
+	Messages    int              `json:"messages"`
+	ByHour      []hourCount      `json:"by_hour"`
+	Models      map[string]int   `json:"models"`
+	Tools       map[string]int   `json:"tools"`
+	LatencyMs   map[string]int64 `json:"latency_ms"`
+}
+
+func loadAnalyticsReport(dataDir string) (*analyticsReport, error) {
+	f, err := os.Open(filepath.Join(dataDir, "analytics", "events.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &analyticsReport{
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+		Models:      map[string]int{},
+		Tools:       map[string]int{},
+		LatencyMs:   map[string]int64{},
+	}
+	hours := map[string]int{}
+	var latencies []int64
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ev analyticsEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			continue
+		}
+		r.Messages++
+		hours[ev.Hour]++
+		r.Models[ev.Model]++
+		for _, t := range ev.Tools {
+			r.Tools[t]++
+		}
+		latencies = append(latencies, ev.LatencyMs)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	for h, c := range hours {
+		r.ByHour = append(r.ByHour, hourCount{Hour: h, Count: c})
+	}
+	sort.Slice(r.ByHour, func(i, j int) bool { return r.ByHour[i].Hour < r.ByHour[j].Hour })
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []int{50, 90, 99} {
+		r.LatencyMs[fmt.Sprintf("p%d", p)] = percentile(latencies, p)
+	}
+	return r, nil
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (p*len(sorted)+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// exportAnalytics writes the aggregated report to path as CSV or JSON,
+// depending on the file extension.
+func exportAnalytics(dataDir, path string) error {
+	r, err := loadAnalyticsReport(dataDir)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"metric", "key", "value"})
+	w.Write([]string{"messages", "total", strconv.Itoa(r.Messages)})
+	for _, h := range r.ByHour {
+		w.Write([]string{"messages_by_hour", h.Hour, strconv.Itoa(h.Count)})
+	}
+	for _, k := range sortedKeys(r.Models) {
+		w.Write([]string{"model", k, strconv.Itoa(r.Models[k])})
+	}
+	for _, k := range sortedKeys(r.Tools) {
+		w.Write([]string{"tool", k, strconv.Itoa(r.Tools[k])})
+	}
+	for _, k := range []string{"p50", "p90", "p99"} {
+		w.Write([]string{"latency_ms", k, strconv.FormatInt(r.LatencyMs[k], 10)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
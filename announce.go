@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// announceCheckInterval is how often due announcements are looked for.
+	announceCheckInterval = 30 * time.Second
+	// announceMissedGrace is how late an announcement is still posted after
+	// downtime; older runs are skipped.
+	announceMissedGrace = time.Hour
+	// maxAnnouncements caps the scheduled announcements of one server.
+	maxAnnouncements = 25
+	// announceDigestMessages bounds the messages a digest reads.
+	announceDigestMessages = 1000
+
+	announcePrompt = "You are posting a scheduled message to a Discord channel. Write it according to the instructions below. " +
+		"Reply with only the message."
+)
+
+// announcement posts model-generated content to a channel on a cron
+// schedule. With Digest, the messages posted in DigestChannel (or
+// ChannelID) since the last run are summarized, and Prompt, if set, adds
+// instructions to the summary.
+type announcement struct {
+	ID            string `json:"id" yaml:"-"`
+	GuildID       string `json:"guild_id" yaml:"-"`
+	ChannelID     string `json:"channel_id" yaml:"channel"`
+	Cron          string `json:"cron" yaml:"cron"`
+	Timezone      string `json:"timezone,omitempty" yaml:"timezone"`
+	Prompt        string `json:"prompt,omitempty" yaml:"prompt"`
+	Digest        bool   `json:"digest,omitempty" yaml:"digest"`
+	DigestChannel string `json:"digest_channel,omitempty" yaml:"digest_channel"`
+	CreatedBy     string `json:"created_by,omitempty" yaml:"-"`
+	// Daily marks the end-of-day digest of a channel set with /digest; a
+	// channel has at most one.
+	Daily bool `json:"daily,omitempty" yaml:"-"`
+}
+
+// schedule parses the announcement's cron expression in its time zone.
+func (a announcement) schedule() (*cronSchedule, error) {
+	loc := time.Local
+	if a.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(a.Timezone); err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", a.Timezone)
+		}
+	}
+	return parseCron(a.Cron, loc)
+}
+
+type announceState struct {
+	// Announcements are those added with /schedule; the config file's are
+	// not stored.
+	Announcements []*announcement `json:"announcements,omitempty"`
+	// LastRun is when each announcement, by ID, was last posted.
+	LastRun map[string]time.Time `json:"last_run,omitempty"`
+	Next    int                  `json:"next,omitempty"`
+}
+
+// announcer posts the scheduled announcements of the config file's
+// "announcements" guild setting and of /schedule. Its state is kept in
+// <data>/announcements.json.
+type announcer struct {
+	path    string
+	eng     *engine.Engine
+	replies *outbox
+	// config holds the announcements from the config file, which cannot be
+	// changed with /schedule.
+	config []*announcement
+
+	mu    sync.Mutex
+	state announceState
+}
+
+func newAnnouncer(dataDir string, eng *engine.Engine, replies *outbox, defaults map[string]guildConfig) *announcer {
+	an := &announcer{
+		path:    filepath.Join(dataDir, "announcements.json"),
+		eng:     eng,
+		replies: replies,
+		state:   announceState{LastRun: make(map[string]time.Time)},
+	}
+	for guildID, cfg := range defaults {
+		if guildID == "*" {
+			continue
+		}
+		for n, a := range cfg.Announcements {
+			a.ID = fmt.Sprintf("config-%s-%d", guildID, n+1)
+			a.GuildID = guildID
+			if _, err := a.schedule(); err != nil {
+				slog.Error("invalid announcement in config", "guild", guildID, "id", a.ID, "err", err)
+				continue
+			}
+			if a.ChannelID == "" || (a.Prompt == "" && !a.Digest) {
+				slog.Error("announcement in config needs a channel and a prompt or digest", "guild", guildID, "id", a.ID)
+				continue
+			}
+			an.config = append(an.config, &a)
+		}
+	}
+	data, err := os.ReadFile(an.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read announcements", "err", err)
+		}
+		return an
+	}
+	if err := json.Unmarshal(data, &an.state); err != nil {
+		slog.Error("failed to parse announcements", "err", err)
+	}
+	if an.state.LastRun == nil {
+		an.state.LastRun = make(map[string]time.Time)
+	}
+	return an
+}
+
+// save writes the state to disk. The caller must hold an.mu.
+func (an *announcer) save() error {
+	if err := os.MkdirAll(filepath.Dir(an.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(an.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(an.path, b, 0600)
+}
+
+// list returns the announcements of guildID, those from the config file
+// first. An empty guildID yields every announcement.
+func (an *announcer) list(guildID string) []announcement {
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	var out []announcement
+	for _, a := range slices.Concat(an.config, an.state.Announcements) {
+		if guildID == "" || a.GuildID == guildID {
+			out = append(out, *a)
+		}
+	}
+	return out
+}
+
+// add schedules a and returns it with its ID set.
+func (an *announcer) add(a announcement) (announcement, error) {
+	if _, err := a.schedule(); err != nil {
+		return a, err
+	}
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	n := 0
+	for _, x := range an.state.Announcements {
+		if x.GuildID == a.GuildID {
+			n++
+		}
+	}
+	if n >= maxAnnouncements {
+		return a, fmt.Errorf("this server already has %d scheduled announcements", n)
+	}
+	an.state.Next++
+	a.ID = strconv.FormatInt(int64(an.state.Next), 36)
+	// The first run is the first match from now on.
+	an.state.LastRun[a.ID] = time.Now()
+	an.state.Announcements = append(an.state.Announcements, &a)
+	return a, an.save()
+}
+
+// remove deletes the announcement id of guildID and reports whether there
+// was one.
+func (an *announcer) remove(guildID, id string) (bool, error) {
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	n := len(an.state.Announcements)
+	an.state.Announcements = slices.DeleteFunc(an.state.Announcements, func(a *announcement) bool {
+		return a.GuildID == guildID && a.ID == id
+	})
+	if len(an.state.Announcements) == n {
+		return false, nil
+	}
+	delete(an.state.LastRun, id)
+	return true, an.save()
+}
+
+// find returns the announcement id of guildID.
+func (an *announcer) find(guildID, id string) (announcement, bool) {
+	for _, a := range an.list(guildID) {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return announcement{}, false
+}
+
+// run posts announcements as they come due. A run missed by more than
+// announceMissedGrace, because the bot was down, is skipped.
+func (an *announcer) run(s *discordgo.Session) {
+	type dueRun struct {
+		a     announcement
+		since time.Time
+	}
+	for {
+		now := time.Now()
+		var due []dueRun
+		an.mu.Lock()
+		changed := false
+		for _, a := range slices.Concat(an.config, an.state.Announcements) {
+			last, ok := an.state.LastRun[a.ID]
+			if !ok {
+				// A new announcement from the config file starts from now.
+				an.state.LastRun[a.ID], changed = now, true
+				continue
+			}
+			sched, err := a.schedule()
+			if err != nil {
+				continue
+			}
+			next := sched.next(last)
+			if next.IsZero() || next.After(now) {
+				continue
+			}
+			an.state.LastRun[a.ID], changed = now, true
+			if now.Sub(next) > announceMissedGrace {
+				slog.Info("skipping announcement missed while offline", "guild", a.GuildID, "id", a.ID, "due", next)
+				continue
+			}
+			due = append(due, dueRun{*a, last})
+		}
+		if changed {
+			if err := an.save(); err != nil {
+				slog.Error("failed to save announcements", "err", err)
+			}
+		}
+		an.mu.Unlock()
+
+		for _, d := range due {
+			if err := an.post(s, d.a, d.since); err != nil {
+				slog.Error("failed to post announcement", "guild", d.a.GuildID, "id", d.a.ID, "err", err)
+			}
+		}
+		time.Sleep(announceCheckInterval)
+	}
+}
+
+// post generates the content of a and posts it. A digest covers the
+// messages since then.
+func (an *announcer) post(s *discordgo.Session, a announcement, since time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxKeyGuildID, a.GuildID)
+
+	var content string
+	if a.Digest {
+		source := a.DigestChannel
+		if source == "" {
+			source = a.ChannelID
+		}
+		msgs, err := recentHistory(s, source, announceDigestMessages, since)
+		if err != nil {
+			return fmt.Errorf("read history of %s: %w", source, err)
+		}
+		msgs = slices.DeleteFunc(msgs, func(m *discordgo.Message) bool {
+			return m.Author != nil && m.Author.ID == s.State.User.ID
+		})
+		if len(transcriptLines(msgs)) == 0 {
+			slog.Info("no messages for announcement digest", "guild", a.GuildID, "id", a.ID)
+			return nil
+		}
+		summary, err := summarizeHistory(ctx, an.eng, msgs, false)
+		if err != nil {
+			return err
+		}
+		content = summary
+		if a.Daily {
+			content = "-# Digest of the day's messages\n" + summary
+		}
+		if a.Prompt != "" {
+			if content, err = complete(ctx, an.eng, announcePrompt, a.Prompt+"\n\nSummary of the channel since the last post:\n"+summary); err != nil {
+				return err
+			}
+		}
+	} else {
+		var err error
+		if content, err = complete(ctx, an.eng, announcePrompt, a.Prompt); err != nil {
+			return err
+		}
+	}
+	an.replies.send(s, a.ChannelID, nil, content)
+	slog.Info("posted announcement", "guild", a.GuildID, "id", a.ID, "channel", a.ChannelID)
+	return nil
+}
+
+// describe renders a for /schedule list.
+func (a announcement) describe() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "`%s` `%s`", a.ID, a.Cron)
+	if a.Timezone != "" {
+		sb.WriteString(" (" + a.Timezone + ")")
+	}
+	sb.WriteString(" in <#" + a.ChannelID + ">")
+	if a.Daily {
+		sb.WriteString(", daily digest (/digest)")
+	} else if a.Digest {
+		sb.WriteString(", digest")
+		if a.DigestChannel != "" && a.DigestChannel != a.ChannelID {
+			sb.WriteString(" of <#" + a.DigestChannel + ">")
+		}
+	}
+	if a.Prompt != "" {
+		prompt := []rune(strings.ReplaceAll(a.Prompt, "\n", " "))
+		if len(prompt) > 100 {
+			prompt = append(prompt[:100], '…')
+		}
+		sb.WriteString(": " + string(prompt))
+	}
+	if strings.HasPrefix(a.ID, "config-") {
+		sb.WriteString(" (config file)")
+	}
+	if sched, err := a.schedule(); err == nil {
+		if next := sched.next(time.Now()); !next.IsZero() {
+			fmt.Fprintf(&sb, ", next <t:%d:R>", next.Unix())
+		}
+	}
+	return sb.String()
+}
+
+func scheduleCommand(an *announcer) *slashCommand {
+	channelTypes := []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "schedule",
+			Description: "Post generated messages on a schedule (Manage Server only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Schedule a recurring announcement",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "cron",
+							Description: "When, as a cron expression: minute hour day month weekday (e.g. 0 9 * * 1-5)",
+							Required:    true,
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Where to post",
+							ChannelTypes: channelTypes,
+							Required:     true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "prompt",
+							Description: "What to write, e.g. a friendly standup prompt asking what everyone works on",
+							MaxLength:   2000,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "digest",
+							Description: "Summarize the messages since the last post",
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "digest_channel",
+							Description:  "The channel to summarize (default: the channel posted to)",
+							ChannelTypes: channelTypes,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "timezone",
+							Description: "Time zone of the schedule, e.g. Asia/Tokyo (default: the bot's)",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List this server's scheduled announcements",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Remove a scheduled announcement",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "id",
+							Description: "The announcement's ID, as shown by /schedule list",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "run",
+					Description: "Post a scheduled announcement now, to try it",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "id",
+							Description: "The announcement's ID, as shown by /schedule list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if i.GuildID == "" {
+				respondEphemeral(s, i, loc.tr("This command only works in a server."))
+				return
+			}
+			if !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("You need the Manage Server permission to use this command."))
+				return
+			}
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			sub := opts[0]
+			switch sub.Name {
+			case "add":
+				a := announcement{GuildID: i.GuildID, CreatedBy: interactionUserID(i)}
+				for _, o := range sub.Options {
+					switch o.Name {
+					case "cron":
+						a.Cron = strings.TrimSpace(o.StringValue())
+					case "channel":
+						a.ChannelID = o.ChannelValue(nil).ID
+					case "prompt":
+						a.Prompt = strings.TrimSpace(o.StringValue())
+					case "digest":
+						a.Digest = o.BoolValue()
+					case "digest_channel":
+						a.DigestChannel = o.ChannelValue(nil).ID
+					case "timezone":
+						a.Timezone = strings.TrimSpace(o.StringValue())
+					}
+				}
+				if a.Prompt == "" && !a.Digest {
+					respondEphemeral(s, i, loc.tr("Give a prompt, or set digest to summarize the channel."))
+					return
+				}
+				a, err := an.add(a)
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to schedule the announcement: %s", err))
+					return
+				}
+				slog.Info("announcement scheduled", "guild", i.GuildID, "id", a.ID, "user", hashID(a.CreatedBy))
+				respondEphemeral(s, i, loc.tr("Scheduled: %s", a.describe()))
+			case "list":
+				list := an.list(i.GuildID)
+				if len(list) == 0 {
+					respondEphemeral(s, i, loc.tr("This server has no scheduled announcements."))
+					return
+				}
+				var sb strings.Builder
+				for _, a := range list {
+					sb.WriteString(a.describe() + "\n")
+				}
+				respondEphemeral(s, i, splitMessage(sb.String(), discordLimit)[0])
+			case "remove":
+				id := strings.TrimSpace(sub.Options[0].StringValue())
+				if strings.HasPrefix(id, "config-") {
+					respondEphemeral(s, i, loc.tr("That announcement comes from the bot's config file and can only be removed there."))
+					return
+				}
+				ok, err := an.remove(i.GuildID, id)
+				switch {
+				case err != nil:
+					respondEphemeral(s, i, loc.tr("Failed to remove the announcement: %s", err))
+				case !ok:
+					respondEphemeral(s, i, loc.tr("This server has no announcement with ID `%s`.", id))
+				default:
+					respondEphemeral(s, i, loc.tr("Removed announcement `%s`.", id))
+				}
+			case "run":
+				id := strings.TrimSpace(sub.Options[0].StringValue())
+				a, ok := an.find(i.GuildID, id)
+				if !ok {
+					respondEphemeral(s, i, loc.tr("This server has no announcement with ID `%s`.", id))
+					return
+				}
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+				})
+				if err != nil {
+					slog.Error("failed to respond to interaction", "err", err)
+					return
+				}
+				// A trial digest covers the last day.
+				if err := an.post(s, a, time.Now().Add(-24*time.Hour)); err != nil {
+					followup(s, i, loc.tr("Failed to post the announcement: %s", err))
+					return
+				}
+				followup(s, i, loc.tr("Posted in <#%s>.", a.ChannelID))
+			}
+		},
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+// apiMaxBody bounds the size of an API request.
+const apiMaxBody = 1 << 20
+
+// errMessageMerged is returned by chatAPI.chat when the message was answered
+// together with earlier ones of the conversation (see -coalesce).
+var errMessageMerged = errors.New("the message was answered together with an earlier one")
+
+// chatAPI serves the HTTP API that lets other services talk to the bot. It
+// works on the same sessions, memory and tools as the Discord front-end, so
+// a user's conversation and what the bot remembers about them are shared.
+// Users are identified by their Discord user ID. The repl subcommand uses
+// it without the HTTP server.
+type chatAPI struct {
+	token string
+	// source names the front-end in logs.
+	source   string
+	store    *sessionStore
+	mem      *memoryStore
+	memIndex *memoryIndex
+	profiles *profileStore
+	personas *personaStore
+	guilds   *guildStore
+	ident    *identity
+	queue    *messageQueue
+	tools    *toolRegistry
+	engCfg   engine.Config
+	eng      *engine.Engine
+	// genLimits bound the users' generation settings.
+	genLimits generationLimits
+	// mod screens messages and replies; nil if moderation is off.
+	mod *moderator
+	// ctx is cancelled on shutdown, and handlers tracks the running chats
+	// so that shutdown waits for them.
+	ctx      context.Context
+	handlers *workTracker
+}
+
+// handler returns the API routes, all of which need the bearer token.
+func (api *chatAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/chat", api.handleChat)
+	mux.HandleFunc("GET /v1/sessions/{user}", api.handleSession)
+	mux.HandleFunc("POST /v1/memory/{user}", api.handleMemory)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			writeAPIError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type apiChatRequest struct {
+	User    string `json:"user"`
+	Message string `json:"message"`
+	// GuildID and ChannelID place the conversation; without them it is
+	// the user's DM conversation.
+	GuildID   string `json:"guild_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+type apiMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (api *chatAPI) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req apiChatRequest
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if req.User == "" || req.Message == "" {
+		writeAPIError(w, http.StatusBadRequest, "user and message are required")
+		return
+	}
+	if !api.handlers.begin() {
+		writeAPIError(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	defer api.handlers.end()
+
+	ctx, cancel := context.WithCancel(api.ctx)
+	defer cancel()
+	stop := context.AfterFunc(r.Context(), cancel)
+	defer stop()
+
+	reply, err := api.chat(ctx, req, nil)
+	switch {
+	case errors.Is(err, errQueueFull):
+		writeAPIError(w, http.StatusTooManyRequests, "too many messages are waiting in this conversation")
+	case errors.Is(err, errMessageMerged):
+		writeAPIError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, errModerated):
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+	case err != nil:
+		slog.Error("API chat failed", "user", hashID(req.User), "err", err)
+		writeAPIError(w, http.StatusBadGateway, err.Error())
+	default:
+		writeAPIJSON(w, http.StatusOK, map[string]string{"reply": reply})
+	}
+}
+
+// chat answers req in the user's conversation the way a Discord message is
+// answered, with the persona, memory, profile and tools that apply there.
+// onToolCall, if set, is told about each tool call.
+func (api *chatAPI) chat(ctx context.Context, req apiChatRequest, onToolCall func(name, arguments string)) (string, error) {
+	start := time.Now()
+	sessionKey := scopedKey(req.GuildID, req.User)
+	gcfg := api.guilds.get(req.GuildID)
+	ev := moderationEvent{Source: api.source, Direction: "prompt", GuildID: req.GuildID, ChannelID: req.ChannelID, User: hashID(req.User)}
+	if action := api.mod.screen(ctx, gcfg, ev, req.Message); action == moderationBlock || action == moderationRedact {
+		return "", errModerated
+	}
+	tk, err := api.queue.enter(sessionKey, req.Message)
+	if err != nil {
+		return "", err
+	}
+	content, ok := tk.wait(ctx)
+	if !ok {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", errMessageMerged
+	}
+	defer tk.done()
+
+	sess := api.store.get(sessionKey)
+	sess.mu.Lock()
+	// There is no one to ask whether to resume, so an expired
+	// conversation simply continues.
+	sess.staleSince = time.Time{}
+	lang := sess.language
+	if lang == "" {
+		lang = gcfg.Language
+	}
+	if lang == "" {
+		lang = detectLanguage(content)
+	}
+	dual := sess.dualLanguage
+	if dual == "" {
+		dual = gcfg.DualLanguage
+	}
+	if len(sess.messages) == 0 {
+		sess.started = time.Now()
+	}
+	sess.messages = append(sess.messages, engine.UserMessage(content)...)
+	sess.dirty = true
+	prompt, err := basePrompt(api.ident.get(), sess.persona, gcfg, api.personas)
+	if err != nil {
+		slog.Warn("failed to load persona", "err", err)
+	}
+	epoch := sess.epoch
+	history := slices.Clone(sess.messages)
+	gen := api.genLimits.apply(sess.generation)
+	sess.beginReply()
+	sess.mu.Unlock()
+
+	scope := memoryScope{GuildID: req.GuildID, ChannelID: req.ChannelID}
+	memCtx, memCancel := context.WithTimeout(ctx, 15*time.Second)
+	memMd := api.mem.relevantMarkdown(memCtx, api.memIndex, req.User, scope, content)
+	memCancel()
+	memMd += api.profiles.markdown(sessionKey)
+	chatMsgs := withSystemPrompt(history, prompt+memMd+languageHint(lang)+dualLanguageHint(dual))
+
+	ctx = context.WithValue(ctx, ctxKeyUserID, req.User)
+	ctx = context.WithValue(ctx, ctxKeyGuildID, req.GuildID)
+	ctx = context.WithValue(ctx, ctxKeyMemoryScope, scope)
+	ctx = context.WithValue(ctx, ctxKeySessionKey, sessionKey)
+	ctx = withGeneration(ctx, gen)
+	progress := &turnProgress{store: api.store, key: sessionKey, sess: sess, epoch: epoch}
+	ctx = withTurnProgress(ctx, progress)
+	chatEng := api.eng
+	disabledTools := gcfg.disabledTools(req.ChannelID, "")
+	if len(disabledTools) > 0 || gcfg.NoSystemPrompt || api.tools.dynamic != nil {
+		cfg := api.engCfg
+		cfg.Model = api.eng.Model()
+		if gcfg.NoSystemPrompt {
+			cfg.SystemMessage = nil
+		}
+		chatEng = api.tools.newEngine(cfg, api.tools.names(disabledTools))
+	}
+	reply, updated, err := chatEng.Chat(ctx, chatMsgs, engine.ChatOptions{OnToolCall: onToolCall})
+	slog.Info("handled message", "source", api.source, "user", hashID(req.User), "guild", req.GuildID,
+		"latency_ms", time.Since(start).Milliseconds(), "err", err)
+	if err != nil {
+		if api.ctx.Err() == nil {
+			progress.discard()
+		}
+		return "", err
+	}
+	ev.Direction = "reply"
+	switch api.mod.screen(ctx, gcfg, ev, reply) {
+	case moderationBlock:
+		progress.discard()
+		return "", errModerated
+	case moderationRedact:
+		reply = "[removed by moderation]"
+		if n := len(updated); n > 0 && updated[n-1].Role == openai.ChatMessageRoleAssistant {
+			updated[n-1].Content, updated[n-1].MultiContent = reply, nil
+		}
+	}
+	if len(updated) > 0 && updated[0].Role == openai.ChatMessageRoleSystem {
+		updated = updated[1:]
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.epoch != epoch {
+		return reply, nil
+	}
+	sess.mergeReply(updated)
+	if err := api.store.save(sessionKey, sess); err != nil {
+		slog.Error("failed to save session", "session", hashID(sessionKey), "err", err)
+	}
+	return reply, nil
+}
+
+// handleSession returns the user's conversation, by default the DM one or
+// the one in the guild given by ?guild_id=. Tool calls are left out.
+func (api *chatAPI) handleSession(w http.ResponseWriter, r *http.Request) {
+	key := scopedKey(r.URL.Query().Get("guild_id"), r.PathValue("user"))
+	sess := api.store.get(key)
+	sess.mu.Lock()
+	resp := struct {
+		Session   string       `json:"session"`
+		StartedAt string       `json:"started_at,omitempty"`
+		Persona   string       `json:"persona,omitempty"`
+		Language  string       `json:"language,omitempty"`
+		Messages  []apiMessage `json:"messages"`
+	}{
+		Session:   key,
+		StartedAt: formatTime(sess.started),
+		Persona:   sess.persona,
+		Language:  sess.language,
+		Messages:  []apiMessage{},
+	}
+	for _, m := range sess.messages {
+		if (m.Role == openai.ChatMessageRoleUser || m.Role == openai.ChatMessageRoleAssistant) && m.Content != "" {
+			resp.Messages = append(resp.Messages, apiMessage{Role: m.Role, Content: m.Content})
+		}
+	}
+	sess.mu.Unlock()
+	writeAPIJSON(w, http.StatusOK, resp)
+}
+
+// handleMemory saves a memory entry for the user, as saveMemoryEntry does.
+func (api *chatAPI) handleMemory(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key       string `json:"key"`
+		Value     string `json:"value"`
+		Scope     string `json:"scope"`
+		GuildID   string `json:"guild_id"`
+		ChannelID string `json:"channel_id"`
+	}
+	if !decodeAPIRequest(w, r, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Key) == "" || req.Value == "" {
+		writeAPIError(w, http.StatusBadRequest, "key and value are required")
+		return
+	}
+	if req.Scope == memoryScopeChannel && req.ChannelID == "" {
+		writeAPIError(w, http.StatusBadRequest, "channel scope needs channel_id")
+		return
+	}
+	sc := memoryScope{GuildID: req.GuildID, ChannelID: req.ChannelID}
+	ns, err := sc.namespace(req.Scope)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := api.mem.set(r.PathValue("user"), sc, ns, req.Key, req.Value)
+	if err != nil {
+		slog.Error("failed to save memory", "user", hashID(r.PathValue("user")), "err", err)
+		writeAPIError(w, http.StatusInternalServerError, "failed to save memory")
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]string{"key": key, "scope": ns})
+}
+
+// decodeAPIRequest decodes the JSON body of r into v, answering with an
+// error and returning false if it is invalid.
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIJSON(w, status, map[string]string{"error": msg})
+}
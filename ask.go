@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	askDefaultQuestion = "Explain this message."
+	// askPendingTTL is how long the selected message is kept while the user
+	// fills in the question.
+	askPendingTTL = 15 * time.Minute
+)
+
+// askTarget is a message picked with the "Ask Yagi" context menu, waiting for
+// the user's question.
+type askTarget struct {
+	message *discordgo.Message
+	at      time.Time
+}
+
+// asker answers questions about a message picked from its context menu,
+// privately or in a thread started on the message.
+type asker struct {
+	eng    *engine.Engine
+	store  *sessionStore
+	guilds *guildStore
+	quotas *quotaTracker
+
+	mu      sync.Mutex
+	pending map[string]askTarget
+}
+
+func newAsker(eng *engine.Engine, store *sessionStore, guilds *guildStore, quotas *quotaTracker) *asker {
+	return &asker{eng: eng, store: store, guilds: guilds, quotas: quotas, pending: make(map[string]askTarget)}
+}
+
+// askCommand is the message context menu entry. In a thread, the answer is
+// posted in a thread started on the message; otherwise only the user sees it.
+func askCommand(a *asker, inThread bool) *slashCommand {
+	name, mode := "Ask Yagi", "private"
+	if inThread {
+		name, mode = "Ask Yagi in thread", "thread"
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Type: discordgo.MessageApplicationCommand,
+			Name: name,
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			data := i.ApplicationCommandData()
+			msg, ok := data.Resolved.Messages[data.TargetID]
+			if !ok {
+				respondEphemeral(s, i, loc.tr("I could not read that message."))
+				return
+			}
+			if msg.ChannelID == "" {
+				msg.ChannelID = i.ChannelID
+			}
+			userID := interactionUserID(i)
+			a.mu.Lock()
+			for k, t := range a.pending {
+				if time.Since(t.at) > askPendingTTL {
+					delete(a.pending, k)
+				}
+			}
+			a.pending[userID+":"+msg.ID] = askTarget{message: msg, at: time.Now()}
+			a.mu.Unlock()
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					CustomID: "ask:" + mode + ":" + msg.ID,
+					Title:    "Ask Yagi about this message",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+							discordgo.TextInput{
+								CustomID:    "question",
+								Label:       "Question (optional)",
+								Style:       discordgo.TextInputParagraph,
+								Placeholder: askDefaultQuestion,
+								MaxLength:   1000,
+							},
+						}},
+					},
+				},
+			})
+			if err != nil {
+				slog.Error("failed to open question form", "err", err)
+			}
+		},
+	}
+}
+
+// handleModal answers the question submitted from the form.
+func (a *asker) handleModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionModalSubmit {
+		return
+	}
+	data := i.ModalSubmitData()
+	rest, ok := strings.CutPrefix(data.CustomID, "ask:")
+	if !ok {
+		return
+	}
+	loc := interactionLocale(i)
+	mode, messageID, _ := strings.Cut(rest, ":")
+	userID := interactionUserID(i)
+
+	a.mu.Lock()
+	target, ok := a.pending[userID+":"+messageID]
+	delete(a.pending, userID+":"+messageID)
+	a.mu.Unlock()
+	if !ok {
+		respondEphemeral(s, i, loc.tr("That request expired. Please pick the message again."))
+		return
+	}
+	if !a.quotas.allow(i.GuildID, userID, a.guilds.get(i.GuildID).DailyQuota) {
+		respondEphemeral(s, i, loc.tr("You have reached today's usage limit. Please try again tomorrow."))
+		return
+	}
+	question := strings.TrimSpace(modalValue(data, "question"))
+	if question == "" {
+		question = askDefaultQuestion
+	}
+	inThread := mode == "thread" && i.GuildID != ""
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+		return
+	}
+
+	msg := target.message
+	prompt := askPrompt(msg, question)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxKeyGuildID, i.GuildID)
+	answer, _, err := a.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: prompt},
+	}, engine.ChatOptions{})
+	if err == nil && strings.TrimSpace(answer) == "" {
+		err = fmt.Errorf("empty reply")
+	}
+	if err != nil {
+		slog.Error("failed to answer question about message", "user", hashID(userID), "err", err)
+		followup(s, i, loc.tr("Failed to answer: %s", err))
+		return
+	}
+
+	if !inThread {
+		followup(s, i, answer)
+		return
+	}
+	th, err := s.MessageThreadStart(msg.ChannelID, msg.ID, threadName(question), 1440)
+	if err != nil {
+		// The message may already have a thread, or the bot may lack the
+		// permission; answer privately instead.
+		slog.Warn("failed to start thread", "channel", msg.ChannelID, "err", err)
+		followup(s, i, answer)
+		return
+	}
+	sendReply(s, th.ID, nil, "<@"+userID+"> "+question+"\n\n"+answer)
+
+	// Follow-ups in the thread continue from the answer in -thread-mode.
+	key := scopedKey(i.GuildID, th.ID)
+	sess := a.store.get(key)
+	sess.mu.Lock()
+	if len(sess.messages) == 0 {
+		sess.started = time.Now()
+	}
+	sess.messages = append(sess.messages, engine.UserMessage(prompt)...)
+	sess.messages = append(sess.messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: answer})
+	if err := a.store.save(key, sess); err != nil {
+		slog.Error("failed to save session", "session", hashID(key), "err", err)
+	}
+	sess.mu.Unlock()
+	followup(s, i, loc.tr("Answered in <#%s>.", th.ID))
+}
+
+// askPrompt frames the picked message and the question for the model.
+func askPrompt(msg *discordgo.Message, question string) string {
+	var sb strings.Builder
+	author := "someone"
+	if msg.Author != nil {
+		author = msg.Author.Username
+	}
+	fmt.Fprintf(&sb, "Message from %s:\n", author)
+	for _, line := range strings.Split(msg.Content, "\n") {
+		sb.WriteString("> " + line + "\n")
+	}
+	for _, att := range msg.Attachments {
+		sb.WriteString("> [attachment: " + att.Filename + "]\n")
+	}
+	sb.WriteString("\n" + question)
+	return sb.String()
+}
+
+// modalValue returns the value of the text input id in a submitted modal.
+func modalValue(data discordgo.ModalSubmitInteractionData, id string) string {
+	for _, c := range data.Components {
+		row, ok := c.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, rc := range row.Components {
+			if in, ok := rc.(*discordgo.TextInput); ok && in.CustomID == id {
+				return in.Value
+			}
+		}
+	}
+	return ""
+}
+
+// followup sends content as ephemeral follow-ups to a deferred interaction,
+// split to fit Discord's message limit.
+func followup(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	for _, part := range splitMessage(content, discordLimit) {
+		if _, err := s.FollowupMessageCreate(i.Interaction, true, &discordgo.WebhookParams{
+			Content: part,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		}); err != nil {
+			slog.Error("failed to send follow-up", "err", err)
+			return
+		}
+	}
+}
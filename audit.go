@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// auditArgsChars and auditResultChars bound what is kept of the
+	// arguments and the result of a tool call.
+	auditArgsChars   = 500
+	auditResultChars = 200
+	// auditMaxEntries bounds the entries /audit shows at once.
+	auditMaxEntries = 25
+)
+
+// toolAuditEntry is one tool call in the audit log.
+type toolAuditEntry struct {
+	At        string `json:"at"`
+	Tool      string `json:"tool"`
+	Args      string `json:"args"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+	UserID    string `json:"user_id,omitempty"`
+	GuildID   string `json:"guild_id,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// toolAudit appends every tool call to <data>/audit/tools.jsonl. Entries
+// are only ever added. With encryption on, each line is sealed on its own
+// and stored as base64. A nil *toolAudit records nothing.
+type toolAudit struct {
+	mu     sync.Mutex
+	path   string
+	cipher *storage.Cipher
+}
+
+func newToolAudit(dataDir string, fc *storage.Cipher) *toolAudit {
+	return &toolAudit{path: filepath.Join(dataDir, "audit", "tools.jsonl"), cipher: fc}
+}
+
+// wrap returns fn recording each of its calls.
+func (ta *toolAudit) wrap(name string, fn engine.ToolFunc) engine.ToolFunc {
+	if ta == nil {
+		return fn
+	}
+	return func(ctx context.Context, args string) (string, error) {
+		start := time.Now()
+		out, err := fn(ctx, args)
+		e := toolAuditEntry{
+			At:        formatTime(start),
+			Tool:      name,
+			Args:      truncateRunes(args, auditArgsChars),
+			Result:    truncateRunes(out, auditResultChars),
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			e.Error = truncateRunes(err.Error(), auditResultChars)
+		}
+		e.UserID, _ = ctx.Value(ctxKeyUserID).(string)
+		e.GuildID, _ = ctx.Value(ctxKeyGuildID).(string)
+		if sc, ok := ctx.Value(ctxKeyMemoryScope).(memoryScope); ok {
+			e.ChannelID = sc.ChannelID
+		}
+		if err := ta.record(e); err != nil {
+			slog.Error("failed to record tool call in the audit log", "tool", name, "err", err)
+		}
+		return out, err
+	}
+}
+
+func (ta *toolAudit) record(e toolAuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if ta.cipher != nil {
+		sealed, err := ta.cipher.Seal(line)
+		if err != nil {
+			return err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(ta.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ta.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// toolAuditFilter selects entries of the audit log. Empty fields match
+// everything.
+type toolAuditFilter struct {
+	tool, userID, guildID string
+	failedOnly            bool
+}
+
+func (f toolAuditFilter) matches(e toolAuditEntry) bool {
+	return (f.tool == "" || e.Tool == f.tool) &&
+		(f.userID == "" || e.UserID == f.userID) &&
+		(f.guildID == "" || e.GuildID == f.guildID) &&
+		(!f.failedOnly || e.Error != "")
+}
+
+// recent returns the last n entries matching f, newest first.
+func (ta *toolAudit) recent(f toolAuditFilter, n int) ([]toolAuditEntry, error) {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	file, err := os.Open(ta.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []toolAuditEntry
+	sc := bufio.NewScanner(file)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) > 0 && line[0] != '{' {
+			sealed, err := base64.StdEncoding.DecodeString(string(line))
+			if err != nil {
+				continue
+			}
+			if line, err = ta.cipher.Open(sealed); err != nil {
+				return nil, err
+			}
+		}
+		var e toolAuditEntry
+		if err := json.Unmarshal(line, &e); err != nil || !f.matches(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	slices.Reverse(entries)
+	return entries, sc.Err()
+}
+
+// truncateRunes cuts s to at most n runes, marking the cut with an ellipsis.
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// auditCommand returns /audit, with which bot admins read the latest tool
+// calls.
+func auditCommand(audit *toolAudit, admin *adminCommands) *slashCommand {
+	minLimit := 1.0
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "audit",
+			Description: "Show the latest tool calls (bot admins only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "tool",
+					Description: "Only calls of this tool",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Name:        "user",
+					Description: "Only calls made for this user",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "failed",
+					Description: "Only failed calls",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "everywhere",
+					Description: "Include calls from other servers and DMs (default: this server only)",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "limit",
+					Description: fmt.Sprintf("Number of calls to show (default 10, at most %d)", auditMaxEntries),
+					MinValue:    &minLimit,
+					MaxValue:    auditMaxEntries,
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if !admin.isAdmin(interactionUserID(i)) {
+				respondEphemeral(s, i, loc.tr("This command is restricted to bot admins."))
+				return
+			}
+			f := toolAuditFilter{guildID: i.GuildID}
+			limit := 10
+			for _, o := range i.ApplicationCommandData().Options {
+				switch o.Name {
+				case "tool":
+					f.tool = strings.TrimSpace(o.StringValue())
+				case "user":
+					f.userID = o.UserValue(nil).ID
+				case "failed":
+					f.failedOnly = o.BoolValue()
+				case "everywhere":
+					if o.BoolValue() {
+						f.guildID = ""
+					}
+				case "limit":
+					limit = int(o.IntValue())
+				}
+			}
+			entries, err := audit.recent(f, limit)
+			if err != nil {
+				respondEphemeral(s, i, loc.tr("Failed to read the audit log: %s", err))
+				return
+			}
+			if len(entries) == 0 {
+				respondEphemeral(s, i, loc.tr("No tool calls match."))
+				return
+			}
+			var sb strings.Builder
+			for _, e := range entries {
+				at := e.At
+				if t, err := time.Parse(time.RFC3339, e.At); err == nil {
+					at = fmt.Sprintf("<t:%d:R>", t.Unix())
+				}
+				status := "ok"
+				if e.Error != "" {
+					status = "failed: " + e.Error
+				}
+				line := fmt.Sprintf("- %s `%s` for <@%s>", at, e.Tool, e.UserID)
+				if e.ChannelID != "" {
+					line += fmt.Sprintf(" in <#%s>", e.ChannelID)
+				}
+				line += fmt.Sprintf(", %d ms, %s\n  `%s`\n", e.LatencyMs, status, truncateRunes(strings.ReplaceAll(e.Args, "`", "'"), 120))
+				if sb.Len()+len(line) > discordLimit-20 {
+					sb.WriteString("…")
+					break
+				}
+				sb.WriteString(line)
+			}
+			respondEphemeral(s, i, sb.String())
+		},
+	}
+}
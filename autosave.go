@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const ctxKeyTurnProgress contextKey = "turnProgress"
+
+// interruptedReply ends a conversation whose reply was cut short by a
+// crash, after the tool calls it had finished.
+const interruptedReply = "(The reply was interrupted.)"
+
+// turnProgress saves the tool calls of a reply as they finish, marked as in
+// progress, so that a crash in a long tool loop does not lose them. When the
+// reply is stored it replaces them; if the bot stops first, they are added
+// to the conversation the next time it is loaded.
+type turnProgress struct {
+	store *sessionStore
+	key   string
+	sess  *userSession
+	epoch int
+}
+
+func withTurnProgress(ctx context.Context, p *turnProgress) context.Context {
+	return context.WithValue(ctx, ctxKeyTurnProgress, p)
+}
+
+// record saves a finished tool call with its result. Tool calls running at
+// the same time are saved as separate rounds.
+func (p *turnProgress) record(name, args, result string) {
+	p.sess.mu.Lock()
+	defer p.sess.mu.Unlock()
+	if p.sess.epoch != p.epoch {
+		return
+	}
+	id := fmt.Sprintf("call_saved_%d", len(p.sess.inProgress)/2+1)
+	p.sess.inProgress = append(p.sess.inProgress,
+		openai.ChatCompletionMessage{
+			Role: openai.ChatMessageRoleAssistant,
+			ToolCalls: []openai.ToolCall{{
+				ID:       id,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: name, Arguments: args},
+			}},
+		},
+		openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: id, Content: result},
+	)
+	p.sess.dirty = true
+	if err := p.store.save(p.key, p.sess); err != nil {
+		slog.Warn("failed to save reply in progress", "session", hashID(p.key), "err", err)
+	}
+}
+
+// discard drops the saved tool calls of a reply that is not stored. They
+// are removed from storage by the next save.
+func (p *turnProgress) discard() {
+	p.sess.mu.Lock()
+	defer p.sess.mu.Unlock()
+	if p.sess.epoch == p.epoch && p.sess.inProgress != nil {
+		p.sess.inProgress = nil
+		p.sess.dirty = true
+	}
+}
+
+// autosavedTool wraps fn so that each call is recorded by the turnProgress
+// in its context, if there is one.
+func autosavedTool(name string, fn engine.ToolFunc) engine.ToolFunc {
+	return func(ctx context.Context, args string) (string, error) {
+		out, err := fn(ctx, args)
+		if p, ok := ctx.Value(ctxKeyTurnProgress).(*turnProgress); ok {
+			result := out
+			if err != nil {
+				result = "Error: " + err.Error()
+			}
+			p.record(name, args, result)
+		}
+		return out, err
+	}
+}
+
+// recoverInterrupted returns msgs with the tool calls of an interrupted
+// reply appended, followed by a note in loc that the reply was cut short.
+func recoverInterrupted(msgs, inProgress []openai.ChatCompletionMessage, loc locale) []openai.ChatCompletionMessage {
+	msgs = append(msgs, inProgress...)
+	return append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: loc.tr(interruptedReply)})
+}
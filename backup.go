@@ -0,0 +1,229 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// backupPartSize is the largest attachment posted, below the upload limit
+// of servers without boosts. Bigger archives are split into parts.
+const backupPartSize = 9 << 20
+
+// backupMaxParts caps how many messages one backup may take.
+const backupMaxParts = 10
+
+// backupSkip lists data directory entries left out of backups because they
+// can be rebuilt or are only scratch space.
+var backupSkip = []string{"embedding_cache", "memory_index", "backup.json"}
+
+// backupState records when the last backup was posted, so that restarts do
+// not postpone it.
+type backupState struct {
+	Last time.Time `json:"last"`
+}
+
+// backupPoster periodically posts an encrypted archive of the data directory
+// to a Discord channel only the operator can see.
+type backupPoster struct {
+	dataDir   string
+	channelID string
+	cipher    *storage.Cipher
+	interval  time.Duration
+}
+
+func (bp *backupPoster) statePath() string {
+	return filepath.Join(bp.dataDir, "backup.json")
+}
+
+func (bp *backupPoster) run(s *discordgo.Session) {
+	// The state file only carries the time across restarts, so a failure
+	// to write it does not make the loop post again right away.
+	var st backupState
+	if data, err := os.ReadFile(bp.statePath()); err == nil {
+		json.Unmarshal(data, &st)
+	}
+	for {
+		if wait := time.Until(st.Last.Add(bp.interval)); wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		if err := bp.post(s); err != nil {
+			slog.Error("backup failed", "channel", bp.channelID, "err", err)
+			// Try again later without flooding the channel.
+			time.Sleep(min(bp.interval, time.Hour))
+			continue
+		}
+		st.Last = time.Now()
+		data, _ := json.Marshal(st)
+		if err := storage.WriteFileAtomic(bp.statePath(), data, 0600); err != nil {
+			slog.Warn("failed to save backup state", "err", err)
+		}
+	}
+}
+
+func (bp *backupPoster) post(s *discordgo.Session) error {
+	ch, err := channel(s, bp.channelID)
+	if err != nil {
+		return err
+	}
+	if ch.GuildID != "" && everyoneCanView(s, ch) {
+		return errors.New("backup channel is visible to @everyone; restrict it to the operator")
+	}
+
+	var buf bytes.Buffer
+	n, err := archiveDataDir(&buf, bp.dataDir)
+	if err != nil {
+		return err
+	}
+	sealed, err := bp.cipher.Seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	parts := (len(sealed) + backupPartSize - 1) / backupPartSize
+	if parts > backupMaxParts {
+		return fmt.Errorf("backup is %d MiB, more than %d parts", len(sealed)>>20, backupMaxParts)
+	}
+
+	name := "yagi-backup-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz.enc"
+	for i := range parts {
+		chunk := sealed[i*backupPartSize : min((i+1)*backupPartSize, len(sealed))]
+		file, content := name, fmt.Sprintf("Backup of %d file(s), %d KiB", n, len(sealed)>>10)
+		if parts > 1 {
+			file = fmt.Sprintf("%s.%03d", name, i+1)
+			content += fmt.Sprintf(", part %d of %d", i+1, parts)
+		}
+		_, err := s.ChannelMessageSendComplex(bp.channelID, &discordgo.MessageSend{
+			Content: content,
+			Files:   []*discordgo.File{{Name: file, ContentType: "application/octet-stream", Reader: bytes.NewReader(chunk)}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("posted backup", "channel", bp.channelID, "files", n, "bytes", len(sealed), "parts", parts)
+	return nil
+}
+
+// everyoneCanView reports whether the @everyone role of ch's guild may see
+// ch. Permissions granted to other roles are not considered.
+func everyoneCanView(s *discordgo.Session, ch *discordgo.Channel) bool {
+	var perms int64
+	if role, err := s.State.Role(ch.GuildID, ch.GuildID); err == nil {
+		perms = role.Permissions
+	} else if roles, err := s.GuildRoles(ch.GuildID); err == nil {
+		for _, r := range roles {
+			if r.ID == ch.GuildID {
+				perms = r.Permissions
+			}
+		}
+	}
+	for _, o := range ch.PermissionOverwrites {
+		if o.ID == ch.GuildID {
+			perms = perms&^o.Deny | o.Allow
+		}
+	}
+	return perms&discordgo.PermissionViewChannel != 0
+}
+
+// archiveDataDir writes a gzipped tar of dataDir to w and returns how many
+// files it holds. Files in the data directory are stored as they are, so
+// encrypted files stay encrypted inside the archive too.
+func archiveDataDir(w io.Writer, dataDir string) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	n := 0
+	err := filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if slices.Contains(backupSkip, rel) || strings.HasSuffix(rel, ".tmp") ||
+			d.IsDir() && strings.HasPrefix(d.Name(), "meeting-") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// The file is read before its header is written, as it may grow or
+		// shrink while the bot keeps running.
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    rel,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// decryptBackup joins the downloaded parts of a backup in the order given,
+// decrypts them and writes the tar.gz archive to w.
+func decryptBackup(w io.Writer, c *storage.Cipher, paths []string) error {
+	if c == nil {
+		return errors.New("decrypt-backup needs -encryption-key or -encryption-key-file")
+	}
+	if len(paths) == 0 {
+		return errors.New("usage: decrypt-backup <file> [<part>...] > backup.tar.gz")
+	}
+	var sealed []byte
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sealed = append(sealed, data...)
+	}
+	data, err := c.Open(sealed)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
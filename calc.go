@@ -0,0 +1,769 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// calcMaxBits bounds the size of numbers, so that 9^9^9 fails instead of
+	// taking the bot down.
+	calcMaxBits = 1 << 16
+	// calcDigits is the number of significant digits of inexact results.
+	calcDigits = 30
+)
+
+// calcTool is the calculate tool: exact arithmetic on rationals, unit
+// conversion and date math, so the model need not do them in its head.
+func calcTool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	expr := strings.TrimSpace(p.Expression)
+	if expr == "" {
+		return "", errors.New("expression is empty")
+	}
+	if out, ok, err := evalDate(expr, time.Now().UTC()); ok {
+		return out, err
+	}
+	if m := unitConversionRe.FindStringSubmatch(expr); m != nil {
+		if to, ok := lookupUnit(m[2]); ok {
+			if value, from, ok := splitUnit(m[1]); ok {
+				return convertUnits(value, from, to)
+			}
+		}
+	}
+	v, err := evalExpr(expr)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// calcValue is a number, exact unless an inexact function or power made
+// it.
+type calcValue struct {
+	r      *big.Rat
+	approx bool
+}
+
+func (v calcValue) String() string {
+	s := v.decimal()
+	if !v.r.IsInt() && !v.approx && v.r.Denom().BitLen() <= 10 {
+		return fmt.Sprintf("%s (= %s)", s, v.r.RatString())
+	}
+	return s
+}
+
+// decimal formats v as an integer or a decimal, marking inexact values.
+func (v calcValue) decimal() string {
+	if v.r.IsInt() && !v.approx {
+		s := v.r.Num().String()
+		if len(s) > 1000 {
+			return fmt.Sprintf("%s (%d digits)", formatFloat(v.r), len(strings.TrimPrefix(s, "-")))
+		}
+		return s
+	}
+	if v.approx {
+		return "≈ " + formatFloat(v.r)
+	}
+	return formatFloat(v.r)
+}
+
+// formatFloat formats r with calcDigits significant digits.
+func formatFloat(r *big.Rat) string {
+	return new(big.Float).SetPrec(256).SetRat(r).Text('g', calcDigits)
+}
+
+// evalExpr evaluates an arithmetic expression with + - * / % ^, !,
+// parentheses, the constants pi and e, and the functions of calcFuncs.
+func evalExpr(s string) (calcValue, error) {
+	p := &calcParser{toks: tokenizeCalc(s)}
+	v, err := p.expr()
+	if err != nil {
+		return calcValue{}, err
+	}
+	if p.pos < len(p.toks) {
+		return calcValue{}, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return v, nil
+}
+
+func tokenizeCalc(s string) []string {
+	var toks []string
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c) || c == '_':
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == ',' && j+3 < len(rs) && isDigits(rs[j+1:j+4]) || rs[j] == '_') {
+				j++
+			}
+			if j < len(rs) && (rs[j] == 'e' || rs[j] == 'E') {
+				k := j + 1
+				if k < len(rs) && (rs[k] == '+' || rs[k] == '-') {
+					k++
+				}
+				if k < len(rs) && unicode.IsDigit(rs[k]) {
+					for j = k; j < len(rs) && unicode.IsDigit(rs[j]); j++ {
+					}
+				}
+			}
+			toks = append(toks, strings.NewReplacer(",", "", "_", "").Replace(string(rs[i:j])))
+			i = j
+		case unicode.IsLetter(c):
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j])) {
+				j++
+			}
+			toks = append(toks, strings.ToLower(string(rs[i:j])))
+			i = j
+		case c == '*' && i+1 < len(rs) && rs[i+1] == '*':
+			toks = append(toks, "^")
+			i += 2
+		case c == '×':
+			toks = append(toks, "*")
+			i++
+		case c == '÷':
+			toks = append(toks, "/")
+			i++
+		case c == '−':
+			toks = append(toks, "-")
+			i++
+		default:
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks
+}
+
+// isDigits reports whether rs are all digits, for thousands separators.
+func isDigits(rs []rune) bool {
+	for _, r := range rs {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type calcParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *calcParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *calcParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *calcParser) expr() (calcValue, error) {
+	v, err := p.term()
+	if err != nil {
+		return v, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()
+		w, err := p.term()
+		if err != nil {
+			return v, err
+		}
+		r := new(big.Rat)
+		if op == "+" {
+			r.Add(v.r, w.r)
+		} else {
+			r.Sub(v.r, w.r)
+		}
+		v = calcValue{r, v.approx || w.approx}
+	}
+	return v, nil
+}
+
+func (p *calcParser) term() (calcValue, error) {
+	v, err := p.unary()
+	if err != nil {
+		return v, err
+	}
+	for p.peek() == "*" || p.peek() == "/" || p.peek() == "%" {
+		op := p.next()
+		w, err := p.unary()
+		if err != nil {
+			return v, err
+		}
+		if op != "*" && w.r.Sign() == 0 {
+			return v, errors.New("division by zero")
+		}
+		r := new(big.Rat)
+		switch op {
+		case "*":
+			r.Mul(v.r, w.r)
+		case "/":
+			r.Quo(v.r, w.r)
+		case "%":
+			// a - b*floor(a/b), which has the sign of b.
+			q := new(big.Rat).Quo(v.r, w.r)
+			r.Sub(v.r, new(big.Rat).Mul(w.r, new(big.Rat).SetInt(floorRat(q))))
+		}
+		if err := checkSize(r); err != nil {
+			return v, err
+		}
+		v = calcValue{r, v.approx || w.approx}
+	}
+	return v, nil
+}
+
+func (p *calcParser) unary() (calcValue, error) {
+	switch p.peek() {
+	case "-":
+		p.next()
+		v, err := p.unary()
+		if err != nil {
+			return v, err
+		}
+		return calcValue{new(big.Rat).Neg(v.r), v.approx}, nil
+	case "+":
+		p.next()
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (calcValue, error) {
+	v, err := p.postfix()
+	if err != nil {
+		return v, err
+	}
+	if p.peek() != "^" {
+		return v, nil
+	}
+	p.next()
+	// Right-associative, and binding tighter than a unary minus on its
+	// left: -2^2 is -4.
+	w, err := p.unary()
+	if err != nil {
+		return v, err
+	}
+	return powRat(v, w)
+}
+
+func (p *calcParser) postfix() (calcValue, error) {
+	v, err := p.primary()
+	if err != nil {
+		return v, err
+	}
+	for p.peek() == "!" {
+		p.next()
+		if v, err = factorial(v); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func (p *calcParser) primary() (calcValue, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return calcValue{}, errors.New("unexpected end of expression")
+	case t == "(":
+		v, err := p.expr()
+		if err != nil {
+			return v, err
+		}
+		if p.next() != ")" {
+			return v, errors.New("missing )")
+		}
+		return v, nil
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		if _, exp, ok := strings.Cut(strings.ToLower(t), "e"); ok {
+			if n, err := strconv.Atoi(exp); err != nil || n > 10000 || n < -10000 {
+				return calcValue{}, fmt.Errorf("invalid number %q", t)
+			}
+		}
+		r, ok := new(big.Rat).SetString(t)
+		if !ok {
+			return calcValue{}, fmt.Errorf("invalid number %q", t)
+		}
+		return calcValue{r: r}, nil
+	case t == "pi" || t == "π":
+		return calcValue{new(big.Rat).SetFloat64(math.Pi), true}, nil
+	case t == "e":
+		return calcValue{new(big.Rat).SetFloat64(math.E), true}, nil
+	}
+	fn, ok := calcFuncs[t]
+	if !ok {
+		return calcValue{}, fmt.Errorf("unknown name %q", t)
+	}
+	if p.next() != "(" {
+		return calcValue{}, fmt.Errorf("%s needs its arguments in parentheses", t)
+	}
+	var args []calcValue
+	for p.peek() != ")" {
+		v, err := p.expr()
+		if err != nil {
+			return v, err
+		}
+		args = append(args, v)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if p.next() != ")" {
+		return calcValue{}, errors.New("missing )")
+	}
+	return fn(args)
+}
+
+// calcFuncs are the functions of expressions.
+var calcFuncs = map[string]func([]calcValue) (calcValue, error){
+	"sqrt": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, errors.New("sqrt takes one argument")
+		}
+		if a[0].r.Sign() < 0 {
+			return calcValue{}, errors.New("sqrt of a negative number")
+		}
+		// Exact for perfect squares of rationals.
+		num, den := new(big.Int).Sqrt(a[0].r.Num()), new(big.Int).Sqrt(a[0].r.Denom())
+		if r := new(big.Rat).SetFrac(num, den); new(big.Rat).Mul(r, r).Cmp(a[0].r) == 0 {
+			return calcValue{r, a[0].approx}, nil
+		}
+		f := new(big.Float).SetPrec(256).SetRat(a[0].r)
+		r, _ := f.Sqrt(f).Rat(nil)
+		return calcValue{r, true}, nil
+	},
+	"abs": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, errors.New("abs takes one argument")
+		}
+		return calcValue{new(big.Rat).Abs(a[0].r), a[0].approx}, nil
+	},
+	"floor": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, errors.New("floor takes one argument")
+		}
+		return calcValue{new(big.Rat).SetInt(floorRat(a[0].r)), a[0].approx}, nil
+	},
+	"ceil": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, errors.New("ceil takes one argument")
+		}
+		neg := new(big.Rat).Neg(a[0].r)
+		return calcValue{new(big.Rat).SetInt(new(big.Int).Neg(floorRat(neg))), a[0].approx}, nil
+	},
+	"round": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 && len(a) != 2 {
+			return calcValue{}, errors.New("round takes a number and optionally the number of decimals")
+		}
+		scale := big.NewRat(1, 1)
+		if len(a) == 2 {
+			if !a[1].r.IsInt() || a[1].r.Num().Int64() < 0 || a[1].r.Num().Int64() > 100 {
+				return calcValue{}, errors.New("round: decimals must be between 0 and 100")
+			}
+			scale.SetInt(new(big.Int).Exp(big.NewInt(10), a[1].r.Num(), nil))
+		}
+		// Half away from zero.
+		x := new(big.Rat).Mul(new(big.Rat).Abs(a[0].r), scale)
+		n := floorRat(x.Add(x, big.NewRat(1, 2)))
+		if a[0].r.Sign() < 0 {
+			n.Neg(n)
+		}
+		return calcValue{new(big.Rat).Quo(new(big.Rat).SetInt(n), scale), a[0].approx}, nil
+	},
+	"min": func(a []calcValue) (calcValue, error) { return pick(a, -1) },
+	"max": func(a []calcValue) (calcValue, error) { return pick(a, 1) },
+	"fact": func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, errors.New("fact takes one argument")
+		}
+		return factorial(a[0])
+	},
+	"ln":    floatFunc("ln", math.Log),
+	"log":   floatFunc("log", math.Log10),
+	"log2":  floatFunc("log2", math.Log2),
+	"exp":   floatFunc("exp", math.Exp),
+	"sin":   floatFunc("sin", math.Sin),
+	"cos":   floatFunc("cos", math.Cos),
+	"tan":   floatFunc("tan", math.Tan),
+	"asin":  floatFunc("asin", math.Asin),
+	"acos":  floatFunc("acos", math.Acos),
+	"atan":  floatFunc("atan", math.Atan),
+	"cbrt":  floatFunc("cbrt", math.Cbrt),
+	"sinh":  floatFunc("sinh", math.Sinh),
+	"cosh":  floatFunc("cosh", math.Cosh),
+	"tanh":  floatFunc("tanh", math.Tanh),
+	"deg":   floatFunc("deg", func(x float64) float64 { return x * 180 / math.Pi }),
+	"rad":   floatFunc("rad", func(x float64) float64 { return x * math.Pi / 180 }),
+	"log10": floatFunc("log10", math.Log10),
+}
+
+// floatFunc makes a function of one argument computed in float64.
+func floatFunc(name string, f func(float64) float64) func([]calcValue) (calcValue, error) {
+	return func(a []calcValue) (calcValue, error) {
+		if len(a) != 1 {
+			return calcValue{}, fmt.Errorf("%s takes one argument", name)
+		}
+		x, _ := a[0].r.Float64()
+		y := f(x)
+		if math.IsNaN(y) || math.IsInf(y, 0) {
+			return calcValue{}, fmt.Errorf("%s is not defined for %s", name, a[0])
+		}
+		return calcValue{new(big.Rat).SetFloat64(y), true}, nil
+	}
+}
+
+func pick(a []calcValue, sign int) (calcValue, error) {
+	if len(a) == 0 {
+		return calcValue{}, errors.New("min and max need arguments")
+	}
+	best := a[0]
+	for _, v := range a[1:] {
+		if v.r.Cmp(best.r) == sign {
+			best = v
+		}
+	}
+	return best, nil
+}
+
+// floorRat returns the largest integer not above r.
+func floorRat(r *big.Rat) *big.Int {
+	// Euclidean division floors for the positive denominator.
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+func factorial(v calcValue) (calcValue, error) {
+	if !v.r.IsInt() || v.r.Sign() < 0 {
+		return calcValue{}, errors.New("factorial needs a non-negative integer")
+	}
+	if v.r.Num().Cmp(big.NewInt(5000)) > 0 {
+		return calcValue{}, errors.New("factorial argument is too large")
+	}
+	n := new(big.Int).MulRange(1, v.r.Num().Int64())
+	return calcValue{new(big.Rat).SetInt(n), v.approx}, nil
+}
+
+// powRat raises v to w, exactly when w is an integer.
+func powRat(v, w calcValue) (calcValue, error) {
+	if w.r.IsInt() && !w.approx {
+		n := w.r.Num()
+		if v.r.Sign() == 0 && n.Sign() < 0 {
+			return calcValue{}, errors.New("division by zero")
+		}
+		// The result has about |n| times the bits of v.
+		bits := int64(max(v.r.Num().BitLen(), v.r.Denom().BitLen()))
+		// Dividing instead of multiplying keeps huge exponents from
+		// overflowing past the check.
+		if !n.IsInt64() || n.Int64() == math.MinInt64 || bits > 1 && abs64(n.Int64()) > calcMaxBits/bits {
+			return calcValue{}, errors.New("result is too large")
+		}
+		e := new(big.Int).Abs(n)
+		r := new(big.Rat).SetFrac(new(big.Int).Exp(v.r.Num(), e, nil), new(big.Int).Exp(v.r.Denom(), e, nil))
+		if n.Sign() < 0 {
+			r.Inv(r)
+		}
+		return calcValue{r, v.approx}, nil
+	}
+	x, _ := v.r.Float64()
+	y, _ := w.r.Float64()
+	z := math.Pow(x, y)
+	if math.IsNaN(z) || math.IsInf(z, 0) {
+		return calcValue{}, fmt.Errorf("%s^%s is not defined or too large", v, w)
+	}
+	return calcValue{new(big.Rat).SetFloat64(z), true}, nil
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func checkSize(r *big.Rat) error {
+	if r.Num().BitLen() > calcMaxBits || r.Denom().BitLen() > calcMaxBits {
+		return errors.New("result is too large")
+	}
+	return nil
+}
+
+// unit is a unit of measure: its dimension and its size in the base unit
+// of the dimension. Temperatures also have an offset.
+type unit struct {
+	name   string
+	dim    string
+	factor *big.Rat
+	offset *big.Rat
+}
+
+var unitConversionRe = regexp.MustCompile(`(?i)^(.+)\s+(?:to|in|into|as|->|→)\s+(.+)$`)
+
+// units lists the units of conversions by their names and abbreviations.
+var units = map[string]unit{}
+
+func init() {
+	add := func(dim, factor, offset string, names ...string) {
+		f, _ := new(big.Rat).SetString(factor)
+		var o *big.Rat
+		if offset != "" {
+			o, _ = new(big.Rat).SetString(offset)
+		}
+		for _, n := range names {
+			units[n] = unit{name: names[0], dim: dim, factor: f, offset: o}
+		}
+	}
+	add("length", "1", "", "m", "meter", "meters", "metre", "metres")
+	add("length", "1000", "", "km", "kilometer", "kilometers", "kilometre", "kilometres")
+	add("length", "0.01", "", "cm", "centimeter", "centimeters", "centimetre", "centimetres")
+	add("length", "0.001", "", "mm", "millimeter", "millimeters", "millimetre", "millimetres")
+	add("length", "0.000001", "", "µm", "um", "micrometer", "micrometers", "micron", "microns")
+	add("length", "1609.344", "", "mi", "mile", "miles")
+	add("length", "0.9144", "", "yd", "yard", "yards")
+	add("length", "0.3048", "", "ft", "foot", "feet")
+	add("length", "0.0254", "", "in", "inch", "inches")
+	add("length", "1852", "", "nmi", "nautical mile", "nautical miles")
+	add("mass", "1", "", "kg", "kilogram", "kilograms", "kilo", "kilos")
+	add("mass", "0.001", "", "g", "gram", "grams")
+	add("mass", "0.000001", "", "mg", "milligram", "milligrams")
+	add("mass", "1000", "", "t", "tonne", "tonnes", "metric ton", "metric tons")
+	add("mass", "0.45359237", "", "lb", "lbs", "pound", "pounds")
+	add("mass", "0.028349523125", "", "oz", "ounce", "ounces")
+	add("mass", "6.35029318", "", "st", "stone", "stones")
+	add("time", "1", "", "s", "sec", "secs", "second", "seconds")
+	add("time", "0.001", "", "ms", "millisecond", "milliseconds")
+	add("time", "60", "", "min", "mins", "minute", "minutes")
+	add("time", "3600", "", "h", "hr", "hrs", "hour", "hours")
+	add("time", "86400", "", "d", "day", "days")
+	add("time", "604800", "", "wk", "week", "weeks")
+	add("time", "31557600", "", "yr", "year", "years")
+	add("volume", "1", "", "l", "liter", "liters", "litre", "litres")
+	add("volume", "0.001", "", "ml", "milliliter", "milliliters", "millilitre", "millilitres")
+	add("volume", "1000", "", "m³", "m3", "cubic meter", "cubic meters")
+	add("volume", "3.785411784", "", "gal", "gallon", "gallons")
+	add("volume", "0.946352946", "", "qt", "quart", "quarts")
+	add("volume", "0.473176473", "", "pt", "pint", "pints")
+	add("volume", "0.2365882365", "", "cup", "cups")
+	add("volume", "0.0295735295625", "", "fl oz", "floz", "fluid ounce", "fluid ounces")
+	add("volume", "0.01478676478125", "", "tbsp", "tablespoon", "tablespoons")
+	add("volume", "0.00492892159375", "", "tsp", "teaspoon", "teaspoons")
+	add("area", "1", "", "m²", "m2", "square meter", "square meters")
+	add("area", "1000000", "", "km²", "km2", "square kilometer", "square kilometers")
+	add("area", "10000", "", "ha", "hectare", "hectares")
+	add("area", "4046.8564224", "", "acre", "acres")
+	add("area", "0.09290304", "", "ft²", "ft2", "sq ft", "square foot", "square feet")
+	add("area", "2589988.110336", "", "mi²", "mi2", "sq mi", "square mile", "square miles")
+	add("speed", "1", "", "m/s", "mps")
+	add("speed", "5/18", "", "km/h", "kmh", "kph")
+	add("speed", "0.44704", "", "mph")
+	add("speed", "463/900", "", "kn", "knot", "knots")
+	add("data", "1", "", "B", "byte", "bytes")
+	add("data", "1/8", "", "bit", "bits")
+	add("data", "1000", "", "KB", "kilobyte", "kilobytes")
+	add("data", "1000000", "", "MB", "megabyte", "megabytes")
+	add("data", "1000000000", "", "GB", "gigabyte", "gigabytes")
+	add("data", "1000000000000", "", "TB", "terabyte", "terabytes")
+	add("data", "1024", "", "KiB", "kibibyte", "kibibytes")
+	add("data", "1048576", "", "MiB", "mebibyte", "mebibytes")
+	add("data", "1073741824", "", "GiB", "gibibyte", "gibibytes")
+	add("data", "1099511627776", "", "TiB", "tebibyte", "tebibytes")
+	add("energy", "1", "", "J", "joule", "joules")
+	add("energy", "1000", "", "kJ", "kilojoule", "kilojoules")
+	add("energy", "4.184", "", "cal", "calorie", "calories")
+	add("energy", "4184", "", "kcal", "kilocalorie", "kilocalories")
+	add("energy", "3600000", "", "kWh", "kilowatt hour", "kilowatt hours")
+	add("temperature", "1", "273.15", "°C", "c", "celsius", "degc", "℃")
+	add("temperature", "5/9", "45967/180", "°F", "f", "fahrenheit", "degf", "℉")
+	add("temperature", "1", "0", "K", "kelvin", "kelvins")
+}
+
+// lookupUnit finds a unit by name, exactly first, so that the
+// abbreviations keep their case, and then ignoring case if that leaves a
+// single unit.
+func lookupUnit(name string) (unit, bool) {
+	name = strings.Join(strings.Fields(name), " ")
+	if u, ok := units[name]; ok {
+		return u, true
+	}
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "°"), "deg ")
+	var found []unit
+	for n, u := range units {
+		if strings.EqualFold(n, name) && !slices.ContainsFunc(found, func(f unit) bool { return f.name == u.name }) {
+			found = append(found, u)
+		}
+	}
+	if len(found) != 1 {
+		return unit{}, false
+	}
+	return found[0], true
+}
+
+// splitUnit splits "100 fl oz" into the value and the longest unit it ends
+// with.
+func splitUnit(s string) (string, unit, bool) {
+	for i, c := range s {
+		if i == 0 || !unicode.IsLetter(c) && !strings.ContainsRune("µ°℃℉", c) {
+			continue
+		}
+		if prev := s[i-1]; prev != ' ' && prev != ')' && (prev < '0' || prev > '9') {
+			continue
+		}
+		if u, ok := lookupUnit(s[i:]); ok {
+			return strings.TrimSpace(s[:i]), u, true
+		}
+	}
+	return "", unit{}, false
+}
+
+// convertUnits converts the value of the expression s from one unit to
+// another of the same dimension.
+func convertUnits(s string, from, to unit) (string, error) {
+	if from.dim != to.dim {
+		return "", fmt.Errorf("cannot convert %s (%s) to %s (%s)", from.name, from.dim, to.name, to.dim)
+	}
+	v, err := evalExpr(s)
+	if err != nil {
+		return "", err
+	}
+	// Into the base unit, then out of it.
+	r := new(big.Rat).Mul(v.r, from.factor)
+	if from.offset != nil {
+		r.Add(r, from.offset)
+		r.Sub(r, to.offset)
+	}
+	r.Quo(r, to.factor)
+	out := calcValue{r: r, approx: v.approx}
+	return fmt.Sprintf("%s %s = %s %s", v.decimal(), from.name, out.decimal(), to.name), nil
+}
+
+var (
+	calcDateRe     = regexp.MustCompile(`(?i)^(today|now|\d{4}-\d{2}-\d{2}(?:[t ]\d{2}:\d{2}(?::\d{2})?)?)`)
+	calcDurationRe = regexp.MustCompile(`(?i)^\s*([+-])\s*(\d+)\s*(years?|y|months?|mo|weeks?|w|days?|d|hours?|h|minutes?|mins?)\b`)
+)
+
+// evalDate evaluates date math: a date or "today"/"now" with days, weeks,
+// months, years, hours or minutes added or taken away ("2025-03-01 + 90
+// days"), the time between two dates ("2025-12-25 - today"), or the
+// weekday of a date. ok is false if s is not date math.
+func evalDate(s string, now time.Time) (out string, ok bool, err error) {
+	m := calcDateRe.FindStringSubmatch(s)
+	if m == nil {
+		return "", false, nil
+	}
+	t, hasTime, err := parseCalcDate(m[1], now)
+	if err != nil {
+		return "", true, err
+	}
+	rest := strings.TrimSpace(s[len(m[0]):])
+	if d := strings.TrimSpace(strings.TrimPrefix(rest, "-")); d != rest {
+		if dm := calcDateRe.FindStringSubmatch(d); dm != nil && len(dm[0]) == len(d) {
+			u, uTime, err := parseCalcDate(dm[1], now)
+			if err != nil {
+				return "", true, err
+			}
+			return describeDateDiff(t.Sub(u), hasTime || uTime), true, nil
+		}
+	}
+	for rest != "" {
+		dm := calcDurationRe.FindStringSubmatch(rest)
+		if dm == nil {
+			return "", true, fmt.Errorf("cannot read %q: add or take away a number of years, months, weeks, days, hours or minutes", rest)
+		}
+		n, err := strconv.Atoi(dm[2])
+		if err != nil || n > 100000 {
+			return "", true, errors.New("too many to add")
+		}
+		if dm[1] == "-" {
+			n = -n
+		}
+		switch u := strings.ToLower(dm[3]); {
+		case strings.HasPrefix(u, "y"):
+			t = addMonths(t, 12*n)
+		case strings.HasPrefix(u, "mo"):
+			t = addMonths(t, n)
+		case strings.HasPrefix(u, "w"):
+			t = t.AddDate(0, 0, 7*n)
+		case strings.HasPrefix(u, "d"):
+			t = t.AddDate(0, 0, n)
+		case strings.HasPrefix(u, "h"):
+			t, hasTime = t.Add(time.Duration(n)*time.Hour), true
+		default:
+			t, hasTime = t.Add(time.Duration(n)*time.Minute), true
+		}
+		rest = strings.TrimSpace(rest[len(dm[0]):])
+	}
+	if hasTime {
+		return t.Format("2006-01-02 15:04 UTC (Monday)"), true, nil
+	}
+	return t.Format("2006-01-02 (Monday)"), true, nil
+}
+
+func parseCalcDate(s string, now time.Time) (time.Time, bool, error) {
+	switch strings.ToLower(s) {
+	case "today":
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), false, nil
+	case "now":
+		return now.Truncate(time.Minute), true, nil
+	}
+	s = strings.ToUpper(strings.Replace(s, " ", "T", 1))
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, len(layout) > 10, nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q", s)
+}
+
+// addMonths adds n months to t, staying in the last day of the month when
+// the day does not exist there: a month after January 31 is February 28
+// or 29.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), last)-1)
+}
+
+func describeDateDiff(d time.Duration, withTime bool) string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	days := int(d / (24 * time.Hour))
+	if !withTime {
+		s := sign + plural(days, "day")
+		if days >= 7 {
+			s += fmt.Sprintf(" (%s and %s)", plural(days/7, "week"), plural(days%7, "day"))
+		}
+		return s
+	}
+	rem := d - time.Duration(days)*24*time.Hour
+	parts := []string{plural(int(rem/time.Hour), "hour"), plural(int(rem%time.Hour/time.Minute), "minute")}
+	if days > 0 {
+		parts = append([]string{plural(days, "day")}, parts...)
+	}
+	return sign + strings.Join(parts, ", ")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// checkinRetry is how long to wait before asking the model again about a
+	// user for whom it found nothing to follow up on.
+	checkinRetry = 24 * time.Hour
+
+	checkinPrompt = "\n---\nYou may send the user a short, friendly direct message to follow up on something from the information above: " +
+		"a plan, deadline, event or task they mentioned or asked you to follow up on. Ask how it went or whether there is an update, in one or two sentences. " +
+		"Do not follow up on plain facts or preferences. If nothing warrants a follow-up, reply with exactly NONE."
+
+	checkinFooter = "\n-# To stop these messages, send `yagi checkin off`."
+)
+
+type checkinState struct {
+	Enabled     bool      `json:"enabled"`
+	LastSent    time.Time `json:"last_sent,omitzero"`
+	LastChecked time.Time `json:"last_checked,omitzero"`
+}
+
+// checkinStore keeps which users opted into proactive check-ins in
+// <data>/checkins.json.
+type checkinStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*checkinState
+}
+
+func newCheckinStore(dataDir string) *checkinStore {
+	cs := &checkinStore{
+		path:  filepath.Join(dataDir, "checkins.json"),
+		users: make(map[string]*checkinState),
+	}
+	data, err := os.ReadFile(cs.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read check-ins", "err", err)
+		}
+		return cs
+	}
+	if err := json.Unmarshal(data, &cs.users); err != nil {
+		slog.Error("failed to parse check-ins", "err", err)
+	}
+	return cs
+}
+
+// save writes the store to disk. The caller must hold cs.mu.
+func (cs *checkinStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(cs.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cs.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(cs.path, b, 0600)
+}
+
+func (cs *checkinStore) get(userID string) checkinState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if st, ok := cs.users[userID]; ok {
+		return *st
+	}
+	return checkinState{}
+}
+
+func (cs *checkinStore) setEnabled(userID string, enabled bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	st, ok := cs.users[userID]
+	if !ok {
+		if !enabled {
+			return nil
+		}
+		st = &checkinState{}
+		cs.users[userID] = st
+	}
+	// The record is kept when opting out so that opting back in does not
+	// reset the frequency cap.
+	st.Enabled = enabled
+	return cs.save()
+}
+
+// remove forgets everything about userID.
+func (cs *checkinStore) remove(userID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.users[userID]; !ok {
+		return nil
+	}
+	delete(cs.users, userID)
+	return cs.save()
+}
+
+// due returns the opted-in users that may get a check-in now: nothing was
+// sent within interval and the model was not asked within checkinRetry.
+func (cs *checkinStore) due(now time.Time, interval time.Duration) []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var ids []string
+	for id, st := range cs.users {
+		if st.Enabled && now.Sub(st.LastSent) >= interval && now.Sub(st.LastChecked) >= checkinRetry {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// mark records that userID was considered at now, and whether a message
+// was sent.
+func (cs *checkinStore) mark(userID string, now time.Time, sent bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	st, ok := cs.users[userID]
+	if !ok {
+		return nil
+	}
+	st.LastChecked = now
+	if sent {
+		st.LastSent = now
+	}
+	return cs.save()
+}
+
+// checkinScheduler periodically looks through the memory of opted-in users
+// and DMs them a follow-up when the model finds something worth asking
+// about. Each user gets at most one check-in per interval.
+type checkinScheduler struct {
+	checkins *checkinStore
+	mem      *memoryStore
+	store    *sessionStore
+	eng      *engine.Engine
+	ident    *identity
+	interval time.Duration
+}
+
+func (cs *checkinScheduler) run(s *discordgo.Session, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		cs.tick(s)
+	}
+}
+
+func (cs *checkinScheduler) tick(s *discordgo.Session) {
+	now := time.Now()
+	for _, userID := range cs.checkins.due(now, cs.interval) {
+		sent, err := cs.checkin(s, userID)
+		if err != nil {
+			slog.Warn("check-in failed", "user", hashID(userID), "err", err)
+		}
+		if err := cs.checkins.mark(userID, now, sent); err != nil {
+			slog.Error("failed to save check-ins", "err", err)
+		}
+	}
+}
+
+func (cs *checkinScheduler) checkin(s *discordgo.Session, userID string) (bool, error) {
+	memory, err := cs.mem.list(userID, memoryScope{})
+	if err != nil || len(memory) == 0 {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	system := cs.ident.get() + memoryMarkdown(memory) + checkinPrompt +
+		"\nCurrent date: " + time.Now().UTC().Format(time.DateOnly)
+	reply, _, err := cs.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: system},
+		{Role: openai.ChatMessageRoleUser, Content: "(check-in)"},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return false, err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "" || strings.EqualFold(strings.Trim(reply, ".\"'` "), "NONE") {
+		return false, nil
+	}
+
+	dm, err := s.UserChannelCreate(userID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.ChannelMessageSend(dm.ID, reply+checkinFooter); err != nil {
+		return false, err
+	}
+
+	// Keep the check-in in the DM conversation so a reply has context.
+	key := scopedKey("", userID)
+	sess := cs.store.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.messages = append(sess.messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply})
+	if err := cs.store.save(key, sess); err != nil {
+		slog.Error("failed to save session", "user", hashID(userID), "err", err)
+	}
+	return true, nil
+}
+
+func checkinStatus(loc locale, st checkinState, interval time.Duration) string {
+	if !st.Enabled {
+		return loc.tr("Check-ins are off. Turn them on with `/checkin on`.")
+	}
+	msg := loc.tr("Check-ins are on. I DM you at most once every %s when something in your memory is worth following up on.", humanizeDuration(interval))
+	if !st.LastSent.IsZero() {
+		msg += loc.tr(" Last check-in: %s.", humanizeAge(time.Since(st.LastSent)))
+	}
+	return msg
+}
+
+func checkinCommand(checkins *checkinStore, interval time.Duration) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "checkin",
+			Description: "Occasional follow-up DMs about things you told the bot",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "on",
+					Description: "Let the bot DM you to follow up on your plans",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Stop follow-up DMs",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "status",
+					Description: "Show whether check-ins are on",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			switch opts[0].Name {
+			case "on", "off":
+				if err := checkins.setEnabled(userID, opts[0].Name == "on"); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to save: %s", err))
+					return
+				}
+			}
+			respondEphemeral(s, i, checkinStatus(loc, checkins.get(userID), interval))
+		},
+	}
+}
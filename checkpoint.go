@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// maxCheckpoints bounds the checkpoints of one conversation, not
+	// counting the one kept by a restore.
+	maxCheckpoints = 10
+	// previousCheckpoint is where a restore keeps the conversation it
+	// replaced, so that the restore can be undone.
+	previousCheckpoint = "previous"
+)
+
+var checkpointNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+var errNoCheckpoint = errors.New("no such checkpoint")
+
+// saveCheckpoint stores the conversation of key as checkpoint name,
+// replacing an earlier one of that name.
+func (s *sessionStore) saveCheckpoint(key, name string) error {
+	sess := s.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	msgs := slices.DeleteFunc(slices.Clone(sess.messages), func(m openai.ChatCompletionMessage) bool {
+		return m.Role == openai.ChatMessageRoleSystem
+	})
+	if len(msgs) == 0 {
+		return errors.New("there is no conversation to save yet")
+	}
+	i := slices.IndexFunc(sess.checkpoints, func(c storage.Checkpoint) bool { return c.Name == name })
+	if i < 0 && countCheckpoints(sess.checkpoints) >= maxCheckpoints {
+		return fmt.Errorf("a conversation can have at most %d checkpoints; delete one first", maxCheckpoints)
+	}
+	cp := storage.Checkpoint{
+		Name:      name,
+		CreatedAt: formatTime(s.clock.Now()),
+		StartedAt: formatTime(sess.started),
+		Messages:  msgs,
+	}
+	if i >= 0 {
+		sess.checkpoints[i] = cp
+	} else {
+		sess.checkpoints = append(sess.checkpoints, cp)
+	}
+	sess.dirty = true
+	return s.save(key, sess)
+}
+
+// restoreCheckpoint replaces the conversation of key with checkpoint name
+// and returns how many messages it has. The replaced conversation, if any,
+// becomes the previous checkpoint, so restoring that one swaps the two.
+func (s *sessionStore) restoreCheckpoint(key, name string) (int, bool, error) {
+	sess := s.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	i := slices.IndexFunc(sess.checkpoints, func(c storage.Checkpoint) bool { return c.Name == name })
+	if i < 0 {
+		return 0, false, errNoCheckpoint
+	}
+	cp := sess.checkpoints[i]
+	sess.checkpoints = slices.DeleteFunc(sess.checkpoints, func(c storage.Checkpoint) bool { return c.Name == previousCheckpoint })
+	kept := len(sess.messages) > 0
+	if kept {
+		sess.checkpoints = append(sess.checkpoints, storage.Checkpoint{
+			Name:      previousCheckpoint,
+			CreatedAt: formatTime(s.clock.Now()),
+			StartedAt: formatTime(sess.started),
+			Messages:  slices.Clone(sess.messages),
+		})
+	}
+	s.reset(key, sess)
+	sess.messages = slices.Clone(cp.Messages)
+	sess.started, _ = time.Parse(time.RFC3339, cp.StartedAt)
+	return len(sess.messages), kept, s.save(key, sess)
+}
+
+// deleteCheckpoint removes checkpoint name of the conversation of key.
+func (s *sessionStore) deleteCheckpoint(key, name string) error {
+	sess := s.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	n := len(sess.checkpoints)
+	sess.checkpoints = slices.DeleteFunc(sess.checkpoints, func(c storage.Checkpoint) bool { return c.Name == name })
+	if len(sess.checkpoints) == n {
+		return errNoCheckpoint
+	}
+	sess.dirty = true
+	return s.save(key, sess)
+}
+
+// countCheckpoints counts cps without the previous checkpoint.
+func countCheckpoints(cps []storage.Checkpoint) int {
+	n := 0
+	for _, c := range cps {
+		if c.Name != previousCheckpoint {
+			n++
+		}
+	}
+	return n
+}
+
+func checkpointCommand(store *sessionStore) *slashCommand {
+	nameOption := func(desc string) []*discordgo.ApplicationCommandOption {
+		return []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "name",
+			Description: desc,
+			Required:    true,
+			MaxLength:   32,
+		}}
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "checkpoint",
+			Description: "Save the conversation and go back to it later",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "save",
+					Description: "Save the conversation as it is now",
+					Options:     nameOption("Name of the checkpoint, such as before-refactor"),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "restore",
+					Description: "Go back to a checkpoint; the current conversation is kept as \"previous\"",
+					Options:     nameOption("Checkpoint to go back to"),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List the checkpoints of the conversation",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "delete",
+					Description: "Delete a checkpoint",
+					Options:     nameOption("Checkpoint to delete"),
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			key := conversationKey(store, i)
+			var name string
+			if len(opts[0].Options) > 0 {
+				name = strings.ToLower(strings.TrimSpace(opts[0].Options[0].StringValue()))
+			}
+
+			switch opts[0].Name {
+			case "save":
+				if !checkpointNameRe.MatchString(name) || name == previousCheckpoint {
+					respondEphemeral(s, i, loc.tr("Use a name of up to 32 letters, digits, dots, dashes and underscores, other than \"previous\"."))
+					return
+				}
+				if err := store.saveCheckpoint(key, name); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to save the checkpoint: %s", err))
+					return
+				}
+				respondEphemeral(s, i, loc.tr("Saved checkpoint **%[1]s**. `/checkpoint restore name:%[1]s` brings the conversation back to this point.", name))
+			case "restore":
+				n, kept, err := store.restoreCheckpoint(key, name)
+				if errors.Is(err, errNoCheckpoint) {
+					respondEphemeral(s, i, loc.tr("There is no checkpoint named %s. `/checkpoint list` shows them.", name))
+					return
+				}
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to restore the checkpoint: %s", err))
+					return
+				}
+				msg := loc.tr("Went back to checkpoint **%s** (%d messages).", name, n)
+				if kept {
+					msg += loc.tr(" The conversation you had is kept as **%s**.", previousCheckpoint)
+				}
+				respondEphemeral(s, i, msg)
+			case "delete":
+				err := store.deleteCheckpoint(key, name)
+				if errors.Is(err, errNoCheckpoint) {
+					respondEphemeral(s, i, loc.tr("There is no checkpoint named %s.", name))
+					return
+				}
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to delete the checkpoint: %s", err))
+					return
+				}
+				respondEphemeral(s, i, loc.tr("Deleted checkpoint **%s**.", name))
+			case "list":
+				sess := store.get(key)
+				sess.mu.Lock()
+				cps := slices.Clone(sess.checkpoints)
+				sess.mu.Unlock()
+				if len(cps) == 0 {
+					respondEphemeral(s, i, loc.tr("This conversation has no checkpoints. `/checkpoint save` creates one."))
+					return
+				}
+				var sb strings.Builder
+				sb.WriteString(loc.tr("Checkpoints:") + "\n")
+				for _, c := range cps {
+					created := c.CreatedAt
+					if t, err := time.Parse(time.RFC3339, c.CreatedAt); err == nil {
+						created = fmt.Sprintf("<t:%d:R>", t.Unix())
+					}
+					sb.WriteString(loc.tr("- **%s**: %d messages, saved %s", c.Name, len(c.Messages), created) + "\n")
+				}
+				respondEphemeral(s, i, sb.String())
+			}
+		},
+	}
+}
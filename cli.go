@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// cliCommand is a subcommand of the binary. Every command shares the one
+// flag set, so options and the config file work the same for all of them.
+type cliCommand struct {
+	name    string
+	args    string
+	summary string
+	// aliases are earlier names that still work.
+	aliases []string
+}
+
+var cliCommands = []cliCommand{
+	{name: "serve", summary: "Run the bot (the default)"},
+	{name: "doctor", summary: "Check the token, provider key, intents, data directory and storage"},
+	{name: "repl", args: "[user ID]", summary: "Chat with the bot in the terminal"},
+	{name: "eval", args: "<suite.yaml>", summary: "Check replies against a prompt suite"},
+	{name: "sessions export", summary: "Write every stored conversation to stdout as JSON lines"},
+	{name: "sessions import", summary: "Store the conversations read from stdin as JSON lines"},
+	{name: "storage migrate", args: "<backend>", summary: "Copy conversations and memory from -storage to another backend"},
+	{name: "storage encrypt", summary: "Encrypt the plain files in the data directory", aliases: []string{"migrate-encrypt"}},
+	{name: "decrypt-backup", args: "<file>...", summary: "Decrypt backup files to stdout"},
+	{name: "export-training", args: "[openai|anthropic]", summary: "Write fine-tuning data of opted-in users to stdout"},
+	{name: "export-feedback", summary: "Write the recorded ratings to stdout"},
+}
+
+// parseCommand picks the command from the arguments fs left over and parses
+// the flags that follow it, returning the command's name and its positional
+// arguments. Without arguments the command is serve.
+func parseCommand(fs *flag.FlagSet) (string, []string, error) {
+	args := fs.Args()
+	if len(args) == 0 {
+		return "serve", nil, nil
+	}
+	for _, c := range cliCommands {
+		if n := c.match(args); n > 0 {
+			if err := fs.Parse(args[n:]); err != nil {
+				return "", nil, err
+			}
+			return c.name, fs.Args(), nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown command %q; run with -h for the list", args[0])
+}
+
+// match returns how many of args name c, or 0 if they do not.
+func (c cliCommand) match(args []string) int {
+	words := strings.Fields(c.name)
+	if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+		return len(words)
+	}
+	if slices.Contains(c.aliases, args[0]) {
+		return 1
+	}
+	return 0
+}
+
+// usage prints the commands and the flags.
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] [command] [flags] [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "  %-34s %s\n", strings.TrimSpace(c.name+" "+c.args), c.summary)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+// exportSessions writes every conversation in sessions to w, one JSON
+// document per line, and returns how many there were.
+func exportSessions(w io.Writer, sessions storage.SessionStore) (int, error) {
+	all, err := sessions.All()
+	if err != nil {
+		return 0, err
+	}
+	slices.SortFunc(all, func(a, b *storage.SessionData) int { return strings.Compare(a.UserID, b.UserID) })
+	enc := json.NewEncoder(w)
+	for _, sd := range all {
+		if err := enc.Encode(sd); err != nil {
+			return 0, err
+		}
+	}
+	return len(all), nil
+}
+
+// importSessions stores the conversations read from r as written by
+// exportSessions, replacing stored ones with the same key, and returns how
+// many there were.
+func importSessions(r io.Reader, sessions storage.SessionStore) (int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 64<<20)
+	n, line := 0, 0
+	for sc.Scan() {
+		line++
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var sd storage.SessionData
+		if err := json.Unmarshal(sc.Bytes(), &sd); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		if ns, _ := storage.SplitKey(sd.UserID); ns == "" {
+			return n, fmt.Errorf("line %d: user_id %q is not a session key (<namespace>/<id>)", line, sd.UserID)
+		}
+		if err := sessions.Save(sd.UserID, &sd); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		n++
+	}
+	return n, sc.Err()
+}
+
+// migrateStorage copies the conversations and memory documents in from to
+// to as they are, still encrypted if they were, and returns how many were
+// copied. Documents already in to are overwritten.
+func migrateStorage(from, to storage.Blobs) (int, error) {
+	var keys []string
+	for _, prefix := range []string{"dm", "guilds", "sessions", "memory"} {
+		k, err := from.List(prefix)
+		if err != nil {
+			return 0, err
+		}
+		keys = append(keys, k...)
+	}
+	n := 0
+	for _, key := range keys {
+		if !isStorageDoc(key) {
+			continue
+		}
+		data, err := from.Get(key)
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", key, err)
+		}
+		if err := to.Put(key, data, 0); err != nil {
+			return n, fmt.Errorf("%s: %w", key, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// isStorageDoc reports whether key is a conversation or memory document,
+// as opposed to other files in the data directory.
+func isStorageDoc(key string) bool {
+	for _, kind := range []string{"sessions/", "memory/"} {
+		if strings.HasPrefix(key, kind) || strings.Contains(key, "/"+kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// Application flags telling whether the message content intent is enabled.
+const (
+	appFlagGatewayMessageContent        = 1 << 18
+	appFlagGatewayMessageContentLimited = 1 << 19
+)
+
+// doctor checks what the bot needs to run and reports each check to w. It
+// returns an error if any check failed.
+type doctor struct {
+	token   string
+	client  *openai.Client
+	model   string
+	dataDir string
+	blobs   func() (storage.Blobs, error)
+	idPath  string
+}
+
+func (d *doctor) run(w io.Writer) error {
+	failed := 0
+	report := func(name string, err error, ok string) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintf(w, "ok    %s: %s\n", name, ok)
+	}
+	warn := func(name, msg string) {
+		fmt.Fprintf(w, "warn  %s: %s\n", name, msg)
+	}
+
+	if d.token == "" {
+		report("discord token", errors.New("not set: use DISCORD_BOT_TOKEN or -token"), "")
+	} else if dg, err := discordgo.New("Bot " + d.token); err != nil {
+		report("discord token", err, "")
+	} else {
+		if u, err := dg.User("@me"); err != nil {
+			report("discord token", err, "")
+		} else {
+			report("discord token", nil, "logged in as "+u.Username)
+		}
+		if app, err := dg.Application("@me"); err != nil {
+			report("intents", err, "")
+		} else if app.Flags&(appFlagGatewayMessageContent|appFlagGatewayMessageContentLimited) == 0 {
+			report("intents", errors.New("the Message Content intent is off; enable it in the Discord Developer Portal"), "")
+		} else {
+			report("intents", nil, "Message Content intent enabled")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if models, err := d.client.ListModels(ctx); err != nil {
+		report("provider key", err, "")
+	} else {
+		report("provider key", nil, fmt.Sprintf("%d models available", len(models.Models)))
+		if len(models.Models) > 0 && !slices.ContainsFunc(models.Models, func(m openai.Model) bool { return m.ID == d.model }) {
+			warn("model", d.model+" is not among the provider's models")
+		}
+	}
+
+	if err := os.MkdirAll(d.dataDir, 0700); err != nil {
+		report("data directory", err, "")
+	} else {
+		report("data directory", (&healthChecker{dataDir: d.dataDir}).dataDirWritable(), d.dataDir+" is writable")
+	}
+	if b, err := d.blobs(); err != nil {
+		report("storage", err, "")
+	} else if _, err := b.List("dm"); err != nil {
+		report("storage", err, "")
+	} else {
+		report("storage", nil, "reachable")
+	}
+	if _, err := os.Stat(d.idPath); err != nil {
+		warn("identity", d.idPath+" is missing; replies use no identity")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
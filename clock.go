@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Clock tells the time. The session store reads it instead of calling
+// time.Now, so that expiry can be driven by a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// MessageSender posts, edits and deletes Discord messages. *discordgo.Session
+// implements it; the reply path only needs this much, so a recorder can stand
+// in for Discord, for example to replay conversations.
+type MessageSender interface {
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID, messageID string, options ...discordgo.RequestOption) error
+}
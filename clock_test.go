@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// recordingSender is a MessageSender that keeps what would have been sent
+// to Discord.
+type recordingSender struct {
+	next    int
+	sent    []string
+	edited  map[string]string
+	deleted []string
+}
+
+func (r *recordingSender) post(content string) *discordgo.Message {
+	r.next++
+	r.sent = append(r.sent, content)
+	return &discordgo.Message{ID: fmt.Sprint(r.next), Content: content}
+}
+
+func (r *recordingSender) ChannelMessageSend(_ string, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return r.post(content), nil
+}
+
+func (r *recordingSender) ChannelMessageSendComplex(_ string, data *discordgo.MessageSend, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	return r.post(data.Content), nil
+}
+
+func (r *recordingSender) ChannelMessageEdit(_, messageID, content string, _ ...discordgo.RequestOption) (*discordgo.Message, error) {
+	if r.edited == nil {
+		r.edited = make(map[string]string)
+	}
+	r.edited[messageID] = content
+	return &discordgo.Message{ID: messageID, Content: content}, nil
+}
+
+func (r *recordingSender) ChannelMessageDelete(_, messageID string, _ ...discordgo.RequestOption) error {
+	r.deleted = append(r.deleted, messageID)
+	return nil
+}
+
+func newTestSessionStore(clock Clock) *sessionStore {
+	blobs := storage.NewFileBlobsFS("data", storage.NewMemFS())
+	s := newSessionStore("data", storage.NewSessionStore(blobs, nil, 0))
+	s.clock = clock
+	return s
+}
+
+func TestSessionStoreGCSavesAndEvictsIdleSessions(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	store := newTestSessionStore(clock)
+	ended := make(chan string, 1)
+	store.onEnd = func(key string, _ time.Time, _ []openai.ChatCompletionMessage) { ended <- key }
+
+	key := scopedKey("", "user")
+	sess := store.get(key)
+	sess.mu.Lock()
+	sess.messages = engine.UserMessage("hello")
+	sess.dirty = true
+	sess.mu.Unlock()
+
+	clock.now = clock.now.Add(sessionExpiry / 2)
+	store.gc()
+	if _, ok := store.sessions[key]; !ok {
+		t.Fatal("session evicted before it expired")
+	}
+
+	clock.now = clock.now.Add(sessionExpiry)
+	store.gc()
+	if _, ok := store.sessions[key]; ok {
+		t.Fatal("idle session still in memory")
+	}
+	select {
+	case got := <-ended:
+		if got != key {
+			t.Errorf("onEnd called with %q, want %q", got, key)
+		}
+	case <-time.After(time.Second):
+		t.Error("onEnd not called for the expired conversation")
+	}
+
+	sd, err := store.persist.Load(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd == nil || len(sd.Messages) != 1 || sd.Messages[0].Content != "hello" {
+		t.Fatalf("saved session = %+v, want the conversation", sd)
+	}
+	if want := clock.now.UTC().Format(time.RFC3339); sd.UpdatedAt != want {
+		t.Errorf("UpdatedAt = %q, want the fake clock's %q", sd.UpdatedAt, want)
+	}
+}
+
+func TestSendReplySplitsLongReplies(t *testing.T) {
+	rec := &recordingSender{}
+	content := strings.Repeat("word ", discordLimit/5*2)
+	ids := sendReply(rec, "channel", nil, content)
+	if len(rec.sent) < 2 {
+		t.Fatalf("sent %d messages, want the reply split", len(rec.sent))
+	}
+	if len(ids) != len(rec.sent) {
+		t.Errorf("returned %d IDs for %d messages", len(ids), len(rec.sent))
+	}
+	for _, m := range rec.sent {
+		if len([]rune(m)) > discordLimit {
+			t.Errorf("message of %d characters exceeds the limit", len([]rune(m)))
+		}
+	}
+}
+
+func TestEditReplyReusesSendsAndDeletesMessages(t *testing.T) {
+	rec := &recordingSender{next: 10}
+	ids := editReply(rec, "channel", []string{"1", "2", "3"}, "short")
+	if !slices.Equal(ids, []string{"1"}) {
+		t.Errorf("IDs = %v, want [1]", ids)
+	}
+	if rec.edited["1"] != "short" {
+		t.Errorf("first message edited to %q", rec.edited["1"])
+	}
+	if !slices.Equal(rec.deleted, []string{"2", "3"}) {
+		t.Errorf("deleted %v, want the messages no longer needed", rec.deleted)
+	}
+
+	rec = &recordingSender{next: 10}
+	ids = editReply(rec, "channel", []string{"1"}, strings.Repeat("word ", discordLimit/5*2))
+	if len(ids) < 2 || ids[0] != "1" || len(rec.sent) != len(ids)-1 {
+		t.Errorf("IDs = %v, sent %d; want the first edited and the rest sent", ids, len(rec.sent))
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type slashCommand struct {
+	def     *discordgo.ApplicationCommand
+	handler func(s *discordgo.Session, i *discordgo.InteractionCreate)
+}
+
+// registerSlashCommands syncs the bot's application commands with cmds and
+// installs a handler that dispatches interactions to them. With guildIDs the
+// commands are registered in those guilds only, where changes apply at once,
+// and any global commands are removed so they do not show up twice.
+func registerSlashCommands(dg *discordgo.Session, guildIDs []string, cmds []*slashCommand) {
+	handlers := make(map[string]*slashCommand, len(cmds))
+	defs := make([]*discordgo.ApplicationCommand, 0, len(cmds))
+	for _, c := range cmds {
+		handlers[c.def.Name] = c
+		defs = append(defs, c.def)
+	}
+
+	dg.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		appID := s.State.User.ID
+		if len(guildIDs) == 0 {
+			syncCommands(s, appID, "", defs)
+			return
+		}
+		syncCommands(s, appID, "", nil)
+		for _, g := range guildIDs {
+			syncCommands(s, appID, g, defs)
+		}
+	})
+
+	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		if c, ok := handlers[i.ApplicationCommandData().Name]; ok {
+			c.handler(s, i)
+		}
+	})
+}
+
+// interactionUserID returns the ID of the user who triggered the interaction,
+// whether it happened in a guild or in a DM.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// conversationKey returns the session key of the conversation an
+// interaction refers to: that of the thread it happened in, if the bot
+// talks there, or otherwise the user's own in the guild or DM.
+func conversationKey(store *sessionStore, i *discordgo.InteractionCreate) string {
+	if i.GuildID != "" {
+		key := scopedKey(i.GuildID, i.ChannelID)
+		sess := store.get(key)
+		sess.mu.Lock()
+		shared := len(sess.messages) > 0 || len(sess.checkpoints) > 0
+		sess.mu.Unlock()
+		if shared {
+			return key
+		}
+	}
+	return scopedKey(i.GuildID, interactionUserID(i))
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	respondEphemeralComponents(s, i, content, nil)
+}
+
+// canManageGuild reports whether the interaction comes from a guild member
+// with the Manage Server permission.
+func canManageGuild(i *discordgo.InteractionCreate) bool {
+	return i.Member != nil && i.Member.Permissions&discordgo.PermissionManageGuild != 0
+}
+
+func respondEphemeralComponents(s *discordgo.Session, i *discordgo.InteractionCreate, content string, components []discordgo.MessageComponent) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: components,
+			Flags:      discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
+
+// syncCommands makes the application commands registered in guildID, or
+// globally if it is empty, match defs. Only commands that are missing,
+// different or no longer defined are created, edited or deleted, so that
+// restarts do not touch unchanged commands.
+func syncCommands(s *discordgo.Session, appID, guildID string, defs []*discordgo.ApplicationCommand) {
+	log := slog.With("guild", guildID)
+	registered, err := s.ApplicationCommands(appID, guildID)
+	if err != nil {
+		log.Error("failed to list slash commands", "err", err)
+		return
+	}
+	type key struct {
+		name string
+		typ  discordgo.ApplicationCommandType
+	}
+	keyOf := func(c *discordgo.ApplicationCommand) key {
+		return key{c.Name, max(c.Type, discordgo.ChatApplicationCommand)}
+	}
+	existing := make(map[key]*discordgo.ApplicationCommand, len(registered))
+	for _, c := range registered {
+		existing[keyOf(c)] = c
+	}
+
+	var created, updated, deleted int
+	for _, def := range defs {
+		k := keyOf(def)
+		cur, ok := existing[k]
+		delete(existing, k)
+		switch {
+		case !ok:
+			if _, err := s.ApplicationCommandCreate(appID, guildID, def); err != nil {
+				log.Error("failed to create slash command", "command", def.Name, "err", err)
+				continue
+			}
+			created++
+		case !sameCommand(cur, def):
+			if _, err := s.ApplicationCommandEdit(appID, guildID, cur.ID, def); err != nil {
+				log.Error("failed to update slash command", "command", def.Name, "err", err)
+				continue
+			}
+			updated++
+		}
+	}
+	for _, c := range existing {
+		if err := s.ApplicationCommandDelete(appID, guildID, c.ID); err != nil {
+			log.Error("failed to delete slash command", "command", c.Name, "err", err)
+			continue
+		}
+		deleted++
+	}
+	if created+updated+deleted > 0 {
+		log.Info("synced slash commands", "created", created, "updated", updated, "deleted", deleted)
+	}
+}
+
+// sameCommand reports whether the registered command cur matches def. Fields
+// Discord fills in itself are only compared when def sets them.
+func sameCommand(cur, def *discordgo.ApplicationCommand) bool {
+	a, b := commandShape(cur), commandShape(def)
+	if def.Contexts == nil {
+		a.Contexts = nil
+	}
+	if def.IntegrationTypes == nil {
+		a.IntegrationTypes = nil
+	}
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(ja) == string(jb)
+}
+
+// commandShape returns a copy of c without the fields Discord assigns, with
+// defaults and empty lists written the same way on both sides.
+func commandShape(c *discordgo.ApplicationCommand) discordgo.ApplicationCommand {
+	out := *c
+	out.ID, out.ApplicationID, out.GuildID, out.Version = "", "", "", ""
+	out.DefaultPermission, out.DMPermission = nil, nil
+	out.Type = max(out.Type, discordgo.ChatApplicationCommand)
+	if out.NSFW != nil && !*out.NSFW {
+		out.NSFW = nil
+	}
+	if out.NameLocalizations != nil && len(*out.NameLocalizations) == 0 {
+		out.NameLocalizations = nil
+	}
+	if out.DescriptionLocalizations != nil && len(*out.DescriptionLocalizations) == 0 {
+		out.DescriptionLocalizations = nil
+	}
+	out.Options = optionShapes(c.Options)
+	return out
+}
+
+func optionShapes(opts []*discordgo.ApplicationCommandOption) []*discordgo.ApplicationCommandOption {
+	if len(opts) == 0 {
+		return nil
+	}
+	out := make([]*discordgo.ApplicationCommandOption, len(opts))
+	for i, o := range opts {
+		c := *o
+		if len(c.NameLocalizations) == 0 {
+			c.NameLocalizations = nil
+		}
+		if len(c.DescriptionLocalizations) == 0 {
+			c.DescriptionLocalizations = nil
+		}
+		if len(c.ChannelTypes) == 0 {
+			c.ChannelTypes = nil
+		}
+		if len(c.Choices) == 0 {
+			c.Choices = nil
+		}
+		c.Options = optionShapes(o.Options)
+		out[i] = &c
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads the YAML config file at path and applies it to the flags
+// of fs. Top-level keys are flag names ("model", "data", "tool-selection",
+// ...), and lists are joined with commas. Flags given on the command line
+// keep their value. The "guilds" key holds per-guild defaults keyed by guild
+// ID, the "tools" key tool plugins, the "mcp" key MCP servers and the
+// "github" key the GitHub tools, which are returned. ${VAR} and $VAR in
+// values are replaced by environment variables. Errors name the
+// file, line and key at fault.
+func loadConfig(fs *flag.FlagSet, path string) (fileConfig, error) {
+	var fc fileConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fc, err
+	}
+	var doc yaml.Node
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return fc, nil
+		}
+		return fc, fmt.Errorf("%s: %w", path, err)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fc, fmt.Errorf("%s:%d: expected a mapping of option names to values", path, root.Line)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, val := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "guilds":
+			if fc.guilds, err = configGuilds(path, val); err != nil {
+				return fc, err
+			}
+			continue
+		case "tools":
+			if fc.tools, err = configTools(path, val); err != nil {
+				return fc, err
+			}
+			continue
+		case "mcp":
+			if fc.mcp, err = configMCP(path, val); err != nil {
+				return fc, err
+			}
+			continue
+		case "github":
+			fc.github = new(githubConfig)
+			if err := configStruct(path, val, "github", fc.github); err != nil {
+				return fc, err
+			}
+			if err := fc.github.check(); err != nil {
+				return fc, configError(path, val, "github", err.Error())
+			}
+			continue
+		}
+		if key.Value == "config" || fs.Lookup(key.Value) == nil {
+			return fc, configError(path, key, key.Value, "unknown option")
+		}
+		value, err := configValue(val)
+		if err != nil {
+			return fc, configError(path, val, key.Value, err.Error())
+		}
+		if explicit[key.Value] {
+			continue
+		}
+		if err := fs.Set(key.Value, value); err != nil {
+			return fc, configError(path, val, key.Value, fmt.Sprintf("invalid value %q: %v", value, err))
+		}
+	}
+	return fc, nil
+}
+
+// fileConfig is what the config file holds besides flag values.
+type fileConfig struct {
+	guilds map[string]guildConfig
+	tools  []pluginConfig
+	mcp    map[string]mcpServerConfig
+	github *githubConfig
+}
+
+// configError reports a problem with the option at keyPath, found at n.
+func configError(path string, n *yaml.Node, keyPath, msg string) error {
+	return fmt.Errorf("%s:%d: %s: %s", path, n.Line, keyPath, msg)
+}
+
+// configValue returns the flag value of a scalar or a list of scalars, with
+// environment variables expanded.
+func configValue(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return os.ExpandEnv(n.Value), nil
+	case yaml.SequenceNode:
+		items := make([]string, len(n.Content))
+		for i, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", errors.New("lists may only hold plain values")
+			}
+			items[i] = os.ExpandEnv(item.Value)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("expected a value or a list of values")
+}
+
+// configGuilds decodes the "guilds" section. Its option names are those of
+// the stored guild settings (channels, persona, language, dual_language,
+// disabled_tools, channel_disabled_tools, daily_quota, no_system_prompt,
+// reaction_channels, translate_channels, api_key, announcements, moderation,
+// moderation_channel).
+func configGuilds(path string, n *yaml.Node) (map[string]guildConfig, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, configError(path, n, "guilds", "expected a mapping of guild IDs to settings")
+	}
+	fields := make(map[string]int)
+	t := reflect.TypeFor[guildConfig]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = i
+	}
+
+	guilds := make(map[string]guildConfig)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		id, settings := n.Content[i], n.Content[i+1]
+		if settings.Kind != yaml.MappingNode {
+			return nil, configError(path, settings, "guilds."+id.Value, "expected a mapping of settings")
+		}
+		var cfg guildConfig
+		v := reflect.ValueOf(&cfg).Elem()
+		for j := 0; j+1 < len(settings.Content); j += 2 {
+			key, val := settings.Content[j], settings.Content[j+1]
+			keyPath := "guilds." + id.Value + "." + key.Value
+			field, ok := fields[key.Value]
+			if !ok {
+				return nil, configError(path, key, keyPath, "unknown setting")
+			}
+			expandEnv(val)
+			if err := val.Decode(v.Field(field).Addr().Interface()); err != nil {
+				return nil, configError(path, val, keyPath, "expected "+v.Field(field).Type().String())
+			}
+		}
+		guilds[id.Value] = cfg
+	}
+	return guilds, nil
+}
+
+// configTools decodes the "tools" section, a list of tool plugins (see
+// pluginConfig).
+func configTools(path string, n *yaml.Node) ([]pluginConfig, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, configError(path, n, "tools", "expected a list of tools")
+	}
+	var tools []pluginConfig
+	for i, item := range n.Content {
+		keyPath := fmt.Sprintf("tools[%d]", i)
+		var pc pluginConfig
+		if err := configStruct(path, item, keyPath, &pc); err != nil {
+			return nil, err
+		}
+		if err := pc.check(); err != nil {
+			return nil, configError(path, item, keyPath, err.Error())
+		}
+		for _, prev := range tools {
+			if prev.Name == pc.Name {
+				return nil, configError(path, item, keyPath, fmt.Sprintf("tool %q is declared twice", pc.Name))
+			}
+		}
+		tools = append(tools, pc)
+	}
+	return tools, nil
+}
+
+// configMCP decodes the "mcp" section, a mapping of names of MCP servers to
+// their settings (see mcpServerConfig).
+func configMCP(path string, n *yaml.Node) (map[string]mcpServerConfig, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, configError(path, n, "mcp", "expected a mapping of server names to settings")
+	}
+	servers := make(map[string]mcpServerConfig)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		name, settings := n.Content[i], n.Content[i+1]
+		keyPath := "mcp." + name.Value
+		if !toolNameRe.MatchString(name.Value) {
+			return nil, configError(path, name, keyPath, "server names may only hold letters, digits, underscores and dashes")
+		}
+		var sc mcpServerConfig
+		if err := configStruct(path, settings, keyPath, &sc); err != nil {
+			return nil, err
+		}
+		if err := sc.check(); err != nil {
+			return nil, configError(path, settings, keyPath, err.Error())
+		}
+		servers[name.Value] = sc
+	}
+	return servers, nil
+}
+
+// configStruct decodes the mapping n into v, a pointer to a struct with
+// yaml tags, after checking that every key names one of its fields.
+func configStruct(path string, n *yaml.Node, keyPath string, v any) error {
+	if n.Kind != yaml.MappingNode {
+		return configError(path, n, keyPath, "expected a mapping of settings")
+	}
+	t := reflect.TypeOf(v).Elem()
+	fields := make(map[string]bool)
+	for i := range t.NumField() {
+		fields[t.Field(i).Tag.Get("yaml")] = true
+	}
+	for j := 0; j+1 < len(n.Content); j += 2 {
+		if key := n.Content[j]; !fields[key.Value] {
+			return configError(path, key, keyPath+"."+key.Value, "unknown setting")
+		}
+	}
+	expandEnv(n)
+	if err := n.Decode(v); err != nil {
+		return configError(path, n, keyPath, err.Error())
+	}
+	return nil
+}
+
+// expandEnv replaces environment variables in every scalar under n.
+func expandEnv(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode {
+		n.Value = os.ExpandEnv(n.Value)
+	}
+	for _, c := range n.Content {
+		expandEnv(c)
+	}
+}
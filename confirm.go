@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const ctxKeyConfirmTarget contextKey = "confirmTarget"
+
+// confirmTarget is where a reply asks the user to approve tool calls.
+type confirmTarget struct {
+	s         *discordgo.Session
+	channelID string
+	ref       *discordgo.MessageReference
+	userID    string
+	loc       locale
+}
+
+// withConfirmTarget lets the tool calls made with ctx be approved by the
+// user of t. Without a target, calls that need approval are refused.
+func withConfirmTarget(ctx context.Context, t *confirmTarget) context.Context {
+	return context.WithValue(ctx, ctxKeyConfirmTarget, t)
+}
+
+// pendingConfirm is a tool call waiting for its user's answer.
+type pendingConfirm struct {
+	userID string
+	answer chan bool
+}
+
+// toolConfirmer asks users to approve the calls of the tools in patterns
+// with buttons, holding the engine's tool loop until they answer. It is the
+// engine's ToolApprover; the engine asks it only about tools registered as
+// not safe (see toolRegistry.newEngine).
+type toolConfirmer struct {
+	patterns []string
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingConfirm
+}
+
+func newToolConfirmer(patterns []string, timeout time.Duration) *toolConfirmer {
+	return &toolConfirmer{patterns: patterns, timeout: timeout, pending: make(map[string]*pendingConfirm)}
+}
+
+// needs reports whether calls of name must be approved.
+func (tc *toolConfirmer) needs(name string) bool {
+	return tc != nil && toolDisabled(tc.patterns, name)
+}
+
+// Approve posts the call of toolName with args to the user and waits for
+// Approve or Deny, the timeout or the end of ctx.
+func (tc *toolConfirmer) Approve(ctx context.Context, toolName, args string) (bool, error) {
+	if !tc.needs(toolName) {
+		return true, nil
+	}
+	t, _ := ctx.Value(ctxKeyConfirmTarget).(*confirmTarget)
+	if t == nil {
+		return false, errors.New("this tool needs approval, which can only be given on Discord")
+	}
+	id := newRequestID()
+	p := &pendingConfirm{userID: t.userID, answer: make(chan bool, 1)}
+	tc.mu.Lock()
+	tc.pending[id] = p
+	tc.mu.Unlock()
+	defer func() {
+		tc.mu.Lock()
+		delete(tc.pending, id)
+		tc.mu.Unlock()
+	}()
+
+	msg, err := t.s.ChannelMessageSendComplex(t.channelID, &discordgo.MessageSend{
+		Content:   describeToolCall(t.loc, toolName, args),
+		Reference: t.ref,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: t.loc.tr("Approve"), Style: discordgo.SuccessButton, CustomID: "confirm:yes:" + id},
+				discordgo.Button{Label: t.loc.tr("Deny"), Style: discordgo.DangerButton, CustomID: "confirm:no:" + id},
+			}},
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to ask for approval: %w", err)
+	}
+
+	timer := time.NewTimer(tc.timeout)
+	defer timer.Stop()
+	select {
+	case ok := <-p.answer:
+		slog.Info("tool call answered", "tool", toolName, "user", hashID(t.userID), "approved", ok)
+		return ok, nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	slog.Info("tool call not approved in time", "tool", toolName, "user", hashID(t.userID))
+	empty := []discordgo.MessageComponent{}
+	content := describeToolCall(t.loc, toolName, args) + "\n" + t.loc.tr("Not approved in time.")
+	t.s.ChannelMessageEditComplex(&discordgo.MessageEdit{Channel: t.channelID, ID: msg.ID, Content: &content, Components: &empty})
+	return false, nil
+}
+
+// describeToolCall is the approval question for a call of name with args.
+func describeToolCall(loc locale, name, args string) string {
+	args = truncateRunes(strings.ReplaceAll(args, codeFence, "'''"), 1500)
+	return loc.tr("The assistant wants to run **%s** with:", name) + "\n" + codeFence + "json\n" + args + "\n" + codeFence
+}
+
+func (tc *toolConfirmer) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	rest, ok := strings.CutPrefix(i.MessageComponentData().CustomID, "confirm:")
+	if !ok {
+		return
+	}
+	choice, id, _ := strings.Cut(rest, ":")
+	loc := interactionLocale(i)
+	tc.mu.Lock()
+	p := tc.pending[id]
+	if p != nil && p.userID == interactionUserID(i) {
+		delete(tc.pending, id)
+	}
+	tc.mu.Unlock()
+
+	content := i.Message.Content
+	switch {
+	case p == nil:
+		content += "\n" + loc.tr("This request has expired.")
+	case p.userID != interactionUserID(i):
+		respondEphemeral(s, i, loc.tr("Only the person who asked can choose."))
+		return
+	case choice == "yes":
+		p.answer <- true
+		content += "\n" + loc.tr("Approved by <@%s>.", p.userID)
+	default:
+		p.answer <- false
+		content += "\n" + loc.tr("Denied by <@%s>.", p.userID)
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
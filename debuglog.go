@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Discord snowflakes (user, channel and guild IDs).
+	snowflakePattern = regexp.MustCompile(`\b\d{17,20}\b`)
+	// Common API key shapes, in case a key ends up in a payload.
+	apiKeyPattern = regexp.MustCompile(`\b(sk|pk|gsk|xai|AIza)[-_A-Za-z0-9]{16,}`)
+)
+
+// debugTransport logs every provider request and response to a file, with
+// API keys and Discord IDs redacted.
+type debugTransport struct {
+	base    http.RoundTripper
+	secrets []string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newDebugTransport(path string, secrets ...string) (*debugTransport, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var nonEmpty []string
+	for _, s := range secrets {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	return &debugTransport{base: http.DefaultTransport, secrets: nonEmpty, w: f}, nil
+}
+
+func (t *debugTransport) redact(s string) string {
+	for _, secret := range t.secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	s = apiKeyPattern.ReplaceAllString(s, "[REDACTED]")
+	return snowflakePattern.ReplaceAllStringFunc(s, func(id string) string {
+		return "[id:" + hashID(id) + "]"
+	})
+}
+
+func (t *debugTransport) headers(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		switch strings.ToLower(k) {
+		case "authorization", "x-api-key", "api-key", "cookie", "set-cookie":
+			v = "[REDACTED]"
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", k, v)
+	}
+	return sb.String()
+}
+
+func (t *debugTransport) write(entry string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	io.WriteString(t.w, t.redact(entry))
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := fmt.Sprintf("%x", time.Now().UnixNano())
+	start := time.Now()
+
+	var reqBody []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = b
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	t.write(fmt.Sprintf("=== %s request %s\n%s %s\n%s\n%s\n\n",
+		start.Format(time.RFC3339Nano), id, req.Method, req.URL, t.headers(req.Header), reqBody))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.write(fmt.Sprintf("=== %s error %s (%s)\n%v\n\n",
+			time.Now().Format(time.RFC3339Nano), id, time.Since(start), err))
+		return nil, err
+	}
+
+	header := fmt.Sprintf("=== %s response %s (%s)\n%s\n%s\n",
+		time.Now().Format(time.RFC3339Nano), id, time.Since(start), resp.Status, t.headers(resp.Header))
+	resp.Body = &loggedBody{ReadCloser: resp.Body, onClose: func(body []byte) {
+		t.write(header + string(body) + "\n\n")
+	}}
+	return resp, nil
+}
+
+// loggedBody records everything read from a response body, including
+// streamed responses, and hands it to onClose once the body is closed.
+type loggedBody struct {
+	io.ReadCloser
+	buf     bytes.Buffer
+	once    sync.Once
+	onClose func([]byte)
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *loggedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.onClose(b.buf.Bytes()) })
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// messageHash identifies a user message in a conversation by its text.
+func messageHash(m openai.ChatCompletionMessage) string {
+	h := sha256.New()
+	h.Write([]byte(m.Content))
+	for _, part := range m.MultiContent {
+		h.Write([]byte(part.Text))
+		if part.ImageURL != nil {
+			h.Write([]byte(part.ImageURL.URL))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// removeTurn removes the exchange that starts with the last user message
+// with the given hash: that message and everything up to the next user
+// message. msgs is modified in place.
+func removeTurn(msgs []openai.ChatCompletionMessage, hash string) ([]openai.ChatCompletionMessage, bool) {
+	i, end, ok := findTurn(msgs, hash)
+	if !ok {
+		return msgs, false
+	}
+	return slices.Delete(msgs, i, end), true
+}
+
+// findTurn returns the bounds msgs[i:end] of the exchange removeTurn
+// removes.
+func findTurn(msgs []openai.ChatCompletionMessage, hash string) (i, end int, ok bool) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role != openai.ChatMessageRoleUser || messageHash(msgs[i]) != hash {
+			continue
+		}
+		end := i + 1
+		for end < len(msgs) && msgs[end].Role != openai.ChatMessageRoleUser {
+			end++
+		}
+		return i, end, true
+	}
+	return 0, 0, false
+}
+
+// beginReply marks the current end of the conversation as where the reply
+// about to be generated starts from. The caller must hold sess.mu.
+func (sess *userSession) beginReply() {
+	sess.replyBase = len(sess.messages)
+	sess.removed = nil
+}
+
+// mergeReply stores msgs, the conversation as updated by the reply, in
+// sess. Messages added while the reply was generated are kept, and
+// exchanges deleted meanwhile are left out again. The caller must hold
+// sess.mu and have checked that the conversation was not reset.
+func (sess *userSession) mergeReply(msgs []openai.ChatCompletionMessage) {
+	added := sess.messages[min(sess.replyBase, len(sess.messages)):]
+	sess.messages = append(msgs, added...)
+	sess.inProgress = nil
+	for _, h := range sess.removed {
+		sess.messages, _ = removeTurn(sess.messages, h)
+	}
+	sess.removed = nil
+}
+
+// addTurn records that the last user message of sess was sent as Discord
+// message messageID and answered with replyIDs by model. The caller must
+// hold sess.mu.
+func (s *sessionStore) addTurn(key string, sess *userSession, messageID string, replyIDs []string, model string) {
+	last := -1
+	for i, m := range sess.messages {
+		if m.Role == openai.ChatMessageRoleUser {
+			last = i
+		}
+	}
+	if last < 0 {
+		return
+	}
+	ref := storage.TurnRef{
+		MessageID: messageID,
+		ReplyIDs:  replyIDs,
+		Hash:      messageHash(sess.messages[last]),
+		At:        formatTime(s.clock.Now()),
+		Model:     model,
+	}
+	// An edited message replaces its earlier exchange.
+	sess.turns = slices.DeleteFunc(sess.turns, func(t storage.TurnRef) bool {
+		if t.MessageID == messageID {
+			s.unindexTurn(t)
+			return true
+		}
+		return false
+	})
+	sess.turns = append(sess.turns, ref)
+	sess.dirty = true
+	s.indexTurn(key, ref)
+}
+
+func (s *sessionStore) indexTurn(key string, t storage.TurnRef) {
+	s.turnsMu.Lock()
+	defer s.turnsMu.Unlock()
+	if s.byMessage == nil {
+		s.byMessage = make(map[string]string)
+	}
+	s.byMessage[t.MessageID] = key
+	for _, id := range t.ReplyIDs {
+		s.byMessage[id] = key
+	}
+}
+
+func (s *sessionStore) unindexTurn(t storage.TurnRef) {
+	s.turnsMu.Lock()
+	defer s.turnsMu.Unlock()
+	delete(s.byMessage, t.MessageID)
+	for _, id := range t.ReplyIDs {
+		delete(s.byMessage, id)
+	}
+}
+
+// pruneTurns drops the turn records whose user message is no longer in
+// msgs, for example after old messages were cut. The caller must hold
+// sess.mu.
+func (s *sessionStore) pruneTurns(sess *userSession, msgs []openai.ChatCompletionMessage) {
+	if len(sess.turns) == 0 {
+		return
+	}
+	present := make(map[string]bool)
+	for _, m := range msgs {
+		if m.Role == openai.ChatMessageRoleUser {
+			present[messageHash(m)] = true
+		}
+	}
+	sess.turns = slices.DeleteFunc(sess.turns, func(t storage.TurnRef) bool {
+		if !present[t.Hash] {
+			s.unindexTurn(t)
+			return true
+		}
+		return false
+	})
+}
+
+// indexStoredTurns indexes the turn records of every stored conversation,
+// so that deletions are noticed for conversations not loaded since the
+// start.
+func (s *sessionStore) indexStoredTurns() {
+	all, err := s.persist.All()
+	if err != nil {
+		slog.Error("failed to index conversation messages", "err", err)
+		return
+	}
+	for _, sd := range all {
+		for _, t := range sd.Turns {
+			s.indexTurn(sd.UserID, t)
+		}
+	}
+}
+
+// dropMessage removes the exchange that Discord message messageID, a user's
+// message or the bot's reply, belonged to from its stored conversation.
+func (s *sessionStore) dropMessage(messageID string) {
+	s.turnsMu.Lock()
+	key, ok := s.byMessage[messageID]
+	s.turnsMu.Unlock()
+	if !ok {
+		return
+	}
+	sess := s.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	i := slices.IndexFunc(sess.turns, func(t storage.TurnRef) bool {
+		return t.MessageID == messageID || slices.Contains(t.ReplyIDs, messageID)
+	})
+	if i < 0 {
+		return
+	}
+	t := sess.turns[i]
+	sess.turns = slices.Delete(sess.turns, i, i+1)
+	s.unindexTurn(t)
+	if i, end, ok := findTurn(sess.messages, t.Hash); ok {
+		// Messages added after a reply started move up with the rest.
+		if i < sess.replyBase {
+			sess.replyBase -= min(end, sess.replyBase) - i
+		}
+		sess.messages = slices.Delete(sess.messages, i, end)
+	}
+	// A reply being generated works on a copy that still has the
+	// exchange; it is removed again when the reply is stored.
+	sess.removed = append(sess.removed, t.Hash)
+	if err := s.save(key, sess); err != nil {
+		slog.Error("failed to save session", "session", hashID(key), "err", err)
+	}
+	slog.Info("removed deleted message from conversation", "session", hashID(key))
+}
+
+// handleMessageDelete removes deleted messages from stored conversations.
+func (s *sessionStore) handleMessageDelete(_ *discordgo.Session, d *discordgo.MessageDelete) {
+	s.dropMessage(d.ID)
+}
+
+func (s *sessionStore) handleMessageDeleteBulk(_ *discordgo.Session, d *discordgo.MessageDeleteBulk) {
+	for _, id := range d.Messages {
+		s.dropMessage(id)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+func TestDropMessageWhileReplyPending(t *testing.T) {
+	store := newTestSessionStore(&fakeClock{now: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)})
+	key := scopedKey("", "user")
+	assistant := func(content string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}
+	}
+
+	sess := store.get(key)
+	sess.mu.Lock()
+	for _, q := range []string{"first", "second"} {
+		sess.messages = append(sess.messages, engine.UserMessage(q)...)
+		sess.messages = append(sess.messages, assistant("re: "+q))
+		store.addTurn(key, sess, "msg-"+q, []string{"reply-" + q}, "")
+	}
+	sess.messages = append(sess.messages, engine.UserMessage("third")...)
+	history := slices.Clone(sess.messages)
+	sess.beginReply()
+	// A check-in arrives while the reply is generated.
+	sess.messages = append(sess.messages, assistant("check-in"))
+	sess.mu.Unlock()
+
+	store.dropMessage("reply-first")
+	store.dropMessage("msg-second")
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.mergeReply(append(history, assistant("re: third")))
+	var got []string
+	for _, m := range sess.messages {
+		got = append(got, m.Content)
+	}
+	want := []string{"third", "re: third", "check-in"}
+	if !slices.Equal(got, want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// dailyDigestDefaultTime is when the daily digest is posted unless another
+// time is given.
+const dailyDigestDefaultTime = "18:00"
+
+// setDaily schedules a as the daily digest of its channel, posted at clock
+// (HH:MM) in its time zone, replacing the channel's previous one.
+func (an *announcer) setDaily(a announcement, clock string) (announcement, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return a, fmt.Errorf("invalid time %q: use HH:MM, e.g. 18:00", clock)
+	}
+	a.Cron = fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour())
+	a.Digest, a.Daily = true, true
+	if _, err := a.schedule(); err != nil {
+		return a, err
+	}
+	if old, ok := an.daily(a.GuildID, a.ChannelID); ok {
+		if _, err := an.remove(a.GuildID, old.ID); err != nil {
+			return a, err
+		}
+	}
+	return an.add(a)
+}
+
+// daily returns the daily digest of channelID, if it has one.
+func (an *announcer) daily(guildID, channelID string) (announcement, bool) {
+	list := an.list(guildID)
+	i := slices.IndexFunc(list, func(a announcement) bool {
+		return a.Daily && a.ChannelID == channelID
+	})
+	if i < 0 {
+		return announcement{}, false
+	}
+	return list[i], true
+}
+
+// digestCommand turns the end-of-day digest of the current channel on and
+// off. The digests run as announcements, so /schedule lists them too.
+func digestCommand(an *announcer) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "digest",
+			Description: "Post a summary of this channel's messages at the end of each day (Manage Server only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "on",
+					Description: "Post a daily digest of this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "time",
+							Description: "When to post it, as HH:MM (default: " + dailyDigestDefaultTime + ")",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "timezone",
+							Description: "Time zone of the time, e.g. Asia/Tokyo (default: the bot's)",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Stop the daily digest of this channel",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "status",
+					Description: "Show whether this channel has a daily digest",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if i.GuildID == "" {
+				respondEphemeral(s, i, loc.tr("This command only works in a server."))
+				return
+			}
+			if !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("You need the Manage Server permission to use this command."))
+				return
+			}
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			switch opts[0].Name {
+			case "on":
+				clock := dailyDigestDefaultTime
+				a := announcement{GuildID: i.GuildID, ChannelID: i.ChannelID, CreatedBy: interactionUserID(i)}
+				for _, o := range opts[0].Options {
+					switch o.Name {
+					case "time":
+						clock = strings.TrimSpace(o.StringValue())
+					case "timezone":
+						a.Timezone = strings.TrimSpace(o.StringValue())
+					}
+				}
+				a, err := an.setDaily(a, clock)
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to set up the digest: %s", err))
+					return
+				}
+				slog.Info("daily digest enabled", "guild", i.GuildID, "channel", i.ChannelID, "id", a.ID)
+				respondEphemeral(s, i, loc.tr("Done. I will post a digest of this channel's messages every day at %s. `/digest off` stops it.", clock+dailyZone(a)))
+			case "off":
+				a, ok := an.daily(i.GuildID, i.ChannelID)
+				if !ok {
+					respondEphemeral(s, i, loc.tr("This channel has no daily digest."))
+					return
+				}
+				if _, err := an.remove(i.GuildID, a.ID); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to stop the digest: %s", err))
+					return
+				}
+				slog.Info("daily digest disabled", "guild", i.GuildID, "channel", i.ChannelID)
+				respondEphemeral(s, i, loc.tr("Done. The daily digest of this channel is off."))
+			case "status":
+				a, ok := an.daily(i.GuildID, i.ChannelID)
+				if !ok {
+					respondEphemeral(s, i, loc.tr("This channel has no daily digest. `/digest on` sets one up."))
+					return
+				}
+				msg := loc.tr("This channel gets a daily digest%s.", dailyZone(a))
+				if sched, err := a.schedule(); err == nil {
+					if next := sched.next(time.Now()); !next.IsZero() {
+						msg = loc.tr("This channel gets a daily digest; the next one is <t:%d:F>.", next.Unix())
+					}
+				}
+				respondEphemeral(s, i, msg)
+			}
+		},
+	}
+}
+
+// dailyZone names the time zone of a for replies, if it has its own.
+func dailyZone(a announcement) string {
+	if a.Timezone == "" {
+		return ""
+	}
+	return " (" + a.Timezone + ")"
+}
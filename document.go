@@ -0,0 +1,401 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/ledongthuc/pdf"
+)
+
+const (
+	// docMaxSize bounds the size of an attached document.
+	docMaxSize = 10 << 20
+	// docMaxChars bounds the text kept of a document.
+	docMaxChars = 400_000
+	// docInlineChars is the longest text added to the message itself;
+	// longer documents are read with readDocument.
+	docInlineChars = 8000
+	// docChunkChars is the size of the parts readDocument returns.
+	docChunkChars = 6000
+	// docsPerMessage bounds the documents read from one message, and
+	// docsPerConversation those kept for readDocument.
+	docsPerMessage      = 3
+	docsPerConversation = 5
+	// docMaxAge is how long a document stays readable.
+	docMaxAge = 24 * time.Hour
+)
+
+// docFormat is a kind of document the bot reads, with the content types
+// Discord may report for it.
+type docFormat struct {
+	name         string
+	contentTypes []string
+	extract      func([]byte) (string, error)
+}
+
+var docFormats = map[string]docFormat{
+	".pdf":      {name: "PDF", contentTypes: []string{"application/pdf"}, extract: extractPDF},
+	".docx":     {name: "DOCX", contentTypes: []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip"}, extract: extractDOCX},
+	".txt":      {name: "text", contentTypes: []string{"text/plain"}, extract: extractText},
+	".md":       {name: "Markdown", contentTypes: []string{"text/markdown", "text/x-markdown", "text/plain"}, extract: extractText},
+	".markdown": {name: "Markdown", contentTypes: []string{"text/markdown", "text/x-markdown", "text/plain"}, extract: extractText},
+}
+
+// documentAttachments returns the attachments that are documents the bot
+// reads, judged by their file names.
+func documentAttachments(atts []*discordgo.MessageAttachment) []*discordgo.MessageAttachment {
+	var docs []*discordgo.MessageAttachment
+	for _, a := range atts {
+		if _, ok := docFormats[strings.ToLower(filepath.Ext(a.Filename))]; ok {
+			docs = append(docs, a)
+		}
+	}
+	return docs
+}
+
+// document is the text of an attached document, in parts.
+type document struct {
+	name   string
+	chars  int
+	chunks []string
+	added  time.Time
+}
+
+// documentStore reads documents attached to messages and keeps the long
+// ones in memory, by conversation, for readDocument.
+type documentStore struct {
+	mu     sync.Mutex
+	docs   map[string][]*document
+	client *http.Client
+}
+
+func newDocumentStore() *documentStore {
+	return &documentStore{docs: make(map[string][]*document), client: &http.Client{Timeout: time.Minute}}
+}
+
+// attach reads the documents atts attached to a message of the
+// conversation sessionKey and returns content with them added: the text of
+// short ones, quoted as untrusted, and a note pointing to readDocument for
+// long ones. Documents that cannot be read are noted with the reason, so
+// that the model can tell the user.
+func (ds *documentStore) attach(ctx context.Context, sessionKey string, atts []*discordgo.MessageAttachment, content string) string {
+	parts := []string{content}
+	for i, a := range atts {
+		if i == docsPerMessage {
+			parts = append(parts, fmt.Sprintf("[%d more attached files were not read; at most %d are read per message.]", len(atts)-i, docsPerMessage))
+			break
+		}
+		text, err := ds.read(ctx, a)
+		if err != nil {
+			parts = append(parts, fmt.Sprintf("[The attached file %q could not be read: %v.]", a.Filename, err))
+			continue
+		}
+		if utf8.RuneCountInString(text) <= docInlineChars {
+			parts = append(parts, strings.TrimSpace(untrustedBlock("attached file "+a.Filename, text)))
+			continue
+		}
+		doc := &document{name: a.Filename, chars: utf8.RuneCountInString(text), chunks: chunkText(text, docChunkChars), added: time.Now()}
+		ds.add(sessionKey, doc)
+		parts = append(parts, fmt.Sprintf("[The attached file %q has %d characters in %s, too long to include here. Read it with readDocument, part by part or by searching it.]", doc.name, doc.chars, plural(len(doc.chunks), "part")))
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n\n"))
+}
+
+// read downloads a and extracts its text, after checking its size, its
+// content type and that its bytes are of the format its name says.
+func (ds *documentStore) read(ctx context.Context, a *discordgo.MessageAttachment) (string, error) {
+	format := docFormats[strings.ToLower(filepath.Ext(a.Filename))]
+	if a.Size > docMaxSize {
+		return "", fmt.Errorf("it is larger than %d MB", docMaxSize>>20)
+	}
+	if a.ContentType != "" {
+		mt, _, err := mime.ParseMediaType(a.ContentType)
+		if err != nil || !slices.Contains(format.contentTypes, mt) {
+			return "", fmt.Errorf("its content type %s does not match a %s file", a.ContentType, format.name)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ds.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, docMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > docMaxSize {
+		return "", fmt.Errorf("it is larger than %d MB", docMaxSize>>20)
+	}
+	text, err := format.extract(data)
+	if err != nil {
+		return "", err
+	}
+	text = strings.TrimSpace(sanitizeUntrusted(text))
+	if text == "" {
+		return "", errors.New("it has no text")
+	}
+	return truncateRunes(text, docMaxChars), nil
+}
+
+// add keeps doc for readDocument in the conversation sessionKey, replacing
+// a document of the same name and dropping old ones.
+func (ds *documentStore) add(sessionKey string, doc *document) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for key, docs := range ds.docs {
+		docs = slices.DeleteFunc(docs, func(d *document) bool { return time.Since(d.added) > docMaxAge })
+		if len(docs) == 0 {
+			delete(ds.docs, key)
+		} else {
+			ds.docs[key] = docs
+		}
+	}
+	docs := slices.DeleteFunc(ds.docs[sessionKey], func(d *document) bool { return d.name == doc.name })
+	docs = append(docs, doc)
+	if len(docs) > docsPerConversation {
+		docs = docs[len(docs)-docsPerConversation:]
+	}
+	ds.docs[sessionKey] = docs
+}
+
+// get returns the document name of the conversation sessionKey, or its only
+// or latest document if name is empty.
+func (ds *documentStore) get(sessionKey, name string) (*document, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	docs := slices.DeleteFunc(slices.Clone(ds.docs[sessionKey]), func(d *document) bool { return time.Since(d.added) > docMaxAge })
+	if len(docs) == 0 {
+		return nil, errors.New("no long document was attached in this conversation recently; ask the user to attach it again")
+	}
+	if name == "" {
+		return docs[len(docs)-1], nil
+	}
+	for _, d := range docs {
+		if strings.EqualFold(d.name, name) {
+			return d, nil
+		}
+	}
+	names := make([]string, len(docs))
+	for i, d := range docs {
+		names[i] = d.name
+	}
+	return nil, fmt.Errorf("no document %q; the documents are %s", name, strings.Join(names, ", "))
+}
+
+// tool is the readDocument tool.
+func (ds *documentStore) tool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Name  string `json:"name"`
+		Part  int    `json:"part"`
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	sessionKey, _ := ctx.Value(ctxKeySessionKey).(string)
+	doc, err := ds.get(sessionKey, p.Name)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Query) != "" {
+		parts := searchChunks(doc.chunks, p.Query, 2)
+		if len(parts) == 0 {
+			return fmt.Sprintf("Nothing in %s matches %q. Read it part by part instead.", doc.name, p.Query), nil
+		}
+		var sb strings.Builder
+		for _, i := range parts {
+			fmt.Fprintf(&sb, "%s, part %d of %d:\n%s\n\n", doc.name, i+1, len(doc.chunks), doc.chunks[i])
+		}
+		return strings.TrimSpace(sb.String()), nil
+	}
+	part := max(p.Part, 1)
+	if part > len(doc.chunks) {
+		return "", fmt.Errorf("%s only has %s", doc.name, plural(len(doc.chunks), "part"))
+	}
+	out := fmt.Sprintf("%s, part %d of %d:\n%s", doc.name, part, len(doc.chunks), doc.chunks[part-1])
+	if part < len(doc.chunks) {
+		out += fmt.Sprintf("\n\n(Call again with part %d for the rest.)", part+1)
+	}
+	return out, nil
+}
+
+// searchChunks returns the indexes of up to n chunks sharing the most words
+// with query, best first.
+func searchChunks(chunks []string, query string, n int) []int {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) })
+	type scored struct{ i, score int }
+	var matches []scored
+	for i, c := range chunks {
+		c = strings.ToLower(c)
+		score := 0
+		for _, w := range words {
+			score += strings.Count(c, w)
+		}
+		if score > 0 {
+			matches = append(matches, scored{i, score})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].score > matches[b].score })
+	var idx []int
+	for _, m := range matches[:min(n, len(matches))] {
+		idx = append(idx, m.i)
+	}
+	return idx
+}
+
+// chunkText splits text into chunks of about size bytes at paragraph
+// breaks, or at line or word breaks within paragraphs that are too long.
+func chunkText(text string, size int) []string {
+	var pieces []string
+	for _, para := range strings.Split(text, "\n\n") {
+		for len(para) > size {
+			cut := strings.LastIndex(para[:size], "\n")
+			if cut <= 0 {
+				cut = strings.LastIndex(para[:size], " ")
+			}
+			if cut <= 0 {
+				// Cut between characters.
+				cut = size
+				for cut > 0 && !utf8.RuneStart(para[cut]) {
+					cut--
+				}
+			}
+			pieces = append(pieces, para[:cut])
+			para = strings.TrimLeft(para[cut:], " \n")
+		}
+		pieces = append(pieces, para+"\n")
+	}
+	chunks := chunkLines(pieces, size)
+	for i, c := range chunks {
+		chunks[i] = strings.TrimSpace(c)
+	}
+	return chunks
+}
+
+// extractText checks that data is UTF-8 text.
+func extractText(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", errors.New("it is not UTF-8 text")
+	}
+	return string(data), nil
+}
+
+// extractDOCX reads the paragraphs of the main part of a Word document.
+func extractDOCX(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", errors.New("it is not a DOCX file")
+	}
+	var doc *zip.File
+	for _, f := range zr.File {
+		if f.Name == "word/document.xml" {
+			doc = f
+		}
+	}
+	if doc == nil {
+		return "", errors.New("it is not a DOCX file")
+	}
+	rc, err := doc.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	// The XML is many times larger than its text, but not without bound.
+	dec := xml.NewDecoder(io.LimitReader(rc, 20*docMaxSize))
+	var sb strings.Builder
+	inText := false
+	for sb.Len() < 4*docMaxChars {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("it is not a valid DOCX file: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				sb.WriteByte('\t')
+			case "br", "cr":
+				sb.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				sb.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				sb.Write(t)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+// extractPDF reads the text of each page of a PDF, which has none if it
+// is scanned.
+func extractPDF(data []byte) (text string, err error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", errors.New("it is not a PDF file")
+	}
+	// The parser panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", errors.New("it is not a valid PDF file")
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		if errors.Is(err, pdf.ErrInvalidPassword) {
+			return "", errors.New("it is password protected")
+		}
+		return "", fmt.Errorf("it is not a valid PDF file: %w", err)
+	}
+	var sb strings.Builder
+	for i := 1; i <= r.NumPage() && sb.Len() < 4*docMaxChars; i++ {
+		page := r.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		t, err := page.GetPlainText(nil)
+		if err != nil || strings.TrimSpace(t) == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "[Page %d]\n%s\n\n", i, strings.TrimSpace(t))
+	}
+	if sb.Len() == 0 {
+		return "", errors.New("it has no text; it may be scanned")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// replyTurn is the last exchange of a conversation: the user's message and
+// the bot's reply to it, so that the reply can be regenerated when the
+// message is edited.
+type replyTurn struct {
+	sessionKey string
+	channelID  string
+	// triggerID is the user's message and content its text as answered;
+	// replyIDs are the messages the reply was split into.
+	triggerID string
+	content   string
+	replyIDs  []string
+	// start and end delimit the turn in the session's messages, and epoch
+	// is the session's epoch at the time.
+	start, end int
+	epoch      int
+	at         time.Time
+}
+
+// turnTracker remembers the last turn of each conversation for window.
+type turnTracker struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// byTrigger and bySession hold the same turns, by message and by
+	// conversation.
+	byTrigger map[string]*replyTurn
+	bySession map[string]*replyTurn
+}
+
+func newTurnTracker(window time.Duration) *turnTracker {
+	return &turnTracker{
+		window:    window,
+		byTrigger: make(map[string]*replyTurn),
+		bySession: make(map[string]*replyTurn),
+	}
+}
+
+// record makes t the last turn of its conversation.
+func (tt *turnTracker) record(t *replyTurn) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if old, ok := tt.bySession[t.sessionKey]; ok {
+		delete(tt.byTrigger, old.triggerID)
+	}
+	tt.bySession[t.sessionKey] = t
+	tt.byTrigger[t.triggerID] = t
+	// Drop expired turns so the maps do not grow with every conversation.
+	for key, old := range tt.bySession {
+		if time.Since(old.at) > tt.window {
+			delete(tt.bySession, key)
+			delete(tt.byTrigger, old.triggerID)
+		}
+	}
+}
+
+// take returns and forgets the turn triggered by messageID if it is still
+// the last of its conversation, within the window, and content differs from
+// what was answered. Discord also reports updates that do not change the
+// text, such as link previews being added.
+func (tt *turnTracker) take(messageID, content string) *replyTurn {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	t, ok := tt.byTrigger[messageID]
+	if !ok || t.content == content {
+		return nil
+	}
+	delete(tt.byTrigger, messageID)
+	delete(tt.bySession, t.sessionKey)
+	if time.Since(t.at) > tt.window {
+		return nil
+	}
+	return t
+}
+
+// editReply replaces the reply made of the messages ids in channelID with
+// content, editing them in place. Parts beyond the old ones are sent as new
+// messages and surplus old messages are deleted. It returns the IDs of the
+// reply's messages.
+func editReply(s MessageSender, channelID string, ids []string, content string) []string {
+	var out []string
+	parts := splitMessage(content, discordLimit)
+	for i, part := range parts {
+		if i < len(ids) {
+			if _, err := s.ChannelMessageEdit(channelID, ids[i], part); err != nil {
+				slog.Error("failed to edit message", "channel", channelID, "err", err)
+			}
+			out = append(out, ids[i])
+			continue
+		}
+		msg, err := s.ChannelMessageSend(channelID, part)
+		if err != nil {
+			slog.Error("failed to send message", "channel", channelID, "err", err)
+			continue
+		}
+		out = append(out, msg.ID)
+	}
+	deleteMessages(s, channelID, ids[min(len(parts), len(ids)):])
+	return out
+}
+
+func deleteMessages(s MessageSender, channelID string, ids []string) {
+	for _, id := range ids {
+		if err := s.ChannelMessageDelete(channelID, id); err != nil {
+			slog.Warn("failed to delete message", "channel", channelID, "err", err)
+		}
+	}
+}
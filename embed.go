@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// embedBatchWindow is how long a request waits for others to share
+	// its API call.
+	embedBatchWindow = 20 * time.Millisecond
+	// embedMaxBatch caps the inputs sent in one API call.
+	embedMaxBatch = 256
+)
+
+// embedRequest is one caller's share of a pending batch.
+type embedRequest struct {
+	texts   []string
+	noCache bool
+	done    chan struct{}
+	vecs    [][]float32
+	err     error
+}
+
+// embedder computes embeddings through an on-disk cache keyed by model and
+// content hash, in <data>/embedding_cache/. Cache misses from concurrent
+// callers are collected for a short window and sent as one batched API
+// call.
+type embedder struct {
+	client *openai.Client
+	model  string
+	dir    string
+
+	mu      sync.Mutex
+	pending []*embedRequest
+	queued  int
+	timer   *time.Timer
+}
+
+func newEmbedder(dataDir string, client *openai.Client, model string) *embedder {
+	return &embedder{
+		client: client,
+		model:  model,
+		dir:    filepath.Join(dataDir, "embedding_cache"),
+	}
+}
+
+func (e *embedder) cachePath(text string) string {
+	h := sha256.Sum256([]byte(e.model + "\x00" + text))
+	name := fmt.Sprintf("%x", h)
+	return filepath.Join(e.dir, name[:2], name[2:]+".bin")
+}
+
+// cached returns the cached vector of text, or nil.
+func (e *embedder) cached(text string) []float32 {
+	data, err := os.ReadFile(e.cachePath(text))
+	if err != nil || len(data)%4 != 0 {
+		return nil
+	}
+	vec := make([]float32, len(data)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return vec
+}
+
+func (e *embedder) store(text string, vec []float32) error {
+	path := e.cachePath(text)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data := make([]byte, len(vec)*4)
+	for i, v := range vec {
+		binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(v))
+	}
+	return storage.WriteFileAtomic(path, data, 0600)
+}
+
+// embed returns one vector per text, in order, using and filling the cache.
+func (e *embedder) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.request(ctx, texts, false)
+}
+
+// embedTransient is like embed but bypasses the cache, for one-off texts
+// such as search queries.
+func (e *embedder) embedTransient(ctx context.Context, texts []string) ([][]float32, error) {
+	return e.request(ctx, texts, true)
+}
+
+func (e *embedder) request(ctx context.Context, texts []string, noCache bool) ([][]float32, error) {
+	vecs := make([][]float32, len(texts))
+	var missing []string
+	var missingIdx []int
+	for i, t := range texts {
+		if !noCache {
+			if v := e.cached(t); v != nil {
+				vecs[i] = v
+				continue
+			}
+		}
+		missing = append(missing, t)
+		missingIdx = append(missingIdx, i)
+	}
+	if len(missing) == 0 {
+		return vecs, nil
+	}
+
+	req := &embedRequest{texts: missing, noCache: noCache, done: make(chan struct{})}
+	e.enqueue(req)
+	select {
+	case <-req.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if req.err != nil {
+		return nil, req.err
+	}
+	for j, i := range missingIdx {
+		vecs[i] = req.vecs[j]
+	}
+	return vecs, nil
+}
+
+func (e *embedder) enqueue(req *embedRequest) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, req)
+	e.queued += len(req.texts)
+	if e.queued >= embedMaxBatch {
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+		go e.flush(e.take())
+		return
+	}
+	if e.timer == nil {
+		e.timer = time.AfterFunc(embedBatchWindow, func() {
+			e.mu.Lock()
+			batch := e.take()
+			e.mu.Unlock()
+			e.flush(batch)
+		})
+	}
+}
+
+// take removes the pending requests. The caller must hold e.mu.
+func (e *embedder) take() []*embedRequest {
+	batch := e.pending
+	e.pending, e.queued, e.timer = nil, 0, nil
+	return batch
+}
+
+// flush embeds the distinct texts of batch in API calls of at most
+// embedMaxBatch inputs and hands every request its vectors.
+func (e *embedder) flush(batch []*embedRequest) {
+	if len(batch) == 0 {
+		return
+	}
+	index := make(map[string]int)
+	cache := make(map[string]bool)
+	var inputs []string
+	for _, req := range batch {
+		for _, t := range req.texts {
+			if _, ok := index[t]; !ok {
+				index[t] = len(inputs)
+				inputs = append(inputs, t)
+			}
+			if !req.noCache {
+				cache[t] = true
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	vecs := make([][]float32, 0, len(inputs))
+	var err error
+	for start := 0; start < len(inputs) && err == nil; start += embedMaxBatch {
+		var part [][]float32
+		part, err = e.call(ctx, inputs[start:min(start+embedMaxBatch, len(inputs))])
+		vecs = append(vecs, part...)
+	}
+	if err == nil {
+		for t := range cache {
+			if err := e.store(t, vecs[index[t]]); err != nil {
+				slog.Warn("failed to cache embedding", "err", err)
+			}
+		}
+	}
+
+	for _, req := range batch {
+		if err != nil {
+			req.err = err
+		} else {
+			req.vecs = make([][]float32, len(req.texts))
+			for j, t := range req.texts {
+				req.vecs[j] = vecs[index[t]]
+			}
+		}
+		close(req.done)
+	}
+}
+
+func (e *embedder) call(ctx context.Context, inputs []string) ([][]float32, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: inputs,
+		Model: openai.EmbeddingModel(e.model),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) != len(inputs) {
+		return nil, fmt.Errorf("embedding count mismatch: got %d, want %d", len(resp.Data), len(inputs))
+	}
+	vecs := make([][]float32, len(inputs))
+	for _, d := range resp.Data {
+		if d.Index < 0 || d.Index >= len(vecs) {
+			return nil, fmt.Errorf("embedding index out of range: %d", d.Index)
+		}
+		vecs[d.Index] = d.Embedding
+	}
+	for _, v := range vecs {
+		if v == nil {
+			return nil, errors.New("embedding response is missing an input")
+		}
+	}
+	return vecs, nil
+}
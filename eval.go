@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	evalJudgePrompt = "You grade a chatbot's reply against a criterion. Reply with PASS or FAIL on the first line " +
+		"and a one-sentence reason on the second."
+	// evalTimeout bounds the time of one case, judging included.
+	evalTimeout = 2 * time.Minute
+)
+
+// evalSuite is a YAML file of prompts to check the bot's replies against,
+// run with the eval subcommand.
+type evalSuite struct {
+	// Persona, if set, is used instead of the identity for every case
+	// that does not name its own.
+	Persona string     `yaml:"persona"`
+	Cases   []evalCase `yaml:"cases"`
+}
+
+type evalCase struct {
+	Name    string `yaml:"name"`
+	Persona string `yaml:"persona"`
+	// History holds earlier exchanges of the conversation.
+	History []struct {
+		User      string `yaml:"user"`
+		Assistant string `yaml:"assistant"`
+	} `yaml:"history"`
+	Prompt string     `yaml:"prompt"`
+	Expect evalExpect `yaml:"expect"`
+}
+
+// evalExpect lists what a reply must satisfy. Text checks ignore case.
+type evalExpect struct {
+	Contains    []string `yaml:"contains"`
+	NotContains []string `yaml:"not_contains"`
+	Matches     string   `yaml:"matches"`
+	NotMatches  string   `yaml:"not_matches"`
+	// Equals is compared line by line after trimming, with a diff on
+	// failure.
+	Equals *string `yaml:"equals"`
+	// Judge is a criterion the model grades the reply against, such as
+	// "refuses and stays in character".
+	Judge string `yaml:"judge"`
+}
+
+func loadEvalSuite(path string) (*evalSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var suite evalSuite
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&suite); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(suite.Cases) == 0 {
+		return nil, fmt.Errorf("%s: no cases", path)
+	}
+	for i, c := range suite.Cases {
+		if strings.TrimSpace(c.Prompt) == "" {
+			return nil, fmt.Errorf("%s: case %d (%s) has no prompt", path, i+1, c.Name)
+		}
+		for _, re := range []string{c.Expect.Matches, c.Expect.NotMatches} {
+			if _, err := regexp.Compile("(?i)" + re); err != nil {
+				return nil, fmt.Errorf("%s: case %d (%s): %w", path, i+1, c.Name, err)
+			}
+		}
+		if suite.Cases[i].Name == "" {
+			suite.Cases[i].Name = fmt.Sprintf("case %d", i+1)
+		}
+	}
+	return &suite, nil
+}
+
+// evaluator runs eval suites: each prompt is answered with the identity or
+// persona as the bot would, without tools or memory, and the reply is
+// checked. judge grades the judge criteria.
+type evaluator struct {
+	eng      *engine.Engine
+	judge    *engine.Engine
+	identity string
+	personas *personaStore
+}
+
+// run runs suite and reports each case to w, returning how many failed.
+func (ev *evaluator) run(ctx context.Context, w io.Writer, suite *evalSuite) int {
+	failed := 0
+	for _, c := range suite.Cases {
+		start := time.Now()
+		reply, problems := ev.runCase(ctx, suite, c)
+		elapsed := time.Since(start).Round(100 * time.Millisecond)
+		if len(problems) == 0 {
+			fmt.Fprintf(w, "PASS  %s (%s)\n", c.Name, elapsed)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL  %s (%s)\n", c.Name, elapsed)
+		for _, p := range problems {
+			fmt.Fprintln(w, indent(p, "      "))
+		}
+		if reply != "" {
+			fmt.Fprintln(w, "      reply:")
+			fmt.Fprintln(w, indent(reply, "        "))
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", len(suite.Cases)-failed, failed)
+	return failed
+}
+
+// runCase answers c and returns the reply with what is wrong with it.
+func (ev *evaluator) runCase(ctx context.Context, suite *evalSuite, c evalCase) (string, []string) {
+	ctx, cancel := context.WithTimeout(ctx, evalTimeout)
+	defer cancel()
+	prompt := ev.identity
+	persona := c.Persona
+	if persona == "" {
+		persona = suite.Persona
+	}
+	if persona != "" {
+		p, err := ev.personas.load(persona)
+		if err != nil {
+			return "", []string{fmt.Sprintf("persona %s: %v", persona, err)}
+		}
+		prompt = p
+	}
+	var msgs []openai.ChatCompletionMessage
+	for _, h := range c.History {
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: h.User})
+		if h.Assistant != "" {
+			msgs = append(msgs, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: h.Assistant})
+		}
+	}
+	msgs = append(msgs, engine.UserMessage(c.Prompt)...)
+	reply, _, err := ev.eng.Chat(ctx, withSystemPrompt(msgs, prompt+languageHint(detectLanguage(c.Prompt))), engine.ChatOptions{})
+	if err != nil {
+		return "", []string{"error: " + err.Error()}
+	}
+	reply = strings.TrimSpace(reply)
+	return reply, ev.check(ctx, c.Expect, reply)
+}
+
+// check returns the expectations reply does not meet.
+func (ev *evaluator) check(ctx context.Context, exp evalExpect, reply string) []string {
+	var problems []string
+	lower := strings.ToLower(reply)
+	for _, s := range exp.Contains {
+		if !strings.Contains(lower, strings.ToLower(s)) {
+			problems = append(problems, fmt.Sprintf("contains %q: not found", s))
+		}
+	}
+	for _, s := range exp.NotContains {
+		if strings.Contains(lower, strings.ToLower(s)) {
+			problems = append(problems, fmt.Sprintf("not_contains %q: found", s))
+		}
+	}
+	if exp.Matches != "" && !regexp.MustCompile("(?i)"+exp.Matches).MatchString(reply) {
+		problems = append(problems, fmt.Sprintf("matches %q: no match", exp.Matches))
+	}
+	if exp.NotMatches != "" {
+		if m := regexp.MustCompile("(?i)" + exp.NotMatches).FindString(reply); m != "" {
+			problems = append(problems, fmt.Sprintf("not_matches %q: matched %q", exp.NotMatches, m))
+		}
+	}
+	if exp.Equals != nil {
+		if d := lineDiff(strings.TrimSpace(*exp.Equals), reply); d != "" {
+			problems = append(problems, "equals: differs (- expected, + reply)\n"+indent(d, "  "))
+		}
+	}
+	if exp.Judge != "" {
+		if reason, ok := ev.grade(ctx, exp.Judge, reply); !ok {
+			problems = append(problems, fmt.Sprintf("judge %q: %s", exp.Judge, reason))
+		}
+	}
+	return problems
+}
+
+// grade asks the judge whether reply meets criterion, with its reason.
+func (ev *evaluator) grade(ctx context.Context, criterion, reply string) (string, bool) {
+	out, err := complete(ctx, ev.judge, evalJudgePrompt, "Criterion: "+criterion+"\n\nReply:\n"+reply)
+	if err != nil {
+		return "judge failed: " + err.Error(), false
+	}
+	verdict, reason, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = verdict
+	}
+	return reason, strings.HasPrefix(strings.ToUpper(strings.TrimSpace(verdict)), "PASS")
+}
+
+// lineDiff returns a line diff turning want into got, or "" if they have
+// the same lines. Unchanged lines are prefixed with two spaces, removed
+// ones with "- " and added ones with "+ ".
+func lineDiff(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	for i := range a {
+		a[i] = strings.TrimRight(a[i], " \t")
+	}
+	for i := range b {
+		b[i] = strings.TrimRight(b[i], " \t")
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var sb strings.Builder
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("  " + a[i] + "\n")
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("- " + a[i] + "\n")
+			i, changed = i+1, true
+		default:
+			sb.WriteString("+ " + b[j] + "\n")
+			j, changed = j+1, true
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// indent prefixes every line of s with prefix.
+func indent(s, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// eventCheckInterval is how often events are checked for reminders.
+	eventCheckInterval = 30 * time.Second
+	// eventReminderLead is how long before the start attendees are
+	// reminded.
+	eventReminderLead = time.Hour
+	// eventDefaultLength is the length of an event given without an end.
+	eventDefaultLength = 2 * time.Hour
+	// eventKeep is how long an event is kept after it ended.
+	eventKeep = 24 * time.Hour
+	// maxEventMentions is how many attendees a reminder mentions.
+	maxEventMentions = 50
+)
+
+// RSVP answers, which are also the button IDs.
+const (
+	rsvpGoing = "going"
+	rsvpMaybe = "maybe"
+	rsvpNo    = "no"
+)
+
+// guildEvent is a Discord scheduled event the bot created and announced.
+type guildEvent struct {
+	ID      string `json:"id"`
+	GuildID string `json:"guild_id"`
+	// ChannelID and MessageID are those of the announcement.
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id,omitempty"`
+	EventID   string    `json:"event_id"`
+	Name      string    `json:"name"`
+	Details   string    `json:"details,omitempty"`
+	Location  string    `json:"location"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	CreatedBy string    `json:"created_by"`
+	// RSVP maps user IDs to their answer.
+	RSVP     map[string]string `json:"rsvp,omitempty"`
+	Reminded bool              `json:"reminded,omitempty"`
+}
+
+// eventRSVP is a user's answer to an event, as exported by /mydata.
+type eventRSVP struct {
+	GuildID string    `json:"guild_id"`
+	Event   string    `json:"event"`
+	Start   time.Time `json:"start"`
+	Answer  string    `json:"answer"`
+}
+
+// eventPlanner creates Discord scheduled events for the createEvent tool,
+// announces them with RSVP buttons and reminds those who answered going or
+// maybe before the start. Its events are kept in <data>/events.json.
+type eventPlanner struct {
+	// s is set once the Discord session exists.
+	s *discordgo.Session
+
+	mu     sync.Mutex
+	path   string
+	cipher *storage.Cipher
+	events []*guildEvent
+	next   int
+}
+
+func newEventPlanner(dataDir string, fc *storage.Cipher) *eventPlanner {
+	ep := &eventPlanner{path: filepath.Join(dataDir, "events.json"), cipher: fc}
+	err := storage.ReadRecover(ep.path, fc.ReadFile, func(b []byte) error {
+		ep.events = nil
+		return json.Unmarshal(b, &ep.events)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("failed to read events", "err", err)
+	}
+	for _, e := range ep.events {
+		if n, err := strconv.ParseInt(e.ID, 36, 64); err == nil {
+			ep.next = max(ep.next, int(n))
+		}
+	}
+	return ep
+}
+
+// save writes the events to disk. The caller must hold ep.mu.
+func (ep *eventPlanner) save() error {
+	if err := os.MkdirAll(filepath.Dir(ep.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ep.events, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ep.cipher.WriteFile(ep.path, b)
+}
+
+// eventRequest is what the createEvent tool is called with.
+type eventRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Start       string `json:"start"`
+	End         string `json:"end"`
+	Location    string `json:"location"`
+}
+
+// create creates the event asked for by userID in channelID and posts its
+// announcement there. The user needs permission to create events.
+func (ep *eventPlanner) create(userID, guildID, channelID string, req eventRequest, now time.Time) (*guildEvent, error) {
+	if guildID == "" {
+		return nil, errors.New("events can only be created in a server")
+	}
+	if ep.s == nil {
+		return nil, errors.New("not connected to Discord")
+	}
+	perms, err := ep.s.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the user's permissions: %w", err)
+	}
+	if perms&(discordgo.PermissionManageEvents|discordgo.PermissionCreateEvents) == 0 {
+		return nil, errors.New("the user does not have permission to create events in this server")
+	}
+	e, err := newGuildEvent(req, now)
+	if err != nil {
+		return nil, err
+	}
+	e.GuildID, e.ChannelID, e.CreatedBy = guildID, channelID, userID
+	// Whoever plans an event on short notice already knows it is soon.
+	e.Reminded = !e.Start.Add(-eventReminderLead).After(now)
+
+	se, err := ep.s.GuildScheduledEventCreate(guildID, &discordgo.GuildScheduledEventParams{
+		Name:               e.Name,
+		Description:        e.Details,
+		ScheduledStartTime: &e.Start,
+		ScheduledEndTime:   &e.End,
+		PrivacyLevel:       discordgo.GuildScheduledEventPrivacyLevelGuildOnly,
+		EntityType:         discordgo.GuildScheduledEventEntityTypeExternal,
+		EntityMetadata:     &discordgo.GuildScheduledEventEntityMetadata{Location: e.Location},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the Discord event (the bot needs the Create Events permission): %w", err)
+	}
+	e.EventID = se.ID
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.next++
+	e.ID = strconv.FormatInt(int64(ep.next), 36)
+	msg, err := ep.s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    e.announcement(),
+		Components: rsvpButtons(e.ID),
+	})
+	if err != nil {
+		slog.Warn("failed to announce event", "event", e.ID, "channel", channelID, "err", err)
+	} else {
+		e.MessageID = msg.ID
+	}
+	ep.events = append(ep.events, e)
+	return e, ep.save()
+}
+
+// newGuildEvent checks req and turns it into an event.
+func newGuildEvent(req eventRequest, now time.Time) (*guildEvent, error) {
+	e := &guildEvent{
+		Name:     strings.TrimSpace(req.Name),
+		Details:  strings.TrimSpace(req.Description),
+		Location: strings.TrimSpace(req.Location),
+	}
+	if e.Name == "" {
+		return nil, errors.New("name is empty")
+	}
+	if r := []rune(e.Name); len(r) > 100 {
+		e.Name = string(r[:100])
+	}
+	if r := []rune(e.Details); len(r) > 1000 {
+		e.Details = string(r[:1000])
+	}
+	if e.Location == "" {
+		e.Location = "Discord"
+	}
+	start, err := time.Parse(time.RFC3339, req.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start %q: use RFC 3339, e.g. 2025-01-31T20:00:00+09:00", req.Start)
+	}
+	if !start.After(now) {
+		return nil, errors.New("the start is in the past")
+	}
+	if start.Sub(now) > maxReminderDelay {
+		return nil, errors.New("events can be planned at most a year ahead")
+	}
+	end := start.Add(eventDefaultLength)
+	if req.End != "" {
+		if end, err = time.Parse(time.RFC3339, req.End); err != nil {
+			return nil, fmt.Errorf("invalid end %q: use RFC 3339", req.End)
+		}
+		if !end.After(start) {
+			return nil, errors.New("the end is not after the start")
+		}
+	}
+	e.Start, e.End = start.UTC(), end.UTC()
+	return e, nil
+}
+
+// link returns the URL of the Discord event.
+func (e *guildEvent) link() string {
+	return "https://discord.com/events/" + e.GuildID + "/" + e.EventID
+}
+
+// count returns how many answered answer.
+func (e *guildEvent) count(answer string) int {
+	n := 0
+	for _, a := range e.RSVP {
+		if a == answer {
+			n++
+		}
+	}
+	return n
+}
+
+// announcement renders the announcement with the current RSVP counts.
+func (e *guildEvent) announcement() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "📅 **%s**\n<t:%d:F> (<t:%d:R>) · %s\n", e.Name, e.Start.Unix(), e.Start.Unix(), e.Location)
+	if e.Details != "" {
+		sb.WriteString(e.Details + "\n")
+	}
+	fmt.Fprintf(&sb, "✅ Going: %d · 🤔 Maybe: %d · ❌ Can't go: %d\n", e.count(rsvpGoing), e.count(rsvpMaybe), e.count(rsvpNo))
+	sb.WriteString(e.link())
+	return sb.String()
+}
+
+func rsvpButtons(id string) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Going", Style: discordgo.SuccessButton, CustomID: "event:" + rsvpGoing + ":" + id},
+			discordgo.Button{Label: "Maybe", Style: discordgo.SecondaryButton, CustomID: "event:" + rsvpMaybe + ":" + id},
+			discordgo.Button{Label: "Can't go", Style: discordgo.DangerButton, CustomID: "event:" + rsvpNo + ":" + id},
+		}},
+	}
+}
+
+// handleComponent records RSVP button clicks. Clicking the current answer
+// again withdraws it.
+func (ep *eventPlanner) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	rest, ok := strings.CutPrefix(i.MessageComponentData().CustomID, "event:")
+	if !ok {
+		return
+	}
+	loc := interactionLocale(i)
+	answer, id, _ := strings.Cut(rest, ":")
+	userID := interactionUserID(i)
+
+	ep.mu.Lock()
+	idx := slices.IndexFunc(ep.events, func(e *guildEvent) bool { return e.ID == id })
+	if idx < 0 {
+		ep.mu.Unlock()
+		respondEphemeral(s, i, loc.tr("This event is over or was cancelled."))
+		return
+	}
+	e := ep.events[idx]
+	if e.RSVP == nil {
+		e.RSVP = make(map[string]string)
+	}
+	if e.RSVP[userID] == answer {
+		delete(e.RSVP, userID)
+	} else {
+		e.RSVP[userID] = answer
+	}
+	content := e.announcement()
+	if err := ep.save(); err != nil {
+		slog.Error("failed to save events", "err", err)
+	}
+	ep.mu.Unlock()
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: rsvpButtons(id),
+		},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
+
+// run reminds attendees of events that start within eventReminderLead and
+// drops events that are over or were cancelled in Discord.
+func (ep *eventPlanner) run(s *discordgo.Session) {
+	for {
+		now := time.Now()
+		ep.mu.Lock()
+		var due, over []*guildEvent
+		for _, e := range ep.events {
+			switch {
+			case now.Sub(e.End) > eventKeep:
+				over = append(over, e)
+			case !e.Reminded && !e.Start.Add(-eventReminderLead).After(now):
+				due = append(due, e)
+			}
+		}
+		ep.mu.Unlock()
+
+		for _, e := range due {
+			if ep.remind(s, e) {
+				ep.mu.Lock()
+				e.Reminded = true
+				ep.mu.Unlock()
+			} else {
+				over = append(over, e)
+			}
+		}
+		for _, e := range over {
+			if e.MessageID != "" {
+				// Best effort: the buttons go once the event is over.
+				empty := []discordgo.MessageComponent{}
+				s.ChannelMessageEditComplex(&discordgo.MessageEdit{Channel: e.ChannelID, ID: e.MessageID, Components: &empty})
+			}
+		}
+		if len(due) > 0 || len(over) > 0 {
+			ep.mu.Lock()
+			ep.events = slices.DeleteFunc(ep.events, func(e *guildEvent) bool { return slices.Contains(over, e) })
+			if err := ep.save(); err != nil {
+				slog.Error("failed to save events", "err", err)
+			}
+			ep.mu.Unlock()
+		}
+		time.Sleep(eventCheckInterval)
+	}
+}
+
+// remind posts the reminder of e, mentioning those who answered going or
+// maybe and those interested in the Discord event. It reports false if the
+// event was cancelled or deleted in Discord.
+func (ep *eventPlanner) remind(s *discordgo.Session, e *guildEvent) bool {
+	se, err := s.GuildScheduledEvent(e.GuildID, e.EventID, false)
+	var rerr *discordgo.RESTError
+	if errors.As(err, &rerr) && rerr.Response != nil && rerr.Response.StatusCode == http.StatusNotFound {
+		slog.Info("event was deleted in Discord; dropping it", "event", e.ID)
+		return false
+	}
+	if err == nil && se.Status == discordgo.GuildScheduledEventStatusCanceled {
+		slog.Info("event was cancelled in Discord; dropping it", "event", e.ID)
+		return false
+	}
+
+	ep.mu.Lock()
+	var users []string
+	for id, a := range e.RSVP {
+		if a == rsvpGoing || a == rsvpMaybe {
+			users = append(users, id)
+		}
+	}
+	ep.mu.Unlock()
+	if interested, err := s.GuildScheduledEventUsers(e.GuildID, e.EventID, 100, false, "", ""); err == nil {
+		for _, u := range interested {
+			if u.User != nil && !slices.Contains(users, u.User.ID) && ep.answer(e, u.User.ID) != rsvpNo {
+				users = append(users, u.User.ID)
+			}
+		}
+	}
+	if len(users) == 0 {
+		return true
+	}
+	slices.Sort(users)
+	if len(users) > maxEventMentions {
+		users = users[:maxEventMentions]
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "⏰ **%s** starts <t:%d:R> · %s\n", e.Name, e.Start.Unix(), e.Location)
+	for _, id := range users {
+		sb.WriteString("<@" + id + "> ")
+	}
+	msg := &discordgo.MessageSend{
+		Content:         strings.TrimSpace(sb.String()),
+		AllowedMentions: &discordgo.MessageAllowedMentions{Users: users},
+	}
+	if e.MessageID != "" {
+		msg.Reference = &discordgo.MessageReference{MessageID: e.MessageID, ChannelID: e.ChannelID, GuildID: e.GuildID}
+	}
+	if _, err := s.ChannelMessageSendComplex(e.ChannelID, msg); err != nil {
+		slog.Warn("failed to post event reminder", "event", e.ID, "channel", e.ChannelID, "err", err)
+	}
+	return true
+}
+
+func (ep *eventPlanner) answer(e *guildEvent, userID string) string {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return e.RSVP[userID]
+}
+
+// of returns the RSVPs of userID.
+func (ep *eventPlanner) of(userID string) []eventRSVP {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	var out []eventRSVP
+	for _, e := range ep.events {
+		if a, ok := e.RSVP[userID]; ok {
+			out = append(out, eventRSVP{GuildID: e.GuildID, Event: e.Name, Start: e.Start, Answer: a})
+		}
+	}
+	return out
+}
+
+// remove withdraws every RSVP of userID.
+func (ep *eventPlanner) remove(userID string) error {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	changed := false
+	for _, e := range ep.events {
+		if _, ok := e.RSVP[userID]; ok {
+			delete(e.RSVP, userID)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return ep.save()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execStderrMax bounds what is kept of a command's stderr for errors.
+const execStderrMax = 4 << 10
+
+// execResponse is what a command writes to stdout: the result of the call,
+// any JSON value, or an error for the model.
+type execResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// execTool runs a plugin's command for each call. The command gets the
+// call as one JSON object (pluginRequest) on stdin and answers with an
+// execResponse on stdout. It runs with only PATH, HOME, LANG and the
+// plugin's Env, so the bot's secrets are not passed on.
+type execTool struct {
+	cfg pluginConfig
+}
+
+func newExecTool(cfg pluginConfig) *execTool {
+	return &execTool{cfg: cfg}
+}
+
+func (t *execTool) call(ctx context.Context, args string) (string, error) {
+	req, err := newPluginRequest(ctx, t.cfg.Name, args)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.cfg.Command[0], t.cfg.Command[1:]...)
+	cmd.WaitDelay = time.Second
+	cmd.Env = pluginEnv(t.cfg.Env)
+	cmd.Stdin = bytes.NewReader(append(req, '\n'))
+	stdout := &cappedBuffer{max: pluginMaxResult}
+	stderr := &cappedBuffer{max: execStderrMax}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s did not finish within %s", t.cfg.Name, t.cfg.Timeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", fmt.Errorf("%s failed: %w", t.cfg.Name, err)
+		}
+		return "", fmt.Errorf("%s failed: %w: %s", t.cfg.Name, err, truncateRunes(msg, 200))
+	}
+	return decodeExecResponse(t.cfg.Name, stdout)
+}
+
+// decodeExecResponse returns the result in the stdout of the plugin name.
+func decodeExecResponse(name string, stdout *cappedBuffer) (string, error) {
+	if stdout.overflow {
+		return "", fmt.Errorf("%s wrote more than %d KB", name, pluginMaxResult>>10)
+	}
+	var resp execResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("%s wrote invalid output: %w", name, err)
+	}
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+	var s string
+	if err := json.Unmarshal(resp.Result, &s); err == nil {
+		return s, nil
+	}
+	return string(resp.Result), nil
+}
+
+// pluginEnv returns the environment of a plugin's command: PATH, HOME and
+// LANG of the bot, and extra.
+func pluginEnv(extra map[string]string) []string {
+	var env []string
+	for _, k := range []string{"PATH", "HOME", "LANG"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	for k, v := range extra {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// cappedBuffer keeps the first max bytes written to it and drops the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.overflow = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
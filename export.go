@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// conversationExport is a conversation as /export sends it: the user and
+// assistant messages, with tool calls reduced to the names of the tools
+// each reply used.
+type conversationExport struct {
+	Session    string          `json:"session"`
+	ExportedAt string          `json:"exported_at"`
+	StartedAt  string          `json:"started_at,omitempty"`
+	Persona    string          `json:"persona,omitempty"`
+	Messages   []exportMessage `json:"messages"`
+}
+
+type exportMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// At is when the exchange was answered and Model what answered it, for
+	// exchanges the bot recorded them for.
+	At     string   `json:"at,omitempty"`
+	Model  string   `json:"model,omitempty"`
+	Tools  []string `json:"tools,omitempty"`
+	Images int      `json:"images,omitempty"`
+}
+
+// exportConversation collects the messages of sess. The caller must hold
+// sess.mu.
+func exportConversation(key string, sess *userSession, now time.Time) *conversationExport {
+	ex := &conversationExport{
+		Session:    key,
+		ExportedAt: formatTime(now),
+		StartedAt:  formatTime(sess.started),
+		Persona:    sess.persona,
+		Messages:   []exportMessage{},
+	}
+	turns := make(map[string]storage.TurnRef, len(sess.turns))
+	for _, t := range sess.turns {
+		turns[t.Hash] = t
+	}
+	var turn storage.TurnRef
+	var tools []string
+	for _, m := range sess.messages {
+		switch m.Role {
+		case openai.ChatMessageRoleUser:
+			turn, tools = turns[messageHash(m)], nil
+			em := exportMessage{Role: m.Role, Content: messageText(m), At: turn.At}
+			for _, p := range m.MultiContent {
+				if p.Type == openai.ChatMessagePartTypeImageURL {
+					em.Images++
+				}
+			}
+			ex.Messages = append(ex.Messages, em)
+		case openai.ChatMessageRoleAssistant:
+			for _, tc := range m.ToolCalls {
+				tools = append(tools, tc.Function.Name)
+			}
+			if text := messageText(m); text != "" {
+				ex.Messages = append(ex.Messages, exportMessage{
+					Role:    m.Role,
+					Content: text,
+					At:      turn.At,
+					Model:   turn.Model,
+					Tools:   tools,
+				})
+				tools = nil
+			}
+		}
+	}
+	return ex
+}
+
+// markdown renders ex as a readable document.
+func (ex *conversationExport) markdown() string {
+	var sb strings.Builder
+	sb.WriteString("# Conversation\n\n")
+	if ex.StartedAt != "" {
+		fmt.Fprintf(&sb, "- Started: %s\n", exportTime(ex.StartedAt))
+	}
+	if ex.Persona != "" {
+		fmt.Fprintf(&sb, "- Persona: %s\n", ex.Persona)
+	}
+	fmt.Fprintf(&sb, "- Exported: %s\n", exportTime(ex.ExportedAt))
+	for _, m := range ex.Messages {
+		who := "You"
+		if m.Role == openai.ChatMessageRoleAssistant {
+			who = "Bot"
+			if m.Model != "" {
+				who += " (" + m.Model + ")"
+			}
+		}
+		if m.At != "" {
+			who += " · " + exportTime(m.At)
+		}
+		fmt.Fprintf(&sb, "\n## %s\n\n", who)
+		if len(m.Tools) > 0 {
+			fmt.Fprintf(&sb, "_Used %s_\n\n", strings.Join(m.Tools, ", "))
+		}
+		if m.Images > 0 {
+			fmt.Fprintf(&sb, "_%d image(s) attached_\n\n", m.Images)
+		}
+		sb.WriteString(strings.TrimSpace(m.Content) + "\n")
+	}
+	return sb.String()
+}
+
+// exportTime formats an RFC 3339 time for the Markdown export.
+func exportTime(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+// file renders ex in format, "markdown" or "json".
+func (ex *conversationExport) file(format string) (*discordgo.File, error) {
+	name := "conversation-" + time.Now().UTC().Format("20060102-150405")
+	if format == "json" {
+		b, err := json.MarshalIndent(ex, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return &discordgo.File{Name: name + ".json", ContentType: "application/json", Reader: bytes.NewReader(b)}, nil
+	}
+	return &discordgo.File{Name: name + ".md", ContentType: "text/markdown", Reader: strings.NewReader(ex.markdown())}, nil
+}
+
+// exportCommand lets a user download the current conversation (see
+// conversationKey).
+func exportCommand(store *sessionStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "export",
+			Description: "Download the current conversation",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "format",
+					Description: "File format (default: markdown)",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "markdown", Value: "markdown"},
+						{Name: "json", Value: "json"},
+					},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			format := "markdown"
+			for _, o := range i.ApplicationCommandData().Options {
+				if o.Name == "format" {
+					format = o.StringValue()
+				}
+			}
+			userID := interactionUserID(i)
+
+			key := conversationKey(store, i)
+			sess := store.get(key)
+			sess.mu.Lock()
+			ex := exportConversation(key, sess, time.Now())
+			sess.mu.Unlock()
+			if len(ex.Messages) == 0 {
+				respondEphemeral(s, i, loc.tr("There is no conversation to export here."))
+				return
+			}
+			f, err := ex.file(format)
+			if err != nil {
+				respondEphemeral(s, i, loc.tr("Failed to build the export: %s", err))
+				return
+			}
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: fmt.Sprintf("Here is the conversation (%d messages).", len(ex.Messages)),
+					Files:   []*discordgo.File{f},
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				slog.Error("failed to send conversation export", "user", hashID(userID), "err", err)
+			}
+		},
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// maxFeeds caps the feed subscriptions of one server.
+	maxFeeds = 20
+	// feedMaxPosts is how many new entries of a feed are posted per poll;
+	// the rest are skipped, so a feed that republishes everything does not
+	// flood the channel.
+	feedMaxPosts = 5
+	// feedSeenLimit is how many entry IDs are remembered per feed.
+	feedSeenLimit = 500
+	// feedMaxBytes bounds the size of a fetched feed.
+	feedMaxBytes = 5 << 20
+	// feedEntryChars bounds the entry text sent to the model.
+	feedEntryChars = 8000
+
+	feedPrompt = "Summarize the following feed entry in two or three sentences for a chat channel. " +
+		"Write in the language of the entry. Reply with only the summary."
+)
+
+// feedSubscription is a feed whose new entries are summarized and posted to
+// a channel.
+type feedSubscription struct {
+	ID        string    `json:"id"`
+	GuildID   string    `json:"guild_id"`
+	ChannelID string    `json:"channel_id"`
+	URL       string    `json:"url"`
+	Title     string    `json:"title,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+	// Seen holds the IDs of the entries already posted or skipped, newest
+	// first.
+	Seen         []string  `json:"seen,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	LastPolled   time.Time `json:"last_polled,omitzero"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type feedState struct {
+	Feeds []*feedSubscription `json:"feeds,omitempty"`
+	Next  int                 `json:"next,omitempty"`
+}
+
+// feedPoller polls the subscribed RSS and Atom feeds and posts summaries of
+// their new entries. Subscriptions and what was seen of each feed are kept
+// in <data>/feeds.json.
+type feedPoller struct {
+	path    string
+	eng     *engine.Engine
+	replies *outbox
+	client  *http.Client
+
+	mu    sync.Mutex
+	state feedState
+}
+
+func newFeedPoller(dataDir string, eng *engine.Engine, replies *outbox) *feedPoller {
+	fp := &feedPoller{
+		path:    filepath.Join(dataDir, "feeds.json"),
+		eng:     eng,
+		replies: replies,
+		client:  publicHTTPClient(30 * time.Second),
+	}
+	data, err := os.ReadFile(fp.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read feeds", "err", err)
+		}
+		return fp
+	}
+	if err := json.Unmarshal(data, &fp.state); err != nil {
+		slog.Error("failed to parse feeds", "err", err)
+	}
+	return fp
+}
+
+// save writes the state to disk. The caller must hold fp.mu.
+func (fp *feedPoller) save() error {
+	if err := os.MkdirAll(filepath.Dir(fp.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(fp.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(fp.path, b, 0600)
+}
+
+// subscribe fetches the feed at rawURL and subscribes channelID to it. The
+// entries already in the feed are not posted.
+func (fp *feedPoller) subscribe(ctx context.Context, guildID, channelID, rawURL, userID string) (*feedSubscription, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("not an http or https URL")
+	}
+	sub := &feedSubscription{GuildID: guildID, ChannelID: channelID, URL: u.String(), CreatedBy: userID, Created: time.Now()}
+	f, err := fp.fetch(ctx, sub)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, fmt.Errorf("the server returned no feed")
+	}
+	sub.Title = f.title
+	for _, e := range f.entries {
+		sub.Seen = append(sub.Seen, e.id)
+	}
+	sub.LastPolled = time.Now()
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	n := 0
+	for _, x := range fp.state.Feeds {
+		if x.GuildID == guildID {
+			n++
+			if x.ChannelID == channelID && x.URL == sub.URL {
+				return nil, fmt.Errorf("this channel is already subscribed to that feed (ID `%s`)", x.ID)
+			}
+		}
+	}
+	if n >= maxFeeds {
+		return nil, fmt.Errorf("this server already has %d feed subscriptions", n)
+	}
+	fp.state.Next++
+	sub.ID = strconv.FormatInt(int64(fp.state.Next), 36)
+	fp.state.Feeds = append(fp.state.Feeds, sub)
+	return sub, fp.save()
+}
+
+// list returns the subscriptions of guildID.
+func (fp *feedPoller) list(guildID string) []feedSubscription {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	var out []feedSubscription
+	for _, sub := range fp.state.Feeds {
+		if sub.GuildID == guildID {
+			out = append(out, *sub)
+		}
+	}
+	return out
+}
+
+// unsubscribe removes the subscription id of guildID and reports whether
+// there was one.
+func (fp *feedPoller) unsubscribe(guildID, id string) (bool, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	n := len(fp.state.Feeds)
+	fp.state.Feeds = slices.DeleteFunc(fp.state.Feeds, func(sub *feedSubscription) bool {
+		return sub.GuildID == guildID && sub.ID == id
+	})
+	if len(fp.state.Feeds) == n {
+		return false, nil
+	}
+	return true, fp.save()
+}
+
+// run polls every feed every interval.
+func (fp *feedPoller) run(s *discordgo.Session, every time.Duration) {
+	for {
+		fp.mu.Lock()
+		subs := slices.Clone(fp.state.Feeds)
+		fp.mu.Unlock()
+		for _, sub := range subs {
+			fp.poll(s, sub)
+		}
+		time.Sleep(every)
+	}
+}
+
+// poll fetches the feed of sub and posts summaries of its new entries.
+func (fp *feedPoller) poll(s *discordgo.Session, sub *feedSubscription) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	ctx = context.WithValue(ctx, ctxKeyGuildID, sub.GuildID)
+
+	fp.mu.Lock()
+	req := *sub
+	fp.mu.Unlock()
+	f, err := fp.fetch(ctx, &req)
+
+	fp.mu.Lock()
+	sub.LastPolled = time.Now()
+	sub.ETag, sub.LastModified = req.ETag, req.LastModified
+	sub.LastError = ""
+	if err != nil {
+		sub.LastError = err.Error()
+		slog.Warn("failed to fetch feed", "guild", sub.GuildID, "feed", sub.ID, "err", err)
+	}
+	var fresh []feedEntry
+	if f != nil {
+		if f.title != "" {
+			sub.Title = f.title
+		}
+		for _, e := range f.entries {
+			if !slices.Contains(sub.Seen, e.id) {
+				fresh = append(fresh, e)
+			}
+		}
+		seen := make([]string, 0, len(fresh)+len(sub.Seen))
+		for _, e := range fresh {
+			seen = append(seen, e.id)
+		}
+		sub.Seen = append(seen, sub.Seen...)
+		if len(sub.Seen) > feedSeenLimit {
+			sub.Seen = sub.Seen[:feedSeenLimit]
+		}
+	}
+	title := sub.Title
+	if err := fp.save(); err != nil {
+		slog.Error("failed to save feeds", "err", err)
+	}
+	fp.mu.Unlock()
+
+	if len(fresh) > feedMaxPosts {
+		slog.Info("skipping older new feed entries", "feed", sub.ID, "skipped", len(fresh)-feedMaxPosts)
+		fresh = fresh[:feedMaxPosts]
+	}
+	// Feeds list the newest entry first; post the oldest first.
+	slices.Reverse(fresh)
+	for _, e := range fresh {
+		fp.replies.send(s, sub.ChannelID, nil, fp.render(ctx, title, e))
+	}
+}
+
+// render formats e for the channel, with a summary of its text if it has
+// any and the model can write one.
+func (fp *feedPoller) render(ctx context.Context, feedTitle string, e feedEntry) string {
+	var sb strings.Builder
+	sb.WriteString("📰 ")
+	if feedTitle != "" {
+		sb.WriteString(feedTitle + ": ")
+	}
+	entryTitle := e.title
+	if entryTitle == "" {
+		entryTitle = "(untitled)"
+	}
+	if e.link != "" {
+		fmt.Fprintf(&sb, "**[%s](<%s>)**", entryTitle, e.link)
+	} else {
+		sb.WriteString("**" + entryTitle + "**")
+	}
+	if e.text == "" {
+		return sb.String()
+	}
+	text := []rune(e.text)
+	if len(text) > feedEntryChars {
+		text = text[:feedEntryChars]
+	}
+	summary, err := complete(ctx, fp.eng, feedPrompt, e.title+"\n\n"+string(text))
+	if err != nil {
+		slog.Warn("failed to summarize feed entry", "link", e.link, "err", err)
+		return sb.String()
+	}
+	return sb.String() + "\n" + summary
+}
+
+// parsedFeed is a fetched feed, entries newest first as the feed lists them.
+type parsedFeed struct {
+	title   string
+	entries []feedEntry
+}
+
+type feedEntry struct {
+	id, title, link, text string
+}
+
+// fetch downloads and parses the feed of sub, updating its ETag and
+// Last-Modified. It returns nil without an error if the feed did not
+// change.
+func (fp *feedPoller) fetch(ctx context.Context, sub *feedSubscription) (*parsedFeed, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rss+xml, application/atom+xml, application/xml;q=0.9, */*;q=0.8")
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion())
+	if sub.ETag != "" {
+		req.Header.Set("If-None-Match", sub.ETag)
+	}
+	if sub.LastModified != "" {
+		req.Header.Set("If-Modified-Since", sub.LastModified)
+	}
+	resp, err := fp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the server returned %s", resp.Status)
+	}
+	f, err := parseFeed(io.LimitReader(resp.Body, feedMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	sub.ETag, sub.LastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return f, nil
+}
+
+// xmlFeed covers RSS 2.0, RSS 1.0 (RDF) and Atom documents.
+type xmlFeed struct {
+	XMLName xml.Name
+	// RSS 2.0 keeps the title and items in <channel>; RSS 1.0 only the
+	// title, with the items next to it.
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []xmlItem `xml:"item"`
+	} `xml:"channel"`
+	Items []xmlItem `xml:"item"`
+	// Atom
+	Title   string     `xml:"title"`
+	Entries []xmlEntry `xml:"entry"`
+}
+
+type xmlItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Description string `xml:"description"`
+	Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+}
+
+type xmlEntry struct {
+	ID    string `xml:"id"`
+	Title string `xml:"title"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Summary string `xml:"summary"`
+	Content string `xml:"content"`
+}
+
+func parseFeed(r io.Reader) (*parsedFeed, error) {
+	var doc xmlFeed
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Non-UTF-8 feeds are rare; their ASCII parts still decode.
+		return input, nil
+	}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("not a valid feed: %w", err)
+	}
+	f := &parsedFeed{}
+	switch doc.XMLName.Local {
+	case "rss", "RDF":
+		f.title = strings.TrimSpace(doc.Channel.Title)
+		for _, it := range slices.Concat(doc.Channel.Items, doc.Items) {
+			text := it.Content
+			if text == "" {
+				text = it.Description
+			}
+			f.entries = append(f.entries, feedEntry{
+				id:    firstNonEmpty(it.GUID, it.Link, it.Title),
+				title: plainText(it.Title),
+				link:  strings.TrimSpace(it.Link),
+				text:  plainText(text),
+			})
+		}
+	case "feed":
+		f.title = strings.TrimSpace(doc.Title)
+		for _, e := range doc.Entries {
+			var link string
+			for _, l := range e.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					link = l.Href
+					break
+				}
+			}
+			text := e.Content
+			if text == "" {
+				text = e.Summary
+			}
+			f.entries = append(f.entries, feedEntry{
+				id:    firstNonEmpty(e.ID, link, e.Title),
+				title: plainText(e.Title),
+				link:  strings.TrimSpace(link),
+				text:  plainText(text),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("not an RSS or Atom feed (root element <%s>)", doc.XMLName.Local)
+	}
+	f.entries = slices.DeleteFunc(f.entries, func(e feedEntry) bool { return e.id == "" })
+	return f, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+var (
+	htmlBlockRe = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTagRe   = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// plainText turns the HTML of a feed entry into plain text.
+func plainText(s string) string {
+	s = htmlBlockRe.ReplaceAllString(s, " ")
+	s = htmlTagRe.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// errPrivateAddress is returned when a URL resolves to an address on the
+// bot's own machine or network.
+var errPrivateAddress = errors.New("the address is not public")
+
+// publicHTTPClient returns a client for URLs given by users, which only
+// connects to public addresses, so that the bot cannot be used to reach
+// services on its own machine or network.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func feedCommand(fp *feedPoller) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "feed",
+			Description: "Post summaries of new RSS or Atom feed entries in this channel (Manage Server only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "subscribe",
+					Description: "Post new entries of a feed in this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "url",
+							Description: "URL of the RSS or Atom feed",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List this server's feed subscriptions",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "unsubscribe",
+					Description: "Stop posting a feed",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "id",
+							Description: "The subscription's ID, as shown by /feed list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if i.GuildID == "" {
+				respondEphemeral(s, i, loc.tr("This command only works in a server."))
+				return
+			}
+			if !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("You need the Manage Server permission to use this command."))
+				return
+			}
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			switch opts[0].Name {
+			case "subscribe":
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+				})
+				if err != nil {
+					slog.Error("failed to respond to interaction", "err", err)
+					return
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				rawURL := strings.TrimSpace(opts[0].Options[0].StringValue())
+				sub, err := fp.subscribe(ctx, i.GuildID, i.ChannelID, rawURL, interactionUserID(i))
+				if err != nil {
+					followup(s, i, loc.tr("Failed to subscribe: %s", err))
+					return
+				}
+				slog.Info("feed subscribed", "guild", i.GuildID, "channel", i.ChannelID, "feed", sub.ID)
+				name := sub.Title
+				if name == "" {
+					name = sub.URL
+				}
+				followup(s, i, loc.tr("Subscribed to **%s** (ID `%s`). New entries will be summarized here; the %d already in the feed are skipped.", name, sub.ID, len(sub.Seen)))
+			case "list":
+				subs := fp.list(i.GuildID)
+				if len(subs) == 0 {
+					respondEphemeral(s, i, loc.tr("This server has no feed subscriptions."))
+					return
+				}
+				var sb strings.Builder
+				for _, sub := range subs {
+					fmt.Fprintf(&sb, "`%s` %s in <#%s>", sub.ID, sub.URL, sub.ChannelID)
+					if sub.Title != "" {
+						sb.WriteString(" (" + sub.Title + ")")
+					}
+					if sub.LastError != "" {
+						sb.WriteString(" ⚠️ " + sub.LastError)
+					}
+					sb.WriteString("\n")
+				}
+				respondEphemeral(s, i, splitMessage(sb.String(), discordLimit)[0])
+			case "unsubscribe":
+				id := strings.TrimSpace(opts[0].Options[0].StringValue())
+				ok, err := fp.unsubscribe(i.GuildID, id)
+				switch {
+				case err != nil:
+					respondEphemeral(s, i, loc.tr("Failed to unsubscribe: %s", err))
+				case !ok:
+					respondEphemeral(s, i, loc.tr("This server has no feed subscription with ID `%s`.", id))
+				default:
+					respondEphemeral(s, i, loc.tr("Unsubscribed from feed `%s`.", id))
+				}
+			}
+		},
+	}
+}
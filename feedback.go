@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	feedbackUp   = "👍"
+	feedbackDown = "👎"
+
+	// feedbackWindow is how long after a reply ratings of it are recorded.
+	feedbackWindow = 24 * time.Hour
+)
+
+// feedbackRecord is one rating of a reply.
+type feedbackRecord struct {
+	At      time.Time `json:"at"`
+	ReplyID string    `json:"reply_id"`
+	GuildID string    `json:"guild_id,omitempty"`
+	// AskedBy is the user the reply was for and UserID the one who rated it.
+	AskedBy  string `json:"asked_by"`
+	UserID   string `json:"user_id"`
+	Model    string `json:"model"`
+	Prompt   string `json:"prompt"`
+	Response string `json:"response"`
+	// Rating is 1 for 👍 and -1 for 👎.
+	Rating int `json:"rating"`
+}
+
+// ratedReply is a recent reply that can still be rated.
+type ratedReply struct {
+	record feedbackRecord
+	at     time.Time
+}
+
+// feedbackStore records 👍/👎 reactions to the bot's replies, with the
+// prompt and reply they rate, in <data>/feedback.json.
+type feedbackStore struct {
+	mu      sync.Mutex
+	path    string
+	cipher  *storage.Cipher
+	records []feedbackRecord
+	// replies holds recent replies by the ID of their last message, which
+	// carries the rating reactions.
+	replies map[string]*ratedReply
+}
+
+func newFeedbackStore(dataDir string, fc *storage.Cipher) *feedbackStore {
+	fs := &feedbackStore{
+		path:    filepath.Join(dataDir, "feedback.json"),
+		cipher:  fc,
+		replies: make(map[string]*ratedReply),
+	}
+	records, err := readFeedback(fs.path, fc)
+	if err != nil {
+		slog.Error("failed to read feedback", "err", err)
+	}
+	fs.records = records
+	return fs
+}
+
+func readFeedback(path string, fc *storage.Cipher) ([]feedbackRecord, error) {
+	var records []feedbackRecord
+	err := storage.ReadRecover(path, fc.ReadFile, func(b []byte) error {
+		records = nil
+		return json.Unmarshal(b, &records)
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return records, err
+}
+
+// save writes the records to disk. The caller must hold fs.mu.
+func (fs *feedbackStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(fs.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fs.cipher.WriteFile(fs.path, b)
+}
+
+// track makes the reply made of the messages ids ratable and adds the
+// rating reactions to its last message.
+func (fs *feedbackStore) track(s *discordgo.Session, channelID string, ids []string, rec feedbackRecord) {
+	if len(ids) == 0 {
+		return
+	}
+	last := ids[len(ids)-1]
+	rec.ReplyID = last
+	fs.mu.Lock()
+	for id, r := range fs.replies {
+		if time.Since(r.at) > feedbackWindow {
+			delete(fs.replies, id)
+		}
+	}
+	fs.replies[last] = &ratedReply{record: rec, at: time.Now()}
+	fs.mu.Unlock()
+	for _, emoji := range []string{feedbackUp, feedbackDown} {
+		if err := s.MessageReactionAdd(channelID, last, emoji); err != nil {
+			slog.Warn("failed to add feedback reaction", "channel", channelID, "err", err)
+			return
+		}
+	}
+}
+
+func feedbackRating(emoji string) int {
+	switch emoji {
+	case feedbackUp:
+		return 1
+	case feedbackDown:
+		return -1
+	}
+	return 0
+}
+
+// handleReactionAdd records a rating. A user's later rating of the same
+// reply replaces the earlier one.
+func (fs *feedbackStore) handleReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	rating := feedbackRating(r.Emoji.Name)
+	if rating == 0 || r.UserID == s.State.User.ID {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	reply, ok := fs.replies[r.MessageID]
+	if !ok {
+		return
+	}
+	rec := reply.record
+	rec.At, rec.UserID, rec.Rating = time.Now().UTC(), r.UserID, rating
+	fs.records = slices.DeleteFunc(fs.records, func(old feedbackRecord) bool {
+		return old.ReplyID == rec.ReplyID && old.UserID == rec.UserID
+	})
+	fs.records = append(fs.records, rec)
+	if err := fs.save(); err != nil {
+		slog.Error("failed to save feedback", "err", err)
+	}
+}
+
+// handleReactionRemove withdraws a rating.
+func (fs *feedbackStore) handleReactionRemove(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	rating := feedbackRating(r.Emoji.Name)
+	if rating == 0 {
+		return
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := len(fs.records)
+	fs.records = slices.DeleteFunc(fs.records, func(old feedbackRecord) bool {
+		return old.ReplyID == r.MessageID && old.UserID == r.UserID && old.Rating == rating
+	})
+	if len(fs.records) == n {
+		return
+	}
+	if err := fs.save(); err != nil {
+		slog.Error("failed to save feedback", "err", err)
+	}
+}
+
+// of returns the ratings userID gave and the ratings of replies to them.
+func (fs *feedbackStore) of(userID string) []feedbackRecord {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var out []feedbackRecord
+	for _, rec := range fs.records {
+		if rec.UserID == userID || rec.AskedBy == userID {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// remove deletes the ratings userID gave and the ratings of replies to them.
+func (fs *feedbackStore) remove(userID string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := len(fs.records)
+	fs.records = slices.DeleteFunc(fs.records, func(rec feedbackRecord) bool {
+		return rec.UserID == userID || rec.AskedBy == userID
+	})
+	for id, r := range fs.replies {
+		if r.record.AskedBy == userID {
+			delete(fs.replies, id)
+		}
+	}
+	if len(fs.records) == n {
+		return nil
+	}
+	return fs.save()
+}
+
+// exportFeedback writes the ratings in path to w as JSON Lines and returns
+// how many were written.
+func exportFeedback(w io.Writer, path string, fc *storage.Cipher) (int, error) {
+	records, err := readFeedback(path, fc)
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return 0, err
+		}
+	}
+	return len(records), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// isForumPost reports whether ch is a post (thread) inside a forum channel.
+func isForumPost(s *discordgo.Session, ch *discordgo.Channel) bool {
+	if !ch.IsThread() || ch.ParentID == "" {
+		return false
+	}
+	parent, err := channel(s, ch.ParentID)
+	if err != nil {
+		return false
+	}
+	return parent.Type == discordgo.ChannelTypeGuildForum
+}
+
+// forumPostContext prefixes content with the post title and starter message
+// so the model sees what the post is about. The starter message shares its ID
+// with the post thread; when it is the triggering message itself only the
+// title is added.
+func forumPostContext(s *discordgo.Session, post *discordgo.Channel, messageID, content string) string {
+	var sb strings.Builder
+	sb.WriteString("[Forum post: ")
+	sb.WriteString(post.Name)
+	sb.WriteString("]\n")
+	if messageID != post.ID {
+		starter, err := s.ChannelMessage(post.ID, post.ID)
+		if err != nil {
+			slog.Warn("failed to fetch forum starter message", "err", err)
+		} else if text := strings.TrimSpace(starter.Content); text != "" {
+			sb.WriteString(text)
+			sb.WriteString("\n\n---\n")
+		}
+	}
+	sb.WriteString(content)
+	return sb.String()
+}
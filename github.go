@@ -0,0 +1,581 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// githubFileChars bounds the file text returned at once.
+	githubFileChars = 12000
+	// githubThreadChars bounds an issue thread, and githubCommentChars
+	// each of its comments.
+	githubThreadChars  = 12000
+	githubCommentChars = 2000
+	// githubResults is how many issues or code matches are listed.
+	githubResults = 20
+)
+
+var (
+	githubRepoRe    = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+	githubPatternRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.*?-]+$`)
+	githubIssueRe   = regexp.MustCompile(`^([A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+)#(\d+)$`)
+	githubLinesRe   = regexp.MustCompile(`^L(\d+)(?:-L(\d+))?$`)
+)
+
+// githubConfig is the "github" section of the config file, which offers
+// the GitHub tools for the repositories in Repos.
+type githubConfig struct {
+	// Token authenticates the requests. It is needed for private
+	// repositories and code search.
+	Token string `yaml:"token"`
+	// Repos are the repositories the tools may read, as owner/name or
+	// patterns such as owner/*.
+	Repos []string `yaml:"repos"`
+	// URL is the REST API, https://api.github.com unless GitHub Enterprise.
+	URL string `yaml:"url"`
+}
+
+// check validates c and fills in its defaults.
+func (c *githubConfig) check() error {
+	if len(c.Repos) == 0 {
+		return errors.New("repos is required")
+	}
+	for _, r := range c.Repos {
+		if !githubPatternRe.MatchString(r) {
+			return fmt.Errorf("repo %q must be owner/name or a pattern such as owner/*", r)
+		}
+	}
+	if c.URL == "" {
+		c.URL = "https://api.github.com"
+	}
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("url %q must be an http or https URL", c.URL)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	return nil
+}
+
+// gitHub answers the GitHub tools with the REST API.
+type gitHub struct {
+	cfg    githubConfig
+	client *http.Client
+}
+
+func newGitHub(cfg githubConfig) *gitHub {
+	return &gitHub{cfg: cfg, client: &http.Client{Timeout: 20 * time.Second}}
+}
+
+// allowed reports whether repo is one of the configured repositories.
+func (gh *gitHub) allowed(repo string) bool {
+	for _, pattern := range gh.cfg.Repos {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(repo)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// webHost is the host of the GitHub web pages users link to.
+func (gh *gitHub) webHost() string {
+	u, err := url.Parse(gh.cfg.URL)
+	if err != nil || u.Host == "api.github.com" {
+		return "github.com"
+	}
+	return u.Host
+}
+
+// githubRef is what a tool call points at: a repository and, depending on
+// the tool, a file or an issue.
+type githubRef struct {
+	repo     string
+	ref      string
+	path     string
+	number   int
+	from, to int
+}
+
+// parseGitHubLink reads a link to a repository, file, directory, issue or
+// pull request, such as https://github.com/owner/name/blob/main/go.mod#L3-L9,
+// or the shorthand owner/name#123. Branch names with slashes are not
+// recognized in links.
+func (gh *gitHub) parseGitHubLink(link string) (githubRef, error) {
+	var r githubRef
+	link = strings.TrimSpace(link)
+	if m := githubIssueRe.FindStringSubmatch(link); m != nil {
+		r.repo = m[1]
+		r.number, _ = strconv.Atoi(m[2])
+		return r, nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return r, fmt.Errorf("%q is not a GitHub link", link)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch host := strings.TrimPrefix(u.Host, "www."); {
+	case host == "raw.githubusercontent.com" && len(parts) >= 4:
+		// raw.githubusercontent.com/owner/name/ref/path
+		parts = append(parts[:2], append([]string{"blob"}, parts[2:]...)...)
+	case host != gh.webHost() || len(parts) < 2:
+		return r, fmt.Errorf("%q is not a GitHub link", link)
+	}
+	r.repo = parts[0] + "/" + strings.TrimSuffix(parts[1], ".git")
+	if len(parts) >= 4 {
+		switch parts[2] {
+		case "blob", "tree":
+			r.ref = parts[3]
+			r.path = strings.Join(parts[4:], "/")
+			if m := githubLinesRe.FindStringSubmatch(u.Fragment); m != nil {
+				r.from, _ = strconv.Atoi(m[1])
+				r.to, _ = strconv.Atoi(m[2])
+			}
+		case "issues", "pull", "pulls":
+			if r.number, err = strconv.Atoi(parts[3]); err != nil {
+				return r, fmt.Errorf("%q is not a link to an issue", link)
+			}
+		}
+	}
+	return r, nil
+}
+
+// target resolves the link or repo argument of a tool call and checks
+// that the repository may be read.
+func (gh *gitHub) target(link, repo string) (githubRef, error) {
+	var r githubRef
+	if link != "" {
+		var err error
+		if r, err = gh.parseGitHubLink(link); err != nil {
+			return r, err
+		}
+	} else if m := githubIssueRe.FindStringSubmatch(repo); m != nil {
+		r.repo = m[1]
+		r.number, _ = strconv.Atoi(m[2])
+	} else {
+		r.repo = strings.TrimSpace(repo)
+	}
+	if r.repo == "" {
+		return r, errors.New("repo or link is required")
+	}
+	if !githubRepoRe.MatchString(r.repo) || strings.Contains(r.repo, "..") {
+		return r, fmt.Errorf("%q is not a repository name such as owner/name", r.repo)
+	}
+	if !gh.allowed(r.repo) {
+		return r, fmt.Errorf("repository %s is not one the bot may read; it can read %s", r.repo, strings.Join(gh.cfg.Repos, ", "))
+	}
+	return r, nil
+}
+
+// get fetches the API path with query into v.
+func (gh *gitHub) get(ctx context.Context, apiPath string, query url.Values, accept string, v any) error {
+	u := gh.cfg.URL + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", cmp.Or(accept, "application/vnd.github+json"))
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion())
+	if gh.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+gh.cfg.Token)
+	}
+	resp, err := gh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("GitHub returned %s: %s", resp.Status, e.Message)
+		}
+		return fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// escapePath escapes each segment of a repository path.
+func escapePath(p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i, s := range parts {
+		parts[i] = url.PathEscape(s)
+	}
+	return strings.Join(parts, "/")
+}
+
+// githubContent is a file or directory entry of the contents API.
+type githubContent struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Size     int    `json:"size"`
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+	HTMLURL  string `json:"html_url"`
+}
+
+// fileTool is the getGitHubFile tool.
+func (gh *gitHub) fileTool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Link string `json:"link"`
+		Repo string `json:"repo"`
+		Path string `json:"path"`
+		Ref  string `json:"ref"`
+		From int    `json:"from"`
+		To   int    `json:"to"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	r, err := gh.target(p.Link, p.Repo)
+	if err != nil {
+		return "", err
+	}
+	r.path, r.ref = cmp.Or(p.Path, r.path), cmp.Or(p.Ref, r.ref)
+	r.from, r.to = cmp.Or(p.From, r.from), cmp.Or(p.To, r.to)
+	if slices.Contains(strings.Split(r.path, "/"), "..") {
+		return "", fmt.Errorf("invalid path %q", r.path)
+	}
+	q := url.Values{}
+	if r.ref != "" {
+		q.Set("ref", r.ref)
+	}
+	var raw json.RawMessage
+	if err := gh.get(ctx, "/repos/"+r.repo+"/contents/"+escapePath(r.path), q, "", &raw); err != nil {
+		return "", err
+	}
+	at := ""
+	if r.ref != "" {
+		at = "@" + r.ref
+	}
+
+	var entries []githubContent
+	if json.Unmarshal(raw, &entries) == nil {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "Directory %s%s:\n", strings.TrimSuffix(r.repo+"/"+r.path, "/"), at)
+		for _, e := range entries {
+			if e.Type == "dir" {
+				fmt.Fprintf(&sb, "%s/\n", e.Name)
+			} else {
+				fmt.Fprintf(&sb, "%s (%d bytes)\n", e.Name, e.Size)
+			}
+		}
+		return strings.TrimSpace(sb.String()), nil
+	}
+	var file githubContent
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return "", err
+	}
+	if file.Type != "file" {
+		return "", fmt.Errorf("%s is a %s, not a file", file.Path, file.Type)
+	}
+	if file.Encoding != "base64" {
+		return "", fmt.Errorf("%s is too large to read (%d bytes)", file.Path, file.Size)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(file.Content, "\n", ""))
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(data) || strings.ContainsRune(string(data), 0) {
+		return fmt.Sprintf("%s/%s%s is a binary file of %d bytes.", r.repo, file.Path, at, file.Size), nil
+	}
+	return describeFile(r.repo+"/"+file.Path+at, file.HTMLURL, string(data), r.from, r.to), nil
+}
+
+// describeFile numbers the lines from to to of text, from the first and to
+// the last by default, up to githubFileChars.
+func describeFile(name, link, text string, from, to int) string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	from = max(from, 1)
+	if to <= 0 || to > len(lines) {
+		to = len(lines)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%d lines)\n%s\n\n", name, len(lines), link)
+	if from > len(lines) {
+		fmt.Fprintf(&sb, "The file has no line %d.", from)
+		return sb.String()
+	}
+	n := 0
+	for i := from; i <= to; i++ {
+		line := fmt.Sprintf("%d: %s\n", i, lines[i-1])
+		if n > 0 && n+len(line) > githubFileChars {
+			fmt.Fprintf(&sb, "(Cut at line %d. Call again with from %d for more.)", i-1, i)
+			return sb.String()
+		}
+		sb.WriteString(line)
+		n += len(line)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// scope returns search qualifiers for repo, or for every configured
+// repository when repo is empty.
+func (gh *gitHub) scope(link, repo string) (string, error) {
+	if link != "" || repo != "" {
+		r, err := gh.target(link, repo)
+		if err != nil {
+			return "", err
+		}
+		return "repo:" + r.repo, nil
+	}
+	var quals []string
+	for _, pattern := range gh.cfg.Repos {
+		owner, name, _ := strings.Cut(pattern, "/")
+		if strings.ContainsAny(name, "*?") {
+			quals = append(quals, "user:"+owner)
+		} else {
+			quals = append(quals, "repo:"+pattern)
+		}
+	}
+	return strings.Join(quals, " "), nil
+}
+
+// githubIssueItem is an issue or pull request of the issues and search
+// APIs.
+type githubIssueItem struct {
+	githubIssue
+	State       string    `json:"state"`
+	Comments    int       `json:"comments"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	PullRequest *struct {
+		MergedAt *time.Time `json:"merged_at"`
+	} `json:"pull_request"`
+	RepositoryURL string `json:"repository_url"`
+}
+
+// repo returns the owner/name of the issue's repository.
+func (is githubIssueItem) repo() string {
+	parts := strings.Split(is.RepositoryURL, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.Join(parts[len(parts)-2:], "/")
+}
+
+func (is githubIssueItem) kind() string {
+	switch {
+	case is.PullRequest == nil:
+		return "issue"
+	case is.PullRequest.MergedAt != nil:
+		return "merged PR"
+	}
+	return "PR"
+}
+
+// issuesTool is the listGitHubIssues tool.
+func (gh *gitHub) issuesTool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Link   string   `json:"link"`
+		Repo   string   `json:"repo"`
+		Type   string   `json:"type"`
+		State  string   `json:"state"`
+		Labels []string `json:"labels"`
+		Query  string   `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	scope, err := gh.scope(p.Link, p.Repo)
+	if err != nil {
+		return "", err
+	}
+	q := []string{scope}
+	switch p.Type {
+	case "issue", "pr":
+		q = append(q, "is:"+p.Type)
+	}
+	switch p.State {
+	case "", "open":
+		q = append(q, "is:open")
+	case "closed", "merged":
+		q = append(q, "is:"+p.State)
+	}
+	for _, l := range p.Labels {
+		q = append(q, fmt.Sprintf("label:%q", l))
+	}
+	if p.Query != "" {
+		q = append(q, p.Query)
+	}
+	var res struct {
+		Total int               `json:"total_count"`
+		Items []githubIssueItem `json:"items"`
+	}
+	query := url.Values{"q": {strings.Join(q, " ")}, "sort": {"updated"}, "per_page": {strconv.Itoa(githubResults)}}
+	if err := gh.get(ctx, "/search/issues", query, "", &res); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	n := 0
+	for _, is := range res.Items {
+		// The query may name other repositories.
+		if !gh.allowed(is.repo()) {
+			continue
+		}
+		n++
+		fmt.Fprintf(&sb, "- %s#%d [%s, %s] %s by %s, %s, updated %s", is.repo(), is.Number, is.kind(), is.State, is.Title, is.User.Login, plural(is.Comments, "comment"), is.UpdatedAt.Format(time.DateOnly))
+		for i, l := range is.Labels {
+			if i == 0 {
+				sb.WriteString(", labels: ")
+			} else {
+				sb.WriteString(", ")
+			}
+			sb.WriteString(l.Name)
+		}
+		sb.WriteString("\n")
+	}
+	if n == 0 {
+		return "No matching issues or pull requests.", nil
+	}
+	if res.Total > len(res.Items) {
+		fmt.Fprintf(&sb, "(The %d most recently updated of %d matches.)", n, res.Total)
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
+
+// issueTool is the getGitHubIssue tool.
+func (gh *gitHub) issueTool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Link   string `json:"link"`
+		Repo   string `json:"repo"`
+		Number int    `json:"number"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	r, err := gh.target(p.Link, p.Repo)
+	if err != nil {
+		return "", err
+	}
+	r.number = cmp.Or(p.Number, r.number)
+	if r.number <= 0 {
+		return "", errors.New("number is required")
+	}
+	base := fmt.Sprintf("/repos/%s/issues/%d", r.repo, r.number)
+	var is githubIssueItem
+	if err := gh.get(ctx, base, nil, "", &is); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s#%d [%s, %s] %s\n%s\nOpened by %s on %s", r.repo, r.number, is.kind(), is.State, is.Title, is.HTMLURL, is.User.Login, is.CreatedAt.Format(time.DateOnly))
+	if is.PullRequest != nil {
+		var pr struct {
+			Head struct {
+				Label string `json:"label"`
+			} `json:"head"`
+			Base struct {
+				Ref string `json:"ref"`
+			} `json:"base"`
+			Draft        bool `json:"draft"`
+			ChangedFiles int  `json:"changed_files"`
+			Additions    int  `json:"additions"`
+			Deletions    int  `json:"deletions"`
+		}
+		if err := gh.get(ctx, fmt.Sprintf("/repos/%s/pulls/%d", r.repo, r.number), nil, "", &pr); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "\n%s into %s, %s (+%d −%d)", pr.Head.Label, pr.Base.Ref, plural(pr.ChangedFiles, "changed file"), pr.Additions, pr.Deletions)
+		if pr.Draft {
+			sb.WriteString(", draft")
+		}
+	}
+	fmt.Fprintf(&sb, "\n\n%s", truncateRunes(strings.TrimSpace(cmp.Or(is.Body, "(no description)")), githubCommentChars))
+
+	var comments []struct {
+		Body      string     `json:"body"`
+		User      githubUser `json:"user"`
+		CreatedAt time.Time  `json:"created_at"`
+	}
+	if is.Comments > 0 {
+		if err := gh.get(ctx, base+"/comments", url.Values{"per_page": {"100"}}, "", &comments); err != nil {
+			return "", err
+		}
+	}
+	for i, c := range comments {
+		text := fmt.Sprintf("\n\n%s on %s:\n%s", c.User.Login, c.CreatedAt.Format(time.DateOnly), truncateRunes(strings.TrimSpace(c.Body), githubCommentChars))
+		if sb.Len()+len(text) > githubThreadChars {
+			fmt.Fprintf(&sb, "\n\n(%d more comments not shown; see the link.)", len(comments)-i)
+			break
+		}
+		sb.WriteString(text)
+	}
+	return sb.String(), nil
+}
+
+// codeTool is the searchGitHubCode tool.
+func (gh *gitHub) codeTool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Query string `json:"query"`
+		Repo  string `json:"repo"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Query) == "" {
+		return "", errors.New("query is required")
+	}
+	scope, err := gh.scope("", p.Repo)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Total int `json:"total_count"`
+		Items []struct {
+			Path       string `json:"path"`
+			HTMLURL    string `json:"html_url"`
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+			TextMatches []struct {
+				Fragment string `json:"fragment"`
+			} `json:"text_matches"`
+		} `json:"items"`
+	}
+	query := url.Values{"q": {p.Query + " " + scope}, "per_page": {strconv.Itoa(githubResults)}}
+	if err := gh.get(ctx, "/search/code", query, "application/vnd.github.text-match+json", &res); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	n := 0
+	for _, it := range res.Items {
+		if !gh.allowed(it.Repository.FullName) {
+			continue
+		}
+		n++
+		fmt.Fprintf(&sb, "%s/%s\n%s\n", it.Repository.FullName, it.Path, it.HTMLURL)
+		for _, m := range it.TextMatches {
+			fmt.Fprintf(&sb, "```\n%s\n```\n", truncateRunes(strings.TrimSpace(m.Fragment), 500))
+		}
+		sb.WriteString("\n")
+	}
+	if n == 0 {
+		return fmt.Sprintf("No code matches %q.", p.Query), nil
+	}
+	if res.Total > len(res.Items) {
+		fmt.Fprintf(&sb, "(%d of %d matching files.)", n, res.Total)
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
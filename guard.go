@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	// A tool call pattern of period 1 or 2 repeated this many times in a
+	// row is treated as an oscillating tool loop.
+	maxToolCallRepeats = 3
+
+	// Streamed output whose tail consists of the same segment repeated at
+	// least minRepeatCount times over at least minRepeatSpan bytes is
+	// treated as degenerate.
+	minRepeatSpan  = 1000
+	minRepeatCount = 5
+	maxRepeatUnit  = 200
+
+	loopAbortMessage = "I stopped because the reply kept repeating itself. Please rephrase the question and try again."
+)
+
+// loopGuard watches a single engine.Chat call through its callbacks and
+// cancels the request when the model gets stuck repeating itself.
+type loopGuard struct {
+	cancel  context.CancelFunc
+	calls   []string
+	content strings.Builder
+	checked int
+	reason  string
+}
+
+func newLoopGuard(cancel context.CancelFunc) *loopGuard {
+	return &loopGuard{cancel: cancel}
+}
+
+func (g *loopGuard) abort(reason string) {
+	if g.reason != "" {
+		return
+	}
+	g.reason = reason
+	g.cancel()
+}
+
+// tripped reports why the guard aborted the request, or "" if it did not.
+func (g *loopGuard) tripped() string {
+	return g.reason
+}
+
+func (g *loopGuard) onToolCall(name, arguments string) {
+	g.calls = append(g.calls, name+"\x00"+arguments)
+	for period := 1; period <= 2; period++ {
+		if repeatsTail(g.calls, period) >= maxToolCallRepeats {
+			g.abort(fmt.Sprintf("tool loop: %s repeated %d times", name, maxToolCallRepeats))
+			return
+		}
+	}
+}
+
+func (g *loopGuard) onContent(text string) {
+	g.content.WriteString(text)
+	if g.content.Len()-g.checked < 256 {
+		return
+	}
+	g.checked = g.content.Len()
+	if isRepetitive(g.content.String()) {
+		g.abort("repetitive output")
+	}
+}
+
+// repeatsTail counts how many times the last period entries of calls repeat
+// consecutively going backwards.
+func repeatsTail(calls []string, period int) int {
+	if len(calls) < period {
+		return 0
+	}
+	n := 1
+	for end := len(calls) - period; end-period >= 0; end -= period {
+		for i := 0; i < period; i++ {
+			if calls[end-period+i] != calls[len(calls)-period+i] {
+				return n
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// isRepetitive reports whether s ends with a short segment repeated many
+// times in a row.
+func isRepetitive(s string) bool {
+	for unit := 1; unit <= maxRepeatUnit && unit*minRepeatCount <= len(s); unit++ {
+		seg := s[len(s)-unit:]
+		n := 1
+		for end := len(s) - unit; end >= unit && s[end-unit:end] == seg; end -= unit {
+			n++
+		}
+		if n >= minRepeatCount && n*unit >= minRepeatSpan {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// guildConfig holds per-guild settings changed by server managers.
+type guildConfig struct {
+	// Channels limits the bot to these channels (and their threads).
+	// Empty means every channel.
+	Channels []string `json:"channels,omitempty"`
+	// Persona and Language are defaults for members who have not chosen
+	// their own.
+	Persona      string `json:"persona,omitempty"`
+	Language     string `json:"language,omitempty"`
+	DualLanguage string `json:"dual_language,omitempty"`
+	// DisabledTools are never offered to the model in this guild, and
+	// ChannelDisabledTools not in the channels they are keyed by or their
+	// threads. Entries may be patterns such as "*MemoryEntry".
+	DisabledTools        []string            `json:"disabled_tools,omitempty"`
+	ChannelDisabledTools map[string][]string `json:"channel_disabled_tools,omitempty"`
+	// DailyQuota caps messages per member per day. Zero means unlimited.
+	DailyQuota int `json:"daily_quota,omitempty"`
+	// NoSystemPrompt stops the identity or persona prompt from being sent.
+	// Memory and language hints are still added.
+	NoSystemPrompt bool `json:"no_system_prompt,omitempty"`
+	// ReactionChannels are the channels where the bot reacts to messages
+	// with server emojis.
+	ReactionChannels []string `json:"reaction_channels,omitempty"`
+	// TranslateChannels maps channels where every message is translated to
+	// the language it is translated into.
+	TranslateChannels map[string]string `json:"translate_channels,omitempty"`
+	// Moderation is the action taken on flagged content (see -moderation)
+	// and ModerationChannel where admins are warned about it.
+	Moderation        string `json:"moderation,omitempty"`
+	ModerationChannel string `json:"moderation_channel,omitempty"`
+	// APIKey bills the guild's requests to its own provider key. It is only
+	// read from the config file; /apikey stores keys encrypted elsewhere.
+	APIKey string `json:"api_key,omitempty"`
+	// Announcements are posted on a schedule. They are only read from the
+	// config file; /schedule keeps its own.
+	Announcements []announcement `json:"announcements,omitempty"`
+}
+
+// allowsChannel reports whether the bot may answer in channelID, or in a
+// thread whose parent is parentID.
+func (cfg guildConfig) allowsChannel(channelID, parentID string) bool {
+	if len(cfg.Channels) == 0 {
+		return true
+	}
+	for _, c := range cfg.Channels {
+		if c == channelID || (parentID != "" && c == parentID) {
+			return true
+		}
+	}
+	return false
+}
+
+// disabledTools returns the tools disabled in channelID, or in a thread
+// whose parent is parentID.
+func (cfg guildConfig) disabledTools(channelID, parentID string) []string {
+	disabled := slices.Concat(cfg.DisabledTools, cfg.ChannelDisabledTools[channelID])
+	if parentID != "" {
+		disabled = append(disabled, cfg.ChannelDisabledTools[parentID]...)
+	}
+	return disabled
+}
+
+// withDefaults fills the settings left unset in cfg from def.
+func (cfg guildConfig) withDefaults(def guildConfig) guildConfig {
+	if len(cfg.Channels) == 0 {
+		cfg.Channels = def.Channels
+	}
+	if cfg.Persona == "" {
+		cfg.Persona = def.Persona
+	}
+	if cfg.Language == "" {
+		cfg.Language = def.Language
+	}
+	if cfg.DualLanguage == "" {
+		cfg.DualLanguage = def.DualLanguage
+	}
+	if len(cfg.DisabledTools) == 0 {
+		cfg.DisabledTools = def.DisabledTools
+	}
+	if len(cfg.ChannelDisabledTools) == 0 {
+		cfg.ChannelDisabledTools = def.ChannelDisabledTools
+	}
+	if cfg.DailyQuota == 0 {
+		cfg.DailyQuota = def.DailyQuota
+	}
+	cfg.NoSystemPrompt = cfg.NoSystemPrompt || def.NoSystemPrompt
+	if len(cfg.ReactionChannels) == 0 {
+		cfg.ReactionChannels = def.ReactionChannels
+	}
+	if len(cfg.TranslateChannels) == 0 {
+		cfg.TranslateChannels = def.TranslateChannels
+	}
+	if cfg.Moderation == "" {
+		cfg.Moderation = def.Moderation
+	}
+	if cfg.ModerationChannel == "" {
+		cfg.ModerationChannel = def.ModerationChannel
+	}
+	return cfg
+}
+
+// quotaTracker counts messages per guild member per UTC day. Counts live in
+// memory and reset on restart.
+type quotaTracker struct {
+	mu     sync.Mutex
+	day    string
+	counts map[string]int
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{counts: make(map[string]int)}
+}
+
+// allow records a message from userID in guildID and reports whether it is
+// within limit. A limit of zero or less always allows.
+func (q *quotaTracker) allow(guildID, userID string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if today := time.Now().UTC().Format(time.DateOnly); today != q.day {
+		q.day = today
+		q.counts = make(map[string]int)
+	}
+	key := guildID + "/" + userID
+	if q.counts[key] >= limit {
+		return false
+	}
+	q.counts[key]++
+	return true
+}
+
+// usage returns today's message counts of userID by guild.
+func (q *quotaTracker) usage(userID string) map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.day != time.Now().UTC().Format(time.DateOnly) {
+		return nil
+	}
+	var counts map[string]int
+	for key, n := range q.counts {
+		guildID, user, _ := strings.Cut(key, "/")
+		if user == userID {
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			counts[guildID] = n
+		}
+	}
+	return counts
+}
+
+// forget drops today's counts of userID.
+func (q *quotaTracker) forget(userID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key := range q.counts {
+		if _, user, _ := strings.Cut(key, "/"); user == userID {
+			delete(q.counts, key)
+		}
+	}
+}
+
+// guildStore persists guild configs as <data>/guilds/<guildID>/settings.json.
+type guildStore struct {
+	mu      sync.Mutex
+	dataDir string
+	// defaults come from the config file, by guild ID or "*" for every
+	// guild. Stored settings take precedence over them.
+	defaults map[string]guildConfig
+}
+
+func newGuildStore(dataDir string, defaults map[string]guildConfig) *guildStore {
+	return &guildStore{dataDir: dataDir, defaults: defaults}
+}
+
+func (gs *guildStore) path(guildID string) string {
+	return filepath.Join(gs.dataDir, filepath.FromSlash(storage.Namespace(guildID)), "settings.json")
+}
+
+// legacyPath is where the config was kept before data namespaces existed.
+func (gs *guildStore) legacyPath(guildID string) string {
+	return filepath.Join(gs.dataDir, "guilds", guildID+".json")
+}
+
+func (gs *guildStore) load(guildID string) (guildConfig, error) {
+	var cfg guildConfig
+	data, err := os.ReadFile(gs.path(guildID))
+	if os.IsNotExist(err) {
+		data, err = os.ReadFile(gs.legacyPath(guildID))
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// get returns the config of guildID over its defaults. An empty guildID
+// (DMs) yields the zero config.
+func (gs *guildStore) get(guildID string) guildConfig {
+	if guildID == "" {
+		return guildConfig{}
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	cfg, err := gs.load(guildID)
+	if err != nil {
+		cfg = guildConfig{}
+	}
+	return cfg.withDefaults(gs.defaults[guildID]).withDefaults(gs.defaults["*"])
+}
+
+// update applies fn to the stored config of guildID and saves the result.
+func (gs *guildStore) update(guildID string, fn func(*guildConfig)) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	cfg, err := gs.load(guildID)
+	if err != nil {
+		return err
+	}
+	fn(&cfg)
+
+	if err := os.MkdirAll(filepath.Dir(gs.path(guildID)), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := storage.WriteFileAtomic(gs.path(guildID), b, 0600); err != nil {
+		return err
+	}
+	return storage.RemoveFile(gs.legacyPath(guildID))
+}
+
+// forget deletes the config of guildID.
+func (gs *guildStore) forget(guildID string) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if err := storage.RemoveFile(gs.legacyPath(guildID)); err != nil {
+		return err
+	}
+	return storage.RemoveFile(gs.path(guildID))
+}
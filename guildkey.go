@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// guildKeys holds the provider API keys guilds brought themselves, so that
+// their usage is billed to them. A key set with /apikey is kept encrypted in
+// <data>/guilds/<guildID>/api_key and takes precedence over api_key in the
+// config file.
+type guildKeys struct {
+	dataDir string
+	cipher  *storage.Cipher
+	// config holds the keys from the config file by guild ID.
+	config map[string]guildConfig
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newGuildKeys(dataDir string, fc *storage.Cipher, config map[string]guildConfig) *guildKeys {
+	return &guildKeys{dataDir: dataDir, cipher: fc, config: config, cache: make(map[string]string)}
+}
+
+func (gk *guildKeys) path(guildID string) string {
+	return filepath.Join(gk.dataDir, filepath.FromSlash(storage.Namespace(guildID)), "api_key")
+}
+
+// get returns the key of guildID, or "" to use the bot's own keys.
+func (gk *guildKeys) get(guildID string) string {
+	if guildID == "" {
+		return ""
+	}
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	if key, ok := gk.cache[guildID]; ok {
+		return key
+	}
+	key := gk.config[guildID].APIKey
+	data, err := gk.cipher.ReadFile(gk.path(guildID))
+	switch {
+	case err == nil:
+		key = strings.TrimSpace(string(data))
+	case !os.IsNotExist(err):
+		slog.Error("failed to read guild API key", "guild", guildID, "err", err)
+	}
+	gk.cache[guildID] = key
+	return key
+}
+
+// set stores key for guildID, or removes the stored key if it is empty.
+func (gk *guildKeys) set(guildID, key string) error {
+	gk.mu.Lock()
+	defer gk.mu.Unlock()
+	delete(gk.cache, guildID)
+	path := gk.path(guildID)
+	if key == "" {
+		return storage.RemoveFile(path)
+	}
+	if gk.cipher == nil {
+		return errors.New("the bot has no encryption key to store API keys with")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return gk.cipher.WriteFile(path, []byte(key))
+}
+
+// stored reports whether guildID has a key set with /apikey, and whether the
+// config file gives it one.
+func (gk *guildKeys) stored(guildID string) (command, config bool) {
+	_, err := os.Stat(gk.path(guildID))
+	return err == nil, gk.config[guildID].APIKey != ""
+}
+
+// guildKeyTransport sends the requests made for a guild with its own API
+// key, past the bot's key pool, and all others through base.
+type guildKeyTransport struct {
+	keys *guildKeys
+	// base holds the bot's keys; direct is the same chain without them.
+	base, direct http.RoundTripper
+}
+
+func (t *guildKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	guildID, _ := req.Context().Value(ctxKeyGuildID).(string)
+	key := t.keys.get(guildID)
+	if key == "" {
+		return t.base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+key)
+	return t.direct.RoundTrip(r)
+}
+
+func apiKeyCommand(keys *guildKeys) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "apikey",
+			Description: "Use this server's own provider API key (Manage Server only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Bill this server's requests to its own API key",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "key",
+							Description: "API key for the bot's provider",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "clear",
+					Description: "Go back to the bot's own API key",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "status",
+					Description: "Show which API key this server uses",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if i.GuildID == "" {
+				respondEphemeral(s, i, loc.tr("This command only works in a server."))
+				return
+			}
+			if !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("You need the Manage Server permission to use this command."))
+				return
+			}
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			switch opts[0].Name {
+			case "set":
+				key := strings.TrimSpace(opts[0].Options[0].StringValue())
+				if err := keys.set(i.GuildID, key); err != nil {
+					slog.Error("failed to store guild API key", "guild", i.GuildID, "err", err)
+					respondEphemeral(s, i, loc.tr("Failed to store the key: %s", err))
+					return
+				}
+				slog.Info("guild API key set", "guild", i.GuildID, "user", hashID(interactionUserID(i)))
+				respondEphemeral(s, i, loc.tr("Done. Requests from this server now use its own API key."))
+			case "clear":
+				if err := keys.set(i.GuildID, ""); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to remove the key: %s", err))
+					return
+				}
+				slog.Info("guild API key cleared", "guild", i.GuildID, "user", hashID(interactionUserID(i)))
+				msg := loc.tr("Done. Requests from this server use the bot's own API key again.")
+				if _, config := keys.stored(i.GuildID); config {
+					msg = loc.tr("Done. Requests from this server use the key from the bot's config file again.")
+				}
+				respondEphemeral(s, i, msg)
+			case "status":
+				command, config := keys.stored(i.GuildID)
+				switch {
+				case command:
+					respondEphemeral(s, i, loc.tr("This server uses its own API key, set with `/apikey set`."))
+				case config:
+					respondEphemeral(s, i, loc.tr("This server uses its own API key from the bot's config file."))
+				default:
+					respondEphemeral(s, i, loc.tr("This server uses the bot's own API key."))
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// gatewayGrace is how long the gateway may stay disconnected before
+	// /healthz reports the bot as unhealthy. discordgo reconnects on its
+	// own, so short outages are expected.
+	gatewayGrace = 5 * time.Minute
+	// providerCheckEvery limits how often the provider is pinged, however
+	// often /readyz is polled.
+	providerCheckEvery = 30 * time.Second
+)
+
+// healthChecker answers /healthz and /readyz. Liveness only depends on the
+// Discord gateway; readiness also requires the model provider to answer and
+// the data directory to be writable.
+type healthChecker struct {
+	dataDir string
+	client  *openai.Client
+
+	mu        sync.Mutex
+	connected bool
+	changed   time.Time
+
+	// providerMu is separate so a slow provider does not hold up /healthz.
+	providerMu   sync.Mutex
+	providerErr  error
+	providerTime time.Time
+}
+
+func newHealthChecker(dataDir string, client *openai.Client) *healthChecker {
+	return &healthChecker{dataDir: dataDir, client: client, changed: time.Now()}
+}
+
+// register tracks the gateway connection through s's events.
+func (hc *healthChecker) register(s *discordgo.Session) {
+	s.AddHandler(func(_ *discordgo.Session, _ *discordgo.Ready) { hc.setConnected(true) })
+	s.AddHandler(func(_ *discordgo.Session, _ *discordgo.Resumed) { hc.setConnected(true) })
+	s.AddHandler(func(_ *discordgo.Session, _ *discordgo.Disconnect) { hc.setConnected(false) })
+}
+
+func (hc *healthChecker) setConnected(connected bool) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.connected != connected {
+		hc.connected, hc.changed = connected, time.Now()
+	}
+}
+
+// gateway returns an error if the gateway is not connected. With grace,
+// disconnections shorter than gatewayGrace are tolerated.
+func (hc *healthChecker) gateway(grace bool) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.connected || (grace && time.Since(hc.changed) < gatewayGrace) {
+		return nil
+	}
+	return fmt.Errorf("gateway disconnected %s", humanizeAge(time.Since(hc.changed)))
+}
+
+// provider lists the provider's models, which needs a valid API key but no
+// tokens. The result is cached for providerCheckEvery.
+func (hc *healthChecker) provider() error {
+	hc.providerMu.Lock()
+	defer hc.providerMu.Unlock()
+	if time.Since(hc.providerTime) < providerCheckEvery {
+		return hc.providerErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, hc.providerErr = hc.client.ListModels(ctx)
+	hc.providerTime = time.Now()
+	return hc.providerErr
+}
+
+func (hc *healthChecker) dataDirWritable() error {
+	f, err := os.CreateTemp(hc.dataDir, ".healthcheck*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(name)
+	return err
+}
+
+func (hc *healthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]error{"gateway": hc.gateway(true)})
+}
+
+func (hc *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]error{
+		"gateway":  hc.gateway(false),
+		"provider": hc.provider(),
+		"data_dir": hc.dataDirWritable(),
+	})
+}
+
+// writeHealth responds 200 when every check passed and 503 otherwise, with
+// the result of each check as JSON.
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	status := http.StatusOK
+	body := make(map[string]string, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			body[name] = err.Error()
+		} else {
+			body[name] = "ok"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
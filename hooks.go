@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// hookReloadInterval is how often the hooks directory is checked for
+	// changed scripts.
+	hookReloadInterval = 2 * time.Second
+	// hookMaxSteps bounds the work of one hook call, so that a runaway loop
+	// cannot stall replies.
+	hookMaxSteps = 10_000_000
+	// hookTimeout bounds the time of one hook call.
+	hookTimeout = 5 * time.Second
+)
+
+// hookScript is one loaded Starlark file.
+type hookScript struct {
+	name    string
+	modTime time.Time
+	globals starlark.StringDict
+	tools   []*toolDef
+}
+
+// hookMessage is what on_message_pre and on_reply_post get to see of the
+// message being answered.
+type hookMessage struct {
+	Content   string
+	UserID    string
+	Username  string
+	GuildID   string
+	ChannelID string
+	DM        bool
+}
+
+// hookResult is what on_message_pre decided.
+type hookResult struct {
+	// Content is the message to answer, possibly rewritten.
+	Content string
+	// Reply, if set, is sent instead of asking the model.
+	Reply string
+	// Drop is set when the message is to be ignored.
+	Drop bool
+}
+
+// hooks runs operator scripts from <data>/hooks/*.star, reloaded when they
+// change. A script may define on_message_pre(msg), on_reply_post(msg,
+// reply) and call tool(...) to add tools. Scripts run in order of their
+// file names.
+type hooks struct {
+	dir string
+
+	mu      sync.RWMutex
+	scripts []*hookScript
+}
+
+func newHooks(dataDir string) *hooks {
+	h := &hooks{dir: filepath.Join(dataDir, "hooks")}
+	h.reload()
+	return h
+}
+
+// run reloads the scripts as they change.
+func (h *hooks) run() {
+	for {
+		time.Sleep(hookReloadInterval)
+		h.reload()
+	}
+}
+
+// reload loads new and changed scripts and drops removed ones. A script
+// that fails to load keeps its previous version.
+func (h *hooks) reload() {
+	paths, err := filepath.Glob(filepath.Join(h.dir, "*.star"))
+	if err != nil {
+		slog.Error("failed to list hooks", "err", err)
+		return
+	}
+	slices.Sort(paths)
+
+	h.mu.RLock()
+	old := make(map[string]*hookScript, len(h.scripts))
+	for _, sc := range h.scripts {
+		old[sc.name] = sc
+	}
+	h.mu.RUnlock()
+
+	var scripts []*hookScript
+	changed := len(paths) != len(old)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		prev := old[name]
+		if prev != nil && prev.modTime.Equal(info.ModTime()) {
+			scripts = append(scripts, prev)
+			continue
+		}
+		changed = true
+		sc, err := loadHookScript(path, info.ModTime())
+		if err != nil {
+			slog.Error("failed to load hook script", "script", name, "err", err)
+			if prev != nil {
+				scripts = append(scripts, prev)
+			}
+			continue
+		}
+		slog.Info("loaded hook script", "script", name, "tools", len(sc.tools))
+		scripts = append(scripts, sc)
+	}
+	if !changed {
+		return
+	}
+	h.mu.Lock()
+	h.scripts = scripts
+	h.mu.Unlock()
+}
+
+func loadHookScript(path string, modTime time.Time) (*hookScript, error) {
+	sc := &hookScript{name: filepath.Base(path), modTime: modTime}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	thread := hookThread(sc.name)
+	tool := starlark.NewBuiltin("tool", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var name, description string
+		var parameters *starlark.Dict
+		var fn starlark.Callable
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "name", &name, "description", &description, "parameters", &parameters, "fn", &fn); err != nil {
+			return nil, err
+		}
+		schema, err := starlark.Call(thread, json.Module.Members["encode"], starlark.Tuple{parameters}, nil)
+		if err != nil {
+			return nil, err
+		}
+		t := &toolDef{
+			name:        name,
+			description: description,
+			parameters:  []byte(schema.(starlark.String).GoString()),
+			fn:          tracedTool(name, hookTool(sc.name, fn)),
+		}
+		t.keywords = append(keywordsOf(snakeCase(name)), keywordsOf(description)...)
+		sc.tools = append(sc.tools, t)
+		return starlark.None, nil
+	})
+	predeclared := starlark.StringDict{
+		"json": json.Module,
+		"tool": tool,
+	}
+	opts := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true}
+	sc.globals, err = starlark.ExecFileOptions(opts, thread, path, src, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	sc.globals.Freeze()
+	return sc, nil
+}
+
+// hookThread returns a thread for one call into script, with print going to
+// the log and a bound on its work.
+func hookThread(script string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: script,
+		Print: func(_ *starlark.Thread, msg string) {
+			slog.Info("hook", "script", script, "msg", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(hookMaxSteps)
+	return thread
+}
+
+// hookCall runs fn on a fresh thread, cancelled when ctx ends.
+func hookCall(ctx context.Context, script string, fn starlark.Value, args ...starlark.Value) (starlark.Value, error) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	thread := hookThread(script)
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+	defer stop()
+	return starlark.Call(thread, fn, args, nil)
+}
+
+// hookTool turns a Starlark function taking the arguments as a dict into a
+// tool. A string result is returned as is, anything else as JSON.
+func hookTool(script string, fn starlark.Callable) func(ctx context.Context, args string) (string, error) {
+	return func(ctx context.Context, args string) (string, error) {
+		if args == "" {
+			args = "{}"
+		}
+		thread := hookThread(script)
+		parsed, err := starlark.Call(thread, json.Module.Members["decode"], starlark.Tuple{starlark.String(args)}, nil)
+		if err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+		out, err := hookCall(ctx, script, fn, parsed)
+		if err != nil {
+			return "", err
+		}
+		if s, ok := out.(starlark.String); ok {
+			return s.GoString(), nil
+		}
+		enc, err := starlark.Call(thread, json.Module.Members["encode"], starlark.Tuple{out}, nil)
+		if err != nil {
+			return "", err
+		}
+		return enc.(starlark.String).GoString(), nil
+	}
+}
+
+func (h *hooks) current() []*hookScript {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.scripts
+}
+
+// tools returns the tools the scripts define.
+func (h *hooks) tools() []*toolDef {
+	var out []*toolDef
+	for _, sc := range h.current() {
+		out = append(out, sc.tools...)
+	}
+	return out
+}
+
+// messagePre runs the on_message_pre hooks over msg. Each gets the content
+// as the previous one left it and returns None to leave it, a string to
+// replace it, False to drop the message, or {"reply": text} to answer it
+// without the model. A failing hook is logged and skipped.
+func (h *hooks) messagePre(ctx context.Context, msg hookMessage) hookResult {
+	res := hookResult{Content: msg.Content}
+	for _, sc := range h.current() {
+		fn, ok := sc.globals["on_message_pre"]
+		if !ok {
+			continue
+		}
+		msg.Content = res.Content
+		out, err := hookCall(ctx, sc.name, fn, msg.value())
+		if err != nil {
+			slog.Error("on_message_pre failed", "script", sc.name, "err", err)
+			continue
+		}
+		switch v := out.(type) {
+		case starlark.NoneType:
+		case starlark.String:
+			res.Content = v.GoString()
+		case starlark.Bool:
+			if !v {
+				res.Drop = true
+				return res
+			}
+		case *starlark.Dict:
+			if r, found, _ := v.Get(starlark.String("reply")); found {
+				if s, ok := starlark.AsString(r); ok {
+					res.Reply = s
+					return res
+				}
+			}
+			slog.Error("on_message_pre returned a dict without a reply string", "script", sc.name)
+		default:
+			slog.Error("on_message_pre returned an unexpected value", "script", sc.name, "type", out.Type())
+		}
+	}
+	return res
+}
+
+// replyPost runs the on_reply_post hooks over reply, each returning None to
+// leave it or a string to replace it.
+func (h *hooks) replyPost(ctx context.Context, msg hookMessage, reply string) string {
+	for _, sc := range h.current() {
+		fn, ok := sc.globals["on_reply_post"]
+		if !ok {
+			continue
+		}
+		out, err := hookCall(ctx, sc.name, fn, msg.value(), starlark.String(reply))
+		if err != nil {
+			slog.Error("on_reply_post failed", "script", sc.name, "err", err)
+			continue
+		}
+		switch v := out.(type) {
+		case starlark.NoneType:
+		case starlark.String:
+			reply = v.GoString()
+		default:
+			slog.Error("on_reply_post returned an unexpected value", "script", sc.name, "type", out.Type())
+		}
+	}
+	return reply
+}
+
+// value renders msg as a Starlark dict.
+func (msg hookMessage) value() *starlark.Dict {
+	d := starlark.NewDict(6)
+	d.SetKey(starlark.String("content"), starlark.String(msg.Content))
+	d.SetKey(starlark.String("user_id"), starlark.String(msg.UserID))
+	d.SetKey(starlark.String("username"), starlark.String(msg.Username))
+	d.SetKey(starlark.String("guild_id"), starlark.String(msg.GuildID))
+	d.SetKey(starlark.String("channel_id"), starlark.String(msg.ChannelID))
+	d.SetKey(starlark.String("dm"), starlark.Bool(msg.DM))
+	return d
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// httpTool proxies the calls of a plugin to its URL.
+type httpTool struct {
+	cfg    pluginConfig
+	client *http.Client
+}
+
+func newHTTPTool(cfg pluginConfig) *httpTool {
+	return &httpTool{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// call posts the call to the endpoint and returns the response body. A
+// status other than 2xx is an error.
+func (t *httpTool) call(ctx context.Context, args string) (string, error) {
+	body, err := newPluginRequest(ctx, t.cfg.Name, args)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion())
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, pluginMaxResult))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned %s: %s", t.cfg.Name, resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	return strings.TrimSpace(string(data)), nil
+}
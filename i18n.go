@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// locale is a language the bot's own messages are available in. Messages
+// are written in English in the code and translated by looking up that
+// text, so a missing translation falls back to English.
+type locale string
+
+const (
+	localeEnglish  locale = "en"
+	localeJapanese locale = "ja"
+)
+
+// defaultLocale is used when neither the user, the guild nor the message
+// tells which locale to use. It is set from -locale.
+var defaultLocale = localeJapanese
+
+// localeNames maps language names, as used by /language and detected by
+// detectLanguage, and locale codes to the locales.
+var localeNames = map[string]locale{
+	"en":       localeEnglish,
+	"english":  localeEnglish,
+	"ja":       localeJapanese,
+	"japanese": localeJapanese,
+	"日本語":      localeJapanese,
+}
+
+// parseLocale returns the locale of a language name or a locale code such
+// as Discord's "en-US", or "" if there is none for it.
+func parseLocale(s string) locale {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if loc, ok := localeNames[s]; ok {
+		return loc
+	}
+	if base, _, ok := strings.Cut(s, "-"); ok {
+		return localeNames[base]
+	}
+	return ""
+}
+
+// pickLocale returns the locale of the first of langs that has one, or
+// defaultLocale.
+func pickLocale(langs ...string) locale {
+	for _, l := range langs {
+		if loc := parseLocale(l); loc != "" {
+			return loc
+		}
+	}
+	return defaultLocale
+}
+
+// languagePrefs returns the reply language the user chose in a guild, or
+// in DMs if guildID is empty, and the guild's. It is set once the session
+// and guild stores are open.
+var languagePrefs = func(guildID, userID string) (user, guild string) { return "", "" }
+
+// interactionLocale returns the locale to answer an interaction in: the
+// user's language, the guild's, or else that of the user's Discord client.
+func interactionLocale(i *discordgo.InteractionCreate) locale {
+	user, guild := languagePrefs(i.GuildID, interactionUserID(i))
+	return pickLocale(user, guild, string(i.Locale))
+}
+
+// tr returns msg in loc, formatted with args if there are any.
+func (loc locale) tr(msg string, args ...any) string {
+	if t, ok := translations[loc][msg]; ok {
+		msg = t
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// translations holds the messages of each locale other than English.
+var translations = map[locale]map[string]string{
+	localeJapanese: {
+		// Replies
+		"An error occurred: %s":        "エラーが発生しました: %s",
+		"(no reply)":                   "(応答なし)",
+		"(The reply was interrupted.)": "(応答は中断されました)",
+		"You have reached today's usage limit. Please try again tomorrow.":                               "本日の利用上限に達しました。また明日お試しください。",
+		"Too many messages are waiting for a reply. Please wait for the previous reply first.":           "返信待ちのメッセージが多すぎます。前の返信が終わってから送ってください。",
+		"I'm busy right now. Please wait a moment and send it again.":                                    "混み合っています。少し待ってからもう一度送ってください。",
+		"Still answering your previous question…":                                                        "まだ前の質問に答えています…",
+		"I stopped because the reply kept repeating itself. Please rephrase the question and try again.": "同じ内容の繰り返しを検出したため応答を中断しました。質問を言い換えてもう一度お試しください。",
+
+		"I can't answer this message because it was flagged by moderation.":     "このメッセージはモデレーションで問題ありと判定されたため、返信できません。",
+		"<@%s>, your message was removed because it was flagged by moderation.": "<@%s> さん、メッセージはモデレーションで問題ありと判定されたため削除されました。",
+		"I can't send the reply because it was flagged by moderation.":          "返信がモデレーションで問題ありと判定されたため、送信できません。",
+		"[removed by moderation]": "[モデレーションにより削除]",
+
+		// Tool approval
+		"The assistant wants to run **%s** with:": "アシスタントが **%s** を次の内容で実行しようとしています:",
+		"Approve":                   "承認",
+		"Deny":                      "拒否",
+		"Not approved in time.":     "時間内に承認されませんでした。",
+		"This request has expired.": "このリクエストは期限切れです。",
+		"Approved by <@%s>.":        "<@%s> さんが承認しました。",
+		"Denied by <@%s>.":          "<@%s> さんが拒否しました。",
+
+		// Resuming conversations
+		"Continue the previous conversation from %s?": "%sの会話を続けますか？",
+		"Resume":                                "再開",
+		"Start fresh":                           "新しく始める",
+		"Resuming the previous conversation.":   "前の会話を再開します。",
+		"Starting a fresh conversation.":        "新しい会話を始めます。",
+		"Only the person who asked can choose.": "選べるのは質問した人だけです。",
+		"This question is no longer open.":      "この質問はもう受け付けていません。",
+
+		// Commands
+		"This command is not available here.":       "このコマンドはここでは使えません。",
+		"This command is for bot admins only.":      "このコマンドはボットの管理者専用です。",
+		"Unknown command: `%s`":                     "不明なコマンドです: `%s`",
+		"Usage: `%s`":                               "使い方: `%s`",
+		"**Commands**":                              "**コマンド**",
+		"alias":                                     "別名",
+		"Show commands":                             "コマンドを表示",
+		"What the bot remembers about you":          "ボットが覚えているあなたのこと",
+		"List memories visible here":                "ここで見える記憶の一覧",
+		"Show one memory":                           "記憶を1件表示",
+		"Forget one memory":                         "記憶を1件忘れる",
+		"Failed to read memory: %s":                 "記憶を読み込めませんでした: %s",
+		"I don't remember anything about you here.": "ここではあなたについて何も覚えていません。",
+		"Nothing is remembered under `%s`.":         "`%s` には何も記憶していません。",
+		"Failed to delete memory: %s":               "記憶を削除できませんでした: %s",
+		"Deleted `%s`.":                             "`%s` を削除しました。",
+		"Your conversation with the bot":            "ボットとの会話",
+		"Show the current conversation settings":    "今の会話の設定を表示",
+		"Messages: %d\nPersona: %s\nLanguage: %s":   "メッセージ数: %d\nペルソナ: %s\n言語: %s",
+		"default": "既定",
+		"auto":    "自動",
+		"Forget the conversation history (settings are kept)":     "会話の履歴を消す (設定は残ります)",
+		"Failed to reset the conversation: %s":                    "会話をリセットできませんでした: %s",
+		"The conversation has been reset.":                        "会話をリセットしました。",
+		"List the topics of past conversations":                   "過去の会話の話題を一覧表示",
+		"Failed to read topics: %s":                               "話題を読み込めませんでした: %s",
+		"No past conversations yet.":                              "過去の会話はまだありません。",
+		"…and %d more":                                            "…ほか %d 件",
+		"Bring a past conversation back into the current one":     "過去の会話を今の会話に呼び戻す",
+		"No past conversation about that. Try `%s`.":              "その話題の過去の会話はありません。`%s` を試してください。",
+		"Failed to recall the conversation: %s":                   "会話を呼び戻せませんでした: %s",
+		"Recalled (%s):\n> %s":                                    "呼び戻しました (%s):\n> %s",
+		"Follow-up DMs about things you told the bot":             "話したことについてのフォローアップDM",
+		"Let the bot DM you to follow up on your plans":           "予定についてボットからDMを送ってもらう",
+		"Stop follow-up DMs":                                      "フォローアップDMを止める",
+		"Failed to save: %s":                                      "保存できませんでした: %s",
+		"Check-ins are off. I won't DM you on my own anymore.":    "チェックインをオフにしました。こちらからDMを送ることはもうありません。",
+		"The model the bot uses":                                  "ボットが使うモデル",
+		"Show the current model":                                  "今のモデルを表示",
+		"Model: `%s`":                                             "モデル: `%s`",
+		"Switch to another model of the same provider":            "同じプロバイダーの別のモデルに切り替える",
+		"Only models of `%s` can be selected at runtime.":         "実行中に選べるのは `%s` のモデルだけです。",
+		"Model set to `%s`.":                                      "モデルを `%s` にしました。",
+		"Show the bot version and whether an update is available": "ボットのバージョンと更新の有無を表示",
+		"Maintenance commands (see `admin help`)":                 "メンテナンス用コマンド (`admin help` を参照)",
+
+		// Slash commands
+		"This command only works in a server.":                       "このコマンドはサーバー内でのみ使えます。",
+		"You need the Manage Server permission to use this command.": "このコマンドを使うにはサーバー管理権限が必要です。",
+		"Give a prompt, or set digest to summarize the channel.":     "プロンプトを指定するか、digest を設定してチャンネルを要約してください。",
+		"Failed to schedule the announcement: %s":                    "お知らせを予約できませんでした: %s",
+		"Scheduled: %s": "予約しました: %s",
+		"This server has no scheduled announcements.":                                       "このサーバーには予約されたお知らせがありません。",
+		"That announcement comes from the bot's config file and can only be removed there.": "そのお知らせはボットの設定ファイルのもので、そこでしか削除できません。",
+		"Failed to remove the announcement: %s":                                             "お知らせを削除できませんでした: %s",
+		"This server has no announcement with ID `%s`.":                                     "このサーバーに ID `%s` のお知らせはありません。",
+		"Removed announcement `%s`.":                                                        "お知らせ `%s` を削除しました。",
+		"Failed to post the announcement: %s":                                               "お知らせを投稿できませんでした: %s",
+		"Posted in <#%s>.":                                                                  "<#%s> に投稿しました。",
+		"I could not read that message.":                                                    "そのメッセージを読み込めませんでした。",
+		"That request expired. Please pick the message again.":                              "リクエストの期限が切れました。もう一度メッセージを選んでください。",
+		"Failed to answer: %s":                                                              "回答できませんでした: %s",
+		"Answered in <#%s>.":                                                                "<#%s> で回答しました。",
+		"This command is restricted to bot admins.":                                         "このコマンドはボットの管理者に限られています。",
+		"Failed to read the audit log: %s":                                                  "監査ログを読み込めませんでした: %s",
+		"No tool calls match.":                                                              "該当するツール呼び出しはありません。",
+		"Check-ins are off. Turn them on with `/checkin on`.":                               "チェックインはオフです。`/checkin on` でオンにできます。",
+		"Check-ins are on. I DM you at most once every %s when something in your memory is worth following up on.": "チェックインはオンです。記憶の中にフォローアップしたいことがあれば、最大で%sに1回DMを送ります。",
+		" Last check-in: %s.": " 前回のチェックイン: %s。",
+		"Use a name of up to 32 letters, digits, dots, dashes and underscores, other than \"previous\".": "名前は \"previous\" 以外で、英数字・ドット・ハイフン・アンダースコアの32文字以内にしてください。",
+		"Failed to save the checkpoint: %s": "チェックポイントを保存できませんでした: %s",
+		"Saved checkpoint **%[1]s**. `/checkpoint restore name:%[1]s` brings the conversation back to this point.": "チェックポイント **%[1]s** を保存しました。`/checkpoint restore name:%[1]s` で会話をこの時点に戻せます。",
+		"There is no checkpoint named %s. `/checkpoint list` shows them.":                                          "%s という名前のチェックポイントはありません。`/checkpoint list` で一覧を表示できます。",
+		"Failed to restore the checkpoint: %s":                                                                     "チェックポイントに戻せませんでした: %s",
+		"Went back to checkpoint **%s** (%d messages).":                                                            "チェックポイント **%s** に戻りました (メッセージ %d 件)。",
+		" The conversation you had is kept as **%s**.":                                                             " それまでの会話は **%s** として残しています。",
+		"There is no checkpoint named %s.":                                                                         "%s という名前のチェックポイントはありません。",
+		"Failed to delete the checkpoint: %s":                                                                      "チェックポイントを削除できませんでした: %s",
+		"Deleted checkpoint **%s**.":                                                                               "チェックポイント **%s** を削除しました。",
+		"This conversation has no checkpoints. `/checkpoint save` creates one.":                                    "この会話にチェックポイントはありません。`/checkpoint save` で作成できます。",
+		"Checkpoints:":                    "チェックポイント:",
+		"- **%s**: %d messages, saved %s": "- **%s**: メッセージ %d 件、%s に保存",
+		"Failed to set up the digest: %s": "ダイジェストを設定できませんでした: %s",
+		"Done. I will post a digest of this channel's messages every day at %s. `/digest off` stops it.": "設定しました。毎日 %s にこのチャンネルのメッセージのダイジェストを投稿します。`/digest off` で止められます。",
+		"This channel has no daily digest.":                           "このチャンネルには毎日のダイジェストがありません。",
+		"Failed to stop the digest: %s":                               "ダイジェストを止められませんでした: %s",
+		"Done. The daily digest of this channel is off.":              "このチャンネルの毎日のダイジェストをオフにしました。",
+		"This channel has no daily digest. `/digest on` sets one up.": "このチャンネルには毎日のダイジェストがありません。`/digest on` で設定できます。",
+		"This channel gets a daily digest%s.":                         "このチャンネルには毎日ダイジェストが投稿されます%s。",
+		"This channel gets a daily digest; the next one is <t:%d:F>.": "このチャンネルには毎日ダイジェストが投稿されます。次回は <t:%d:F> です。",
+		"This event is over or was cancelled.":                        "このイベントは終了したか、中止されました。",
+		"There is no conversation to export here.":                    "ここにはエクスポートする会話がありません。",
+		"Failed to build the export: %s":                              "エクスポートを作成できませんでした: %s",
+		"Failed to subscribe: %s":                                     "購読できませんでした: %s",
+		"Subscribed to **%s** (ID `%s`). New entries will be summarized here; the %d already in the feed are skipped.": "**%s** (ID `%s`) を購読しました。新しい記事はここで要約します。フィードにすでにある %d 件は飛ばします。",
+		"This server has no feed subscriptions.":                                                             "このサーバーはフィードを購読していません。",
+		"Failed to unsubscribe: %s":                                                                          "購読を解除できませんでした: %s",
+		"This server has no feed subscription with ID `%s`.":                                                 "このサーバーに ID `%s` のフィード購読はありません。",
+		"Unsubscribed from feed `%s`.":                                                                       "フィード `%s` の購読を解除しました。",
+		"Failed to store the key: %s":                                                                        "キーを保存できませんでした: %s",
+		"Done. Requests from this server now use its own API key.":                                           "設定しました。このサーバーからのリクエストは専用の API キーを使います。",
+		"Failed to remove the key: %s":                                                                       "キーを削除できませんでした: %s",
+		"Done. Requests from this server use the bot's own API key again.":                                   "設定しました。このサーバーからのリクエストは再びボットの API キーを使います。",
+		"Done. Requests from this server use the key from the bot's config file again.":                      "設定しました。このサーバーからのリクエストは再びボットの設定ファイルのキーを使います。",
+		"This server uses its own API key, set with `/apikey set`.":                                          "このサーバーは `/apikey set` で設定した専用の API キーを使っています。",
+		"This server uses its own API key from the bot's config file.":                                       "このサーバーはボットの設定ファイルにある専用の API キーを使っています。",
+		"This server uses the bot's own API key.":                                                            "このサーバーはボットの API キーを使っています。",
+		"Failed to reload identity: %s":                                                                      "アイデンティティを再読み込みできませんでした: %s",
+		"Identity reloaded (%d bytes).":                                                                      "アイデンティティを再読み込みしました (%d バイト)。",
+		"No identity is loaded.":                                                                             "アイデンティティが読み込まれていません。",
+		"Attach the JSON file from `/export format:json`.":                                                   "`/export format:json` で作成した JSON ファイルを添付してください。",
+		"Failed to read the file: %s":                                                                        "ファイルを読み込めませんでした: %s",
+		"This file cannot be imported: %s":                                                                   "このファイルはインポートできません: %s",
+		"Failed to restore the conversation: %s":                                                             "会話を復元できませんでした: %s",
+		"Restored the conversation (%d messages). Your next message continues it.":                           "会話を復元しました (メッセージ %d 件)。次のメッセージから続きになります。",
+		" The oldest %d messages were left out to fit the limit of %d.":                                      " 上限の %[2]d 件に収めるため、古いメッセージ %[1]d 件は省きました。",
+		"I will reply in the language of each message.":                                                      "メッセージごとにその言語で返信します。",
+		"I will reply in %s.":                                                                                "%s で返信します。",
+		"Changing the server setting requires the Manage Server permission.":                                 "サーバーの設定を変えるにはサーバー管理権限が必要です。",
+		"Failed to save the server setting.":                                                                 "サーバーの設定を保存できませんでした。",
+		"Dual-language replies turned off.":                                                                  "2か国語での返信をオフにしました。",
+		"Replies will include a translation into %s.":                                                        "返信に %s への翻訳を付けます。",
+		"This meeting is over.":                                                                              "このミーティングは終了しました。",
+		"You're included. What you say from now on will be transcribed for the notes.":                       "参加しました。これからの発言は議事録のために文字起こしされます。",
+		"You're left out. Nothing you say will be recorded, and what was recorded of you so far is deleted.": "除外しました。発言は録音されず、これまでに録音された分も削除します。",
+		"Failed to save memory: %s":                                                                          "記憶を保存できませんでした: %s",
+		"Saved as `%s`.":                                                                                     "`%s` として保存しました。",
+		"Really forget everything I remember about you, in every server and DM?":                             "すべてのサーバーとDMで、あなたについて覚えていることを本当にすべて忘れますか？",
+		"Forget everything":                                                                                  "すべて忘れる",
+		"Cancel":                                                                                             "キャンセル",
+		"**Memories** (%d, page %d/%d)":                                                                      "**記憶** (%d 件、%d/%d ページ)",
+		"Failed to clear memory: %s":                                                                         "記憶を消去できませんでした: %s",
+		"Done. I no longer remember anything about you.":                                                     "あなたについての記憶をすべて消去しました。",
+		"Cancelled. Your memories were kept.":                                                                "キャンセルしました。記憶はそのまま残っています。",
+		"Run this in a server where you have the Manage Server permission.":                                  "サーバー管理権限のあるサーバーで実行してください。",
+		"Moderation action set to **%s**.":                                                                   "モデレーションの動作を **%s** にしました。",
+		" Warnings go to <#%s>.":                                                                             " 警告は <#%s> に送ります。",
+		" Add `channel:` to have admins warned about flagged content.":                                       " `channel:` を指定すると、問題ありと判定された内容を管理者に知らせます。",
+		"Failed to read the moderation log: %s":                                                              "モデレーションログを読み込めませんでした: %s",
+		"Nothing has been moderated in this server.":                                                         "このサーバーでモデレーションされたものはありません。",
+		"Really delete your conversation history, settings, memories and usage records? This cannot be undone.": "会話の履歴、設定、記憶、利用記録を本当に削除しますか？元には戻せません。",
+		"Delete my data":                  "データを削除する",
+		"Failed to collect your data: %s": "データを集められませんでした: %s",
+		"I could not open a DM with you. Please allow DMs from server members.": "DMを開けませんでした。サーバーメンバーからのDMを許可してください。",
+		"Here is the data I store about you.":                                   "あなたについて保存しているデータです。",
+		"I could not send you a DM. Please allow DMs from server members.":      "DMを送れませんでした。サーバーメンバーからのDMを許可してください。",
+		"I sent your data to you in a DM.":                                      "データをDMで送りました。",
+		"Failed to delete your data: %s":                                        "データを削除できませんでした: %s",
+		"Done. Everything I stored about you has been deleted.":                 "あなたについて保存していたものをすべて削除しました。",
+		"Cancelled. Nothing was deleted.":                                       "キャンセルしました。何も削除していません。",
+		"This reply can no longer be paged.":                                    "この返信はもうページ送りできません。",
+		"Failed to list personas: %s":                                           "ペルソナの一覧を取得できませんでした: %s",
+		"No personas are available.":                                            "使えるペルソナがありません。",
+		"(default)":                                                             "(既定)",
+		"Available personas: %s\nCurrent: %s":                                   "使えるペルソナ: %s\n現在: %s",
+		"Unknown persona: %s":                                                   "不明なペルソナです: %s",
+		"Persona reset to the default identity.":                                "ペルソナを既定のアイデンティティに戻しました。",
+		"Persona set to %s.":                                                    "ペルソナを %s にしました。",
+		"Changing reactions requires the Manage Server permission.":             "リアクションの設定を変えるにはサーバー管理権限が必要です。",
+		"I'll react to some messages in this channel with the server's emojis.": "このチャンネルのいくつかのメッセージにサーバーの絵文字でリアクションします。",
+		"I won't react to messages in this channel anymore.":                    "このチャンネルのメッセージにはもうリアクションしません。",
+		"You have no pending reminders.":                                        "予定されているリマインダーはありません。",
+		"Failed to cancel the reminder: %s":                                     "リマインダーを取り消せませんでした: %s",
+		"You have no reminder with ID `%s`.":                                    "ID `%s` のリマインダーはありません。",
+		"Cancelled reminder `%s`.":                                              "リマインダー `%s` を取り消しました。",
+		"Your settings:":                                                        "あなたの設定:",
+		"Give at least one setting to change.":                                  "変更する設定を1つ以上指定してください。",
+		"%s must be within %s.":                                                 "%s は %s の範囲で指定してください。",
+		"Failed to save your settings.":                                         "設定を保存できませんでした。",
+		"Temperature":                                                           "Temperature",
+		"Top P":                                                                 "Top P",
+		"Max tokens":                                                            "最大トークン数",
+		"Language":                                                              "言語",
+		"The identity prompt is now sent in this server.":                       "このサーバーでアイデンティティのプロンプトを送るようにしました。",
+		"The identity prompt is no longer sent in this server. Memory and language hints still are.": "このサーバーではアイデンティティのプロンプトを送らないようにしました。記憶と言語のヒントは引き続き送ります。",
+		"I sent you a DM to continue the setup.":                                                     "セットアップの続きをDMで送りました。",
+		"**Setup for %s** — step %d/%d":                                                              "**%s のセットアップ** — ステップ %d/%d",
+		"Skip":                                                                                       "スキップ",
+		"Which channels may the bot answer in? Select none to allow all channels.": "ボットが返信してよいチャンネルはどれですか？何も選ばなければすべてのチャンネルで返信します。",
+		"(No channels found.)": "(チャンネルが見つかりません。)",
+		"All channels":         "すべてのチャンネル",
+		"Which persona should members get by default?": "メンバーに既定で使うペルソナはどれですか？",
+		"Default identity": "既定のアイデンティティ",
+		"Which language should the bot reply in by default?": "ボットが既定で返信する言語はどれですか？",
+		"Auto-detect": "自動検出",
+		"Which tools may the bot use? Unselected tools are disabled.": "ボットが使ってよいツールはどれですか？選ばなかったツールは無効になります。",
+		"How many messages may each member send per day?":             "各メンバーは1日に何件までメッセージを送れますか？",
+		"Unlimited":                      "無制限",
+		"Review and save:":               "確認して保存してください:",
+		"Save":                           "保存",
+		"Choose…":                        "選択…",
+		"all":                            "すべて",
+		"default identity":               "既定のアイデンティティ",
+		"auto-detect":                    "自動検出",
+		"none":                           "なし",
+		"unlimited":                      "無制限",
+		"%d messages per member per day": "メンバーごとに1日 %d 件",
+		"- Channels: %s\n- Persona: %s\n- Language: %s\n- Disabled tools: %s\n- Quota: %s": "- チャンネル: %s\n- ペルソナ: %s\n- 言語: %s\n- 無効なツール: %s\n- 上限: %s",
+		"This setup session has expired. Run `/yagi setup` again.":                         "このセットアップは期限切れです。もう一度 `/yagi setup` を実行してください。",
+		"Setup cancelled. Nothing was changed.":                                            "セットアップをキャンセルしました。何も変更していません。",
+		"Failed to save the configuration: %s":                                             "設定を保存できませんでした: %s",
+		"Configuration saved for %s:":                                                      "%s の設定を保存しました:",
+		"I could not read the messages in this channel.":                                   "このチャンネルのメッセージを読み込めませんでした。",
+		"Failed to summarize: %s":                                                          "要約できませんでした: %s",
+		"You need the Read Message History permission in this channel.":                    "このチャンネルのメッセージ履歴を読む権限が必要です。",
+		"I need the View Channel and Read Message History permissions in this channel.":    "このチャンネルを見る権限とメッセージ履歴を読む権限がボットに必要です。",
+		"-# Summary of %d messages":                                                        "-# %d 件のメッセージの要約",
+		"No tool matches `%s`. `/tools list` shows them.":                                  "`%s` に一致するツールはありません。`/tools list` で一覧を表示できます。",
+		"in this server":                "このサーバーで",
+		"in <#%s>":                      "<#%s> で",
+		"`%s` is no longer offered %s.": "`%s` は%sは使われなくなりました。",
+		"`%s` is offered %s again, unless a server-wide setting or the operator disables it.": "`%s` は%s再び使われます。ただし、サーバー全体の設定や運用者が無効にしている場合を除きます。",
+		"Tools:":                 "ツール:",
+		"the whole server":       "サーバー全体",
+		"- `%s`: disabled in %s": "- `%s`: %s で無効",
+		"Your stored conversations with the bot, with IDs, emails and phone numbers removed, may be exported by the operator to fine-tune its persona. Turn this off with `/training off`; exports made before that are not recalled.": "ボットとの保存された会話は、ID・メールアドレス・電話番号を除いたうえで、ペルソナのファインチューニングのために運用者がエクスポートすることがあります。`/training off` でオフにできます。それ以前のエクスポートは取り消されません。",
+		"Your conversations are not used for fine-tuning. Turn this on with `/training on`.": "あなたの会話はファインチューニングに使われません。`/training on` でオンにできます。",
+		"Changing translation requires the Manage Server permission.":                        "翻訳の設定を変えるにはサーバー管理権限が必要です。",
+		"Name the language to translate into.":                                               "翻訳先の言語を指定してください。",
+		"I'll reply to every message in this channel with a translation into %s.":            "このチャンネルのすべてのメッセージに %s への翻訳を返信します。",
+		"I won't translate messages in this channel anymore.":                                "このチャンネルのメッセージはもう翻訳しません。",
+	},
+}
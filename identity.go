@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// identity holds the system prompt loaded from IDENTITY.md and reloads it
+// when the file changes.
+type identity struct {
+	mu      sync.RWMutex
+	path    string
+	prompt  string
+	modTime time.Time
+}
+
+func newIdentity(path string) *identity {
+	id := &identity{path: path}
+	if err := id.reload(); err != nil {
+		slog.Warn("failed to read identity file", "path", path, "err", err)
+	}
+	return id
+}
+
+func (id *identity) get() string {
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return id.prompt
+}
+
+// reload re-reads the identity file. A missing file clears the prompt.
+func (id *identity) reload() error {
+	info, err := os.Stat(id.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			id.mu.Lock()
+			id.prompt = ""
+			id.modTime = time.Time{}
+			id.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	data, err := os.ReadFile(id.path)
+	if err != nil {
+		return err
+	}
+
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.prompt = string(data)
+	id.modTime = info.ModTime()
+	return nil
+}
+
+// changed reports whether the file on disk differs from the loaded one.
+func (id *identity) changed() bool {
+	var modTime time.Time
+	if info, err := os.Stat(id.path); err == nil {
+		modTime = info.ModTime()
+	}
+	id.mu.RLock()
+	defer id.mu.RUnlock()
+	return !modTime.Equal(id.modTime)
+}
+
+// watch polls the identity file and reloads it whenever it changes.
+func (id *identity) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !id.changed() {
+			continue
+		}
+		if err := id.reload(); err != nil {
+			slog.Error("failed to reload identity", "err", err)
+			continue
+		}
+		slog.Info("identity reloaded", "path", id.path)
+	}
+}
+
+func identityCommand(id *identity, admin *adminCommands) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "identity",
+			Description: "Manage the bot identity (admin only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reload",
+					Description: "Reload the identity file from disk",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show the current system prompt",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			if !admin.isAdmin(interactionUserID(i)) {
+				respondEphemeral(s, i, loc.tr("This command is restricted to bot admins."))
+				return
+			}
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			switch opts[0].Name {
+			case "reload":
+				if err := id.reload(); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to reload identity: %s", err))
+					return
+				}
+				slog.Info("identity reloaded", "path", id.path)
+				respondEphemeral(s, i, loc.tr("Identity reloaded (%d bytes).", len(id.get())))
+			case "show":
+				prompt := id.get()
+				if prompt == "" {
+					respondEphemeral(s, i, loc.tr("No identity is loaded."))
+					return
+				}
+				if len(prompt) <= 1900 {
+					respondEphemeral(s, i, "```markdown\n"+prompt+"\n```")
+					return
+				}
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Flags: discordgo.MessageFlagsEphemeral,
+						Files: []*discordgo.File{{
+							Name:        "IDENTITY.md",
+							ContentType: "text/markdown",
+							Reader:      strings.NewReader(prompt),
+						}},
+					},
+				})
+				if err != nil {
+					slog.Error("failed to respond to interaction", "err", err)
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// importMaxSize bounds the size of a file given to /import.
+const importMaxSize = 4 << 20
+
+// conversationImporter restores conversations exported with /export as the
+// JSON format.
+type conversationImporter struct {
+	store    *sessionStore
+	personas *personaStore
+	client   *http.Client
+}
+
+func newConversationImporter(store *sessionStore, personas *personaStore) *conversationImporter {
+	return &conversationImporter{store: store, personas: personas, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// parseConversation reads an export and returns its messages, checked and
+// cut to the session limit, with how many were dropped to fit it.
+func parseConversation(data []byte) (*conversationExport, []openai.ChatCompletionMessage, int, error) {
+	var ex conversationExport
+	if err := json.Unmarshal(data, &ex); err != nil {
+		return nil, nil, 0, fmt.Errorf("not a JSON conversation export: %w", err)
+	}
+	msgs := make([]openai.ChatCompletionMessage, 0, len(ex.Messages))
+	for n, m := range ex.Messages {
+		if m.Role != openai.ChatMessageRoleUser && m.Role != openai.ChatMessageRoleAssistant {
+			return nil, nil, 0, fmt.Errorf("message %d: role %q is not user or assistant", n+1, m.Role)
+		}
+		if strings.TrimSpace(m.Content) == "" {
+			if m.Images > 0 {
+				// Only the images' count is exported, not the images.
+				continue
+			}
+			return nil, nil, 0, fmt.Errorf("message %d: no content", n+1)
+		}
+		msgs = append(msgs, openai.ChatCompletionMessage{Role: m.Role, Content: m.Content})
+	}
+	kept := truncateMessages(msgs, maxSessionMessages)
+	if len(kept) == 0 {
+		return nil, nil, 0, fmt.Errorf("no messages to restore")
+	}
+	return &ex, kept, len(msgs) - len(kept), nil
+}
+
+// restore replaces the conversation of key with the messages of ex. The
+// previous conversation ends as with a reset.
+func (ci *conversationImporter) restore(key string, ex *conversationExport, msgs []openai.ChatCompletionMessage) error {
+	sess := ci.store.get(key)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	ci.store.reset(key, sess)
+	sess.messages = msgs
+	sess.started = time.Now()
+	if t, err := time.Parse(time.RFC3339, ex.StartedAt); err == nil {
+		sess.started = t
+	}
+	if ex.Persona != "" {
+		if _, err := ci.personas.load(ex.Persona); err == nil {
+			sess.persona = ex.Persona
+		}
+	}
+	return ci.store.save(key, sess)
+}
+
+// download fetches the attachment a, refusing files over importMaxSize.
+func (ci *conversationImporter) download(ctx context.Context, a *discordgo.MessageAttachment) ([]byte, error) {
+	if a.Size > importMaxSize {
+		return nil, fmt.Errorf("the file is larger than %d MB", importMaxSize>>20)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ci.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, importMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > importMaxSize {
+		return nil, fmt.Errorf("the file is larger than %d MB", importMaxSize>>20)
+	}
+	return data, nil
+}
+
+// command returns /import, which restores a JSON file from /export as the
+// user's conversation in the guild or DM it is used in.
+func (ci *conversationImporter) command() *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "import",
+			Description: "Restore a conversation exported with /export (JSON) as your current one",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionAttachment,
+					Name:        "file",
+					Description: "The JSON file from /export format:json",
+					Required:    true,
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			data := i.ApplicationCommandData()
+			var att *discordgo.MessageAttachment
+			for _, o := range data.Options {
+				if o.Name == "file" && data.Resolved != nil {
+					id, _ := o.Value.(string)
+					att = data.Resolved.Attachments[id]
+				}
+			}
+			if att == nil {
+				respondEphemeral(s, i, loc.tr("Attach the JSON file from `/export format:json`."))
+				return
+			}
+			userID := interactionUserID(i)
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+			})
+			if err != nil {
+				slog.Error("failed to respond to interaction", "err", err)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			body, err := ci.download(ctx, att)
+			if err != nil {
+				followup(s, i, loc.tr("Failed to read the file: %s", err))
+				return
+			}
+			ex, msgs, dropped, err := parseConversation(body)
+			if err != nil {
+				followup(s, i, loc.tr("This file cannot be imported: %s", err))
+				return
+			}
+			key := scopedKey(i.GuildID, userID)
+			if err := ci.restore(key, ex, msgs); err != nil {
+				slog.Error("failed to restore conversation", "session", hashID(key), "err", err)
+				followup(s, i, loc.tr("Failed to restore the conversation: %s", err))
+				return
+			}
+			slog.Info("restored conversation", "session", hashID(key), "messages", len(msgs), "dropped", dropped)
+			msg := loc.tr("Restored the conversation (%d messages). Your next message continues it.", len(msgs))
+			if dropped > 0 {
+				msg += loc.tr(" The oldest %d messages were left out to fit the limit of %d.", dropped, maxSessionMessages)
+			}
+			followup(s, i, msg)
+		},
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keyAuthBench is how long a key refused with 401 or 403 is left out.
+	keyAuthBench = time.Hour
+	// keyLimitBench is how long a key refused with 429 is left out when the
+	// provider does not say.
+	keyLimitBench = time.Minute
+)
+
+// poolKey is one API key and how it is being used.
+type poolKey struct {
+	key string
+	// inFlight counts requests whose response body is still open.
+	inFlight int
+	uses     int64
+	benched  time.Time
+}
+
+// apiKeyPool spreads provider requests over several API keys of the same
+// provider, round-robin or to the key with the fewest requests in flight.
+// A key the provider refuses is benched for a while and the request is
+// retried with another key.
+type apiKeyPool struct {
+	base      http.RoundTripper
+	leastUsed bool
+
+	mu   sync.Mutex
+	keys []*poolKey
+	next int
+}
+
+// splitKeys splits a comma-separated list of API keys.
+func splitKeys(s string) []string {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func newAPIKeyPool(base http.RoundTripper, keys []string, strategy string) *apiKeyPool {
+	p := &apiKeyPool{base: base, leastUsed: strategy == "least-used"}
+	for _, k := range keys {
+		p.keys = append(p.keys, &poolKey{key: k})
+	}
+	return p
+}
+
+// pick returns the key for the next request, skipping the ones in tried.
+// When every other key is benched, it returns the one whose bench ends
+// first. It returns nil when all keys were tried.
+func (p *apiKeyPool) pick(tried map[*poolKey]bool) *poolKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var best, soonest *poolKey
+	bestAt, soonestAt := 0, 0
+	for i := range p.keys {
+		at := (p.next + i) % len(p.keys)
+		k := p.keys[at]
+		if tried[k] {
+			continue
+		}
+		if now.Before(k.benched) {
+			if soonest == nil || k.benched.Before(soonest.benched) {
+				soonest, soonestAt = k, at
+			}
+			continue
+		}
+		if best == nil {
+			best, bestAt = k, at
+			if !p.leastUsed {
+				break
+			}
+		} else if k.inFlight < best.inFlight || k.inFlight == best.inFlight && k.uses < best.uses {
+			best, bestAt = k, at
+		}
+	}
+	if best == nil {
+		best, bestAt = soonest, soonestAt
+	}
+	if best == nil {
+		return nil
+	}
+	p.next = bestAt + 1
+	best.inFlight++
+	best.uses++
+	return best
+}
+
+func (p *apiKeyPool) release(k *poolKey) {
+	p.mu.Lock()
+	k.inFlight--
+	p.mu.Unlock()
+}
+
+func (p *apiKeyPool) bench(k *poolKey, d time.Duration, status int) {
+	p.mu.Lock()
+	k.benched = time.Now().Add(d)
+	p.mu.Unlock()
+	slog.Warn("API key refused; benching it", "key", hashID(k.key), "status", status, "for", d)
+}
+
+func (p *apiKeyPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*poolKey]bool)
+	for {
+		k := p.pick(tried)
+		if k == nil {
+			return nil, errors.New("no API key left to try")
+		}
+		tried[k] = true
+		r := req.Clone(req.Context())
+		r.Header.Set("Authorization", "Bearer "+k.key)
+		if len(tried) > 1 {
+			body, err := req.GetBody()
+			if err != nil {
+				p.release(k)
+				return nil, err
+			}
+			r.Body = body
+		}
+		resp, err := p.base.RoundTrip(r)
+		if err != nil {
+			p.release(k)
+			return nil, err
+		}
+
+		var bench time.Duration
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			bench = keyAuthBench
+		case http.StatusTooManyRequests:
+			bench = parseRetryAfter(resp.Header.Get("Retry-After"))
+			if bench <= 0 {
+				bench = keyLimitBench
+			}
+		}
+		if bench > 0 {
+			p.bench(k, bench, resp.StatusCode)
+			if len(tried) < len(p.keys) && req.GetBody != nil {
+				resp.Body.Close()
+				p.release(k)
+				continue
+			}
+		}
+		resp.Body = &keyBody{ReadCloser: resp.Body, release: func() { p.release(k) }}
+		return resp, nil
+	}
+}
+
+// keyBody releases its key when the response body is closed, so that
+// streamed replies count as in flight until they end.
+type keyBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *keyBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// latinStopwords maps a few very common words to the Latin-script language
+// they most likely belong to.
+var latinStopwords = map[string][]string{
+	"English":    {"the", "and", "is", "are", "you", "what", "how", "this", "that", "with", "can", "please"},
+	"Spanish":    {"el", "la", "los", "que", "es", "por", "para", "con", "una", "cómo", "qué", "gracias"},
+	"French":     {"le", "les", "est", "et", "une", "des", "pour", "avec", "que", "comment", "je", "vous"},
+	"German":     {"der", "die", "das", "und", "ist", "nicht", "ich", "sie", "mit", "wie", "was", "bitte"},
+	"Portuguese": {"o", "os", "não", "é", "uma", "para", "com", "que", "você", "como", "obrigado", "isso"},
+	"Italian":    {"il", "lo", "gli", "è", "che", "non", "una", "per", "con", "come", "sono", "grazie"},
+}
+
+// detectLanguage guesses the language of text from its Unicode scripts and,
+// for Latin script, from common stopwords. It returns "" when unsure.
+func detectLanguage(text string) string {
+	var kana, han, hangul, cyrillic, arabic, thai, hebrew, greek, devanagari, latin int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Arabic, r):
+			arabic++
+		case unicode.Is(unicode.Thai, r):
+			thai++
+		case unicode.Is(unicode.Hebrew, r):
+			hebrew++
+		case unicode.Is(unicode.Greek, r):
+			greek++
+		case unicode.Is(unicode.Devanagari, r):
+			devanagari++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	switch {
+	case kana > 0:
+		return "Japanese"
+	case hangul > 0:
+		return "Korean"
+	case han > 0:
+		return "Chinese"
+	}
+	scripts := []struct {
+		name  string
+		count int
+	}{
+		{"Russian", cyrillic},
+		{"Arabic", arabic},
+		{"Thai", thai},
+		{"Hebrew", hebrew},
+		{"Greek", greek},
+		{"Hindi", devanagari},
+	}
+	for _, sc := range scripts {
+		if sc.count > latin {
+			return sc.name
+		}
+	}
+	if latin == 0 {
+		return ""
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	best, bestScore := "", 0
+	for lang, stopwords := range latinStopwords {
+		score := 0
+		for _, w := range words {
+			for _, sw := range stopwords {
+				if w == sw {
+					score++
+				}
+			}
+		}
+		if score > bestScore || (score == bestScore && score > 0 && lang < best) {
+			best, bestScore = lang, score
+		}
+	}
+	return best
+}
+
+// languageHint returns a system prompt section telling the model which
+// language to answer in, or "" if lang is empty.
+func languageHint(lang string) string {
+	if lang == "" {
+		return ""
+	}
+	return "\n---\nReply in " + lang + " unless the user explicitly asks for another language.\n"
+}
+
+func languageCommand(store *sessionStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "language",
+			Description: "Set the language the bot replies in",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Always reply in this language",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "language",
+							Description: "Language name, e.g. English or 日本語",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "auto",
+					Description: "Reply in the language of each message",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			lang := ""
+			if opts[0].Name == "set" {
+				lang = strings.TrimSpace(opts[0].Options[0].StringValue())
+			}
+
+			userID := interactionUserID(i)
+			key := scopedKey(i.GuildID, userID)
+			sess := store.get(key)
+			sess.mu.Lock()
+			sess.language = lang
+			err := store.save(key, sess)
+			sess.mu.Unlock()
+			if err != nil {
+				slog.Error("failed to save session", "user", hashID(userID), "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to save your settings."))
+				return
+			}
+
+			if lang == "" {
+				respondEphemeral(s, i, loc.tr("I will reply in the language of each message."))
+			} else {
+				respondEphemeral(s, i, loc.tr("I will reply in %s.", lang))
+			}
+		},
+	}
+}
+
+// dualLanguageHint asks the model to follow its answer with a translation
+// into second. It returns "" if second is empty.
+func dualLanguageHint(second string) string {
+	if second == "" {
+		return ""
+	}
+	return "\n---\nAfter your answer, add a line containing only \"---\" followed by a full translation of the answer into " + second +
+		". If the answer is already in " + second + ", translate it into the user's language instead. Keep code blocks unchanged in the translation.\n"
+}
+
+func dualCommand(store *sessionStore, guilds *guildStore) *slashCommand {
+	scopeOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "scope",
+		Description: "Apply to yourself or the whole server (default: yourself)",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "me", Value: "user"},
+			{Name: "server", Value: "guild"},
+		},
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "dual",
+			Description: "Reply in two languages at once",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Add a translation into this language to every reply",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "language",
+							Description: "Second language, e.g. English",
+							Required:    true,
+						},
+						scopeOption,
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Reply in a single language",
+					Options:     []*discordgo.ApplicationCommandOption{scopeOption},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			lang, scope := "", "user"
+			for _, o := range opts[0].Options {
+				switch o.Name {
+				case "language":
+					lang = strings.TrimSpace(o.StringValue())
+				case "scope":
+					scope = o.StringValue()
+				}
+			}
+
+			if scope == "guild" {
+				if i.GuildID == "" || !canManageGuild(i) {
+					respondEphemeral(s, i, loc.tr("Changing the server setting requires the Manage Server permission."))
+					return
+				}
+				if err := guilds.update(i.GuildID, func(cfg *guildConfig) { cfg.DualLanguage = lang }); err != nil {
+					slog.Error("failed to save guild config", "guild", i.GuildID, "err", err)
+					respondEphemeral(s, i, loc.tr("Failed to save the server setting."))
+					return
+				}
+			} else {
+				userID := interactionUserID(i)
+				key := scopedKey(i.GuildID, userID)
+				sess := store.get(key)
+				sess.mu.Lock()
+				sess.dualLanguage = lang
+				err := store.save(key, sess)
+				sess.mu.Unlock()
+				if err != nil {
+					slog.Error("failed to save session", "user", hashID(userID), "err", err)
+					respondEphemeral(s, i, loc.tr("Failed to save your settings."))
+					return
+				}
+			}
+
+			if lang == "" {
+				respondEphemeral(s, i, loc.tr("Dual-language replies turned off."))
+			} else {
+				respondEphemeral(s, i, loc.tr("Replies will include a translation into %s.", lang))
+			}
+		},
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const ctxKeyTokenUsage contextKey = "tokenUsage"
+
+// setupLogging makes slog write to stderr at level ("debug", "info", "warn"
+// or "error") in format ("text" or "json"). Output of the log package goes
+// through the same handler.
+func setupLogging(level, format string) error {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level: %s (use debug, info, warn or error)", level)
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format: %s (use text or json)", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// newRequestID returns a random ID that ties together the log lines of one
+// handled message.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// hashID returns a short hash of a Discord user ID, so that log lines of one
+// user can be correlated without recording who they are.
+func hashID(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%x", h[:4])
+}
+
+// tokenUsage adds up the token counts of the provider calls made for one
+// message, tool loop rounds included.
+type tokenUsage struct {
+	mu         sync.Mutex
+	prompt     int
+	completion int
+	reported   bool
+}
+
+func (u *tokenUsage) add(prompt, completion int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.prompt += prompt
+	u.completion += completion
+	u.reported = true
+}
+
+// counts returns the reported totals. If the provider reported none, they
+// are estimated at four characters per token from the conversation and the
+// reply.
+func (u *tokenUsage) counts(msgs []openai.ChatCompletionMessage, reply string) (prompt, completion int, estimated bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.reported {
+		return u.prompt, u.completion, false
+	}
+	chars := 0
+	for _, m := range msgs {
+		chars += utf8.RuneCountInString(m.Content)
+	}
+	return chars / 4, utf8.RuneCountInString(reply) / 4, true
+}
+
+// usageTransport reads the usage field that providers include in chat
+// completion responses and adds it to the tokenUsage in the request context.
+// Requests without one pass through untouched.
+type usageTransport struct {
+	base http.RoundTripper
+}
+
+func (t *usageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	u, _ := req.Context().Value(ctxKeyTokenUsage).(*tokenUsage)
+	if err != nil || u == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return resp, err
+	}
+	resp.Body = &usageBody{ReadCloser: resp.Body, usage: u}
+	return resp, nil
+}
+
+// usageBody scans a streamed or plain response body for usage as it is
+// read.
+type usageBody struct {
+	io.ReadCloser
+	usage *tokenUsage
+	buf   bytes.Buffer
+	once  sync.Once
+}
+
+func (b *usageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *usageBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.parse)
+	return err
+}
+
+func (b *usageBody) parse() {
+	var whole struct {
+		Usage *openai.Usage `json:"usage"`
+	}
+	if json.Unmarshal(b.buf.Bytes(), &whole) == nil {
+		if whole.Usage != nil {
+			b.usage.add(whole.Usage.PromptTokens, whole.Usage.CompletionTokens)
+		}
+		return
+	}
+	// A stream repeats or ends with usage; the last one is the total.
+	var last *openai.Usage
+	sc := bufio.NewScanner(&b.buf)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimPrefix(strings.TrimSpace(sc.Text()), "data:")
+		var chunk struct {
+			Usage *openai.Usage `json:"usage"`
+		}
+		if json.Unmarshal([]byte(strings.TrimSpace(line)), &chunk) == nil && chunk.Usage != nil {
+			last = chunk.Usage
+		}
+	}
+	if last != nil {
+		b.usage.add(last.PromptTokens, last.CompletionTokens)
+	}
+}
+
+// withTokenUsage returns a context whose provider calls are counted in u.
+func withTokenUsage(ctx context.Context, u *tokenUsage) context.Context {
+	return context.WithValue(ctx, ctxKeyTokenUsage, u)
+}
@@ -2,50 +2,109 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yagi-agent/yagi-discord-bot/storage"
 	"github.com/yagi-agent/yagi/engine"
 	"github.com/yagi-agent/yagi/provider"
 )
 
 type contextKey string
 
-const ctxKeyUserID contextKey = "userID"
+const (
+	ctxKeyUserID      contextKey = "userID"
+	ctxKeyMemoryScope contextKey = "memoryScope"
+	ctxKeySessionKey  contextKey = "sessionKey"
+	// ctxKeyGuildID selects the guild's own API key, if it has one.
+	ctxKeyGuildID contextKey = "guildID"
+)
 
 const (
 	maxSessionMessages = 100
 	sessionExpiry      = 30 * time.Minute
+	// sessionFlushInterval is how often sessions with unsaved changes are
+	// written out, in case saving after a reply failed.
+	sessionFlushInterval = time.Minute
 )
 
 type userSession struct {
-	mu       sync.Mutex
-	messages []openai.ChatCompletionMessage
-	lastUsed time.Time
+	mu           sync.Mutex
+	messages     []openai.ChatCompletionMessage
+	persona      string
+	language     string
+	dualLanguage string
+	// generation holds the user's sampling parameters, if any.
+	generation *storage.GenerationSettings
+	lastUsed   time.Time
+	// staleSince is set when an expired conversation was reloaded from
+	// disk and the user has not yet chosen to resume it.
+	staleSince time.Time
+	// started is when the current conversation began.
+	started time.Time
+	// dirty is set while changes to the session have not been saved.
+	dirty bool
+	// epoch changes whenever the conversation is reset or removed, so that
+	// a reply generated for the old one is not stored in the new one.
+	epoch int
+	// turns links the exchanges to their Discord messages.
+	turns []storage.TurnRef
+	// removed holds the hashes of exchanges deleted while a reply may be
+	// in progress, to be removed again from what it stores.
+	removed []string
+	// replyBase is the length of the conversation the reply in progress
+	// started from; the messages after it were added meanwhile.
+	replyBase int
+	// inProgress holds the finished tool calls of the reply being
+	// generated, saved with the conversation until the reply is stored.
+	inProgress []openai.ChatCompletionMessage
+	// checkpoints are the saved copies of the conversation; they outlast
+	// resets.
+	checkpoints []storage.Checkpoint
 }
 
 type sessionStore struct {
 	mu       sync.Mutex
 	sessions map[string]*userSession
 	dataDir  string
+	persist  storage.SessionStore
+	clock    Clock
+	// onEnd, if set, is called in its own goroutine with a copy of each
+	// conversation that expires or is reset.
+	onEnd func(key string, started time.Time, msgs []openai.ChatCompletionMessage)
+	// ending tracks the running onEnd calls.
+	ending workTracker
+
+	turnsMu sync.Mutex
+	// byMessage maps Discord message IDs to the session key of the
+	// conversation they belong to.
+	byMessage map[string]string
 }
 
-func newSessionStore(dataDir string) *sessionStore {
+func newSessionStore(dataDir string, persist storage.SessionStore) *sessionStore {
 	return &sessionStore{
 		sessions: make(map[string]*userSession),
 		dataDir:  dataDir,
+		persist:  persist,
+		clock:    systemClock{},
 	}
 }
 
@@ -56,88 +115,265 @@ func (s *sessionStore) get(userID string) *userSession {
 	sess, ok := s.sessions[userID]
 	if !ok {
 		sess = &userSession{}
-		msgs, err := loadSession(s.dataDir, userID)
+		sd, err := s.persist.Load(userID)
 		if err != nil {
-			log.Printf("failed to load session for %s: %v", userID, err)
-		} else {
-			sess.messages = msgs
+			slog.Error("failed to load session", "session", hashID(userID), "err", err)
+		} else if sd != nil {
+			sess.messages = sd.Messages
+			if len(sd.InProgress) > 0 {
+				slog.Info("recovered interrupted reply", "session", hashID(userID), "messages", len(sd.InProgress))
+				sess.messages = recoverInterrupted(sess.messages, sd.InProgress, pickLocale(sd.Language))
+				sess.dirty = true
+			}
+			sess.persona = sd.Persona
+			sess.language = sd.Language
+			sess.dualLanguage = sd.DualLanguage
+			sess.generation = sd.Generation
+			sess.turns = sd.Turns
+			sess.checkpoints = sd.Checkpoints
+			for _, t := range sd.Turns {
+				s.indexTurn(userID, t)
+			}
+			sess.started, _ = time.Parse(time.RFC3339, sd.StartedAt)
+			if updated, err := time.Parse(time.RFC3339, sd.UpdatedAt); err == nil && len(sd.Messages) > 0 && s.clock.Now().Sub(updated) > sessionExpiry {
+				sess.staleSince = updated
+			}
 		}
 		s.sessions[userID] = sess
 	}
-	sess.lastUsed = time.Now()
+	sess.lastUsed = s.clock.Now()
 	return sess
 }
 
+// preferences are the settings a user chose with /persona, /language,
+// /dual and /settings. They live in the user's own session, while a
+// conversation in a thread or forum post is kept under the channel.
+type preferences struct {
+	persona      string
+	language     string
+	dualLanguage string
+	generation   *storage.GenerationSettings
+}
+
+// preferences returns the settings stored in the session of userKey.
+func (s *sessionStore) preferences(userKey string) preferences {
+	sess := s.get(userKey)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return preferences{
+		persona:      sess.persona,
+		language:     sess.language,
+		dualLanguage: sess.dualLanguage,
+		generation:   sess.generation,
+	}
+}
+
+// gc drops sessions that have been idle for sessionExpiry from memory. Each
+// is saved first if it has unsaved changes; one that cannot be saved stays
+// in memory until a later run. A session stays in the map while it is saved,
+// so that a concurrent get does not load an older copy from storage.
 func (s *sessionStore) gc() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	now := time.Now()
+	now := s.clock.Now()
+	expired := make(map[string]*userSession)
 	for id, sess := range s.sessions {
 		if now.Sub(sess.lastUsed) > sessionExpiry {
+			expired[id] = sess
+		}
+	}
+	s.mu.Unlock()
+
+	for id, sess := range expired {
+		sess.mu.Lock()
+		if sess.dirty {
+			if err := s.save(id, sess); err != nil {
+				slog.Error("failed to save idle session; keeping it in memory", "session", hashID(id), "err", err)
+				sess.mu.Unlock()
+				continue
+			}
+		}
+		sess.mu.Unlock()
+
+		s.mu.Lock()
+		// The session may have been picked up again while it was saved.
+		evict := s.sessions[id] == sess && s.clock.Now().Sub(sess.lastUsed) > sessionExpiry
+		if evict {
 			delete(s.sessions, id)
 		}
+		s.mu.Unlock()
+		if evict {
+			sess.mu.Lock()
+			s.ended(id, sess)
+			sess.mu.Unlock()
+		}
+	}
+}
+
+// ended reports the conversation in sess to onEnd. The caller must hold
+// sess.mu.
+func (s *sessionStore) ended(key string, sess *userSession) {
+	if s.onEnd != nil && len(sess.messages) > 0 && s.ending.begin() {
+		started, msgs := sess.started, slices.Clone(sess.messages)
+		go func() {
+			defer s.ending.end()
+			s.onEnd(key, started, msgs)
+		}()
 	}
 }
 
-func sessionFilePath(dataDir, userID string) string {
-	h := sha256.Sum256([]byte(userID))
-	name := fmt.Sprintf("%x.json", h[:16])
-	return filepath.Join(dataDir, "sessions", name)
+// reset ends the conversation in sess and clears its history, keeping the
+// settings. The caller must hold sess.mu.
+func (s *sessionStore) reset(key string, sess *userSession) {
+	s.ended(key, sess)
+	sess.messages, sess.inProgress = nil, nil
+	sess.started = time.Time{}
+	sess.staleSince = time.Time{}
+	sess.dirty = true
+	sess.epoch++
 }
 
-type sessionData struct {
-	UserID    string                         `json:"user_id"`
-	UpdatedAt string                         `json:"updated_at"`
-	Messages  []openai.ChatCompletionMessage `json:"messages"`
+// remove deletes the session of userID from memory and disk.
+func (s *sessionStore) remove(userID string) error {
+	sess := s.get(userID)
+	sess.mu.Lock()
+	sess.messages, sess.inProgress, sess.checkpoints = nil, nil, nil
+	sess.persona, sess.language, sess.dualLanguage, sess.generation = "", "", "", nil
+	sess.staleSince, sess.started = time.Time{}, time.Time{}
+	sess.epoch++
+	err := s.save(userID, sess)
+	sess.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.sessions, userID)
+	s.mu.Unlock()
+	return err
 }
 
-func saveSession(dataDir, userID string, messages []openai.ChatCompletionMessage) error {
-	dir := filepath.Join(dataDir, "sessions")
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
+// purge removes persisted sessions that have not been updated since cutoff.
+// In-memory copies are evicted as well so they are not written back. When
+// dryRun is true nothing is deleted and only the matching user IDs are
+// returned.
+func (s *sessionStore) purge(cutoff time.Time, dryRun bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.persist.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, sd := range all {
+		updated, err := time.Parse(time.RFC3339, sd.UpdatedAt)
+		if err != nil {
+			slog.Warn("session has no valid update time", "session", hashID(sd.UserID), "err", err)
+			continue
+		}
+		if !updated.Before(cutoff) {
+			continue
+		}
+		purged = append(purged, sd.UserID)
+		if dryRun {
+			continue
+		}
+		if err := s.persist.Delete(sd.UserID); err != nil {
+			return purged, err
+		}
+		delete(s.sessions, sd.UserID)
 	}
+	return purged, nil
+}
 
-	filtered := make([]openai.ChatCompletionMessage, 0, len(messages))
-	for _, m := range messages {
+// save persists sess. The caller must hold sess.mu.
+func (s *sessionStore) save(userID string, sess *userSession) error {
+	filtered := make([]openai.ChatCompletionMessage, 0, len(sess.messages))
+	for _, m := range sess.messages {
 		if m.Role == openai.ChatMessageRoleSystem {
 			continue
 		}
 		filtered = append(filtered, m)
 	}
-	if len(filtered) == 0 {
+	filtered = truncateMessages(filtered, maxSessionMessages)
+	s.pruneTurns(sess, filtered)
+
+	if len(filtered) == 0 && len(sess.inProgress) == 0 && len(sess.checkpoints) == 0 && sess.persona == "" && sess.language == "" && sess.dualLanguage == "" && sess.generation == nil {
+		if err := s.persist.Delete(userID); err != nil {
+			return err
+		}
+		sess.dirty = false
 		return nil
 	}
 
-	filtered = truncateMessages(filtered, maxSessionMessages)
-
-	sd := sessionData{
-		UserID:    userID,
-		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
-		Messages:  filtered,
+	err := s.persist.Save(userID, &storage.SessionData{
+		UserID:       userID,
+		UpdatedAt:    s.clock.Now().UTC().Format(time.RFC3339),
+		StartedAt:    formatTime(sess.started),
+		Persona:      sess.persona,
+		Language:     sess.language,
+		DualLanguage: sess.dualLanguage,
+		Generation:   sess.generation,
+		Messages:     filtered,
+		Turns:        sess.turns,
+		InProgress:   sess.inProgress,
+		Checkpoints:  sess.checkpoints,
+	})
+	if err == nil {
+		sess.dirty = false
 	}
+	return err
+}
 
-	data, err := json.MarshalIndent(sd, "", "  ")
+// keysOf returns the keys of every conversation of id, a user or thread ID,
+// in memory or stored, across namespaces.
+func (s *sessionStore) keysOf(id string) ([]string, error) {
+	all, err := s.persist.All()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(key string) {
+		if _, kid := storage.SplitKey(key); kid == id && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.sessions {
+		add(key)
+	}
+	for _, sd := range all {
+		add(sd.UserID)
 	}
-	return os.WriteFile(sessionFilePath(dataDir, userID), data, 0600)
+	sort.Strings(keys)
+	return keys, nil
 }
 
-func loadSession(dataDir, userID string) ([]openai.ChatCompletionMessage, error) {
-	data, err := os.ReadFile(sessionFilePath(dataDir, userID))
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+// evict drops the in-memory sessions in namespace ns without saving them.
+func (s *sessionStore) evict(ns string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.sessions {
+		if strings.HasPrefix(key, ns+"/") {
+			delete(s.sessions, key)
 		}
-		return nil, err
 	}
+}
 
-	var sd sessionData
-	if err := json.Unmarshal(data, &sd); err != nil {
-		return nil, err
+// scopedKey returns the session key of id, a user or thread ID, in the data
+// namespace of guildID, so that the same user has separate conversations
+// and archives in each guild and in DMs.
+func scopedKey(guildID, id string) string {
+	return storage.Namespace(guildID) + "/" + id
+}
+
+// formatTime formats t as RFC 3339, or returns "" for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
-	return sd.Messages, nil
+	return t.UTC().Format(time.RFC3339)
 }
 
 func truncateMessages(msgs []openai.ChatCompletionMessage, max int) []openai.ChatCompletionMessage {
@@ -151,124 +387,562 @@ func truncateMessages(msgs []openai.ChatCompletionMessage, max int) []openai.Cha
 	return msgs
 }
 
+// Memory namespaces. Entries in the global namespace are visible everywhere,
+// guild and channel entries only inside that guild or channel.
+const (
+	memoryScopeGlobal  = "global"
+	memoryScopeGuild   = "guild"
+	memoryScopeChannel = "channel"
+)
+
+// memoryScope describes where a conversation takes place. GuildID is empty
+// for DMs.
+type memoryScope struct {
+	GuildID   string
+	ChannelID string
+}
+
+// namespace returns the storage namespace for the named scope. Without a name
+// it defaults to the guild in servers and to global in DMs.
+func (sc memoryScope) namespace(name string) (string, error) {
+	if name == "" {
+		name = memoryScopeGuild
+		if sc.GuildID == "" {
+			name = memoryScopeGlobal
+		}
+	}
+	switch name {
+	case memoryScopeGlobal:
+		return memoryScopeGlobal, nil
+	case memoryScopeGuild:
+		if sc.GuildID == "" {
+			return "", fmt.Errorf("guild scope is not available in DMs")
+		}
+		return "guild:" + sc.GuildID, nil
+	case memoryScopeChannel:
+		return "channel:" + sc.ChannelID, nil
+	}
+	return "", fmt.Errorf("unknown memory scope: %s", name)
+}
+
+// visible lists the namespaces readable from sc, most specific first.
+func (sc memoryScope) visible() []string {
+	ns := []string{"channel:" + sc.ChannelID}
+	if sc.GuildID != "" {
+		ns = append(ns, "guild:"+sc.GuildID)
+	}
+	return append(ns, memoryScopeGlobal)
+}
+
+// dataNamespace returns the data namespace holding entries of the memory
+// namespace ns as seen from sc. Global entries belong to the user and are
+// kept with DMs; guild and channel entries stay with their guild.
+func (sc memoryScope) dataNamespace(ns string) string {
+	if ns == memoryScopeGlobal {
+		return storage.Namespace("")
+	}
+	if g, ok := strings.CutPrefix(ns, "guild:"); ok {
+		return storage.Namespace(g)
+	}
+	return storage.Namespace(sc.GuildID)
+}
+
 type memoryStore struct {
 	mu      sync.Mutex
-	dataDir string
+	persist storage.MemoryStore
+}
+
+func newMemoryStore(persist storage.MemoryStore) *memoryStore {
+	return &memoryStore{persist: persist}
 }
 
-func newMemoryStore(dataDir string) *memoryStore {
-	return &memoryStore{dataDir: dataDir}
+// claimLegacy moves the entries of userID's memory file from before data
+// namespaces existed that are visible from sc into their namespaces.
+// Channel entries of other channels stay behind until they are seen from
+// their channel, as only then is their guild known. The caller must hold
+// ms.mu.
+func (ms *memoryStore) claimLegacy(userID string, sc memoryScope) error {
+	legacy, err := ms.persist.Load("", userID)
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+	moved := make(map[string]map[string]map[string]string)
+	for ns, entries := range legacy {
+		if ns != memoryScopeGlobal && !strings.HasPrefix(ns, "guild:") && ns != "channel:"+sc.ChannelID {
+			continue
+		}
+		dns := sc.dataNamespace(ns)
+		if moved[dns] == nil {
+			m, err := ms.persist.Load(dns, userID)
+			if err != nil {
+				return err
+			}
+			moved[dns] = m
+		}
+		if moved[dns][ns] == nil {
+			moved[dns][ns] = map[string]string{}
+		}
+		for k, v := range entries {
+			moved[dns][ns][k] = v
+		}
+		delete(legacy, ns)
+	}
+	for dns, m := range moved {
+		if err := ms.persist.Save(dns, userID, m); err != nil {
+			return err
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	return ms.persist.Save("", userID, legacy)
 }
 
-func (ms *memoryStore) path(userID string) string {
-	return filepath.Join(ms.dataDir, "memory", userID+".json")
+// loadVisible returns the stored documents holding the namespaces visible
+// from sc, by data namespace. The caller must hold ms.mu.
+func (ms *memoryStore) loadVisible(userID string, sc memoryScope) (map[string]map[string]map[string]string, error) {
+	if err := ms.claimLegacy(userID, sc); err != nil {
+		return nil, err
+	}
+	docs := make(map[string]map[string]map[string]string)
+	for _, ns := range sc.visible() {
+		dns := sc.dataNamespace(ns)
+		if _, ok := docs[dns]; ok {
+			continue
+		}
+		m, err := ms.persist.Load(dns, userID)
+		if err != nil {
+			return nil, err
+		}
+		docs[dns] = m
+	}
+	return docs, nil
 }
 
-func (ms *memoryStore) load(userID string) (map[string]string, error) {
-	data, err := os.ReadFile(ms.path(userID))
+// all returns every memory entry of userID in every namespace.
+func (ms *memoryStore) all(userID string) (map[string]map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	owners, err := ms.persist.Owners()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return map[string]string{}, nil
-		}
 		return nil, err
 	}
-	var m map[string]string
-	if err := json.Unmarshal(data, &m); err != nil {
-		return nil, err
+	all := make(map[string]map[string]string)
+	for _, o := range owners {
+		if o.UserID != userID {
+			continue
+		}
+		m, err := ms.persist.Load(o.Namespace, userID)
+		if err != nil {
+			return nil, err
+		}
+		for ns, entries := range m {
+			if all[ns] == nil {
+				all[ns] = map[string]string{}
+			}
+			for k, v := range entries {
+				all[ns][k] = v
+			}
+		}
 	}
-	return m, nil
+	return all, nil
 }
 
-func (ms *memoryStore) save(userID string, data map[string]string) error {
-	dir := filepath.Join(ms.dataDir, "memory")
-	if err := os.MkdirAll(dir, 0700); err != nil {
-		return err
+// set stores value in namespace ns under the normalized form of key,
+// replacing any existing entry there that refers to the same thing, and
+// returns the key actually used.
+func (ms *memoryStore) set(userID string, sc memoryScope, ns, key, value string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.claimLegacy(userID, sc); err != nil {
+		return "", err
 	}
-	b, err := json.MarshalIndent(data, "", "  ")
+	dns := sc.dataNamespace(ns)
+	m, err := ms.persist.Load(dns, userID)
 	if err != nil {
-		return err
+		return "", err
+	}
+	entries := m[ns]
+	if entries == nil {
+		entries = map[string]string{}
+		m[ns] = entries
 	}
-	return os.WriteFile(ms.path(userID), b, 0600)
+	canon := normalizeMemoryKey(key)
+	if old, ok := findMemoryKey(entries, key); ok && old != canon {
+		delete(entries, old)
+	}
+	entries[canon] = value
+	return canon, ms.persist.Save(dns, userID, m)
+}
+
+// get looks key up in the namespaces visible from sc, most specific first.
+func (ms *memoryStore) get(userID string, sc memoryScope, key string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	docs, err := ms.loadVisible(userID, sc)
+	if err != nil {
+		return "", err
+	}
+	for _, ns := range sc.visible() {
+		entries := docs[sc.dataNamespace(ns)][ns]
+		if k, ok := findMemoryKey(entries, key); ok {
+			return entries[k], nil
+		}
+	}
+	return "", nil
 }
 
-func (ms *memoryStore) set(userID, key, value string) error {
+// delete removes key from the most specific visible namespace containing it.
+func (ms *memoryStore) delete(userID string, sc memoryScope, key string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	m, err := ms.load(userID)
+	docs, err := ms.loadVisible(userID, sc)
 	if err != nil {
 		return err
 	}
-	m[key] = value
-	return ms.save(userID, m)
+	for _, ns := range sc.visible() {
+		dns := sc.dataNamespace(ns)
+		if k, ok := findMemoryKey(docs[dns][ns], key); ok {
+			delete(docs[dns][ns], k)
+			return ms.persist.Save(dns, userID, docs[dns])
+		}
+	}
+	return nil
 }
 
-func (ms *memoryStore) get(userID, key string) (string, error) {
+// list returns the entries visible from sc. Entries in more specific
+// namespaces shadow global ones with the same key.
+func (ms *memoryStore) list(userID string, sc memoryScope) (map[string]string, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	m, err := ms.load(userID)
+	docs, err := ms.loadVisible(userID, sc)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	visible := make(map[string]string)
+	ns := sc.visible()
+	for i := len(ns) - 1; i >= 0; i-- {
+		for k, v := range docs[sc.dataNamespace(ns[i])][ns[i]] {
+			visible[k] = v
+		}
 	}
-	return m[key], nil
+	return visible, nil
 }
 
-func (ms *memoryStore) delete(userID, key string) error {
+// clear deletes all of the user's memory in every namespace.
+func (ms *memoryStore) clear(userID string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	m, err := ms.load(userID)
+	owners, err := ms.persist.Owners()
 	if err != nil {
 		return err
 	}
-	delete(m, key)
-	return ms.save(userID, m)
+	for _, o := range owners {
+		if o.UserID != userID {
+			continue
+		}
+		if err := ms.persist.Delete(o.Namespace, userID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (ms *memoryStore) list(userID string) (map[string]string, error) {
+// purge deletes memory entries whose key starts with prefix, in every
+// namespace. If userID is empty, every user's memory is scanned. The returned
+// map lists the matching keys per user; with dryRun nothing is deleted.
+func (ms *memoryStore) purge(userID, prefix string, dryRun bool) (map[string][]string, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	return ms.load(userID)
+
+	owners, err := ms.persist.Owners()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make(map[string][]string)
+	for _, o := range owners {
+		if userID != "" && o.UserID != userID {
+			continue
+		}
+		m, err := ms.persist.Load(o.Namespace, o.UserID)
+		if err != nil {
+			return purged, err
+		}
+		var keys []string
+		for ns, entries := range m {
+			for k := range entries {
+				if !strings.HasPrefix(k, prefix) {
+					continue
+				}
+				if ns == memoryScopeGlobal {
+					keys = append(keys, k)
+				} else {
+					keys = append(keys, ns+" "+k)
+				}
+				if !dryRun {
+					delete(entries, k)
+				}
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		purged[o.UserID] = append(purged[o.UserID], keys...)
+		if dryRun {
+			continue
+		}
+		if err := ms.persist.Save(o.Namespace, o.UserID, m); err != nil {
+			return purged, err
+		}
+	}
+	for _, keys := range purged {
+		sort.Strings(keys)
+	}
+	return purged, nil
+}
+
+// relevantMarkdown renders the memory visible from sc as a system prompt
+// section. When idx is non-nil only the entries most relevant to query are
+// included; if the embedding lookup fails all visible entries are used.
+func (ms *memoryStore) relevantMarkdown(ctx context.Context, idx *memoryIndex, userID string, sc memoryScope, query string) string {
+	m, err := ms.list(userID, sc)
+	if err != nil {
+		return ""
+	}
+	if idx != nil {
+		top, err := idx.relevant(ctx, scopedKey(sc.GuildID, userID), m, query)
+		if err != nil {
+			slog.Warn("memory retrieval failed", "user", hashID(userID), "err", err)
+		} else {
+			m = top
+		}
+	}
+	return memoryMarkdown(m)
+}
+
+// withSystemPrompt returns msgs preceded by a system message with content. The
+// prompt is added on every request, whether or not there is memory to
+// include, and msgs itself is left untouched. A system message msgs already
+// starts with is replaced rather than repeated. An empty content adds
+// nothing.
+func withSystemPrompt(msgs []openai.ChatCompletionMessage, content string) []openai.ChatCompletionMessage {
+	if content == "" {
+		return msgs
+	}
+	if len(msgs) > 0 && msgs[0].Role == openai.ChatMessageRoleSystem {
+		msgs = msgs[1:]
+	}
+	return append([]openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: content,
+	}}, msgs...)
 }
 
-func (ms *memoryStore) asMarkdown(userID string) string {
-	m, err := ms.load(userID)
-	if err != nil || len(m) == 0 {
+// basePrompt returns the prompt a conversation starts from in a guild with
+// cfg: the persona the user chose, else the guild's, else identity. It is
+// empty if the guild turned the system prompt off. A persona that cannot be
+// loaded falls back to identity with the error.
+func basePrompt(identity, persona string, cfg guildConfig, personas *personaStore) (string, error) {
+	if cfg.NoSystemPrompt {
+		return "", nil
+	}
+	if persona == "" {
+		persona = cfg.Persona
+	}
+	if persona == "" {
+		return identity, nil
+	}
+	p, err := personas.load(persona)
+	if err != nil {
+		return identity, err
+	}
+	return p, nil
+}
+
+func memoryMarkdown(m map[string]string) string {
+	if len(m) == 0 {
 		return ""
 	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	var sb strings.Builder
-	sb.WriteString("\n---\n## Learned Information\n")
-	for k, v := range m {
+	for _, k := range keys {
 		sb.WriteString("- ")
-		sb.WriteString(k)
+		sb.WriteString(sanitizeUntrustedLine(k))
 		sb.WriteString(": ")
-		sb.WriteString(v)
+		sb.WriteString(sanitizeUntrustedLine(m[k]))
 		sb.WriteString("\n")
 	}
-	return sb.String()
+	return "\n---\n## Learned Information\n" + untrustedBlock("memory", sb.String())
 }
 
+const codeFence = "```"
+
+// splitMessage splits content into parts of at most limit runes. It never
+// cuts inside a UTF-8 character, prefers paragraph, line, sentence and word
+// boundaries in that order, and closes a code block at the end of a part and
+// re-opens it (with the same language tag) at the start of the next one.
 func splitMessage(content string, limit int) []string {
-	if len(content) <= limit {
+	if utf8.RuneCountInString(content) <= limit {
 		return []string{content}
 	}
 
 	var parts []string
-	for len(content) > 0 {
-		if len(content) <= limit {
-			parts = append(parts, content)
+	fence := ""
+	for content != "" {
+		prefix := ""
+		if fence != "" {
+			prefix = fence + "\n"
+		}
+		room := limit - utf8.RuneCountInString(prefix)
+		if utf8.RuneCountInString(content) <= room {
+			parts = append(parts, prefix+content)
 			break
 		}
 
-		cut := limit
-		if idx := strings.LastIndex(content[:cut], "\n"); idx > 0 {
-			cut = idx + 1
-		}
+		cut := splitPoint(content, room-len("\n"+codeFence))
+		chunk := strings.TrimRight(content[:cut], " \n")
+		content = strings.TrimLeft(content[cut:], "\n")
 
-		parts = append(parts, content[:cut])
-		content = content[cut:]
+		open := fenceAfter(fence, chunk)
+		part := prefix + chunk
+		if open != "" {
+			part += "\n" + codeFence
+		}
+		parts = append(parts, part)
+		fence = open
 	}
 	return parts
 }
 
+// splitPoint returns the byte offset at which to cut s so that the first
+// part holds at most room runes.
+func splitPoint(s string, room int) int {
+	if room < 1 {
+		room = 1
+	}
+	end := len(s)
+	for i := range s {
+		if room == 0 {
+			end = i
+			break
+		}
+		room--
+	}
+	window := s[:end]
+	half := len(window) / 2
+
+	if i := strings.LastIndex(window, "\n\n"); i > half {
+		return i + 2
+	}
+	if i := strings.LastIndex(window, "\n"); i > half {
+		return i + 1
+	}
+	best := -1
+	for _, sep := range []string{"。", "！", "？", ". ", "! ", "? "} {
+		if i := strings.LastIndex(window, sep); i >= 0 && i+len(sep) > best {
+			best = i + len(sep)
+		}
+	}
+	if best > half {
+		return best
+	}
+	if i := strings.LastIndex(window, " "); i > half {
+		return i + 1
+	}
+	return end
+}
+
+// fenceAfter returns the code fence line that is still open at the end of
+// chunk, given the fence that was open at its start, or "" if none is.
+func fenceAfter(open, chunk string) string {
+	for _, line := range strings.Split(chunk, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, codeFence) {
+			continue
+		}
+		if open == "" {
+			open = line
+		} else {
+			open = ""
+		}
+	}
+	return open
+}
+
+const discordLimit = 2000
+
+// sendReply sends content to channelID, split to fit Discord's message limit.
+// ref may be nil to post without replying to a message.
+// It returns the IDs of the messages sent.
+func sendReply(s MessageSender, channelID string, ref *discordgo.MessageReference, content string) []string {
+	var ids []string
+	for _, part := range splitMessage(content, discordLimit) {
+		msg, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content:   part,
+			Reference: ref,
+		})
+		if err != nil {
+			slog.Error("failed to send message", "channel", channelID, "err", err)
+			continue
+		}
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+// typingInterval is how often the typing indicator is renewed; Discord
+// shows it for about ten seconds.
+const typingInterval = 8 * time.Second
+
+// keepTyping shows the typing indicator in channelID until ctx ends or the
+// returned function is called, which may be called more than once.
+func keepTyping(ctx context.Context, s *discordgo.Session, channelID string) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(typingInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.ChannelTyping(channelID); err != nil {
+				slog.Debug("failed to send typing indicator", "channel", channelID, "err", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// channel looks up a channel in the state cache, falling back to the REST API.
+func channel(s *discordgo.Session, channelID string) (*discordgo.Channel, error) {
+	ch, err := s.State.Channel(channelID)
+	if err == nil {
+		return ch, nil
+	}
+	return s.Channel(channelID)
+}
+
+// threadName derives a thread title from the first line of a message.
+func threadName(content string) string {
+	name, _, _ := strings.Cut(content, "\n")
+	name = strings.TrimSpace(name)
+	if r := []rune(name); len(r) > 50 {
+		name = string(r[:50]) + "…"
+	}
+	if name == "" {
+		name = "yagi"
+	}
+	return name
+}
+
 func main() {
 	defaultDataDir := ""
 	if home, err := os.UserHomeDir(); err == nil {
@@ -277,28 +951,247 @@ func main() {
 
 	token := flag.String("token", os.Getenv("DISCORD_BOT_TOKEN"), "Discord bot token")
 	modelFlag := flag.String("model", os.Getenv("YAGI_MODEL"), "Provider/model (e.g. openai/gpt-4.1-nano)")
-	apiKey := flag.String("key", "", "API key (overrides environment variable)")
+	apiKey := flag.String("key", "", "API key, or several comma-separated keys of the same provider (overrides environment variable)")
+	keyStrategy := flag.String("key-strategy", "round-robin", "How requests are spread over several API keys: round-robin or least-used")
 	prefix := flag.String("prefix", "!", "Command prefix")
 	identityFile := flag.String("identity", "", "Path to identity file (default: <data>/IDENTITY.md)")
 	dataDir := flag.String("data", defaultDataDir, "Data directory for session storage")
+	embeddingModel := flag.String("embedding-model", "", "Embedding model for selecting relevant memories (e.g. text-embedding-3-small)")
+	memoryTopK := flag.Int("memory-top-k", 5, "Number of memories injected per message when -embedding-model is set")
+	toolSelection := flag.String("tool-selection", "all", "Which tool schemas to send: all, or keyword (only tools matching the message)")
+	maxTools := flag.Int("max-tools", 0, "Maximum number of tools sent per request with -tool-selection keyword (0: no limit)")
+	debugLog := flag.String("debug-log", "", "Log provider requests and responses (redacted) to this file")
+	embedMode := flag.Bool("embeds", false, "Send long replies as paginated embeds")
+	threadMode := flag.Bool("threads", false, "Start a thread for each conversation in guild channels")
+	commandGuilds := flag.String("command-guilds", os.Getenv("YAGI_COMMAND_GUILDS"), "Comma-separated guild IDs to register slash commands in instead of globally")
+	adminIDs := flag.String("admins", os.Getenv("YAGI_ADMINS"), "Comma-separated Discord user IDs allowed to run admin commands")
+	analyticsFlag := flag.Bool("analytics", false, "Record anonymized usage statistics in the data directory")
+	analyticsExport := flag.String("analytics-export", "", "Write aggregated usage statistics to this .csv or .json file and exit")
+	encryptionKey := flag.String("encryption-key", os.Getenv("YAGI_ENCRYPTION_KEY"), "Base64 AES-256 key for encrypting session and memory files")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "File containing the encryption key")
+	storageSpec := flag.String("storage", os.Getenv("YAGI_STORAGE"), "Backend for sessions and memory: file (the data directory), memory, or a redis:// URL")
+	redisURL := flag.String("redis", os.Getenv("YAGI_REDIS_URL"), "Shorthand for -storage with a Redis URL (e.g. redis://localhost:6379/0)")
+	vectorStore := flag.String("vector-store", os.Getenv("YAGI_VECTOR_STORE"), "Where memory embeddings are kept: file, qdrant:<url>, a postgres:// URL (pgvector) or sqlite:<path> (sqlite-vec builds)")
+	qdrantAPIKey := flag.String("qdrant-api-key", os.Getenv("QDRANT_API_KEY"), "API key for a Qdrant vector store")
+	sessionTTL := flag.Duration("session-ttl", 0, "Expire stored conversations after this long without activity (Redis only; 0: keep)")
+	httpAddr := flag.String("http-addr", "", "Serve metrics and health checks on this address (e.g. :8080)")
+	webhookAddr := flag.String("webhook-addr", "", "Receive GitHub webhooks on this address (e.g. :8081) and post summaries to Discord")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("YAGI_WEBHOOK_SECRET"), "Secret the GitHub webhooks are signed with")
+	webhookRoutes := flag.String("webhook-routes", os.Getenv("YAGI_WEBHOOK_ROUTES"), "Comma-separated owner/repo=channelID pairs; owner/* and * match several repositories")
+	apiAddr := flag.String("api-addr", "", "Serve the REST API for other services on this address (e.g. :8082)")
+	apiToken := flag.String("api-token", os.Getenv("YAGI_API_TOKEN"), "Bearer token the REST API requires")
+	updateCheck := flag.Bool("update-check", true, "Check GitHub daily for a newer release and log it")
+	updateDM := flag.Bool("update-dm", false, "Also DM the admins (-admins) when a newer release is available")
+	transcriptionModel := flag.String("transcription-model", "", "Speech-to-text model for meeting notes in voice channels (e.g. whisper-1); empty disables them")
+	checkinInterval := flag.Duration("checkin-interval", 72*time.Hour, "Minimum time between proactive check-ins for users who opted in")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	backupChannel := flag.String("backup-channel", os.Getenv("YAGI_BACKUP_CHANNEL"), "Discord channel ID to post encrypted data directory backups to")
+	backupInterval := flag.Duration("backup-interval", 24*time.Hour, "Time between backups posted to -backup-channel")
+	pacing := flag.Bool("pacing", true, "Pace provider calls by its rate-limit headers instead of running into 429 errors")
+	queueDepth := flag.Int("queue-depth", 3, "Messages that may wait per conversation while a reply is generated")
+	coalesceWindow := flag.Duration("coalesce", 0, "Wait this long for follow-up messages and answer queued messages together (0 disables)")
+	editWindow := flag.Duration("edit-window", 5*time.Minute, "Re-answer a message edited within this time after the reply (0 disables)")
+	workerCount := flag.Int("workers", 8, "Replies generated at the same time")
+	workerBacklog := flag.Int("worker-backlog", 100, "Replies that may wait for a free worker before new messages are turned away")
+	reactionModel := flag.String("reaction-model", "", "Model of the same provider that picks emoji reactions (default: -model)")
+	translateModel := flag.String("translate-model", "", "Model of the same provider that translates messages in /translate channels (default: -model)")
+	reactionInterval := flag.Duration("reaction-interval", 10*time.Minute, "Minimum time between emoji reactions in a channel")
+	missedWindow := flag.Duration("missed-window", 0, "After downtime, look this far back for mentions and DMs the bot missed (0 disables)")
+	missedAction := flag.String("missed-action", "notify", "What to do with missed messages: notify (DM the admins a list) or answer")
+	confirmTools := flag.String("confirm-tools", "", "Comma-separated tools, or patterns, that only run after the user approves the call with a button")
+	confirmTimeout := flag.Duration("confirm-timeout", 2*time.Minute, "How long to wait for the user to approve a tool call of -confirm-tools")
+	disableTools := flag.String("disable-tools", "", "Comma-separated tools, or patterns such as *MemoryEntry, never offered to the model anywhere")
+	weatherURL := flag.String("weather-url", "https://api.open-meteo.com/v1", "Open-Meteo compatible forecast API of the getWeather tool (empty disables it)")
+	geocodingURL := flag.String("geocoding-url", "https://geocoding-api.open-meteo.com/v1", "Open-Meteo compatible geocoding API that getWeather finds places with")
+	wikipediaOn := flag.Bool("wikipedia", true, "Offer the lookupWikipedia tool, which reads Wikipedia articles in any language")
+	documentsOn := flag.Bool("documents", true, "Read PDF, DOCX, text and Markdown files attached to messages, offering readDocument for long ones")
+	youTubeOn := flag.Bool("youtube", true, "Offer the getYouTubeTranscript tool, which reads the captions of YouTube videos")
+	codeSandboxKind := flag.String("code-sandbox", "", "Offer the runCode tool, running Python and JavaScript snippets in docker, podman or a Piston API at this URL (empty disables it)")
+	codeRuntime := flag.String("code-runtime", "", "Container runtime for -code-sandbox docker or podman, e.g. runsc for gVisor (default: the engine's)")
+	codeTimeout := flag.Duration("code-timeout", 10*time.Second, "How long a runCode snippet may run")
+	codeMemory := flag.Int("code-memory", 256, "Memory limit of a runCode snippet in MB")
+	toolAuditOn := flag.Bool("tool-audit", true, "Record every tool call in <data>/audit/tools.jsonl for /audit")
+	collectFeedback := flag.Bool("feedback", false, "Add 👍/👎 reactions to replies and record the ratings users give")
+	moodAware := flag.Bool("mood", false, "Adjust the reply style to the mood of the user's recent messages")
+	moodModel := flag.String("mood-model", "", "Model of the same provider that classifies the user's mood for -mood (default: -model)")
+	skillRouting := flag.Bool("skills", false, "Classify each request (coding, translation, search or chat) and use a system prompt and tools suited to it")
+	moderation := flag.String("moderation", "", "Screen messages and replies: provider (the provider's moderation endpoint) or model (a chat model classifies them); empty disables moderation")
+	moderationModel := flag.String("moderation-model", "", "Moderation model for -moderation provider, or chat model of the same provider for -moderation model (default: the provider's default or -model)")
+	memoryGuardOn := flag.Bool("memory-guard", false, "Check each memory entry the model saves with a model call and refuse those that read like instructions")
+	memoryGuardModel := flag.String("memory-guard-model", "", "Model of the same provider that checks memory entries for -memory-guard (default: -model)")
+	skillModel := flag.String("skill-model", "", "Model of the same provider that classifies requests for -skills (default: -model)")
+	evalJudgeModel := flag.String("judge-model", "", "Model of the same provider that grades the judge criteria of the eval subcommand (default: -model)")
+	hooksEnabled := flag.Bool("hooks", false, "Run the Starlark hook scripts in <data>/hooks (on_message_pre, on_reply_post and custom tools)")
+	feedInterval := flag.Duration("feed-interval", 30*time.Minute, "How often subscribed RSS and Atom feeds are checked for new entries (0 disables /feed)")
+	localeFlag := flag.String("locale", string(localeJapanese), "Language of the bot's own messages when neither the user, the server nor the message tells: en or ja")
+	modeFlag := flag.String("mode", string(modeBoth), "Where the bot works: both, dm-only (a personal DM assistant) or guild-only (a server bot)")
+	profileInterval := flag.Duration("profile-interval", 24*time.Hour, "Minimum time between rewrites of a user's profile from their past conversations (0 disables profiles)")
+	settingsTemperature := flag.String("settings-temperature", "0-2", "Range users may set the temperature in with /settings (empty: not settable)")
+	settingsTopP := flag.String("settings-top-p", "0-1", "Range users may set top_p in with /settings (empty: not settable)")
+	settingsMaxTokens := flag.String("settings-max-tokens", "1-4096", "Range users may set the maximum reply tokens in with /settings (empty: not settable)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for running replies before shutting down")
+	otlpEndpoint := flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "Export traces over OTLP/HTTP to this collector (e.g. http://localhost:4318)")
+	configFile := flag.String("config", os.Getenv("YAGI_CONFIG"), "YAML file with option values and per-guild settings; command-line flags take precedence")
+	flag.Usage = usage
 	flag.Parse()
+	cmd, args, err := parseCommand(flag.CommandLine)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var guildDefaults map[string]guildConfig
+	var plugins []pluginConfig
+	var mcpServers map[string]mcpServerConfig
+	var githubCfg *githubConfig
+	if *configFile != "" {
+		fileCfg, err := loadConfig(flag.CommandLine, *configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		guildDefaults, plugins, mcpServers, githubCfg = fileCfg.guilds, fileCfg.tools, fileCfg.mcp, fileCfg.github
+	}
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Unsetenv("YAGI_ENCRYPTION_KEY")
+	os.Unsetenv("YAGI_WEBHOOK_SECRET")
+	os.Unsetenv("YAGI_API_TOKEN")
+	mode, err := parseDeployMode(*modeFlag)
+	if err != nil {
+		fatal("invalid -mode", "err", err)
+	}
 
-	if *token == "" {
-		log.Fatal("Discord bot token is required: set DISCORD_BOT_TOKEN or use -token")
+	fc, err := storage.LoadCipher(*encryptionKey, *encryptionKeyFile)
+	if err != nil {
+		fatal("failed to load encryption key", "err", err)
 	}
 
-	if *modelFlag == "" {
-		*modelFlag = "openai/gpt-4.1-nano"
+	if cmd == "storage encrypt" {
+		n, err := storage.MigrateEncrypt(*dataDir, fc, "sessions", "memory", "topics")
+		if err != nil {
+			fatal("failed to encrypt data", "err", err)
+		}
+		fmt.Printf("Encrypted %d file(s)\n", n)
+		return
 	}
 
-	providerName, modelName, ok := strings.Cut(*modelFlag, "/")
-	if !ok {
-		log.Fatalf("Invalid model format: %s (use provider/model)", *modelFlag)
+	if cmd == "decrypt-backup" {
+		if err := decryptBackup(os.Stdout, fc, args); err != nil {
+			fatal("failed to decrypt backup", "err", err)
+		}
+		return
+	}
+
+	if *backupChannel != "" && fc == nil {
+		fatal("-backup-channel needs -encryption-key or -encryption-key-file")
+	}
+
+	if *analyticsExport != "" {
+		if err := exportAnalytics(*dataDir, *analyticsExport); err != nil {
+			fatal("failed to export analytics", "err", err)
+		}
+		return
+	}
+
+	if cmd == "export-training" {
+		if *storageSpec == "" {
+			*storageSpec = *redisURL
+		}
+		blobs, err := storage.Open(*storageSpec, *dataDir)
+		if err != nil {
+			fatal("failed to open storage", "err", err)
+		}
+		idPath := *identityFile
+		if idPath == "" {
+			idPath = filepath.Join(*dataDir, "IDENTITY.md")
+		}
+		format := "openai"
+		if len(args) > 0 {
+			format = args[0]
+		}
+		n, err := exportTraining(os.Stdout, storage.NewSessionStore(blobs, fc, 0), newTrainingStore(*dataDir),
+			newGuildStore(*dataDir, guildDefaults), newPersonaStore(filepath.Join(*dataDir, "personas")), newIdentity(idPath).get(), format)
+		if err != nil {
+			fatal("failed to export training data", "err", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d conversation(s)\n", n)
+		return
+	}
+
+	if cmd == "sessions export" || cmd == "sessions import" || cmd == "storage migrate" {
+		if *storageSpec == "" {
+			*storageSpec = *redisURL
+		}
+		blobs, err := storage.Open(*storageSpec, *dataDir)
+		if err != nil {
+			fatal("failed to open storage", "err", err)
+		}
+		sessions := storage.NewSessionStore(blobs, fc, 0)
+		switch cmd {
+		case "sessions export":
+			n, err := exportSessions(os.Stdout, sessions)
+			if err != nil {
+				fatal("failed to export sessions", "err", err)
+			}
+			fmt.Fprintf(os.Stderr, "Exported %d conversation(s)\n", n)
+		case "sessions import":
+			n, err := importSessions(os.Stdin, sessions)
+			if err != nil {
+				fatal("failed to import sessions", "imported", n, "err", err)
+			}
+			fmt.Fprintf(os.Stderr, "Imported %d conversation(s)\n", n)
+		case "storage migrate":
+			if len(args) != 1 {
+				fatal("usage: storage migrate <backend>")
+			}
+			if args[0] == *storageSpec || (args[0] == "file" && *storageSpec == "") {
+				fatal("the target storage is the same as -storage")
+			}
+			to, err := storage.Open(args[0], *dataDir)
+			if err != nil {
+				fatal("failed to open target storage", "err", err)
+			}
+			n, err := migrateStorage(blobs, to)
+			if err != nil {
+				fatal("failed to migrate storage", "copied", n, "err", err)
+			}
+			fmt.Fprintf(os.Stderr, "Copied %d document(s)\n", n)
+		}
+		return
+	}
+
+	if cmd == "export-feedback" {
+		n, err := exportFeedback(os.Stdout, filepath.Join(*dataDir, "feedback.json"), fc)
+		if err != nil {
+			fatal("failed to export feedback", "err", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d rating(s)\n", n)
+		return
+	}
+
+	if *toolSelection != "all" && *toolSelection != "keyword" {
+		fatal("invalid -tool-selection (use all or keyword)", "value", *toolSelection)
+	}
+
+	if *token == "" && cmd == "serve" {
+		fatal("Discord bot token is required: set DISCORD_BOT_TOKEN or use -token")
+	}
+
+	if *modelFlag == "" {
+		*modelFlag = "openai/gpt-4.1-nano"
+	}
+
+	providerName, modelName, ok := strings.Cut(*modelFlag, "/")
+	if !ok {
+		fatal("invalid model format (use provider/model)", "model", *modelFlag)
 	}
 
 	p := provider.Find(providerName, provider.DefaultProviders)
 	if p == nil {
-		log.Fatalf("Unknown provider: %s", providerName)
+		fatal("unknown provider", "provider", providerName)
 	}
 
 	key := *apiKey
@@ -306,7 +1199,57 @@ func main() {
 		key = os.Getenv(p.EnvKey)
 	}
 
-	client := provider.NewClient(p, key)
+	// Several keys of the same provider may be given, separated by commas.
+	keys := splitKeys(key)
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if *debugLog != "" {
+		t, err := newDebugTransport(*debugLog, append(keys, *token)...)
+		if err != nil {
+			fatal("failed to open debug log", "err", err)
+		}
+		transport = t
+	}
+	if *pacing {
+		transport = &rateLimitTransport{base: transport}
+	}
+	if defaultLocale = parseLocale(*localeFlag); defaultLocale == "" {
+		fatal("invalid -locale (use en or ja)", "locale", *localeFlag)
+	}
+	var genLimits generationLimits
+	for _, r := range []struct {
+		name  string
+		value string
+		dst   *paramRange
+	}{
+		{"-settings-temperature", *settingsTemperature, &genLimits.temperature},
+		{"-settings-top-p", *settingsTopP, &genLimits.topP},
+		{"-settings-max-tokens", *settingsMaxTokens, &genLimits.maxTokens},
+	} {
+		pr, err := parseParamRange(r.value)
+		if err != nil {
+			fatal("invalid "+r.name, "err", err)
+		}
+		*r.dst = pr
+	}
+	// Guild keys skip the key pool but are paced like the bot's keys.
+	direct := transport
+	if len(keys) > 1 {
+		if *keyStrategy != "round-robin" && *keyStrategy != "least-used" {
+			fatal("invalid -key-strategy (use round-robin or least-used)", "value", *keyStrategy)
+		}
+		transport = newAPIKeyPool(transport, keys, *keyStrategy)
+	}
+	guildAPIKeys := newGuildKeys(*dataDir, fc, guildDefaults)
+	transport = &guildKeyTransport{keys: guildAPIKeys, base: transport, direct: direct}
+	transport = &generationTransport{base: transport}
+	config := openai.DefaultConfig(key)
+	config.BaseURL = p.APIURL
+	config.HTTPClient = &http.Client{Transport: &usageTransport{base: &tracingTransport{base: transport}}}
+	client := openai.NewClientWithConfig(config)
 
 	// Clear all *_API_KEY environment variables for security after they are referenced
 	for _, env := range os.Environ() {
@@ -324,52 +1267,183 @@ func main() {
 	if idPath == "" {
 		idPath = filepath.Join(*dataDir, "IDENTITY.md")
 	}
-	var systemPrompt string
-	if data, err := os.ReadFile(idPath); err == nil {
-		systemPrompt = string(data)
-	} else if !os.IsNotExist(err) {
-		log.Printf("Warning: failed to read identity file: %v", err)
+	ident := newIdentity(idPath)
+
+	if cmd == "doctor" {
+		d := &doctor{
+			token:   *token,
+			client:  client,
+			model:   modelName,
+			dataDir: *dataDir,
+			idPath:  idPath,
+			blobs: func() (storage.Blobs, error) {
+				spec := *storageSpec
+				if spec == "" {
+					spec = *redisURL
+				}
+				return storage.Open(spec, *dataDir)
+			},
+		}
+		if err := d.run(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stdout, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cmd == "eval" {
+		if len(args) != 1 {
+			fatal("usage: eval <suite.yaml>")
+		}
+		suite, err := loadEvalSuite(args[0])
+		if err != nil {
+			fatal("failed to load eval suite", "err", err)
+		}
+		judgeModel := modelName
+		if *evalJudgeModel != "" {
+			judgeModel = *evalJudgeModel
+		}
+		ev := &evaluator{
+			eng:      engine.New(engine.Config{Client: client, Model: modelName}),
+			judge:    engine.New(engine.Config{Client: client, Model: judgeModel}),
+			identity: ident.get(),
+			personas: newPersonaStore(filepath.Join(*dataDir, "personas")),
+		}
+		if ev.run(context.Background(), os.Stdout, suite) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	go ident.watch(5 * time.Second)
+
+	if *storageSpec == "" {
+		*storageSpec = *redisURL
+	}
+	blobs, err := storage.Open(*storageSpec, *dataDir)
+	if err != nil {
+		fatal("failed to open storage", "err", err)
+	}
+	os.Unsetenv("YAGI_STORAGE")
+	os.Unsetenv("YAGI_REDIS_URL")
+
+	mem := newMemoryStore(storage.NewMemoryStore(blobs, fc))
+	vectors, err := storage.OpenVectors(*vectorStore, filepath.Join(*dataDir, "memory_index"), storage.VectorOptions{QdrantAPIKey: *qdrantAPIKey})
+	if err != nil {
+		fatal("failed to open vector store", "err", err)
+	}
+	os.Unsetenv("YAGI_VECTOR_STORE")
+	var memIndex *memoryIndex
+	if *embeddingModel != "" {
+		if *memoryTopK <= 0 {
+			fatal("invalid -memory-top-k (must be positive)", "value", *memoryTopK)
+		}
+		memIndex = newMemoryIndex(vectors, newEmbedder(*dataDir, client, *embeddingModel), *memoryTopK)
 	}
+	personas := newPersonaStore(filepath.Join(*dataDir, "personas"))
+	guilds := newGuildStore(*dataDir, guildDefaults)
 
-	mem := newMemoryStore(*dataDir)
+	var stats *analyticsLog
+	if *analyticsFlag {
+		stats = newAnalyticsLog(*dataDir)
+	}
 
-	eng := engine.New(engine.Config{
+	engCfg := engine.Config{
 		Client: client,
 		Model:  modelName,
 		SystemMessage: func(skill string) string {
-			return systemPrompt
+			return ident.get() + skillHint(skill)
 		},
-	})
+	}
+	var confirmer *toolConfirmer
+	if patterns := parseIDList(*confirmTools); len(patterns) > 0 {
+		confirmer = newToolConfirmer(patterns, *confirmTimeout)
+		engCfg.Approver = confirmer
+	}
+	// plainEng has no tools; it is used for background work such as
+	// summaries and check-ins.
+	plainEng := engine.New(engCfg)
+	topics := newTopicStore(*dataDir, fc, plainEng)
+	profiles := newProfileStore(*dataDir, fc, plainEng, topics, *profileInterval)
+
+	var memGuard *memoryGuard
+	if *memoryGuardOn {
+		guardCfg := engCfg
+		guardCfg.SystemMessage = nil
+		if *memoryGuardModel != "" {
+			guardCfg.Model = *memoryGuardModel
+		}
+		memGuard = &memoryGuard{eng: engine.New(guardCfg)}
+	}
+	var mod *moderator
+	switch *moderation {
+	case "":
+	case "provider":
+		mod = newModerator(*dataDir, &providerModeration{client: client, model: *moderationModel})
+	case "model":
+		modCfg := engCfg
+		modCfg.SystemMessage = nil
+		if *moderationModel != "" {
+			modCfg.Model = *moderationModel
+		}
+		mod = newModerator(*dataDir, &modelModeration{eng: engine.New(modCfg)})
+	default:
+		fatal("invalid -moderation (use provider or model)", "value", *moderation)
+	}
+	tools := newToolRegistry()
+	tools.confirm = confirmer
+	if *toolAuditOn {
+		tools.audit = newToolAudit(*dataDir, fc)
+	}
 
-	eng.RegisterTool("saveMemoryEntry", "Save information to memory. Use this when user wants to remember something.", json.RawMessage(`{
+	tools.register("saveMemoryEntry", "Save information to memory. Use this when user wants to remember something.", json.RawMessage(`{
 		"type": "object",
 		"properties": {
 			"key": {
 				"type": "string",
-				"description": "A short identifier for what to remember (e.g., 'user_name', 'favorite_language')"
+				"description": "A short identifier for what to remember, as <category>/<snake_case_name> (e.g., 'fact/name', 'preference/favorite_language'). Keys are normalized to this form."
 			},
 			"value": {
 				"type": "string",
 				"description": "The information to remember"
+			},
+			"scope": {
+				"type": "string",
+				"enum": ["global", "guild", "channel"],
+				"description": "Where this memory applies: everywhere, only in this server, or only in this channel. Defaults to this server, or global in DMs."
 			}
 		},
 		"required": ["key", "value"]
 	}`), func(ctx context.Context, args string) (string, error) {
 		userID := ctx.Value(ctxKeyUserID).(string)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
 		var req struct {
 			Key   string `json:"key"`
 			Value string `json:"value"`
+			Scope string `json:"scope"`
 		}
 		if err := json.Unmarshal([]byte(args), &req); err != nil {
 			return "", err
 		}
-		if err := mem.set(userID, req.Key, req.Value); err != nil {
+		ns, err := sc.namespace(req.Scope)
+		if err != nil {
+			return "", err
+		}
+		if memGuard != nil {
+			guardCtx, guardCancel := context.WithTimeout(ctx, 10*time.Second)
+			suspicious := memGuard.suspicious(guardCtx, req.Key, req.Value)
+			guardCancel()
+			if suspicious {
+				slog.Warn("refused suspicious memory entry", "user", hashID(userID), "key", normalizeMemoryKey(req.Key))
+				return "", fmt.Errorf("not saved: the entry reads like instructions for the assistant rather than information about the user")
+			}
+		}
+		key, err := mem.set(userID, sc, ns, req.Key, req.Value)
+		if err != nil {
 			return "", err
 		}
-		return "Saved", nil
+		return "Saved as " + key, nil
 	}, true)
 
-	eng.RegisterTool("getMemoryEntry", "Retrieve information from memory.", json.RawMessage(`{
+	tools.register("getMemoryEntry", "Retrieve information from memory.", json.RawMessage(`{
 		"type": "object",
 		"properties": {
 			"key": {
@@ -386,10 +1460,11 @@ func main() {
 		if err := json.Unmarshal([]byte(args), &req); err != nil {
 			return "", err
 		}
-		return mem.get(userID, req.Key)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		return mem.get(userID, sc, req.Key)
 	}, true)
 
-	eng.RegisterTool("deleteMemoryEntry", "Delete information from memory.", json.RawMessage(`{
+	tools.register("deleteMemoryEntry", "Delete information from memory.", json.RawMessage(`{
 		"type": "object",
 		"properties": {
 			"key": {
@@ -406,18 +1481,20 @@ func main() {
 		if err := json.Unmarshal([]byte(args), &req); err != nil {
 			return "", err
 		}
-		if err := mem.delete(userID, req.Key); err != nil {
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		if err := mem.delete(userID, sc, req.Key); err != nil {
 			return "", err
 		}
 		return "Deleted", nil
 	}, true)
 
-	eng.RegisterTool("listMemoryEntries", "List all saved information.", json.RawMessage(`{
+	tools.register("listMemoryEntries", "List all saved information visible in this conversation.", json.RawMessage(`{
 		"type": "object",
 		"properties": {}
 	}`), func(ctx context.Context, args string) (string, error) {
 		userID := ctx.Value(ctxKeyUserID).(string)
-		m, err := mem.list(userID)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		m, err := mem.list(userID, sc)
 		if err != nil {
 			return "", err
 		}
@@ -431,39 +1508,533 @@ func main() {
 		return string(b), nil
 	}, true)
 
-	store := newSessionStore(*dataDir)
+	recall := &recaller{mem: mem, topics: topics}
+	if memIndex != nil {
+		recall.emb = memIndex.emb
+	}
+	tools.register("recall", "Search everything known about the user at once: saved memory and summaries of past conversations. Results are ranked and labeled with their source. Use this first when the user refers to something from before.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"query": {
+				"type": "string",
+				"description": "What to look for, in a few words"
+			},
+			"limit": {
+				"type": "integer",
+				"description": "Maximum number of results (default 5)"
+			}
+		},
+		"required": ["query"]
+	}`), func(ctx context.Context, args string) (string, error) {
+		userID := ctx.Value(ctxKeyUserID).(string)
+		sessionKey, _ := ctx.Value(ctxKeySessionKey).(string)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		var req struct {
+			Query string `json:"query"`
+			Limit int    `json:"limit"`
+		}
+		if err := json.Unmarshal([]byte(args), &req); err != nil {
+			return "", err
+		}
+		if req.Limit <= 0 {
+			req.Limit = 5
+		}
+		results, err := recall.recall(ctx, userID, sessionKey, sc, req.Query, req.Limit)
+		if err != nil {
+			return "", err
+		}
+		if len(results) == 0 {
+			return "[]", nil
+		}
+		b, err := json.Marshal(results)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}, true)
+
+	reminders := newReminderStore(*dataDir, fc)
+	tools.register("setReminder", "Remind the user of something later, at a given time or after a delay. The reminder is posted where the conversation is, mentioning the user, or sent as a DM.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"text": {
+				"type": "string",
+				"description": "What to remind the user of, written to them (e.g. 'Time to call the dentist')"
+			},
+			"in": {
+				"type": "string",
+				"description": "Delay from now, e.g. '45m', '2h30m' or '1d'"
+			},
+			"at": {
+				"type": "string",
+				"description": "Time in RFC 3339 format with the user's UTC offset, e.g. '2025-01-31T09:00:00+09:00'. Use instead of in."
+			},
+			"dm": {
+				"type": "boolean",
+				"description": "Send the reminder as a DM instead of posting it in this channel"
+			}
+		},
+		"required": ["text"]
+	}`), func(ctx context.Context, args string) (string, error) {
+		userID := ctx.Value(ctxKeyUserID).(string)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		var req struct {
+			Text string `json:"text"`
+			In   string `json:"in"`
+			At   string `json:"at"`
+			DM   bool   `json:"dm"`
+		}
+		if err := json.Unmarshal([]byte(args), &req); err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(req.Text) == "" {
+			return "", fmt.Errorf("text is empty")
+		}
+		due, err := parseReminderTime(req.In, req.At, time.Now())
+		if err != nil {
+			return "", err
+		}
+		r := reminder{UserID: userID, GuildID: sc.GuildID, Text: req.Text, Due: due.UTC()}
+		if !req.DM && sc.GuildID != "" {
+			r.ChannelID = sc.ChannelID
+		}
+		added, err := reminders.add(r)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Reminder %s set for %s (in %s). The user can list or cancel reminders with /reminders.",
+			added.ID, due.UTC().Format(time.RFC3339), time.Until(due).Round(time.Minute)), nil
+	}, true)
+	tools.hint("setReminder", "remind", "reminder", "later", "tomorrow", "リマインド", "思い出させ", "後で", "明日", "通知")
+
+	events := newEventPlanner(*dataDir, fc)
+	tools.register("createEvent", "Plan a server event, such as a movie night or a meetup: create a Discord scheduled event and announce it in this channel with buttons for members to answer going, maybe or can't go. Those going are reminded an hour before. Only in servers.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"name": {
+				"type": "string",
+				"description": "Short title of the event (e.g. 'Movie Night')"
+			},
+			"description": {
+				"type": "string",
+				"description": "What the event is about, in a sentence or two"
+			},
+			"start": {
+				"type": "string",
+				"description": "Start time in RFC 3339 format with the user's UTC offset, e.g. '2025-01-31T20:00:00+09:00'"
+			},
+			"end": {
+				"type": "string",
+				"description": "End time in RFC 3339 format. Defaults to two hours after the start."
+			},
+			"location": {
+				"type": "string",
+				"description": "Where it takes place, e.g. a voice channel name, a game server or an address. Defaults to Discord."
+			}
+		},
+		"required": ["name", "start"]
+	}`), func(ctx context.Context, args string) (string, error) {
+		userID := ctx.Value(ctxKeyUserID).(string)
+		sc, _ := ctx.Value(ctxKeyMemoryScope).(memoryScope)
+		var req eventRequest
+		if err := json.Unmarshal([]byte(args), &req); err != nil {
+			return "", err
+		}
+		e, err := events.create(userID, sc.GuildID, sc.ChannelID, req, time.Now())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Created event %q starting %s and announced it in this channel with RSVP buttons: %s",
+			e.Name, e.Start.Format(time.RFC3339), e.link()), nil
+	}, false)
+	tools.hint("createEvent", "event", "plan", "movie night", "meetup", "party", "schedule", "イベント", "企画", "計画", "集まり", "予定")
+
+	memoryKeywords := []string{"remember", "forget", "recall", "memory", "name", "favorite", "覚え", "忘れ", "記憶", "名前", "好き", "思い出"}
+	for _, name := range []string{"saveMemoryEntry", "getMemoryEntry", "deleteMemoryEntry", "listMemoryEntries", "recall"} {
+		tools.hint(name, memoryKeywords...)
+	}
+	tools.hint("recall", "before", "last time", "前に", "前回", "この前")
+	tools.untrusted("getMemoryEntry", "listMemoryEntries", "recall")
+
+	tools.register("calculate", "Evaluate arithmetic exactly, convert units or do date math. Use it for every calculation instead of working it out yourself. Arithmetic: + - * / % ^ ! and parentheses, pi, e, sqrt, abs, round(x, decimals), floor, ceil, min, max, ln, log, exp, sin, cos, tan and more, e.g. '(1.5e3 + 2^64) / 7'. Units: '<value> <unit> to <unit>' for length, mass, time, volume, area, speed, data, energy and temperature, e.g. '72 F to C' or '3.5 GB to MiB'. Dates (UTC): 'YYYY-MM-DD' or 'today'/'now' plus or minus years, months, weeks, days, hours or minutes, e.g. '2025-03-01 + 90 days', or the time between two dates, e.g. '2025-12-25 - today'.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"expression": {"type": "string", "description": "The expression, conversion or date math"}
+		},
+		"required": ["expression"]
+	}`), calcTool, true)
+	tools.hint("calculate", "calculate", "compute", "convert", "how many", "how much", "percent", "sum", "total", "days until", "計算", "換算", "何日", "合計", "割合", "足す", "引く", "掛け", "割る")
+
+	if *weatherURL != "" {
+		wc := newWeatherClient(*weatherURL, *geocodingURL)
+		tools.register("getWeather", "Get the current weather and the daily forecast of a place: conditions, temperatures, precipitation and wind, in the place's local time.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"location": {"type": "string", "description": "Place name in English, optionally with the region or country after a comma, e.g. 'Osaka' or 'Portland, Maine'"},
+			"days": {"type": "integer", "description": "Days of forecast from today, 1 to 16 (default 3)"},
+			"units": {"type": "string", "enum": ["metric", "imperial"], "description": "Default metric"}
+		},
+		"required": ["location"]
+	}`), wc.tool, true)
+		tools.hint("getWeather", "weather", "forecast", "rain", "snow", "temperature", "umbrella", "hot", "cold", "天気", "天候", "予報", "雨", "雪", "気温", "傘", "暑い", "寒い")
+	}
+
+	if *wikipediaOn {
+		tools.register("lookupWikipedia", "Look up a topic on Wikipedia and get the introduction of the best matching article, or the whole article, with its URL to cite, and the titles of other matches. Use it for factual questions about people, places, events and concepts instead of relying on memory.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"query": {"type": "string", "description": "Topic or article title, in the language of the Wikipedia searched"},
+			"language": {"type": "string", "description": "Wikipedia language code, e.g. en or ja; usually the user's language (default en)"},
+			"full": {"type": "boolean", "description": "Get the whole article instead of its introduction, when the introduction does not answer the question"}
+		},
+		"required": ["query"]
+	}`), newWikipedia().tool, true)
+		tools.hint("lookupWikipedia", "wikipedia", "who", "what is", "when", "history", "born", "capital", "population", "ウィキペディア", "とは", "誰", "歴史", "いつ")
+		tools.untrusted("lookupWikipedia")
+	}
+
+	if *youTubeOn {
+		tools.register("getYouTubeTranscript", "Get the transcript of a YouTube video from its captions, with timestamps, along with its title, channel and length. Long transcripts come in parts; read them all before summarizing the whole video.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"video": {"type": "string", "description": "YouTube video URL or ID"},
+			"language": {"type": "string", "description": "Preferred caption language code, e.g. en or ja (default: English, else the video's)"},
+			"part": {"type": "integer", "description": "Part of the transcript to get, from 1 (default 1)"}
+		},
+		"required": ["video"]
+	}`), newYouTube().tool, true)
+		tools.hint("getYouTubeTranscript", "youtube", "youtu.be", "video", "transcript", "summarize", "summary", "動画", "要約", "字幕")
+		tools.untrusted("getYouTubeTranscript")
+	}
+
+	var documents *documentStore
+	if *documentsOn {
+		documents = newDocumentStore()
+		tools.register("readDocument", "Read a long document the user attached in this conversation, part by part, or the parts best matching a search. Read every part before summarizing a whole document.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "description": "File name of the document (default: the latest attached)"},
+			"part": {"type": "integer", "description": "Part to read, from 1 (default 1)"},
+			"query": {"type": "string", "description": "Words to find, to read the matching parts instead of a given one"}
+		}
+	}`), documents.tool, true)
+		tools.hint("readDocument", "document", "pdf", "docx", "file", "attached", "ファイル", "資料", "添付", "文書")
+		tools.untrusted("readDocument")
+	}
+
+	if githubCfg != nil {
+		gh := newGitHub(*githubCfg)
+		tools.register("getGitHubFile", "Read a file, or list a directory, of a GitHub repository, with numbered lines. Pass the link the user posted, or the repo and path.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"link": {"type": "string", "description": "GitHub link to a file or directory, e.g. https://github.com/owner/name/blob/main/main.go#L10-L40"},
+			"repo": {"type": "string", "description": "Repository as owner/name, when there is no link"},
+			"path": {"type": "string", "description": "File or directory path in the repository (default: its root)"},
+			"ref": {"type": "string", "description": "Branch, tag or commit (default: the default branch)"},
+			"from": {"type": "integer", "description": "First line to read"},
+			"to": {"type": "integer", "description": "Last line to read"}
+		}
+	}`), gh.fileTool, true)
+		tools.register("listGitHubIssues", "List the issues and pull requests of a GitHub repository, or of every repository the bot may read, most recently updated first.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"repo": {"type": "string", "description": "Repository as owner/name (default: all the bot may read)"},
+			"type": {"type": "string", "enum": ["issue", "pr", "all"], "description": "Default all"},
+			"state": {"type": "string", "enum": ["open", "closed", "merged", "all"], "description": "Default open"},
+			"labels": {"type": "array", "items": {"type": "string"}, "description": "Labels they must all have"},
+			"query": {"type": "string", "description": "Words to search titles and descriptions for, in GitHub search syntax"}
+		}
+	}`), gh.issuesTool, true)
+		tools.register("getGitHubIssue", "Read an issue or pull request of a GitHub repository with its description and comments. Pass the link the user posted, or the repo and number.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"link": {"type": "string", "description": "GitHub link to the issue or pull request, or owner/name#123"},
+			"repo": {"type": "string", "description": "Repository as owner/name, when there is no link"},
+			"number": {"type": "integer", "description": "Issue or pull request number"}
+		}
+	}`), gh.issueTool, true)
+		tools.register("searchGitHubCode", "Search the code of GitHub repositories the bot may read, returning matching files with the matching lines and their links.", json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"query": {"type": "string", "description": "Words or identifiers to find, in GitHub code search syntax, e.g. newEngine language:go"},
+			"repo": {"type": "string", "description": "Repository as owner/name (default: all the bot may read)"}
+		},
+		"required": ["query"]
+	}`), gh.codeTool, true)
+		for _, name := range []string{"getGitHubFile", "listGitHubIssues", "getGitHubIssue", "searchGitHubCode"} {
+			tools.hint(name, "github", "repo", "issue", "pull request", "pr ", "/pull/", "リポジトリ", "イシュー", "プルリク")
+		}
+		tools.hint("getGitHubFile", "file", "code", "source", "ファイル", "コード")
+		tools.hint("searchGitHubCode", "code", "function", "where is", "defined", "source", "コード", "関数", "どこ")
+		tools.untrusted("getGitHubFile", "listGitHubIssues", "getGitHubIssue", "searchGitHubCode")
+	}
+
+	if *codeSandboxKind != "" {
+		cs, err := newCodeSandbox(*codeSandboxKind, *codeRuntime, *codeTimeout, *codeMemory)
+		if err != nil {
+			fatal("invalid -code-sandbox", "err", err)
+		}
+		go cs.pull()
+		tools.register("runCode", fmt.Sprintf("Run a short Python or JavaScript program in a sandbox and get its stdout, stderr and exit code. Use it for calculations, data processing and checking code instead of guessing. The sandbox has no network and no files, and stops programs after %s. Print what you need to see.", *codeTimeout), json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"language": {"type": "string", "enum": ["python", "javascript"]},
+			"code": {"type": "string", "description": "The program; it is run as a script"}
+		},
+		"required": ["language", "code"]
+	}`), cs.tool, true)
+		tools.hint("runCode", "calculate", "compute", "python", "javascript", "code", "run", "plot", "csv", "計算", "コード", "実行", "プログラム")
+	}
+
+	for _, pc := range plugins {
+		if len(tools.unknownTools([]string{pc.Name})) == 0 {
+			slog.Error("tool plugin has the name of a built-in tool", "tool", pc.Name)
+			os.Exit(1)
+		}
+		schema, err := pc.schema()
+		if err != nil {
+			slog.Error("invalid parameters of tool plugin", "tool", pc.Name, "err", err)
+			os.Exit(1)
+		}
+		fn, err := pc.tool()
+		if err != nil {
+			slog.Error("failed to load tool plugin", "tool", pc.Name, "err", err)
+			os.Exit(1)
+		}
+		tools.register(pc.Name, pc.Description, schema, fn, true)
+		tools.hint(pc.Name, pc.Keywords...)
+		if !pc.Trusted {
+			tools.untrusted(pc.Name)
+		}
+		slog.Info("tool plugin registered", "tool", pc.Name)
+	}
+	mcpConns := connectMCP(mcpServers)
+	mcpConns.register(tools)
+
+	var hk *hooks
+	if *hooksEnabled {
+		hk = newHooks(*dataDir)
+		tools.dynamic = hk.tools
+		go hk.run()
+	}
+	tools.disabled = parseIDList(*disableTools)
+	if unknown := tools.unknownTools(tools.disabled); len(unknown) > 0 {
+		slog.Warn("-disable-tools names tools that do not exist", "tools", unknown)
+	}
+	if confirmer != nil {
+		if unknown := tools.unknownTools(confirmer.patterns); len(unknown) > 0 {
+			slog.Warn("-confirm-tools names tools that do not exist", "tools", unknown)
+		}
+	}
+	eng := tools.newEngine(engCfg, nil)
+
+	// A stored conversation must outlive its in-memory copy, or it could
+	// expire in the backend while the user is still talking.
+	ttl := *sessionTTL
+	if ttl > 0 && ttl < sessionExpiry {
+		ttl = sessionExpiry
+	}
+	store := newSessionStore(*dataDir, storage.NewSessionStore(blobs, fc, ttl))
+	go store.indexStoredTurns()
+	languagePrefs = func(guildID, userID string) (string, string) {
+		return store.preferences(scopedKey(guildID, userID)).language, guilds.get(guildID).Language
+	}
+
+	admin := &adminCommands{
+		admins:  parseAdmins(*adminIDs),
+		store:   store,
+		mem:     mem,
+		dataDir: *dataDir,
+		blobs:   blobs,
+		vectors: vectors,
+		guilds:  guilds,
+	}
+
+	pages := newPager()
+	quotas := newQuotaTracker()
+	queue := newMessageQueue(*queueDepth, *coalesceWindow)
+	turns := newTurnTracker(*editWindow)
+	workers := newWorkerPool(*workerCount, *workerBacklog)
+	setup := newSetupWizard(guilds, personas, tools)
 
 	go func() {
 		ticker := time.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 		for range ticker.C {
 			store.gc()
+			pages.gc()
 		}
 	}()
+	go func() {
+		ticker := time.NewTicker(sessionFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := store.flush(); err != nil {
+				slog.Error("failed to save sessions", "saved", n, "err", err)
+			} else if n > 0 {
+				slog.Debug("saved sessions", "count", n)
+			}
+		}
+	}()
+
+	if cmd == "repl" {
+		userID := "repl"
+		if len(args) > 0 {
+			userID = args[0]
+		}
+		r := &repl{
+			api: &chatAPI{
+				source:    "repl",
+				store:     store,
+				mem:       mem,
+				memIndex:  memIndex,
+				profiles:  profiles,
+				personas:  personas,
+				guilds:    guilds,
+				ident:     ident,
+				queue:     queue,
+				tools:     tools,
+				engCfg:    engCfg,
+				eng:       eng,
+				genLimits: genLimits,
+				mod:       mod,
+				ctx:       context.Background(),
+				handlers:  &workTracker{},
+			},
+			userID: userID,
+		}
+		err := r.run(os.Stdin, os.Stdout, os.Stderr)
+		mcpConns.close()
+		if err != nil {
+			fatal("REPL failed", "err", err)
+		}
+		return
+	}
 
 	dg, err := discordgo.New("Bot " + *token)
 	if err != nil {
-		log.Fatalf("Failed to create Discord session: %v", err)
+		fatal("failed to create Discord session", "err", err)
+	}
+	if mod != nil {
+		mod.sender = dg
+	}
+
+	resume := newResumePrompter(store)
+	checkins := newCheckinStore(*dataDir)
+	training := newTrainingStore(*dataDir)
+	feedback := newFeedbackStore(*dataDir, fc)
+	replies := newOutbox(*dataDir, fc)
+	announcements := newAnnouncer(*dataDir, plainEng, replies, guildDefaults)
+	feeds := newFeedPoller(*dataDir, plainEng, replies)
+	go replies.run(dg)
+	go reminders.run(dg)
+	events.s = dg
+	go events.run(dg)
+	store.onEnd = topics.archive
+	if *profileInterval > 0 {
+		store.onEnd = func(key string, started time.Time, msgs []openai.ChatCompletionMessage) {
+			topics.archive(key, started, msgs)
+			profiles.touch(key)
+		}
+		go profiles.run(dg, time.Hour)
 	}
+	var notify []string
+	if *updateDM {
+		for id := range admin.admins {
+			notify = append(notify, id)
+		}
+	}
+	updates := newUpdateChecker(notify)
+	var missed *missedMentions
+	if *missedWindow > 0 {
+		if *missedAction != "notify" && *missedAction != "answer" {
+			fatal("invalid -missed-action (use notify or answer)", "value", *missedAction)
+		}
+		missed = newMissedMentions(*dataDir, *missedWindow, *missedAction == "answer")
+	}
+	reactCfg := engCfg
+	reactCfg.SystemMessage = nil
+	if *reactionModel != "" {
+		reactCfg.Model = *reactionModel
+	}
+	reactions := newReactor(guilds, engine.New(reactCfg), *reactionInterval)
+	translateCfg := reactCfg
+	translateCfg.Model = engCfg.Model
+	if *translateModel != "" {
+		translateCfg.Model = *translateModel
+	}
+	translations := newTranslator(guilds, engine.New(translateCfg))
+	var moods *moodClassifier
+	if *moodAware {
+		moodCfg := reactCfg
+		moodCfg.Model = engCfg.Model
+		if *moodModel != "" {
+			moodCfg.Model = *moodModel
+		}
+		moods = &moodClassifier{eng: engine.New(moodCfg)}
+	}
+	var skillRoutes *skillRouter
+	if *skillRouting {
+		skillCfg := reactCfg
+		skillCfg.Model = engCfg.Model
+		if *skillModel != "" {
+			skillCfg.Model = *skillModel
+		}
+		skillRoutes = &skillRouter{eng: engine.New(skillCfg)}
+	}
+	meetings := newMeetingRecorder(*dataDir, client, *transcriptionModel, plainEng)
+	router := newCommandRouter(*prefix, store, mem, topics, checkins, *checkinInterval, admin, eng, providerName, updates, meetings)
 
-	dg.AddHandler(func(s *discordgo.Session, m *discordgo.MessageCreate) {
-		if m.Author.ID == s.State.User.ID {
+	// handlers tracks running message handlers, and shutdownCtx cancels
+	// their generations when shutdown stops waiting for them.
+	var handlers workTracker
+	shutdownCtx, cancelGenerations := context.WithCancel(context.Background())
+	defer cancelGenerations()
+
+	onMessage := func(s *discordgo.Session, m *discordgo.MessageCreate) {
+		if m.Author.ID == s.State.User.ID || !mode.allows(m.GuildID == "") {
+			return
+		}
+		if !handlers.begin() {
 			return
 		}
+		// handedOff is set once a worker takes over the rest of the work.
+		handedOff := false
+		defer func() {
+			if !handedOff {
+				handlers.end()
+			}
+		}()
 
 		content := m.Content
 
-		ch, err := s.State.Channel(m.ChannelID)
-		if err != nil {
-			ch, err = s.Channel(m.ChannelID)
-			if err != nil {
+		// Edited messages come from the MessageUpdate handler and are
+		// answered again only if they triggered the last reply.
+		var edit *replyTurn
+		if m.EditedTimestamp != nil {
+			if edit = turns.take(m.ID, m.Content); edit == nil {
 				return
 			}
 		}
+
+		ch, err := channel(s, m.ChannelID)
+		if err != nil {
+			return
+		}
 		isDM := ch.Type == discordgo.ChannelTypeDM
+		inBotThread := *threadMode && ch.IsThread() && ch.OwnerID == s.State.User.ID
+		inForumPost := isForumPost(s, ch)
+		if edit == nil {
+			reactions.consider(s, m)
+			translations.consider(s, m)
+		}
 
-		if !isDM {
-			mentioned := false
+		// Text commands need the prefix or a mention to have been
+		// stripped. In DMs and bot threads, where neither is needed to talk
+		// to the bot, only the prefix makes a command.
+		mentioned, prefixed := false, false
+		commandText := content
+		if !isDM && !inBotThread {
 			for _, mention := range m.Mentions {
 				if mention.ID == s.State.User.ID {
 					mentioned = true
@@ -481,71 +2052,676 @@ func main() {
 			if !mentioned {
 				content = strings.TrimPrefix(content, *prefix)
 				content = strings.TrimSpace(content)
+				prefixed = true
 			}
+			commandText = content
+		} else if strings.HasPrefix(content, *prefix) {
+			commandText = strings.TrimSpace(strings.TrimPrefix(content, *prefix))
+			prefixed = true
 		}
 
-		if content == "" {
+		var docAtts []*discordgo.MessageAttachment
+		if documents != nil {
+			docAtts = documentAttachments(m.Attachments)
+		}
+		if content == "" && len(docAtts) == 0 {
 			return
 		}
 
-		s.ChannelTyping(m.ChannelID)
+		received := time.Now()
+		requestID := newRequestID()
+		ctx, span := tracer.Start(shutdownCtx, "discord message", trace.WithAttributes(
+			attribute.String("request_id", requestID),
+			attribute.String("discord.guild_id", m.GuildID),
+			attribute.String("discord.channel_id", m.ChannelID),
+		))
+		defer func() {
+			if !handedOff {
+				span.End()
+			}
+		}()
+		rlog := slog.With(
+			"request_id", requestID,
+			"user", hashID(m.Author.ID),
+			"guild", m.GuildID,
+			"channel", m.ChannelID,
+		)
+
+		if args, ok := router.match(commandText, prefixed, mentioned); ok {
+			if edit != nil {
+				return
+			}
+			key := m.Author.ID
+			if inBotThread || inForumPost {
+				key = m.ChannelID
+			}
+			call := &commandCall{s: s, m: m, sessionKey: scopedKey(m.GuildID, key), userKey: scopedKey(m.GuildID, m.Author.ID), args: args}
+			call.loc = pickLocale(store.preferences(call.userKey).language, guilds.get(m.GuildID).Language)
+			sendReply(s, m.ChannelID, m.Reference(), router.dispatch(call))
+			command := ""
+			if len(args) > 0 {
+				command = args[0]
+			}
+			rlog.Info("handled command", "command", command, "latency_ms", time.Since(received).Milliseconds())
+			return
+		}
 
-		sess := store.get(m.Author.ID)
-		sess.mu.Lock()
-		defer sess.mu.Unlock()
+		gcfg := guilds.get(m.GuildID)
+		parentID := ""
+		if ch.IsThread() {
+			parentID = ch.ParentID
+		}
+		if !gcfg.allowsChannel(m.ChannelID, parentID) {
+			return
+		}
+		hookMsg := hookMessage{
+			UserID:    m.Author.ID,
+			Username:  m.Author.Username,
+			GuildID:   m.GuildID,
+			ChannelID: m.ChannelID,
+			DM:        isDM,
+		}
+		if hk != nil {
+			hookMsg.Content = content
+			res := hk.messagePre(ctx, hookMsg)
+			switch {
+			case res.Drop:
+				rlog.Info("message dropped by hook")
+				return
+			case res.Reply != "":
+				sendReply(s, m.ChannelID, m.Reference(), res.Reply)
+				rlog.Info("message answered by hook")
+				return
+			case res.Content == "":
+				return
+			}
+			content = res.Content
+		}
+		// Until the conversation is loaded, messages are in the guild's
+		// language or the message's.
+		loc := pickLocale(gcfg.Language, detectLanguage(content))
+		if !quotas.allow(m.GuildID, m.Author.ID, gcfg.DailyQuota) {
+			sendReply(s, m.ChannelID, m.Reference(), loc.tr("You have reached today's usage limit. Please try again tomorrow."))
+			return
+		}
+		promptEvent := moderationEvent{Source: "discord", Direction: "prompt", GuildID: m.GuildID, ChannelID: m.ChannelID, MessageID: m.ID, User: hashID(m.Author.ID)}
+		switch mod.screen(ctx, gcfg, promptEvent, content) {
+		case moderationBlock:
+			sendReply(s, m.ChannelID, m.Reference(), loc.tr("I can't answer this message because it was flagged by moderation."))
+			return
+		case moderationRedact:
+			if err := s.ChannelMessageDelete(m.ChannelID, m.ID); err != nil {
+				rlog.Warn("failed to delete flagged message", "err", err)
+				sendReply(s, m.ChannelID, m.Reference(), loc.tr("I can't answer this message because it was flagged by moderation."))
+				return
+			}
+			s.ChannelMessageSend(m.ChannelID, loc.tr("<@%s>, your message was removed because it was flagged by moderation.", m.Author.ID))
+			return
+		}
+		if missed != nil {
+			missed.seen(m.GuildID, m.ChannelID)
+		}
 
-		sess.messages = append(sess.messages, engine.UserMessage(content)...)
+		sessionKey := m.Author.ID
+		replyChannel := m.ChannelID
+		replyRef := m.Reference()
+		if inBotThread || inForumPost {
+			sessionKey = m.ChannelID
+		} else if *threadMode && !isDM && !ch.IsThread() && edit == nil {
+			th, err := s.MessageThreadStart(m.ChannelID, m.ID, threadName(content), 1440)
+			if err != nil {
+				rlog.Warn("failed to start thread", "err", err)
+			} else {
+				sessionKey = th.ID
+				replyChannel = th.ID
+				replyRef = nil
+			}
+		}
+		sessionKey = scopedKey(m.GuildID, sessionKey)
+		if edit != nil {
+			// The reply is edited where it was posted.
+			sessionKey, replyChannel = edit.sessionKey, edit.channelID
+		}
 
-		chatMsgs := sess.messages
-		if memMd := mem.asMarkdown(m.Author.ID); memMd != "" {
-			sysContent := systemPrompt + memMd
-			chatMsgs = append([]openai.ChatCompletionMessage{{
-				Role:    openai.ChatMessageRoleSystem,
-				Content: sysContent,
-			}}, chatMsgs...)
+		if len(docAtts) > 0 {
+			docCtx, docCancel := context.WithTimeout(ctx, 2*time.Minute)
+			content = documents.attach(docCtx, sessionKey, docAtts, content)
+			docCancel()
 		}
 
-		ctx := context.WithValue(context.Background(), ctxKeyUserID, m.Author.ID)
-		reply, updatedMsgs, err := eng.Chat(ctx, chatMsgs, engine.ChatOptions{})
+		tk, err := queue.enter(sessionKey, content)
 		if err != nil {
-			log.Printf("engine error: %v", err)
-			s.ChannelMessageSend(m.ChannelID, "エラーが発生しました: "+err.Error())
+			sendReply(s, replyChannel, replyRef, loc.tr("Too many messages are waiting for a reply. Please wait for the previous reply first."))
 			return
 		}
-		filtered := updatedMsgs
-		if len(filtered) > 0 && filtered[0].Role == openai.ChatMessageRoleSystem {
-			filtered = filtered[1:]
+		var notice *busyNotice
+		if tk.queued {
+			notice = postBusyNotice(s, replyChannel, replyRef, loc)
 		}
-		sess.messages = filtered
-
-		if err := saveSession(store.dataDir, m.Author.ID, sess.messages); err != nil {
-			log.Printf("failed to save session for %s: %v", m.Author.ID, err)
+		text, ok := tk.wait(ctx)
+		if !ok {
+			// Merged into a reply that is starting now, or given up.
+			notice.clear()
+			return
 		}
+		content = text
+
+		// The reply is generated on a worker, which takes over ending the
+		// span, the queue turn and the handler's unit of work.
+		handedOff = workers.submit(func() {
+			defer handlers.end()
+			defer span.End()
+			defer tk.done()
+			defer notice.clear()
+
+			stopTyping := keepTyping(ctx, s, replyChannel)
+			defer stopTyping()
+
+			_, loadSpan := tracer.Start(ctx, "session load")
+			prefs := store.preferences(scopedKey(m.GuildID, m.Author.ID))
+			sess := store.get(sessionKey)
+			loadSpan.End()
+			sess.mu.Lock()
+
+			if !sess.staleSince.IsZero() {
+				resume.ask(s, replyChannel, replyRef, sessionKey, m, sess.staleSince, pickLocale(prefs.language, gcfg.Language, detectLanguage(content)))
+				sess.mu.Unlock()
+				return
+			}
+			if edit != nil {
+				if sess.epoch != edit.epoch || len(sess.messages) != edit.end {
+					// The conversation changed since the reply.
+					sess.mu.Unlock()
+					return
+				}
+				sess.messages = sess.messages[:edit.start]
+			}
+
+			lang := prefs.language
+			if lang == "" {
+				lang = gcfg.Language
+			}
+			if lang == "" {
+				lang = detectLanguage(content)
+			}
+			loc := pickLocale(lang)
+
+			dual := prefs.dualLanguage
+			if dual == "" {
+				dual = gcfg.DualLanguage
+			}
+
+			if inForumPost && len(sess.messages) == 0 {
+				content = forumPostContext(s, ch, m.ID, content)
+			}
+			if len(sess.messages) == 0 {
+				sess.started = time.Now()
+			}
+			sess.messages = append(sess.messages, engine.UserMessage(content)...)
+			sess.dirty = true
+
+			prompt, err := basePrompt(ident.get(), prefs.persona, gcfg, personas)
+			if err != nil {
+				rlog.Warn("failed to load persona", "err", err)
+			}
+
+			// The queue keeps replies in this conversation from overlapping, so
+			// the session is unlocked while the reply is generated.
+			epoch := sess.epoch
+			history := slices.Clone(sess.messages)
+			gen := genLimits.apply(prefs.generation)
+			sess.beginReply()
+			sess.mu.Unlock()
+
+			memCtx, memCancel := context.WithTimeout(ctx, 15*time.Second)
+			memCtx, memSpan := tracer.Start(memCtx, "memory retrieval")
+			scope := memoryScope{GuildID: m.GuildID, ChannelID: m.ChannelID}
+			memMd := mem.relevantMarkdown(memCtx, memIndex, m.Author.ID, scope, content)
+			memSpan.End()
+			memCancel()
+			memMd += profiles.markdown(sessionKey)
+			if moods != nil {
+				moodCtx, moodCancel := context.WithTimeout(ctx, 10*time.Second)
+				memMd += moods.hint(moodCtx, history)
+				moodCancel()
+			}
+
+			var skill string
+			if skillRoutes != nil {
+				skillCtx, skillCancel := context.WithTimeout(ctx, 10*time.Second)
+				skill = skillRoutes.classify(skillCtx, content)
+				skillCancel()
+			}
+
+			chatMsgs := withSystemPrompt(history, prompt+memMd+skillHint(skill)+languageHint(lang)+dualLanguageHint(dual))
+
+			usage := &tokenUsage{}
+			ctx = context.WithValue(ctx, ctxKeyUserID, m.Author.ID)
+			ctx = context.WithValue(ctx, ctxKeyGuildID, m.GuildID)
+			ctx = context.WithValue(ctx, ctxKeyMemoryScope, scope)
+			ctx = context.WithValue(ctx, ctxKeySessionKey, sessionKey)
+			ctx = withTokenUsage(ctx, usage)
+			ctx = withGeneration(ctx, gen)
+			progress := &turnProgress{store: store, key: sessionKey, sess: sess, epoch: epoch}
+			ctx = withTurnProgress(ctx, progress)
+			ctx = withConfirmTarget(ctx, &confirmTarget{s: s, channelID: replyChannel, ref: replyRef, userID: m.Author.ID, loc: loc})
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			guard := newLoopGuard(cancel)
+			var toolsUsed []string
+			start := time.Now()
+			var toolNames []string
+			if *toolSelection == "keyword" {
+				toolNames = tools.relevant(content, *maxTools)
+			}
+			disabledTools := gcfg.disabledTools(m.ChannelID, parentID)
+			if len(disabledTools) > 0 {
+				if toolNames == nil {
+					toolNames = tools.names(disabledTools)
+				} else {
+					toolNames = slices.DeleteFunc(toolNames, func(n string) bool {
+						return toolDisabled(disabledTools, n)
+					})
+				}
+			}
+			if skill != "" {
+				toolNames = skillTools(skill, toolNames, tools.names(disabledTools))
+			}
+			chatEng := eng
+			if toolNames == nil && hk != nil {
+				// Hook tools may have changed since eng was built.
+				toolNames = tools.names(disabledTools)
+			}
+			if toolNames != nil || gcfg.NoSystemPrompt {
+				cfg := engCfg
+				cfg.Model = eng.Model()
+				if gcfg.NoSystemPrompt {
+					// Keep the engine from falling back to the identity.
+					cfg.SystemMessage = nil
+				}
+				chatEng = tools.newEngine(cfg, toolNames)
+			}
+			chatCtx, chatSpan := tracer.Start(ctx, "llm chat", trace.WithAttributes(
+				attribute.String("llm.model", providerName+"/"+chatEng.Model()),
+			))
+			reply, updatedMsgs, err := chatEng.Chat(chatCtx, chatMsgs, engine.ChatOptions{
+				Skill:     skill,
+				OnContent: guard.onContent,
+				OnToolCall: func(name, arguments string) {
+					toolsUsed = append(toolsUsed, name)
+					guard.onToolCall(name, arguments)
+				},
+			})
+			stopTyping()
+			stats.record(providerName+"/"+chatEng.Model(), time.Since(start), toolsUsed)
+			promptTokens, completionTokens, estimated := usage.counts(chatMsgs, reply)
+			chatSpan.SetAttributes(
+				attribute.Int("llm.prompt_tokens", promptTokens),
+				attribute.Int("llm.completion_tokens", completionTokens),
+				attribute.StringSlice("llm.tools", toolsUsed),
+			)
+			endSpan(chatSpan, err)
+			rlog = rlog.With("model", providerName+"/"+chatEng.Model())
+			rlog.Info("handled message",
+				"latency_ms", time.Since(received).Milliseconds(),
+				"prompt_tokens", promptTokens,
+				"completion_tokens", completionTokens,
+				"tokens_estimated", estimated,
+				"tools", toolsUsed,
+				"skill", skill,
+			)
+			if reason := guard.tripped(); reason != "" {
+				rlog.Warn("loop guard aborted generation", "reason", reason)
+				progress.discard()
+				sendReply(s, replyChannel, replyRef, loc.tr(loopAbortMessage))
+				return
+			}
+			if err != nil && shutdownCtx.Err() != nil {
+				// The user message and the finished tool calls stay in the
+				// session and are saved by the shutdown flush.
+				rlog.Warn("generation cancelled by shutdown")
+				return
+			}
+			if err != nil {
+				rlog.Error("engine error", "err", err)
+				progress.discard()
+				s.ChannelMessageSend(replyChannel, loc.tr("An error occurred: %s", err))
+				return
+			}
+			replyEvent := moderationEvent{Source: "discord", Direction: "reply", GuildID: m.GuildID, ChannelID: replyChannel, MessageID: m.ID, User: hashID(m.Author.ID)}
+			switch mod.screen(ctx, gcfg, replyEvent, reply) {
+			case moderationBlock:
+				// The reply is not stored, as after an error.
+				progress.discard()
+				sendReply(s, replyChannel, replyRef, loc.tr("I can't send the reply because it was flagged by moderation."))
+				return
+			case moderationRedact:
+				reply = loc.tr("[removed by moderation]")
+				if n := len(updatedMsgs); n > 0 && updatedMsgs[n-1].Role == openai.ChatMessageRoleAssistant {
+					updatedMsgs[n-1].Content, updatedMsgs[n-1].MultiContent = reply, nil
+				}
+			}
+			filtered := updatedMsgs
+			if len(filtered) > 0 && filtered[0].Role == openai.ChatMessageRoleSystem {
+				filtered = filtered[1:]
+			}
+			var turn *replyTurn
+			sess.mu.Lock()
+			if sess.epoch == epoch {
+				// Keep what was added meanwhile, such as a check-in.
+				sess.mergeReply(filtered)
+				if err := store.save(sessionKey, sess); err != nil {
+					rlog.Error("failed to save session", "err", err)
+				}
+				start := len(filtered) - 1
+				for start > 0 && filtered[start].Role != openai.ChatMessageRoleUser {
+					start--
+				}
+				turn = &replyTurn{
+					sessionKey: sessionKey,
+					channelID:  replyChannel,
+					triggerID:  m.ID,
+					content:    m.Content,
+					start:      max(start, 0),
+					end:        len(sess.messages),
+					epoch:      sess.epoch,
+				}
+			} else {
+				rlog.Info("conversation was reset while replying; reply not stored")
+			}
+			sess.mu.Unlock()
+
+			if hk != nil {
+				hookMsg.Content = content
+				reply = hk.replyPost(ctx, hookMsg, reply)
+			}
+			if reply == "" {
+				reply = loc.tr("(no reply)")
+			}
 
-		if reply == "" {
-			reply = "(応答なし)"
+			_, sendSpan := tracer.Start(ctx, "reply send")
+			defer sendSpan.End()
+			if *embedMode && utf8.RuneCountInString(reply) > discordLimit {
+				if edit != nil {
+					// Paged replies are sent anew; the old reply goes.
+					deleteMessages(s, replyChannel, edit.replyIDs)
+				}
+				if turn != nil {
+					sess.mu.Lock()
+					store.addTurn(sessionKey, sess, m.ID, nil, providerName+"/"+chatEng.Model())
+					sess.mu.Unlock()
+				}
+				footer := replyFooter{model: providerName + "/" + chatEng.Model(), prompt: promptTokens, completion: completionTokens, estimated: estimated}
+				pages.send(s, replyChannel, replyRef, threadName(content), footer, reply)
+				return
+			}
+			var ids []string
+			if edit != nil {
+				ids = editReply(s, replyChannel, edit.replyIDs, reply)
+			} else {
+				ids = replies.send(s, replyChannel, replyRef, reply)
+			}
+			if *collectFeedback {
+				feedback.track(s, replyChannel, ids, feedbackRecord{
+					GuildID:  m.GuildID,
+					AskedBy:  m.Author.ID,
+					Model:    providerName + "/" + chatEng.Model(),
+					Prompt:   content,
+					Response: reply,
+				})
+			}
+			if turn != nil && len(ids) > 0 {
+				turn.replyIDs, turn.at = ids, time.Now()
+				turns.record(turn)
+				sess.mu.Lock()
+				store.addTurn(sessionKey, sess, m.ID, ids, providerName+"/"+chatEng.Model())
+				sess.mu.Unlock()
+			}
+		})
+		if !handedOff {
+			tk.done()
+			notice.clear()
+			sendReply(s, replyChannel, replyRef, loc.tr("I'm busy right now. Please wait a moment and send it again."))
+		}
+	}
+	resume.handle = onMessage
+	if missed != nil {
+		var admins []string
+		for id := range admin.admins {
+			admins = append(admins, id)
 		}
+		dg.AddHandler(missed.handleReady(onMessage, admins))
+		go missed.run()
+	}
 
-		const discordLimit = 2000
-		for _, part := range splitMessage(reply, discordLimit) {
-			if _, err := s.ChannelMessageSendReply(m.ChannelID, part, m.Reference()); err != nil {
-				log.Printf("send error: %v", err)
+	dg.AddHandler(onMessage)
+	if *editWindow > 0 {
+		dg.AddHandler(func(s *discordgo.Session, u *discordgo.MessageUpdate) {
+			if u.Author == nil || u.EditedTimestamp == nil {
+				return
 			}
+			onMessage(s, &discordgo.MessageCreate{Message: u.Message})
+		})
+	}
+	dg.AddHandler(func(s *discordgo.Session, g *discordgo.GuildDelete) {
+		// Unavailable means an outage, not that the bot was removed.
+		if !g.Unavailable {
+			slog.Info("removed from guild; its data stays until `yagi admin purge guild <id>`", "guild", g.ID)
 		}
 	})
+	dg.AddHandler(resume.handleComponent)
+	if confirmer != nil {
+		dg.AddHandler(confirmer.handleComponent)
+	}
+	dg.AddHandler(events.handleComponent)
+	dg.AddHandler(store.handleMessageDelete)
+	dg.AddHandler(store.handleMessageDeleteBulk)
+
+	dg.AddHandler(pages.handleComponent)
+	dg.AddHandler(setup.handleComponent)
+	dg.AddHandler(handleMemoryComponent(mem))
+	dg.AddHandler(meetings.handleComponent)
+	ud := &userData{store: store, mem: mem, vectors: vectors, topics: topics, profiles: profiles, quotas: quotas, checkins: checkins, training: training, feedback: feedback, reminders: reminders, events: events}
+	dg.AddHandler(handleMydataComponent(ud))
+	asks := newAsker(plainEng, store, guilds, quotas)
+	dg.AddHandler(asks.handleModal)
+
+	cmdGuilds := parseIDList(*commandGuilds)
+	if mode == modeDMOnly && len(cmdGuilds) > 0 {
+		// Commands registered in a guild cannot be used in DMs.
+		slog.Warn("-command-guilds is ignored with -mode dm-only; registering commands globally")
+		cmdGuilds = nil
+	}
+	cmds := []*slashCommand{
+		identityCommand(ident, admin),
+		personaCommand(personas, store),
+		languageCommand(store),
+		dualCommand(store, guilds),
+		setup.command(),
+		memoryCommand(mem),
+		mydataCommand(ud),
+		exportCommand(store),
+		newConversationImporter(store, personas).command(),
+		checkpointCommand(store),
+		settingsCommand(store, genLimits),
+		checkinCommand(checkins, *checkinInterval),
+		trainingCommand(training),
+		reactionsCommand(guilds),
+		translateCommand(guilds),
+		askCommand(asks, false),
+		askCommand(asks, true),
+		summarizeFromHereCommand(plainEng, guilds, quotas),
+		summarizeCommand(plainEng, guilds, quotas),
+		apiKeyCommand(guildAPIKeys),
+		remindersCommand(reminders),
+		scheduleCommand(announcements),
+		digestCommand(announcements),
+	}
+	if *feedInterval > 0 {
+		cmds = append(cmds, feedCommand(feeds))
+	}
+	if mod != nil {
+		cmds = append(cmds, mod.command(guilds))
+	}
+	if tools.audit != nil {
+		cmds = append(cmds, auditCommand(tools.audit, admin))
+	}
+	cmds = append(cmds, toolsCommand(tools, guilds))
+	registerSlashCommands(dg, cmdGuilds, mode.commands(cmds))
+
+	// Meetings need to know who is in which voice channel, and feedback
+	// needs the reactions.
+	dg.Identify.Intents = mode.intents(*transcriptionModel != "", *collectFeedback)
+	if *collectFeedback {
+		dg.AddHandler(feedback.handleReactionAdd)
+		dg.AddHandler(feedback.handleReactionRemove)
+	}
+
+	if *otlpEndpoint != "" {
+		shutdown, err := setupTracing(context.Background(), *otlpEndpoint, updates.current)
+		if err != nil {
+			fatal("failed to set up tracing", "err", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			shutdown(ctx)
+		}()
+	}
 
-	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsDirectMessages | discordgo.IntentsMessageContent
+	// The HTTP server starts before the gateway connects so that probes
+	// see the bot as alive but not ready while it logs in.
+	health := newHealthChecker(*dataDir, client)
+	health.register(dg)
+	wd := newWatchdog()
+	go wd.run(time.Minute)
+	if *httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /metrics", wd)
+		mux.HandleFunc("GET /healthz", health.handleHealthz)
+		mux.HandleFunc("GET /readyz", health.handleReadyz)
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, mux); err != nil {
+				slog.Error("HTTP server failed", "addr", *httpAddr, "err", err)
+			}
+		}()
+	}
+
+	if *webhookAddr != "" {
+		if *webhookSecret == "" {
+			fatal("-webhook-addr needs -webhook-secret")
+		}
+		routes, err := parseWebhookRoutes(*webhookRoutes)
+		if err != nil {
+			fatal("invalid -webhook-routes", "err", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("POST /github", &githubWebhook{
+			secret:  []byte(*webhookSecret),
+			routes:  routes,
+			eng:     plainEng,
+			replies: replies,
+			s:       dg,
+		})
+		go func() {
+			if err := http.ListenAndServe(*webhookAddr, mux); err != nil {
+				slog.Error("webhook server failed", "addr", *webhookAddr, "err", err)
+			}
+		}()
+	}
+
+	if *apiAddr != "" {
+		if *apiToken == "" {
+			fatal("-api-addr needs -api-token")
+		}
+		api := &chatAPI{
+			token:     *apiToken,
+			source:    "api",
+			store:     store,
+			mem:       mem,
+			memIndex:  memIndex,
+			profiles:  profiles,
+			personas:  personas,
+			guilds:    guilds,
+			ident:     ident,
+			queue:     queue,
+			tools:     tools,
+			engCfg:    engCfg,
+			eng:       eng,
+			genLimits: genLimits,
+			mod:       mod,
+			ctx:       shutdownCtx,
+			handlers:  &handlers,
+		}
+		go func() {
+			if err := http.ListenAndServe(*apiAddr, api.handler()); err != nil {
+				slog.Error("API server failed", "addr", *apiAddr, "err", err)
+			}
+		}()
+	}
 
 	if err := dg.Open(); err != nil {
-		log.Fatalf("Failed to open Discord connection: %v", err)
+		fatal("failed to open Discord connection", "err", err)
+	}
+
+	scheduler := &checkinScheduler{
+		checkins: checkins,
+		mem:      mem,
+		store:    store,
+		eng:      plainEng,
+		ident:    ident,
+		interval: *checkinInterval,
+	}
+	go scheduler.run(dg, time.Hour)
+	go announcements.run(dg)
+	if *feedInterval > 0 {
+		go feeds.run(dg, *feedInterval)
+	}
+	if *updateCheck {
+		go updates.run(dg, 24*time.Hour)
+	}
+	if *backupChannel != "" {
+		backups := &backupPoster{
+			dataDir:   *dataDir,
+			channelID: *backupChannel,
+			cipher:    fc,
+			interval:  *backupInterval,
+		}
+		go backups.run(dg)
 	}
-	defer dg.Close()
 
-	log.Println("yagi-discord-bot is running. Press Ctrl+C to stop.")
+	slog.Info("yagi-discord-bot is running. Press Ctrl+C to stop.", "version", updates.current)
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for v := range sig {
+		if v != syscall.SIGHUP {
+			break
+		}
+		if err := ident.reload(); err != nil {
+			slog.Error("failed to reload identity", "err", err)
+		} else {
+			slog.Info("identity reloaded", "path", idPath)
+		}
+	}
 
-	log.Println("Shutting down...")
+	slog.Info("shutting down", "timeout", *shutdownTimeout)
+	deadline := time.Now().Add(*shutdownTimeout)
+	if !handlers.close(*shutdownTimeout) {
+		slog.Warn("cancelling generations still running at the shutdown timeout")
+		cancelGenerations()
+		handlers.close(5 * time.Second)
+	}
+	if n, err := store.flush(); err != nil {
+		slog.Error("failed to save sessions", "saved", n, "err", err)
+	} else {
+		slog.Info("saved sessions", "count", n)
+	}
+	if !store.ending.close(time.Until(deadline)) {
+		slog.Warn("conversation summaries still running at the shutdown timeout were dropped")
+	}
+	if err := dg.Close(); err != nil {
+		slog.Warn("failed to close Discord connection", "err", err)
+	}
+	mcpConns.close()
 }
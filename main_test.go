@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+func TestWithSystemPromptWithoutMemory(t *testing.T) {
+	history := engine.UserMessage("hello")
+	prompt, err := basePrompt("You are yagi.", "", guildConfig{}, newPersonaStore(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No memory and no hints: the identity alone is still sent.
+	got := withSystemPrompt(history, prompt+memoryMarkdown(nil))
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want the system prompt and the user message", len(got))
+	}
+	if got[0].Role != openai.ChatMessageRoleSystem || got[0].Content != "You are yagi." {
+		t.Errorf("first message = %s %q, want the identity as system prompt", got[0].Role, got[0].Content)
+	}
+	if len(history) != 1 || history[0].Role != openai.ChatMessageRoleUser {
+		t.Errorf("history changed to %+v", history)
+	}
+}
+
+func TestWithSystemPromptDoesNotDuplicateSystemMessage(t *testing.T) {
+	history := append([]openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: "old prompt",
+	}}, engine.UserMessage("hello")...)
+	got := withSystemPrompt(history, "new prompt")
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want one system message and the user message", len(got))
+	}
+	if got[0].Role != openai.ChatMessageRoleSystem || got[0].Content != "new prompt" {
+		t.Errorf("first message = %s %q, want the new prompt", got[0].Role, got[0].Content)
+	}
+	if got[1].Role != openai.ChatMessageRoleUser {
+		t.Errorf("second message is %s, want the user message", got[1].Role)
+	}
+	if history[0].Content != "old prompt" {
+		t.Errorf("history changed to %+v", history)
+	}
+}
+
+func TestBasePromptGuildOptOut(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "pirate.md"), []byte("You are a pirate."), 0600); err != nil {
+		t.Fatal(err)
+	}
+	personas := newPersonaStore(dir)
+
+	prompt, err := basePrompt("You are yagi.", "pirate", guildConfig{}, personas)
+	if err != nil || prompt != "You are a pirate." {
+		t.Errorf("basePrompt with a persona = %q, %v; want the persona", prompt, err)
+	}
+
+	cfg := guildConfig{Persona: "pirate", NoSystemPrompt: true}
+	for _, persona := range []string{"", "pirate"} {
+		prompt, err := basePrompt("You are yagi.", persona, cfg, personas)
+		if err != nil || prompt != "" {
+			t.Errorf("basePrompt(persona %q) in an opted-out guild = %q, %v; want none", persona, prompt, err)
+		}
+	}
+	history := engine.UserMessage("hello")
+	if got := withSystemPrompt(history, ""); len(got) != 1 || got[0].Role != openai.ChatMessageRoleUser {
+		t.Errorf("withSystemPrompt without a prompt = %+v, want the history alone", got)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+const (
+	// mcpConnectTimeout bounds starting and listing a server at startup.
+	mcpConnectTimeout = 30 * time.Second
+	// mcpCallTimeout is the timeout of a call without the server's own.
+	mcpCallTimeout = 60 * time.Second
+	// mcpMaxResources bounds the resources listed to the model.
+	mcpMaxResources = 50
+)
+
+// mcpServerConfig declares an MCP server, in the "mcp" section of the
+// config file, keyed by a name of its own. The bot starts Command and talks
+// to it over stdin and stdout, or connects to URL.
+type mcpServerConfig struct {
+	Command []string `yaml:"command"`
+	// Env is added to the minimal environment Command runs with.
+	Env map[string]string `yaml:"env"`
+	URL string            `yaml:"url"`
+	// Headers are sent with every request to URL.
+	Headers map[string]string `yaml:"headers"`
+	// Timeout bounds each tool call.
+	Timeout time.Duration `yaml:"timeout"`
+	// Tools, names or patterns, limits the tools taken from the server.
+	Tools []string `yaml:"tools"`
+	// Trusted results are passed to the model as they are.
+	Trusted bool `yaml:"trusted"`
+}
+
+// check validates c and fills in its defaults.
+func (c *mcpServerConfig) check() error {
+	switch {
+	case c.URL != "" && len(c.Command) > 0:
+		return errors.New("url and command cannot both be set")
+	case c.URL != "":
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return fmt.Errorf("url %q must be an http or https URL", c.URL)
+		}
+		if len(c.Env) > 0 {
+			return errors.New("env is only passed to a command")
+		}
+	case len(c.Command) > 0:
+		if len(c.Headers) > 0 {
+			return errors.New("headers are only sent to a url")
+		}
+	default:
+		return errors.New("url or command is required")
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = mcpCallTimeout
+	}
+	return nil
+}
+
+// mcpServer is a connected MCP server.
+type mcpServer struct {
+	name    string
+	cfg     mcpServerConfig
+	session *mcp.ClientSession
+}
+
+// mcpClients holds the connections to the MCP servers of the config file.
+type mcpClients struct {
+	servers []*mcpServer
+}
+
+// connectMCP connects to servers. A server that cannot be reached is
+// logged and left out.
+func connectMCP(servers map[string]mcpServerConfig) *mcpClients {
+	client := mcp.NewClient(&mcp.Implementation{Name: "yagi-discord-bot", Version: currentVersion()}, nil)
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mc := &mcpClients{}
+	for _, name := range names {
+		cfg := servers[name]
+		var transport mcp.Transport
+		if cfg.URL != "" {
+			transport = &mcp.StreamableClientTransport{
+				Endpoint:   cfg.URL,
+				HTTPClient: &http.Client{Transport: &headerTransport{headers: cfg.Headers, base: http.DefaultTransport}},
+			}
+		} else {
+			cmd := exec.Command(cfg.Command[0], cfg.Command[1:]...)
+			cmd.Env = pluginEnv(cfg.Env)
+			transport = &mcp.CommandTransport{Command: cmd}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+		session, err := client.Connect(ctx, transport, nil)
+		cancel()
+		if err != nil {
+			slog.Error("failed to connect to MCP server", "server", name, "err", err)
+			continue
+		}
+		mc.servers = append(mc.servers, &mcpServer{name: name, cfg: cfg, session: session})
+	}
+	return mc
+}
+
+// register adds the tools of the servers to tools, and readResource if
+// any server has resources. A tool whose name is taken is left out.
+func (mc *mcpClients) register(tools *toolRegistry) {
+	var resources []string
+	for _, srv := range mc.servers {
+		ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+		for t, err := range srv.session.Tools(ctx, nil) {
+			if err != nil {
+				slog.Error("failed to list the tools of MCP server", "server", srv.name, "err", err)
+				break
+			}
+			if len(srv.cfg.Tools) > 0 && !toolDisabled(srv.cfg.Tools, t.Name) {
+				continue
+			}
+			if !toolNameRe.MatchString(t.Name) || len(tools.unknownTools([]string{t.Name})) == 0 {
+				slog.Warn("MCP tool left out: its name is invalid or taken", "server", srv.name, "tool", t.Name)
+				continue
+			}
+			schema, err := json.Marshal(t.InputSchema)
+			if err != nil || t.InputSchema == nil {
+				schema = json.RawMessage(`{"type":"object","properties":{}}`)
+			}
+			tools.register(t.Name, t.Description, schema, srv.call(t.Name), true)
+			if !srv.cfg.Trusted {
+				tools.untrusted(t.Name)
+			}
+			slog.Info("MCP tool registered", "server", srv.name, "tool", t.Name)
+		}
+		if caps := srv.session.InitializeResult().Capabilities; caps != nil && caps.Resources != nil {
+			for r, err := range srv.session.Resources(ctx, nil) {
+				if err != nil {
+					slog.Error("failed to list the resources of MCP server", "server", srv.name, "err", err)
+					break
+				}
+				if len(resources) == mcpMaxResources {
+					break
+				}
+				line := fmt.Sprintf("- %s %s", srv.name, r.URI)
+				if desc := cmp.Or(r.Description, r.Name); desc != "" {
+					line += ": " + truncateRunes(desc, 100)
+				}
+				resources = append(resources, line)
+			}
+		}
+		cancel()
+	}
+	if len(resources) == 0 || len(tools.unknownTools([]string{"readResource"})) == 0 {
+		return
+	}
+	tools.register("readResource", "Read a resource, such as a file or a record, of a connected MCP server. Available resources (server, then URI):\n"+strings.Join(resources, "\n"), json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"server": {"type": "string", "description": "The server of the resource"},
+			"uri": {"type": "string", "description": "The URI of the resource"}
+		},
+		"required": ["server", "uri"]
+	}`), mc.readResource, true)
+	tools.untrusted("readResource")
+}
+
+// call returns the function calling the server's tool name.
+func (srv *mcpServer) call(name string) func(ctx context.Context, args string) (string, error) {
+	return func(ctx context.Context, args string) (string, error) {
+		var arguments map[string]any
+		if err := json.Unmarshal([]byte(args), &arguments); err != nil {
+			return "", fmt.Errorf("arguments are not a JSON object: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, srv.cfg.Timeout)
+		defer cancel()
+		res, err := srv.session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: arguments})
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", srv.name, err)
+		}
+		out := truncateRunes(mcpContent(res.Content), pluginMaxResult)
+		if res.IsError {
+			return "", errors.New(out)
+		}
+		return out, nil
+	}
+}
+
+func (mc *mcpClients) readResource(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Server string `json:"server"`
+		URI    string `json:"uri"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	i := slices.IndexFunc(mc.servers, func(srv *mcpServer) bool { return srv.name == p.Server })
+	if i < 0 {
+		return "", fmt.Errorf("no MCP server is called %q", p.Server)
+	}
+	srv := mc.servers[i]
+	ctx, cancel := context.WithTimeout(ctx, srv.cfg.Timeout)
+	defer cancel()
+	res, err := srv.session.ReadResource(ctx, &mcp.ReadResourceParams{URI: p.URI})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", srv.name, err)
+	}
+	var parts []string
+	for _, c := range res.Contents {
+		parts = append(parts, resourceText(c))
+	}
+	return truncateRunes(strings.Join(parts, "\n\n"), pluginMaxResult), nil
+}
+
+// mcpContent renders the content of a tool result as text for the model.
+// Images and audio are only named.
+func mcpContent(content []mcp.Content) string {
+	var parts []string
+	for _, c := range content {
+		switch c := c.(type) {
+		case *mcp.TextContent:
+			parts = append(parts, c.Text)
+		case *mcp.EmbeddedResource:
+			if c.Resource != nil {
+				parts = append(parts, resourceText(c.Resource))
+			}
+		case *mcp.ResourceLink:
+			parts = append(parts, fmt.Sprintf("[resource %s: %s]", c.URI, cmp.Or(c.Title, c.Name)))
+		case *mcp.ImageContent:
+			parts = append(parts, "[image "+c.MIMEType+"]")
+		case *mcp.AudioContent:
+			parts = append(parts, "[audio "+c.MIMEType+"]")
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func resourceText(rc *mcp.ResourceContents) string {
+	if rc.Text != "" || len(rc.Blob) == 0 {
+		return rc.Text
+	}
+	return fmt.Sprintf("[%s, %d bytes of %s]", rc.URI, len(rc.Blob), cmp.Or(rc.MIMEType, "binary data"))
+}
+
+// close ends the connections, stopping the servers started as commands.
+func (mc *mcpClients) close() {
+	for _, srv := range mc.servers {
+		if err := srv.session.Close(); err != nil {
+			slog.Warn("failed to close MCP session", "server", srv.name, "err", err)
+		}
+	}
+}
+
+// headerTransport adds headers to every request.
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	return t.base.RoundTrip(req)
+}
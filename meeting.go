@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// Discord sends one 20ms Opus packet per speaker at a time.
+	meetingFrame = 20 * time.Millisecond
+	// meetingChunkFrames is the length of one audio file, 20 minutes, which
+	// keeps uploads well below the transcription size limit.
+	meetingChunkFrames = 20 * 60 * 50
+	meetingMaxDuration = 3 * time.Hour
+)
+
+// opusSilence is a 20ms Opus packet of silence. Gaps in a speaker's audio
+// are filled with it, so every file runs in step with the meeting clock.
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+const meetingSummaryPrompt = "You are given the transcript of a meeting, one utterance per line as \"[time] Speaker: text\". " +
+	"Write meeting notes in Markdown, in the language of the meeting, with these sections: " +
+	"\"## Summary\" (three to five sentences), \"## Decisions\" (bullets), " +
+	"\"## Action items\" (\"- [ ] owner: task\", with the due date if one was mentioned) and \"## Open questions\" (bullets). " +
+	"Write \"None\" under a section with nothing to report. Do not invent anything that is not in the transcript."
+
+// meetingRecorder records meetings in voice channels, at most one per guild,
+// and posts notes when they end. Only members who consent are recorded.
+type meetingRecorder struct {
+	mu       sync.Mutex
+	meetings map[string]*meeting
+	dataDir  string
+	client   *openai.Client
+	// model transcribes the audio. Empty disables meetings.
+	model string
+	eng   *engine.Engine
+}
+
+func newMeetingRecorder(dataDir string, client *openai.Client, model string, eng *engine.Engine) *meetingRecorder {
+	return &meetingRecorder{
+		meetings: make(map[string]*meeting),
+		dataDir:  dataDir,
+		client:   client,
+		model:    model,
+		eng:      eng,
+	}
+}
+
+type meeting struct {
+	guildID        string
+	voiceChannelID string
+	notesChannelID string
+	startedBy      string
+	started        time.Time
+	dir            string
+	vc             *discordgo.VoiceConnection
+	stop           chan struct{}
+	stopped        chan struct{}
+
+	mu      sync.Mutex
+	ended   time.Time
+	users   map[uint32]string
+	consent map[string]bool
+	tracks  map[string]*meetingTrack
+}
+
+// meetingTrack is the audio of one speaker, split into chunk files of
+// meetingChunkFrames each.
+type meetingTrack struct {
+	chunks map[int]string
+	f      *os.File
+	w      *oggOpusWriter
+	frames int
+	// base and ts0 map RTP timestamps to frames of the meeting clock.
+	base int
+	ts0  uint32
+}
+
+func (t *meetingTrack) close() error {
+	if t.w == nil {
+		return nil
+	}
+	err := t.w.Close()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	t.w, t.f = nil, nil
+	return err
+}
+
+// write writes packet at frame idx of the meeting, padding the gap since the
+// last packet with silence.
+func (t *meetingTrack) write(dir, userID string, idx int, packet []byte) error {
+	// Late or reordered packets are appended where the track is.
+	idx = max(idx, t.frames)
+	// Chunks that would hold nothing but silence are not written.
+	if first := idx / meetingChunkFrames * meetingChunkFrames; t.frames < first {
+		if err := t.close(); err != nil {
+			return err
+		}
+		t.frames = first
+	}
+	for t.frames <= idx {
+		if t.w == nil {
+			if err := t.open(dir, userID); err != nil {
+				return err
+			}
+		}
+		p := opusSilence
+		if t.frames == idx {
+			p = packet
+		}
+		if err := t.w.write(p); err != nil {
+			return err
+		}
+		t.frames++
+		if t.frames%meetingChunkFrames == 0 {
+			if err := t.close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// open starts the file of the chunk the track is in.
+func (t *meetingTrack) open(dir, userID string) error {
+	chunk := t.frames / meetingChunkFrames
+	path := filepath.Join(dir, fmt.Sprintf("%s-%03d.ogg", userID, chunk))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w, err := newOggOpusWriter(f, uint32(chunk+1))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	t.chunks[chunk] = path
+	t.f, t.w = f, w
+	return nil
+}
+
+// start joins voiceChannelID and begins a meeting whose notes go to
+// notesChannelID.
+func (mr *meetingRecorder) start(s *discordgo.Session, guildID, voiceChannelID, notesChannelID, userID string) (*meeting, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	if _, ok := mr.meetings[guildID]; ok {
+		return nil, errors.New("a meeting is already being recorded in this server")
+	}
+	dir, err := os.MkdirTemp(mr.dataDir, "meeting-")
+	if err != nil {
+		return nil, err
+	}
+	vc, err := s.ChannelVoiceJoin(guildID, voiceChannelID, true, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	m := &meeting{
+		guildID:        guildID,
+		voiceChannelID: voiceChannelID,
+		notesChannelID: notesChannelID,
+		startedBy:      userID,
+		started:        time.Now(),
+		dir:            dir,
+		vc:             vc,
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		users:          make(map[uint32]string),
+		consent:        make(map[string]bool),
+		tracks:         make(map[string]*meetingTrack),
+	}
+	vc.AddHandler(func(_ *discordgo.VoiceConnection, vs *discordgo.VoiceSpeakingUpdate) {
+		m.mu.Lock()
+		m.users[uint32(vs.SSRC)] = vs.UserID
+		m.mu.Unlock()
+	})
+	mr.meetings[guildID] = m
+	go m.record()
+	go func() {
+		select {
+		case <-time.After(meetingMaxDuration):
+			if err := mr.stop(s, guildID); err == nil {
+				sendReply(s, notesChannelID, nil, "The meeting recording reached its time limit and was stopped.")
+			}
+		case <-m.stopped:
+		}
+	}()
+	return m, nil
+}
+
+// record writes the audio of consenting speakers until the meeting stops.
+func (m *meeting) record() {
+	defer close(m.stopped)
+	for {
+		var p *discordgo.Packet
+		select {
+		case <-m.stop:
+			return
+		case p = <-m.vc.OpusRecv:
+		}
+		if p == nil || len(p.Opus) == 0 {
+			continue
+		}
+		m.mu.Lock()
+		if userID := m.users[p.SSRC]; userID != "" && m.consent[userID] {
+			t := m.tracks[userID]
+			if t == nil {
+				t = &meetingTrack{
+					chunks: make(map[int]string),
+					base:   int(time.Since(m.started) / meetingFrame),
+					ts0:    p.Timestamp,
+				}
+				m.tracks[userID] = t
+			}
+			// RTP timestamps count 48kHz samples, 960 per frame.
+			idx := t.base + int((p.Timestamp-t.ts0)/960)
+			if err := t.write(m.dir, userID, idx, p.Opus); err != nil {
+				slog.Error("failed to record meeting audio", "guild", m.guildID, "err", err)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// setConsent records whether userID agrees to be recorded. Withdrawing
+// drops what was recorded of them so far.
+func (m *meeting) setConsent(userID string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.consent[userID] = ok
+	if t := m.tracks[userID]; t != nil && !ok {
+		t.close()
+		for _, path := range t.chunks {
+			os.Remove(path)
+		}
+		delete(m.tracks, userID)
+	}
+}
+
+func (mr *meetingRecorder) get(guildID string) *meeting {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return mr.meetings[guildID]
+}
+
+// stop ends the meeting in guildID and posts its notes in the background.
+func (mr *meetingRecorder) stop(s *discordgo.Session, guildID string) error {
+	mr.mu.Lock()
+	m := mr.meetings[guildID]
+	delete(mr.meetings, guildID)
+	mr.mu.Unlock()
+	if m == nil {
+		return errors.New("no meeting is being recorded in this server")
+	}
+	close(m.stop)
+	<-m.stopped
+	if err := m.vc.Disconnect(); err != nil {
+		slog.Warn("failed to leave voice channel", "guild", guildID, "err", err)
+	}
+	m.mu.Lock()
+	m.ended = time.Now()
+	for _, t := range m.tracks {
+		t.close()
+	}
+	m.mu.Unlock()
+
+	go func() {
+		defer os.RemoveAll(m.dir)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+		defer cancel()
+		if err := mr.postNotes(ctx, s, m); err != nil {
+			slog.Error("failed to write meeting notes", "guild", guildID, "err", err)
+			sendReply(s, m.notesChannelID, nil, "Failed to write the meeting notes: "+err.Error())
+		}
+	}()
+	return nil
+}
+
+// utterance is one transcribed segment of a speaker.
+type utterance struct {
+	at     time.Duration
+	userID string
+	text   string
+}
+
+// transcribe returns the utterances of every track in meeting order.
+func (mr *meetingRecorder) transcribe(ctx context.Context, m *meeting) ([]utterance, error) {
+	var all []utterance
+	for userID, t := range m.tracks {
+		for chunk, path := range t.chunks {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := mr.client.CreateTranscription(ctx, openai.AudioRequest{
+				Model:    mr.model,
+				FilePath: filepath.Base(path),
+				Reader:   f,
+				Format:   openai.AudioResponseFormatVerboseJSON,
+			})
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			offset := time.Duration(chunk*meetingChunkFrames) * meetingFrame
+			for _, seg := range resp.Segments {
+				text := strings.TrimSpace(seg.Text)
+				// Whisper tends to hallucinate words in long silences.
+				if text == "" || seg.NoSpeechProb > 0.6 {
+					continue
+				}
+				at := offset + time.Duration(seg.Start*float64(time.Second))
+				all = append(all, utterance{at: at, userID: userID, text: text})
+			}
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].at < all[j].at })
+	return all, nil
+}
+
+func (mr *meetingRecorder) postNotes(ctx context.Context, s *discordgo.Session, m *meeting) error {
+	utterances, err := mr.transcribe(ctx, m)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	nameOf := func(userID string) string {
+		if n, ok := names[userID]; ok {
+			return n
+		}
+		n := userID
+		if member, err := s.State.Member(m.guildID, userID); err == nil {
+			n = member.DisplayName()
+		} else if member, err := s.GuildMember(m.guildID, userID); err == nil {
+			n = member.DisplayName()
+		}
+		names[userID] = n
+		return n
+	}
+
+	header := fmt.Sprintf("**Meeting notes** — <#%s>, %s, %s", m.voiceChannelID,
+		m.started.UTC().Format("2006-01-02 15:04 UTC"), m.ended.Sub(m.started).Round(time.Minute))
+	var consented []string
+	for userID, ok := range m.consent {
+		if ok {
+			consented = append(consented, nameOf(userID))
+		}
+	}
+	sort.Strings(consented)
+	if len(consented) > 0 {
+		header += "\nRecorded with the consent of: " + strings.Join(consented, ", ")
+	}
+	if len(utterances) == 0 {
+		sendReply(s, m.notesChannelID, nil, header+"\n\nNothing was said by members who agreed to be recorded.")
+		return nil
+	}
+
+	var transcript strings.Builder
+	for _, u := range utterances {
+		fmt.Fprintf(&transcript, "[%s] %s: %s\n", formatOffset(u.at), nameOf(u.userID), u.text)
+	}
+	notes, _, err := mr.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: meetingSummaryPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: transcript.String()},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return err
+	}
+	sendReply(s, m.notesChannelID, nil, header+"\n\n"+strings.TrimSpace(notes))
+	_, err = s.ChannelMessageSendComplex(m.notesChannelID, &discordgo.MessageSend{
+		Content: "Full transcript:",
+		Files: []*discordgo.File{{
+			Name:        "transcript-" + m.started.UTC().Format("20060102-1504") + ".txt",
+			ContentType: "text/plain",
+			Reader:      strings.NewReader(transcript.String()),
+		}},
+	})
+	return err
+}
+
+// formatOffset formats a time into a meeting or video as m:ss or h:mm:ss.
+func formatOffset(d time.Duration) string {
+	s := int(d / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// consentMessage asks the members of the voice channel whether they agree to
+// be recorded.
+func (m *meeting) consentMessage() *discordgo.MessageSend {
+	return &discordgo.MessageSend{
+		Content: fmt.Sprintf("🎙️ Recording <#%s> for meeting notes. Only members who press **Include me** are recorded and transcribed; everyone else is left out. You can change your mind until the meeting ends.", m.voiceChannelID),
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Include me", Style: discordgo.SuccessButton, CustomID: "meeting:consent"},
+				discordgo.Button{Label: "Leave me out", Style: discordgo.SecondaryButton, CustomID: "meeting:decline"},
+			}},
+		},
+	}
+}
+
+// handleComponent handles the consent buttons.
+func (mr *meetingRecorder) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	id := i.MessageComponentData().CustomID
+	if id != "meeting:consent" && id != "meeting:decline" {
+		return
+	}
+	loc := interactionLocale(i)
+	m := mr.get(i.GuildID)
+	if m == nil {
+		respondEphemeral(s, i, loc.tr("This meeting is over."))
+		return
+	}
+	ok := id == "meeting:consent"
+	m.setConsent(interactionUserID(i), ok)
+	if ok {
+		respondEphemeral(s, i, loc.tr("You're included. What you say from now on will be transcribed for the notes."))
+	} else {
+		respondEphemeral(s, i, loc.tr("You're left out. Nothing you say will be recorded, and what was recorded of you so far is deleted."))
+	}
+}
+
+// memberCanManageGuild reports whether userID has the Manage Server
+// permission in channelID.
+func memberCanManageGuild(s *discordgo.Session, userID, channelID string) bool {
+	perms, err := s.State.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		perms, err = s.UserChannelPermissions(userID, channelID)
+	}
+	return err == nil && perms&discordgo.PermissionManageGuild != 0
+}
+
+// meetingCommand is the "meeting" text command group.
+func meetingCommand(mr *meetingRecorder) *textCommand {
+	disabled := func() string {
+		return "Meeting notes are not enabled on this bot."
+	}
+	return &textCommand{
+		name: "meeting",
+		help: "Record a voice channel and post notes with action items",
+		subs: []*textCommand{
+			{
+				name: "start",
+				args: "[#notes-channel]",
+				help: "Record the voice channel you are in (members opt in)",
+				run: func(c *commandCall) string {
+					if mr.model == "" {
+						return disabled()
+					}
+					if c.m.GuildID == "" {
+						return "Meetings can only be recorded in servers."
+					}
+					vs, err := c.s.State.VoiceState(c.m.GuildID, c.m.Author.ID)
+					if err != nil || vs.ChannelID == "" {
+						return "Join the voice channel of the meeting first."
+					}
+					notes := c.m.ChannelID
+					if len(c.args) > 0 {
+						id := strings.TrimSuffix(strings.TrimPrefix(c.args[0], "<#"), ">")
+						if ch, err := channel(c.s, id); err != nil || ch.GuildID != c.m.GuildID {
+							return "Unknown channel: " + c.args[0]
+						}
+						notes = id
+					}
+					m, err := mr.start(c.s, c.m.GuildID, vs.ChannelID, notes, c.m.Author.ID)
+					if err != nil {
+						return "Failed to start recording: " + err.Error()
+					}
+					m.setConsent(c.m.Author.ID, true)
+					if _, err := c.s.ChannelMessageSendComplex(c.m.ChannelID, m.consentMessage()); err != nil {
+						slog.Error("failed to send message", "err", err)
+					}
+					return fmt.Sprintf("Recording <#%s>. You're included; the notes will be posted in <#%s> after `meeting stop`.", vs.ChannelID, notes)
+				},
+			},
+			{
+				name: "stop",
+				help: "Stop recording and post the notes",
+				run: func(c *commandCall) string {
+					if mr.model == "" {
+						return disabled()
+					}
+					m := mr.get(c.m.GuildID)
+					if m == nil {
+						return "No meeting is being recorded in this server."
+					}
+					if c.m.Author.ID != m.startedBy && !memberCanManageGuild(c.s, c.m.Author.ID, c.m.ChannelID) {
+						return "Only the member who started the recording or a server manager can stop it."
+					}
+					if err := mr.stop(c.s, c.m.GuildID); err != nil {
+						return "Failed to stop recording: " + err.Error()
+					}
+					return fmt.Sprintf("Stopped recording. The notes will be posted in <#%s> once the transcript is ready.", m.notesChannelID)
+				},
+			},
+		},
+	}
+}
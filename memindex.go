@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// memoryIndex keeps an embedding per memory entry in a vector store, one
+// collection per user and data namespace, and selects the entries most relevant to a prompt, so
+// only those are injected into the system prompt.
+type memoryIndex struct {
+	mu      sync.Mutex
+	vectors storage.VectorStore
+	emb     *embedder
+	topK    int
+}
+
+func newMemoryIndex(vectors storage.VectorStore, emb *embedder, topK int) *memoryIndex {
+	return &memoryIndex{
+		vectors: vectors,
+		emb:     emb,
+		topK:    topK,
+	}
+}
+
+// relevant returns the topK entries of memory closest to query. Missing or
+// outdated vectors are looked up in the embedding cache or computed in one
+// batch and persisted, and vectors of deleted entries are dropped. A
+// concurrent call with an older copy of memory may drop or overwrite a
+// vector; its hash no longer matches, so the next call computes it again.
+func (mi *memoryIndex) relevant(ctx context.Context, collection string, memory map[string]string, query string) (map[string]string, error) {
+	if len(memory) <= mi.topK {
+		return memory, nil
+	}
+
+	// The lock guards the vector store only; embedding calls are made
+	// without it so that one slow request does not hold up other users.
+	mi.mu.Lock()
+	hashes, err := mi.vectors.Hashes(collection)
+	mi.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var staleKeys, staleTexts, staleHashes []string
+	for k, v := range memory {
+		text := k + ": " + v
+		h := fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+		if hashes[k] == h {
+			continue
+		}
+		staleKeys = append(staleKeys, k)
+		staleTexts = append(staleTexts, text)
+		staleHashes = append(staleHashes, h)
+	}
+	var deleted []string
+	for k := range hashes {
+		if _, ok := memory[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+
+	vecs, err := mi.emb.embed(ctx, staleTexts)
+	if err != nil {
+		return nil, err
+	}
+	queryVecs, err := mi.emb.embedTransient(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if len(staleKeys) > 0 {
+		upserts := make([]storage.Vector, len(staleKeys))
+		for i, k := range staleKeys {
+			upserts[i] = storage.Vector{ID: k, Hash: staleHashes[i], Values: vecs[i]}
+		}
+		if err := mi.vectors.Upsert(collection, upserts); err != nil {
+			return nil, err
+		}
+	}
+	if len(deleted) > 0 {
+		if err := mi.vectors.Delete(collection, deleted); err != nil {
+			return nil, err
+		}
+	}
+
+	matches, err := mi.vectors.Search(collection, queryVecs[0], mi.topK)
+	if err != nil {
+		return nil, err
+	}
+	top := make(map[string]string, mi.topK)
+	for _, m := range matches {
+		if v, ok := memory[m.ID]; ok {
+			top[m.ID] = v
+		}
+	}
+	return top, nil
+}
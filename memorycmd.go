@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const memoryPageSize = 15
+
+func memoryCommand(mem *memoryStore) *slashCommand {
+	keyOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "key",
+		Description: "Memory key, e.g. fact/name",
+		Required:    true,
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "memory",
+			Description: "Inspect and edit what the bot remembers about you",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List memories visible here",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "get",
+					Description: "Show one memory",
+					Options:     []*discordgo.ApplicationCommandOption{keyOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Save a memory",
+					Options: []*discordgo.ApplicationCommandOption{
+						keyOption,
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "value",
+							Description: "What to remember",
+							Required:    true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "scope",
+							Description: "Where it applies (default: this server, or global in DMs)",
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "global", Value: memoryScopeGlobal},
+								{Name: "server", Value: memoryScopeGuild},
+								{Name: "channel", Value: memoryScopeChannel},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "delete",
+					Description: "Forget one memory",
+					Options:     []*discordgo.ApplicationCommandOption{keyOption},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "clear",
+					Description: "Forget everything the bot remembers about you",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			sc := memoryScope{GuildID: i.GuildID, ChannelID: i.ChannelID}
+			args := map[string]string{}
+			for _, o := range opts[0].Options {
+				args[o.Name] = o.StringValue()
+			}
+
+			switch opts[0].Name {
+			case "list":
+				content, components := memoryPage(loc, mem, userID, sc, 0)
+				respondEphemeralComponents(s, i, content, components)
+			case "get":
+				v, err := mem.get(userID, sc, args["key"])
+				switch {
+				case err != nil:
+					respondEphemeral(s, i, loc.tr("Failed to read memory: %s", err))
+				case v == "":
+					respondEphemeral(s, i, loc.tr("Nothing is remembered under `%s`.", args["key"]))
+				default:
+					respondEphemeral(s, i, "`"+args["key"]+"`: "+v)
+				}
+			case "set":
+				ns, err := sc.namespace(args["scope"])
+				if err != nil {
+					respondEphemeral(s, i, err.Error())
+					return
+				}
+				key, err := mem.set(userID, sc, ns, args["key"], args["value"])
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to save memory: %s", err))
+					return
+				}
+				respondEphemeral(s, i, loc.tr("Saved as `%s`.", key))
+			case "delete":
+				if err := mem.delete(userID, sc, args["key"]); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to delete memory: %s", err))
+					return
+				}
+				respondEphemeral(s, i, loc.tr("Deleted `%s`.", args["key"]))
+			case "clear":
+				respondEphemeralComponents(s, i, loc.tr("Really forget everything I remember about you, in every server and DM?"), []discordgo.MessageComponent{
+					discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+						discordgo.Button{Label: loc.tr("Forget everything"), Style: discordgo.DangerButton, CustomID: "memory:clear"},
+						discordgo.Button{Label: loc.tr("Cancel"), Style: discordgo.SecondaryButton, CustomID: "memory:cancel"},
+					}},
+				})
+			}
+		},
+	}
+}
+
+// memoryPage renders page n of the memories visible from sc, with ◀▶
+// buttons when there is more than one page.
+func memoryPage(loc locale, mem *memoryStore, userID string, sc memoryScope, n int) (string, []discordgo.MessageComponent) {
+	m, err := mem.list(userID, sc)
+	if err != nil {
+		return loc.tr("Failed to read memory: %s", err), nil
+	}
+	if len(m) == 0 {
+		return loc.tr("I don't remember anything about you here."), nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pages := (len(keys) + memoryPageSize - 1) / memoryPageSize
+	n = max(0, min(n, pages-1))
+	var sb strings.Builder
+	sb.WriteString(loc.tr("**Memories** (%d, page %d/%d)", len(keys), n+1, pages) + "\n")
+	for _, k := range keys[n*memoryPageSize : min(len(keys), (n+1)*memoryPageSize)] {
+		v := m[k]
+		if utf8.RuneCountInString(v) > 100 {
+			v = string([]rune(v)[:100]) + "…"
+		}
+		fmt.Fprintf(&sb, "- `%s`: %s\n", k, v)
+	}
+	if pages < 2 {
+		return sb.String(), nil
+	}
+	return sb.String(), []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "◀", Style: discordgo.SecondaryButton, CustomID: "memory:page:" + strconv.Itoa(n-1), Disabled: n == 0},
+			discordgo.Button{Label: "▶", Style: discordgo.SecondaryButton, CustomID: "memory:page:" + strconv.Itoa(n+1), Disabled: n == pages-1},
+		}},
+	}
+}
+
+func handleMemoryComponent(mem *memoryStore) func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionMessageComponent {
+			return
+		}
+		id := i.MessageComponentData().CustomID
+		if !strings.HasPrefix(id, "memory:") {
+			return
+		}
+		userID := interactionUserID(i)
+		loc := interactionLocale(i)
+
+		var content string
+		components := []discordgo.MessageComponent{}
+		switch {
+		case strings.HasPrefix(id, "memory:page:"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(id, "memory:page:"))
+			var c []discordgo.MessageComponent
+			content, c = memoryPage(loc, mem, userID, memoryScope{GuildID: i.GuildID, ChannelID: i.ChannelID}, n)
+			if c != nil {
+				components = c
+			}
+		case id == "memory:clear":
+			if err := mem.clear(userID); err != nil {
+				content = loc.tr("Failed to clear memory: %s", err)
+			} else {
+				content = loc.tr("Done. I no longer remember anything about you.")
+			}
+		case id == "memory:cancel":
+			content = loc.tr("Cancelled. Your memories were kept.")
+		default:
+			return
+		}
+
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    content,
+				Components: components,
+			},
+		})
+		if err != nil {
+			slog.Error("failed to respond to interaction", "err", err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// memoryCategoryAliases maps the category spellings models tend to invent to
+// the canonical category used in memory keys.
+var memoryCategoryAliases = map[string]string{
+	"pref":        "preference",
+	"prefs":       "preference",
+	"preference":  "preference",
+	"preferences": "preference",
+	"like":        "preference",
+	"likes":       "preference",
+	"fact":        "fact",
+	"facts":       "fact",
+	"info":        "fact",
+	"profile":     "fact",
+}
+
+// preferenceWords mark a key without explicit category as a preference.
+var preferenceWords = []string{"favorite", "favourite", "preferred", "prefers", "likes", "dislikes", "preference"}
+
+// redundantKeyPrefixes are dropped so that "user_name" and "name" end up as
+// the same key.
+var redundantKeyPrefixes = []string{"user_", "users_", "my_"}
+
+// normalizeMemoryKey turns a model-supplied key into the canonical
+// "<category>/<snake_case_name>" form, e.g. "Pref: FavoriteLanguage" becomes
+// "preference/favorite_language" and "userName" becomes "fact/name".
+func normalizeMemoryKey(key string) string {
+	category, name := "", strings.TrimSpace(key)
+	if i := strings.IndexAny(name, "/:."); i > 0 {
+		category, name = snakeCase(name[:i]), name[i+1:]
+	}
+	name = snakeCase(name)
+	if category == "" {
+		if head, rest, ok := strings.Cut(name, "_"); ok && memoryCategoryAliases[head] != "" && rest != "" {
+			category, name = head, rest
+		}
+	}
+	if c, ok := memoryCategoryAliases[category]; ok {
+		category = c
+	}
+	for _, p := range redundantKeyPrefixes {
+		if rest, ok := strings.CutPrefix(name, p); ok && rest != "" {
+			name = rest
+			break
+		}
+	}
+	if category == "" {
+		category = "fact"
+		for _, w := range preferenceWords {
+			if strings.Contains(name, w) {
+				category = "preference"
+				break
+			}
+		}
+	}
+	if name == "" {
+		name = "entry"
+	}
+	return category + "/" + name
+}
+
+// snakeCase lowercases s and joins its words with underscores, splitting on
+// non-alphanumeric characters and camelCase boundaries.
+func snakeCase(s string) string {
+	var sb strings.Builder
+	var prev rune
+	pendingSep := false
+	for _, r := range s {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if unicode.IsUpper(r) && (unicode.IsLower(prev) || unicode.IsDigit(prev)) {
+				pendingSep = true
+			}
+			if pendingSep && sb.Len() > 0 {
+				sb.WriteByte('_')
+			}
+			pendingSep = false
+			sb.WriteRune(unicode.ToLower(r))
+		default:
+			pendingSep = true
+		}
+		prev = r
+	}
+	return sb.String()
+}
+
+// findMemoryKey returns the key in m that key refers to: an exact match
+// first, then an entry whose normalized key matches, then a near-duplicate
+// within the same category.
+func findMemoryKey(m map[string]string, key string) (string, bool) {
+	if _, ok := m[key]; ok {
+		return key, true
+	}
+	canon := normalizeMemoryKey(key)
+	if _, ok := m[canon]; ok {
+		return canon, true
+	}
+	for k := range m {
+		if normalizeMemoryKey(k) == canon {
+			return k, true
+		}
+	}
+	for k := range m {
+		if isNearDuplicateKey(normalizeMemoryKey(k), canon) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// isNearDuplicateKey reports whether two canonical keys in the same category
+// differ by at most one edit, e.g. "favorite_color" and "favorite_colour".
+func isNearDuplicateKey(a, b string) bool {
+	ca, na, _ := strings.Cut(a, "/")
+	cb, nb, _ := strings.Cut(b, "/")
+	if ca != cb || len(na) < 5 || len(nb) < 5 {
+		return false
+	}
+	// Numbered keys such as "phone1" and "phone2" are distinct on purpose.
+	if strings.ContainsAny(na+nb, "0123456789") {
+		return false
+	}
+	return editDistanceAtMostOne(na, nb)
+}
+
+func editDistanceAtMostOne(a, b string) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+	if len(a) == len(b) {
+		return a[i+min(1, len(a)-i):] == b[i+min(1, len(b)-i):]
+	}
+	return a[i:] == b[i+1:]
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// presenceInterval is how often the time the bot was last running is
+	// written down.
+	presenceInterval = time.Minute
+	// presenceChannelTTL is how long a channel the bot was addressed in is
+	// scanned after restarts.
+	presenceChannelTTL = 7 * 24 * time.Hour
+	// missedMinDowntime is the shortest downtime worth a scan.
+	missedMinDowntime = 2 * time.Minute
+)
+
+// presenceState is what the bot remembers across restarts to find the
+// messages it missed.
+type presenceState struct {
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	// Channels holds the channels the bot was recently addressed in.
+	Channels map[string]presenceChannel `json:"channels,omitempty"`
+}
+
+type presenceChannel struct {
+	GuildID string    `json:"guild_id,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// missedMentions finds the mentions and DMs that arrived while the bot was
+// offline, within window, and answers them or lists them for the admins. It
+// keeps its state in <data>/presence.json.
+type missedMentions struct {
+	path   string
+	window time.Duration
+	answer bool
+
+	mu    sync.Mutex
+	state presenceState
+	// down is when the bot was last seen before this start.
+	down    time.Time
+	scanned bool
+}
+
+func newMissedMentions(dataDir string, window time.Duration, answer bool) *missedMentions {
+	mm := &missedMentions{
+		path:   filepath.Join(dataDir, "presence.json"),
+		window: window,
+		answer: answer,
+		state:  presenceState{Channels: make(map[string]presenceChannel)},
+	}
+	data, err := os.ReadFile(mm.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read presence", "err", err)
+		}
+		return mm
+	}
+	if err := json.Unmarshal(data, &mm.state); err != nil {
+		slog.Error("failed to parse presence", "err", err)
+	}
+	if mm.state.Channels == nil {
+		mm.state.Channels = make(map[string]presenceChannel)
+	}
+	mm.down = mm.state.LastSeen
+	return mm
+}
+
+// save writes the state to disk. The caller must hold mm.mu.
+func (mm *missedMentions) save() error {
+	if err := os.MkdirAll(filepath.Dir(mm.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(mm.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(mm.path, b, 0600)
+}
+
+// seen records that the bot was addressed in channelID.
+func (mm *missedMentions) seen(guildID, channelID string) {
+	mm.mu.Lock()
+	mm.state.Channels[channelID] = presenceChannel{GuildID: guildID, At: time.Now()}
+	mm.mu.Unlock()
+}
+
+// run writes down every presenceInterval that the bot is running.
+func (mm *missedMentions) run() {
+	for {
+		mm.mu.Lock()
+		mm.state.LastSeen = time.Now()
+		for id, ch := range mm.state.Channels {
+			if time.Since(ch.At) > presenceChannelTTL {
+				delete(mm.state.Channels, id)
+			}
+		}
+		if err := mm.save(); err != nil {
+			slog.Error("failed to save presence", "err", err)
+		}
+		mm.mu.Unlock()
+		time.Sleep(presenceInterval)
+	}
+}
+
+// handleReady scans for missed messages once, after the first connection.
+// handle answers a message as if it had just arrived; admins get the list
+// when messages are not answered.
+func (mm *missedMentions) handleReady(handle func(*discordgo.Session, *discordgo.MessageCreate), admins []string) func(*discordgo.Session, *discordgo.Ready) {
+	return func(s *discordgo.Session, _ *discordgo.Ready) {
+		mm.mu.Lock()
+		if mm.scanned {
+			mm.mu.Unlock()
+			return
+		}
+		mm.scanned = true
+		channels := make(map[string]presenceChannel, len(mm.state.Channels))
+		for id, ch := range mm.state.Channels {
+			channels[id] = ch
+		}
+		mm.mu.Unlock()
+
+		if mm.down.IsZero() || time.Since(mm.down) < missedMinDowntime {
+			return
+		}
+		go mm.scan(s, channels, handle, admins)
+	}
+}
+
+func (mm *missedMentions) scan(s *discordgo.Session, channels map[string]presenceChannel, handle func(*discordgo.Session, *discordgo.MessageCreate), admins []string) {
+	since := mm.down
+	if cutoff := time.Now().Add(-mm.window); since.Before(cutoff) {
+		since = cutoff
+	}
+	var missed []*discordgo.Message
+	for channelID, ch := range channels {
+		msgs, err := recentHistory(s, channelID, 100, since)
+		if err != nil {
+			slog.Warn("failed to read missed messages", "channel", channelID, "err", err)
+			continue
+		}
+		for _, m := range unanswered(s.State.User.ID, ch.GuildID, msgs) {
+			m.GuildID = ch.GuildID
+			missed = append(missed, m)
+		}
+	}
+	slog.Info("scanned for messages missed while offline", "channels", len(channels), "missed", len(missed), "down_since", mm.down)
+	if len(missed) == 0 {
+		return
+	}
+	slices.SortFunc(missed, func(a, b *discordgo.Message) int { return a.Timestamp.Compare(b.Timestamp) })
+
+	if mm.answer {
+		for _, m := range missed {
+			handle(s, &discordgo.MessageCreate{Message: m})
+		}
+		return
+	}
+	if len(admins) == 0 {
+		slog.Warn("messages were missed while offline; set -admins to be told which", "missed", len(missed))
+		return
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "While I was offline (since %s), these messages to me went unanswered:\n", mm.down.UTC().Format("2006-01-02 15:04 UTC"))
+	for _, m := range missed {
+		guild := m.GuildID
+		if guild == "" {
+			guild = "@me"
+		}
+		excerpt := []rune(strings.ReplaceAll(m.Content, "\n", " "))
+		if len(excerpt) > 80 {
+			excerpt = append(excerpt[:80], '…')
+		}
+		fmt.Fprintf(&sb, "- https://discord.com/channels/%s/%s/%s %s: %s\n", guild, m.ChannelID, m.ID, m.Author.Username, string(excerpt))
+	}
+	for _, id := range admins {
+		dm, err := s.UserChannelCreate(id)
+		if err != nil {
+			slog.Warn("failed to open DM with admin", "user", hashID(id), "err", err)
+			continue
+		}
+		sendReply(s, dm.ID, nil, sb.String())
+	}
+}
+
+// unanswered returns the messages in msgs, oldest first, that address botID
+// (a mention, or any message in a DM, where guildID is empty) and that no
+// later message of the bot replies to.
+func unanswered(botID, guildID string, msgs []*discordgo.Message) []*discordgo.Message {
+	replied := make(map[string]bool)
+	for _, m := range msgs {
+		if m.Author != nil && m.Author.ID == botID && m.MessageReference != nil {
+			replied[m.MessageReference.MessageID] = true
+		}
+	}
+	var out []*discordgo.Message
+	for _, m := range msgs {
+		if m.Author == nil || m.Author.Bot || replied[m.ID] {
+			continue
+		}
+		addressed := guildID == "" && m.Type == discordgo.MessageTypeDefault
+		for _, u := range m.Mentions {
+			if u.ID == botID {
+				addressed = true
+			}
+		}
+		if addressed {
+			out = append(out, m)
+		}
+	}
+	return out
+}
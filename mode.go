@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// deployMode is where the bot works: in DMs, in servers, or both.
+type deployMode string
+
+const (
+	modeBoth      deployMode = "both"
+	modeDMOnly    deployMode = "dm-only"
+	modeGuildOnly deployMode = "guild-only"
+)
+
+// guildOnlyCommands are the application commands that have nothing to do
+// outside a server; they are not registered in dm-only mode.
+var guildOnlyCommands = map[string]bool{
+	"setup":              true,
+	"reactions":          true,
+	"translate":          true,
+	"apikey":             true,
+	"schedule":           true,
+	"digest":             true,
+	"feed":               true,
+	"Ask Yagi in thread": true,
+}
+
+func parseDeployMode(s string) (deployMode, error) {
+	switch m := deployMode(s); m {
+	case modeBoth, modeDMOnly, modeGuildOnly:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid mode %q (use both, dm-only or guild-only)", s)
+}
+
+// allows reports whether the bot answers in a DM (dm) or in a server.
+func (m deployMode) allows(dm bool) bool {
+	switch m {
+	case modeDMOnly:
+		return dm
+	case modeGuildOnly:
+		return !dm
+	}
+	return true
+}
+
+// intents returns the gateway intents needed for messages in this mode,
+// plus those for voice states and reactions when they are used.
+func (m deployMode) intents(voice, reactions bool) discordgo.Intent {
+	intents := discordgo.IntentsMessageContent
+	if m != modeGuildOnly {
+		intents |= discordgo.IntentsDirectMessages
+		if reactions {
+			intents |= discordgo.IntentsDirectMessageReactions
+		}
+	}
+	if m != modeDMOnly {
+		intents |= discordgo.IntentsGuildMessages
+		if voice {
+			intents |= discordgo.IntentsGuildVoiceStates
+		}
+		if reactions {
+			intents |= discordgo.IntentsGuildMessageReactions
+		}
+	}
+	return intents
+}
+
+// commands restricts cmds to the mode: Discord is told where each command
+// may be used, guild-only commands are left out in dm-only mode, and
+// interactions from the other side are turned away.
+func (m deployMode) commands(cmds []*slashCommand) []*slashCommand {
+	if m == modeBoth {
+		return cmds
+	}
+	contexts := []discordgo.InteractionContextType{discordgo.InteractionContextGuild}
+	if m == modeDMOnly {
+		contexts = []discordgo.InteractionContextType{discordgo.InteractionContextBotDM}
+	}
+	var out []*slashCommand
+	for _, c := range cmds {
+		if m == modeDMOnly && guildOnlyCommands[c.def.Name] {
+			continue
+		}
+		def := *c.def
+		def.Contexts = &contexts
+		handler := c.handler
+		out = append(out, &slashCommand{
+			def: &def,
+			handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+				if !m.allows(i.GuildID == "") {
+					respondEphemeral(s, i, interactionLocale(i).tr("This command is not available here."))
+					return
+				}
+				handler(s, i)
+			},
+		})
+	}
+	return out
+}
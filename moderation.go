@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+// What a guild does with flagged content. Block and redact keep it out of
+// the conversation, warn only tells the admins. Every flagged message is
+// recorded in the moderation log whatever the action.
+const (
+	moderationOff    = "off"
+	moderationBlock  = "block"
+	moderationRedact = "redact"
+	moderationWarn   = "warn"
+)
+
+var moderationActions = []string{moderationBlock, moderationRedact, moderationWarn, moderationOff}
+
+// errModerated is returned by chatAPI.chat for a message or reply kept out
+// of the conversation by moderation.
+var errModerated = errors.New("flagged by moderation")
+
+// moderationChecker screens text and returns the categories it is flagged
+// for, or none if it is fine.
+type moderationChecker interface {
+	check(ctx context.Context, text string) ([]string, error)
+}
+
+// providerModeration uses the provider's moderation endpoint.
+type providerModeration struct {
+	client *openai.Client
+	model  string
+}
+
+func (pm *providerModeration) check(ctx context.Context, text string) ([]string, error) {
+	resp, err := pm.client.Moderations(ctx, openai.ModerationRequest{Input: text, Model: pm.model})
+	if err != nil {
+		return nil, err
+	}
+	var cats []string
+	for _, r := range resp.Results {
+		if !r.Flagged {
+			continue
+		}
+		b, err := json.Marshal(r.Categories)
+		if err != nil {
+			return nil, err
+		}
+		var flags map[string]bool
+		if err := json.Unmarshal(b, &flags); err != nil {
+			return nil, err
+		}
+		for name, on := range flags {
+			if on && !slices.Contains(cats, name) {
+				cats = append(cats, name)
+			}
+		}
+		if len(cats) == 0 {
+			cats = append(cats, "flagged")
+		}
+	}
+	sort.Strings(cats)
+	return cats, nil
+}
+
+const moderationPrompt = "You are a content moderator for a chat community. Classify the message you are given. " +
+	"Reply with only ok if it is acceptable, or else with a comma-separated list of the categories it falls under, " +
+	"chosen from: hate, harassment, self-harm, sexual, sexual/minors, violence, illegal."
+
+var moderationCategories = []string{"hate", "harassment", "self-harm", "sexual", "sexual/minors", "violence", "illegal"}
+
+// moderationInputChars bounds the text sent to the classifier model.
+const moderationInputChars = 4000
+
+// modelModeration asks a chat model, such as a small local one, to classify
+// the text, for providers without a moderation endpoint.
+type modelModeration struct {
+	eng *engine.Engine
+}
+
+func (mm *modelModeration) check(ctx context.Context, text string) ([]string, error) {
+	if r := []rune(text); len(r) > moderationInputChars {
+		text = string(r[:moderationInputChars])
+	}
+	reply, _, err := mm.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: moderationPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: text},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var cats []string
+	for _, c := range strings.Split(strings.ToLower(reply), ",") {
+		c = strings.Trim(strings.TrimSpace(c), ".\"'")
+		if slices.Contains(moderationCategories, c) && !slices.Contains(cats, c) {
+			cats = append(cats, c)
+		}
+	}
+	sort.Strings(cats)
+	return cats, nil
+}
+
+// moderationEvent is one flagged message or reply in the moderation log.
+// It carries no content, and the user only as a hash; the message ID lets
+// admins find the message while it exists.
+type moderationEvent struct {
+	At     string `json:"at"`
+	Source string `json:"source"`
+	// Direction is "prompt" for a user's message and "reply" for the
+	// bot's answer to it.
+	Direction  string   `json:"direction"`
+	GuildID    string   `json:"guild_id,omitempty"`
+	ChannelID  string   `json:"channel_id,omitempty"`
+	MessageID  string   `json:"message_id,omitempty"`
+	User       string   `json:"user"`
+	Categories []string `json:"categories"`
+	Action     string   `json:"action"`
+}
+
+// moderator screens user messages and the bot's replies with checker and
+// applies the policy of the guild they are in.
+type moderator struct {
+	checker moderationChecker
+	mu      sync.Mutex
+	path    string
+	// sender posts warnings to the guilds' moderation channels. It is nil
+	// when the bot is not connected to Discord, as in the REPL.
+	sender MessageSender
+}
+
+func newModerator(dataDir string, checker moderationChecker) *moderator {
+	return &moderator{checker: checker, path: filepath.Join(dataDir, "moderation", "events.jsonl")}
+}
+
+// moderationAction returns what cfg does with flagged content, block
+// unless it says otherwise.
+func (cfg guildConfig) moderationAction() string {
+	if cfg.Moderation == "" {
+		return moderationBlock
+	}
+	return cfg.Moderation
+}
+
+// screen checks text for ev under the policy of cfg and returns the action
+// to take, or "" if the text is fine, moderation is off or the check
+// failed. Flagged text is logged and reported to the guild's moderation
+// channel. A nil moderator lets everything through.
+func (md *moderator) screen(ctx context.Context, cfg guildConfig, ev moderationEvent, text string) string {
+	if md == nil || strings.TrimSpace(text) == "" {
+		return ""
+	}
+	action := cfg.moderationAction()
+	if action == moderationOff {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cats, err := md.checker.check(ctx, text)
+	if err != nil {
+		slog.Warn("moderation check failed", "direction", ev.Direction, "err", err)
+		return ""
+	}
+	if len(cats) == 0 {
+		return ""
+	}
+	ev.At = formatTime(time.Now())
+	ev.Categories, ev.Action = cats, action
+	slog.Warn("content flagged by moderation", "source", ev.Source, "direction", ev.Direction,
+		"guild", ev.GuildID, "user", ev.User, "categories", cats, "action", action)
+	if err := md.record(ev); err != nil {
+		slog.Error("failed to record moderation event", "err", err)
+	}
+	md.warnAdmins(cfg, ev)
+	return action
+}
+
+func (md *moderator) record(ev moderationEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(md.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(md.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// recent returns the last n events of guildID, newest first.
+func (md *moderator) recent(guildID string, n int) ([]moderationEvent, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	f, err := os.Open(md.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []moderationEvent
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var ev moderationEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || ev.GuildID != guildID {
+			continue
+		}
+		events = append(events, ev)
+		if len(events) > n {
+			events = events[1:]
+		}
+	}
+	slices.Reverse(events)
+	return events, sc.Err()
+}
+
+// warnAdmins posts ev to the moderation channel of cfg, if it has one.
+func (md *moderator) warnAdmins(cfg guildConfig, ev moderationEvent) {
+	if md.sender == nil || cfg.ModerationChannel == "" {
+		return
+	}
+	if _, err := md.sender.ChannelMessageSend(cfg.ModerationChannel, describeModerationEvent(ev)); err != nil {
+		slog.Warn("failed to post moderation warning", "guild", ev.GuildID, "err", err)
+	}
+}
+
+func describeModerationEvent(ev moderationEvent) string {
+	what := "A message"
+	if ev.Direction == "reply" {
+		what = "A reply of the bot"
+	}
+	where := "through the " + ev.Source
+	if ev.ChannelID != "" {
+		where = "in <#" + ev.ChannelID + ">"
+	}
+	s := fmt.Sprintf("⚠️ %s %s was flagged for %s (action: %s, user %s).", what, where, strings.Join(ev.Categories, ", "), ev.Action, ev.User)
+	if ev.GuildID != "" && ev.ChannelID != "" && ev.MessageID != "" && ev.Direction == "prompt" && ev.Action != moderationRedact {
+		s += fmt.Sprintf(" https://discord.com/channels/%s/%s/%s", ev.GuildID, ev.ChannelID, ev.MessageID)
+	}
+	return s
+}
+
+// command returns /moderation, with which server managers choose what
+// happens to flagged content and read the moderation log.
+func (md *moderator) command(guilds *guildStore) *slashCommand {
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, len(moderationActions))
+	for n, a := range moderationActions {
+		choices[n] = &discordgo.ApplicationCommandOptionChoice{Name: a, Value: a}
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "moderation",
+			Description: "Choose what happens to flagged messages and replies in this server",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "policy",
+					Description: "Set the moderation action and where admins are warned",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "action",
+							Description: "block: not answered or sent; redact: removed; warn: only warn the admins",
+							Required:    true,
+							Choices:     choices,
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "channel",
+							Description:  "Channel for the admin warnings",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "log",
+					Description: "Show the latest moderated messages of this server",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if i.GuildID == "" || !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("Run this in a server where you have the Manage Server permission."))
+				return
+			}
+			switch opts[0].Name {
+			case "policy":
+				var action, channel string
+				for _, o := range opts[0].Options {
+					switch o.Name {
+					case "action":
+						action = o.StringValue()
+					case "channel":
+						channel = o.ChannelValue(nil).ID
+					}
+				}
+				err := guilds.update(i.GuildID, func(cfg *guildConfig) {
+					cfg.Moderation = action
+					if channel != "" {
+						cfg.ModerationChannel = channel
+					}
+				})
+				if err != nil {
+					slog.Error("failed to save guild config", "guild", i.GuildID, "err", err)
+					respondEphemeral(s, i, loc.tr("Failed to save the server setting."))
+					return
+				}
+				msg := loc.tr("Moderation action set to **%s**.", action)
+				if cfg := guilds.get(i.GuildID); cfg.ModerationChannel != "" {
+					msg += loc.tr(" Warnings go to <#%s>.", cfg.ModerationChannel)
+				} else {
+					msg += loc.tr(" Add `channel:` to have admins warned about flagged content.")
+				}
+				respondEphemeral(s, i, msg)
+			case "log":
+				events, err := md.recent(i.GuildID, 10)
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to read the moderation log: %s", err))
+					return
+				}
+				if len(events) == 0 {
+					respondEphemeral(s, i, loc.tr("Nothing has been moderated in this server."))
+					return
+				}
+				var sb strings.Builder
+				for _, ev := range events {
+					at := ev.At
+					if t, err := time.Parse(time.RFC3339, ev.At); err == nil {
+						at = fmt.Sprintf("<t:%d:R>", t.Unix())
+					}
+					fmt.Fprintf(&sb, "- %s: %s %s, %s (%s)\n", at, ev.Direction, ev.Action, strings.Join(ev.Categories, ", "), ev.User)
+				}
+				respondEphemeral(s, i, sb.String())
+			}
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const moodPrompt = "You classify the mood of a chat user from their latest messages, oldest first. " +
+	"Reply with only one word: frustrated, down, excited or neutral. Reply neutral unless the mood is clear."
+
+// moodMessages is how many of the user's latest messages are classified.
+const moodMessages = 3
+
+// moodHints are the style hints added to the system prompt for each mood.
+// Neutral and unknown moods add nothing.
+var moodHints = map[string]string{
+	"frustrated": "The user seems frustrated. Be brief and concrete: lead with the fix or the answer and skip pleasantries.",
+	"down":       "The user seems to be feeling down. Be warm and patient, and acknowledge how they feel before anything else.",
+	"excited":    "The user seems excited. Match their energy while staying accurate.",
+}
+
+// moodClassifier picks a style hint from the mood of the user's recent
+// messages, with a short call to a small model.
+type moodClassifier struct {
+	eng *engine.Engine
+}
+
+// hint returns the style hint for the latest user messages in msgs, or ""
+// if the mood is neutral or could not be told.
+func (mc *moodClassifier) hint(ctx context.Context, msgs []openai.ChatCompletionMessage) string {
+	var recent []string
+	for i := len(msgs) - 1; i >= 0 && len(recent) < moodMessages; i-- {
+		if msgs[i].Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		if text := messageText(msgs[i]); text != "" {
+			recent = append(recent, text)
+		}
+	}
+	if len(recent) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for i := len(recent) - 1; i >= 0; i-- {
+		sb.WriteString("- ")
+		sb.WriteString(recent[i])
+		sb.WriteString("\n")
+	}
+	reply, _, err := mc.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: moodPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return ""
+	}
+	mood := strings.Trim(strings.ToLower(strings.TrimSpace(reply)), ".\"'")
+	if h, ok := moodHints[mood]; ok {
+		return "\n---\n" + h + "\n"
+	}
+	return ""
+}
+
+// messageText returns the text of m, without its images.
+func messageText(m openai.ChatCompletionMessage) string {
+	if m.Content != "" || len(m.MultiContent) == 0 {
+		return m.Content
+	}
+	var parts []string
+	for _, p := range m.MultiContent {
+		if p.Type == openai.ChatMessagePartTypeText && p.Text != "" {
+			parts = append(parts, p.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
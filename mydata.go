@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// userExport is everything the bot stores about one user.
+type userExport struct {
+	UserID     string `json:"user_id"`
+	ExportedAt string `json:"exported_at"`
+	// Sessions holds the conversation in each guild and in DMs.
+	Sessions []*storage.SessionData       `json:"sessions,omitempty"`
+	Memory   map[string]map[string]string `json:"memory,omitempty"`
+	Topics   []topicEntry                 `json:"topics,omitempty"`
+	// Profiles holds the profile the bot wrote of the user, by namespace.
+	Profiles map[string]string `json:"profiles,omitempty"`
+	// UsageToday counts messages sent today per guild, as tracked for
+	// daily quotas.
+	UsageToday map[string]int `json:"usage_today,omitempty"`
+	CheckIns   checkinState   `json:"check_ins"`
+	// Training tells whether the user allowed their conversations to be
+	// exported for fine-tuning.
+	Training trainingConsent `json:"training"`
+	// Feedback holds the ratings the user gave and those of replies to them.
+	Feedback  []feedbackRecord `json:"feedback,omitempty"`
+	Reminders []reminder       `json:"reminders,omitempty"`
+	// RSVPs holds the user's answers to events the bot announced.
+	RSVPs []eventRSVP `json:"rsvps,omitempty"`
+}
+
+// userData gives access to the per-user records spread over the stores.
+type userData struct {
+	store     *sessionStore
+	mem       *memoryStore
+	vectors   storage.VectorStore
+	topics    *topicStore
+	profiles  *profileStore
+	quotas    *quotaTracker
+	checkins  *checkinStore
+	training  *trainingStore
+	feedback  *feedbackStore
+	reminders *reminderStore
+	events    *eventPlanner
+}
+
+// export collects everything stored for userID. Conversations in threads are
+// shared with other participants and are not included.
+func (ud *userData) export(userID string) (*userExport, error) {
+	ex := &userExport{
+		UserID:     userID,
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		UsageToday: ud.quotas.usage(userID),
+		CheckIns:   ud.checkins.get(userID),
+		Training:   ud.training.get(userID),
+		Feedback:   ud.feedback.of(userID),
+		Reminders:  ud.reminders.of(userID),
+		RSVPs:      ud.events.of(userID),
+	}
+
+	keys, err := ud.store.keysOf(userID)
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	for _, key := range keys {
+		sess := ud.store.get(key)
+		sess.mu.Lock()
+		sd, err := ud.store.persist.Load(key)
+		sess.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("session: %w", err)
+		}
+		if sd != nil {
+			ex.Sessions = append(ex.Sessions, sd)
+		}
+	}
+
+	m, err := ud.mem.all(userID)
+	if err != nil {
+		return nil, fmt.Errorf("memory: %w", err)
+	}
+	if len(m) > 0 {
+		ex.Memory = m
+	}
+
+	if ex.Topics, err = ud.topics.all(userID); err != nil {
+		return nil, fmt.Errorf("topics: %w", err)
+	}
+	if ex.Profiles, err = ud.profiles.all(userID); err != nil {
+		return nil, fmt.Errorf("profiles: %w", err)
+	}
+	return ex, nil
+}
+
+// delete removes everything stored for userID in every guild and in DMs:
+// the sessions and their topic archives, memory and its embeddings, usage
+// counts and the check-in opt-in.
+func (ud *userData) delete(userID string) error {
+	keys, err := ud.store.keysOf(userID)
+	if err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+	for _, key := range keys {
+		if err := ud.store.remove(key); err != nil {
+			return fmt.Errorf("session: %w", err)
+		}
+	}
+	owners, err := ud.mem.persist.Owners()
+	if err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	if err := ud.mem.clear(userID); err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	// Embeddings are kept per namespace the user talked in, which the
+	// sessions and memory documents tell.
+	namespaces := map[string]bool{storage.Namespace(""): true}
+	for _, key := range keys {
+		ns, _ := storage.SplitKey(key)
+		namespaces[ns] = true
+	}
+	for _, o := range owners {
+		namespaces[o.Namespace] = true
+	}
+	for ns := range namespaces {
+		if ns == "" {
+			continue
+		}
+		if err := ud.vectors.Drop(ns + "/" + userID); err != nil {
+			return fmt.Errorf("memory index: %w", err)
+		}
+	}
+	if err := ud.topics.removeAll(userID); err != nil {
+		return fmt.Errorf("topics: %w", err)
+	}
+	if err := ud.profiles.removeAll(userID); err != nil {
+		return fmt.Errorf("profiles: %w", err)
+	}
+	ud.quotas.forget(userID)
+	if err := ud.checkins.remove(userID); err != nil {
+		return fmt.Errorf("check-ins: %w", err)
+	}
+	if err := ud.training.setEnabled(userID, false); err != nil {
+		return fmt.Errorf("training consent: %w", err)
+	}
+	if err := ud.feedback.remove(userID); err != nil {
+		return fmt.Errorf("feedback: %w", err)
+	}
+	if err := ud.reminders.remove(userID); err != nil {
+		return fmt.Errorf("reminders: %w", err)
+	}
+	if err := ud.events.remove(userID); err != nil {
+		return fmt.Errorf("events: %w", err)
+	}
+	return nil
+}
+
+// file renders ex as a single JSON document or as a zip with one JSON file
+// per record type.
+func (ex *userExport) file(format string) (*discordgo.File, error) {
+	if format != "zip" {
+		b, err := json.MarshalIndent(ex, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return &discordgo.File{Name: "mydata.json", ContentType: "application/json", Reader: bytes.NewReader(b)}, nil
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := []struct {
+		name string
+		v    any
+	}{
+		{"user.json", map[string]string{"user_id": ex.UserID, "exported_at": ex.ExportedAt}},
+		{"sessions.json", ex.Sessions},
+		{"memory.json", ex.Memory},
+		{"topics.json", ex.Topics},
+		{"profiles.json", ex.Profiles},
+		{"usage.json", ex.UsageToday},
+		{"checkins.json", ex.CheckIns},
+		{"training.json", ex.Training},
+		{"feedback.json", ex.Feedback},
+		{"reminders.json", ex.Reminders},
+		{"rsvps.json", ex.RSVPs},
+	}
+	for _, p := range parts {
+		b, err := json.MarshalIndent(p.v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		w, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &discordgo.File{Name: "mydata.zip", ContentType: "application/zip", Reader: &buf}, nil
+}
+
+func mydataCommand(ud *userData) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "mydata",
+			Description: "Manage the data the bot stores about you",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "export",
+					Description: "Send you a copy of your data in a DM",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "format",
+							Description: "File format (default: json)",
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "json", Value: "json"},
+								{Name: "zip", Value: "zip"},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "delete",
+					Description: "Delete everything the bot stores about you",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if opts[0].Name == "delete" {
+				respondEphemeralComponents(s, i, loc.tr("Really delete your conversation history, settings, memories and usage records? This cannot be undone."), []discordgo.MessageComponent{
+					discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+						discordgo.Button{Label: loc.tr("Delete my data"), Style: discordgo.DangerButton, CustomID: "mydata:delete"},
+						discordgo.Button{Label: loc.tr("Cancel"), Style: discordgo.SecondaryButton, CustomID: "mydata:cancel"},
+					}},
+				})
+				return
+			}
+			format := "json"
+			for _, o := range opts[0].Options {
+				if o.Name == "format" {
+					format = o.StringValue()
+				}
+			}
+			userID := interactionUserID(i)
+
+			ex, err := ud.export(userID)
+			if err != nil {
+				slog.Error("failed to export data", "user", hashID(userID), "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to collect your data: %s", err))
+				return
+			}
+			f, err := ex.file(format)
+			if err != nil {
+				respondEphemeral(s, i, loc.tr("Failed to build the export: %s", err))
+				return
+			}
+			dm, err := s.UserChannelCreate(userID)
+			if err != nil {
+				respondEphemeral(s, i, loc.tr("I could not open a DM with you. Please allow DMs from server members."))
+				return
+			}
+			if _, err := s.ChannelMessageSendComplex(dm.ID, &discordgo.MessageSend{
+				Content: loc.tr("Here is the data I store about you."),
+				Files:   []*discordgo.File{f},
+			}); err != nil {
+				slog.Error("failed to send export", "user", hashID(userID), "err", err)
+				respondEphemeral(s, i, loc.tr("I could not send you a DM. Please allow DMs from server members."))
+				return
+			}
+			respondEphemeral(s, i, loc.tr("I sent your data to you in a DM."))
+		},
+	}
+}
+
+func handleMydataComponent(ud *userData) func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionMessageComponent {
+			return
+		}
+		id := i.MessageComponentData().CustomID
+		if !strings.HasPrefix(id, "mydata:") {
+			return
+		}
+		userID := interactionUserID(i)
+		// Taken before the delete, which also removes the user's language.
+		loc := interactionLocale(i)
+
+		var content string
+		switch id {
+		case "mydata:delete":
+			if err := ud.delete(userID); err != nil {
+				slog.Error("failed to delete data", "user", hashID(userID), "err", err)
+				content = loc.tr("Failed to delete your data: %s", err)
+			} else {
+				content = loc.tr("Done. Everything I stored about you has been deleted.")
+			}
+		case "mydata:cancel":
+			content = loc.tr("Cancelled. Nothing was deleted.")
+		default:
+			return
+		}
+
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    content,
+				Components: []discordgo.MessageComponent{},
+			},
+		})
+		if err != nil {
+			slog.Error("failed to respond to interaction", "err", err)
+		}
+	}
+}
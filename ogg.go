@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// oggCRC is the CRC-32 table of the Ogg framing (polynomial 0x04c11db7,
+// not reflected).
+var oggCRC = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		r := uint32(i) << 24
+		for range 8 {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+// oggOpusWriter muxes 20ms stereo Opus packets, as Discord sends them, into
+// an Ogg Opus stream that transcription services accept.
+type oggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule uint64
+	// packets and lacing buffer the packets of the next page.
+	packets []byte
+	lacing  []byte
+	count   int
+}
+
+// oggPagePackets is how many packets go into one page, one second of audio.
+const oggPagePackets = 50
+
+func newOggOpusWriter(w io.Writer, serial uint32) (*oggOpusWriter, error) {
+	ow := &oggOpusWriter{w: w, serial: serial}
+	head := []byte("OpusHead")
+	head = append(head, 1, 2)                            // version, channels
+	head = binary.LittleEndian.AppendUint16(head, 312)   // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000) // input sample rate
+	head = binary.LittleEndian.AppendUint16(head, 0)     // output gain
+	head = append(head, 0)                               // channel mapping family
+	// The header pages begin the stream and carry no audio.
+	if err := ow.writeRaw(appendLacing(nil, len(head)), head, 0x02, 0); err != nil {
+		return nil, err
+	}
+	tags := []byte("OpusTags")
+	vendor := "yagi-discord-bot"
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0) // no comments
+	if err := ow.writeRaw(appendLacing(nil, len(tags)), tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return ow, nil
+}
+
+// write adds one 20ms packet.
+func (ow *oggOpusWriter) write(packet []byte) error {
+	ow.packets = append(ow.packets, packet...)
+	ow.lacing = appendLacing(ow.lacing, len(packet))
+	ow.count++
+	ow.granule += 960
+	// A page holds at most 255 lacing values; leave room for a large packet.
+	if ow.count >= oggPagePackets || len(ow.lacing) > 200 {
+		return ow.flush(0)
+	}
+	return nil
+}
+
+// Close writes the buffered packets as the last page.
+func (ow *oggOpusWriter) Close() error {
+	return ow.flush(0x04) // end of stream
+}
+
+func (ow *oggOpusWriter) flush(flags byte) error {
+	if ow.count == 0 && flags == 0 {
+		return nil
+	}
+	err := ow.writeRaw(ow.lacing, ow.packets, flags, ow.granule)
+	ow.packets, ow.lacing, ow.count = ow.packets[:0], ow.lacing[:0], 0
+	return err
+}
+
+// appendLacing appends the lacing values of a packet of n bytes: 255 for
+// each full segment and the remainder, which may be zero, to end it.
+func appendLacing(lacing []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		lacing = append(lacing, 255)
+	}
+	return append(lacing, byte(n))
+}
+
+func (ow *oggOpusWriter) writeRaw(lacing, body []byte, flags byte, granule uint64) error {
+	page := []byte("OggS")
+	page = append(page, 0, flags)
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = binary.LittleEndian.AppendUint32(page, ow.serial)
+	page = binary.LittleEndian.AppendUint32(page, ow.seq)
+	page = binary.LittleEndian.AppendUint32(page, 0) // checksum, filled below
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	page = append(page, body...)
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRC[byte(crc>>24)^b]
+	}
+	binary.LittleEndian.PutUint32(page[22:], crc)
+	ow.seq++
+	_, err := ow.w.Write(page)
+	return err
+}
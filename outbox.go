@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// outboxRetryInterval is how often undelivered replies are retried.
+	outboxRetryInterval = 30 * time.Second
+	// outboxMaxAge is how long a reply is retried before it is given up.
+	outboxMaxAge = 24 * time.Hour
+)
+
+// outboxEntry is a reply, or the rest of one, still to be delivered.
+type outboxEntry struct {
+	ID        string                      `json:"id"`
+	ChannelID string                      `json:"channel_id"`
+	Reference *discordgo.MessageReference `json:"reference,omitempty"`
+	// Parts are the messages still to be sent, in order.
+	Parts   []string  `json:"parts"`
+	Created time.Time `json:"created"`
+	// sending is set while the entry is being delivered.
+	sending bool
+}
+
+// outbox delivers generated replies. Each reply is written to
+// <data>/outbox.json before it is sent and removed once every part is
+// delivered, so a reply that could not be sent because Discord was
+// unreachable, or because the bot stopped, is sent later instead of lost.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	cipher  *storage.Cipher
+	entries []*outboxEntry
+	seq     int
+}
+
+func newOutbox(dataDir string, fc *storage.Cipher) *outbox {
+	ob := &outbox{path: filepath.Join(dataDir, "outbox.json"), cipher: fc}
+	err := storage.ReadRecover(ob.path, fc.ReadFile, func(b []byte) error {
+		ob.entries = nil
+		return json.Unmarshal(b, &ob.entries)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("failed to read outbox", "err", err)
+	}
+	if len(ob.entries) > 0 {
+		slog.Info("undelivered replies from the last run", "count", len(ob.entries))
+	}
+	return ob
+}
+
+// save writes the entries to disk. The caller must hold ob.mu.
+func (ob *outbox) save() error {
+	if err := os.MkdirAll(filepath.Dir(ob.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ob.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ob.cipher.WriteFile(ob.path, b)
+}
+
+// send delivers content to channelID like sendReply and returns the IDs of
+// the messages sent. Parts that fail with an error worth retrying stay in
+// the outbox and are sent by run.
+func (ob *outbox) send(s MessageSender, channelID string, ref *discordgo.MessageReference, content string) []string {
+	if ref != nil {
+		// The message replied to may be gone by the time a retry succeeds.
+		soft := *ref
+		soft.FailIfNotExists = new(bool)
+		ref = &soft
+	}
+	ob.mu.Lock()
+	ob.seq++
+	e := &outboxEntry{
+		ID:        fmt.Sprintf("%d-%d", time.Now().UnixNano(), ob.seq),
+		ChannelID: channelID,
+		Reference: ref,
+		Parts:     splitMessage(content, discordLimit),
+		Created:   time.Now(),
+		sending:   true,
+	}
+	ob.entries = append(ob.entries, e)
+	if err := ob.save(); err != nil {
+		slog.Error("failed to save outbox", "err", err)
+	}
+	ob.mu.Unlock()
+	ids, _ := ob.deliver(s, e)
+	return ids
+}
+
+// claim marks e as being delivered, unless it already is.
+func (ob *outbox) claim(e *outboxEntry) bool {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if e.sending {
+		return false
+	}
+	e.sending = true
+	return true
+}
+
+// deliver sends the remaining parts of e, which the caller claimed, and
+// updates the outbox. It reports whether e is done, delivered or given up.
+func (ob *outbox) deliver(s MessageSender, e *outboxEntry) ([]string, bool) {
+	ob.mu.Lock()
+	parts := e.Parts
+	ob.mu.Unlock()
+
+	var ids []string
+	var err error
+	sent := 0
+	for _, part := range parts {
+		var msg *discordgo.Message
+		msg, err = s.ChannelMessageSendComplex(e.ChannelID, &discordgo.MessageSend{
+			Content:   part,
+			Reference: e.Reference,
+		})
+		if err != nil {
+			break
+		}
+		ids = append(ids, msg.ID)
+		sent++
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	e.sending = false
+	e.Parts = e.Parts[sent:]
+	done := len(e.Parts) == 0
+	switch {
+	case done:
+	case !retryable(err):
+		slog.Error("failed to send message; dropping it", "channel", e.ChannelID, "err", err)
+		done = true
+	case time.Since(e.Created) > outboxMaxAge:
+		slog.Error("could not deliver message in time; dropping it", "channel", e.ChannelID, "err", err)
+		done = true
+	default:
+		slog.Warn("failed to send message; will retry", "channel", e.ChannelID, "parts", len(e.Parts), "err", err)
+	}
+	if done {
+		for i, x := range ob.entries {
+			if x == e {
+				ob.entries = append(ob.entries[:i], ob.entries[i+1:]...)
+				break
+			}
+		}
+	}
+	if err := ob.save(); err != nil {
+		slog.Error("failed to save outbox", "err", err)
+	}
+	return ids, done
+}
+
+// retryable reports whether a send that failed with err may succeed later:
+// network errors, rate limits and Discord server errors.
+func retryable(err error) bool {
+	var rest *discordgo.RESTError
+	if !errors.As(err, &rest) {
+		return err != nil
+	}
+	if rest.Response == nil {
+		return true
+	}
+	code := rest.Response.StatusCode
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// run retries the undelivered replies every outboxRetryInterval, starting
+// with those left from the last run.
+func (ob *outbox) run(s MessageSender) {
+	for {
+		ob.mu.Lock()
+		pending := make([]*outboxEntry, len(ob.entries))
+		copy(pending, ob.entries)
+		ob.mu.Unlock()
+		for _, e := range pending {
+			if !ob.claim(e) {
+				continue
+			}
+			if _, done := ob.deliver(s, e); !done {
+				// Discord is still unreachable; try the rest later.
+				break
+			}
+		}
+		time.Sleep(outboxRetryInterval)
+	}
+}
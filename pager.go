@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	embedPageLimit = 4000
+	pagerExpiry    = 30 * time.Minute
+
+	pagerPrevID = "pager:prev"
+	pagerNextID = "pager:next"
+)
+
+type pagedReply struct {
+	title   string
+	footer  string
+	pages   []string
+	current int
+	created time.Time
+}
+
+func (r *pagedReply) embed() *discordgo.MessageEmbed {
+	footer := r.footer
+	if len(r.pages) > 1 {
+		footer = fmt.Sprintf("%s · %d/%d", footer, r.current+1, len(r.pages))
+	}
+	return &discordgo.MessageEmbed{
+		Title:       r.title,
+		Description: r.pages[r.current],
+		Footer:      &discordgo.MessageEmbedFooter{Text: footer},
+	}
+}
+
+func (r *pagedReply) components() []discordgo.MessageComponent {
+	if len(r.pages) < 2 {
+		return nil
+	}
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{
+				Label:    "◀",
+				Style:    discordgo.SecondaryButton,
+				CustomID: pagerPrevID,
+				Disabled: r.current == 0,
+			},
+			discordgo.Button{
+				Label:    "▶",
+				Style:    discordgo.SecondaryButton,
+				CustomID: pagerNextID,
+				Disabled: r.current == len(r.pages)-1,
+			},
+		}},
+	}
+}
+
+// replyFooter is what the footer of a paged reply tells about it: the
+// model and the tokens the reply used.
+type replyFooter struct {
+	model              string
+	prompt, completion int
+	// estimated is set when the provider did not report the usage.
+	estimated bool
+}
+
+func (f replyFooter) String() string {
+	approx := ""
+	if f.estimated {
+		approx = "≈"
+	}
+	return fmt.Sprintf("%s · %s%d prompt + %d completion tokens", f.model, approx, f.prompt, f.completion)
+}
+
+// pager sends long replies as embeds and flips pages when the ◀▶ buttons
+// below them are pressed. Page state is kept in memory per message.
+type pager struct {
+	mu      sync.Mutex
+	replies map[string]*pagedReply
+}
+
+func newPager() *pager {
+	return &pager{replies: make(map[string]*pagedReply)}
+}
+
+func (p *pager) send(s *discordgo.Session, channelID string, ref *discordgo.MessageReference, title string, footer replyFooter, content string) {
+	r := &pagedReply{
+		title:   title,
+		footer:  footer.String(),
+		pages:   splitMessage(content, embedPageLimit),
+		created: time.Now(),
+	}
+	msg, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Embeds:     []*discordgo.MessageEmbed{r.embed()},
+		Components: r.components(),
+		Reference:  ref,
+	})
+	if err != nil {
+		slog.Error("failed to send message", "err", err)
+		return
+	}
+	if len(r.pages) < 2 {
+		return
+	}
+
+	p.mu.Lock()
+	p.replies[msg.ID] = r
+	p.mu.Unlock()
+}
+
+func (p *pager) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent || i.Message == nil {
+		return
+	}
+	id := i.MessageComponentData().CustomID
+	if !strings.HasPrefix(id, "pager:") {
+		return
+	}
+	loc := interactionLocale(i)
+
+	p.mu.Lock()
+	r, ok := p.replies[i.Message.ID]
+	if ok {
+		switch id {
+		case pagerPrevID:
+			if r.current > 0 {
+				r.current--
+			}
+		case pagerNextID:
+			if r.current < len(r.pages)-1 {
+				r.current++
+			}
+		}
+	}
+	var data *discordgo.InteractionResponseData
+	if ok {
+		data = &discordgo.InteractionResponseData{
+			Embeds:     []*discordgo.MessageEmbed{r.embed()},
+			Components: r.components(),
+		}
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		respondEphemeral(s, i, loc.tr("This reply can no longer be paged."))
+		return
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: data,
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
+
+// gc forgets page state of replies older than pagerExpiry.
+func (p *pager) gc() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for id, r := range p.replies {
+		if now.Sub(r.created) > pagerExpiry {
+			delete(p.replies, id)
+		}
+	}
+}
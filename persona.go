@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// personaStore serves persona prompts from markdown files in a directory,
+// one file per persona named <persona>.md.
+type personaStore struct {
+	dir string
+}
+
+func newPersonaStore(dir string) *personaStore {
+	return &personaStore{dir: dir}
+}
+
+func (ps *personaStore) list() ([]string, error) {
+	entries, err := os.ReadDir(ps.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".md" {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(e.Name(), ".md"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ps *personaStore) load(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid persona name: %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(ps.dir, name+".md"))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func personaCommand(ps *personaStore, store *sessionStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "persona",
+			Description: "Choose which personality the bot uses with you",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List available personas",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Switch to a persona",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Persona name",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reset",
+					Description: "Go back to the default identity",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			key := scopedKey(i.GuildID, userID)
+
+			switch opts[0].Name {
+			case "list":
+				names, err := ps.list()
+				if err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to list personas: %s", err))
+					return
+				}
+				if len(names) == 0 {
+					respondEphemeral(s, i, loc.tr("No personas are available."))
+					return
+				}
+				current := loc.tr("(default)")
+				sess := store.get(key)
+				sess.mu.Lock()
+				if sess.persona != "" {
+					current = sess.persona
+				}
+				sess.mu.Unlock()
+				respondEphemeral(s, i, loc.tr("Available personas: %s\nCurrent: %s", strings.Join(names, ", "), current))
+			case "set", "reset":
+				name := ""
+				if opts[0].Name == "set" {
+					name = opts[0].Options[0].StringValue()
+					if _, err := ps.load(name); err != nil {
+						respondEphemeral(s, i, loc.tr("Unknown persona: %s", name))
+						return
+					}
+				}
+				sess := store.get(key)
+				sess.mu.Lock()
+				sess.persona = name
+				err := store.save(key, sess)
+				sess.mu.Unlock()
+				if err != nil {
+					slog.Error("failed to save session", "user", hashID(userID), "err", err)
+					respondEphemeral(s, i, loc.tr("Failed to save your settings."))
+					return
+				}
+				if name == "" {
+					respondEphemeral(s, i, loc.tr("Persona reset to the default identity."))
+				} else {
+					respondEphemeral(s, i, loc.tr("Persona set to %s.", name))
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// pluginTimeout is the timeout of a plugin without its own.
+	pluginTimeout = 10 * time.Second
+	// pluginMaxResult bounds the result of a plugin.
+	pluginMaxResult = 64 << 10
+)
+
+var toolNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// pluginConfig declares a tool, in the "tools" section of the config file,
+// whose calls are run by an HTTP endpoint (URL), a local executable
+// (Command) or a sandboxed WASM module (WASM).
+type pluginConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	URL         string `yaml:"url"`
+	// Headers are sent with every call to URL, e.g. for authorization.
+	Headers map[string]string `yaml:"headers"`
+	// Command is the executable and its arguments.
+	Command []string `yaml:"command"`
+	// WASM is the path of a WASI module.
+	WASM string `yaml:"wasm"`
+	// Memory is the memory limit of WASM in MB.
+	Memory int `yaml:"memory"`
+	// Dirs are host directories WASM may read.
+	Dirs []string `yaml:"dirs"`
+	// Env is added to the minimal environment Command runs with, or is the
+	// whole environment of WASM.
+	Env     map[string]string `yaml:"env"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// Parameters is the JSON schema of the arguments.
+	Parameters map[string]any `yaml:"parameters"`
+	Keywords   []string       `yaml:"keywords"`
+	// Trusted results are passed to the model as they are; others are
+	// quoted as untrusted content.
+	Trusted bool `yaml:"trusted"`
+}
+
+// check validates c and fills in its defaults.
+func (c *pluginConfig) check() error {
+	if !toolNameRe.MatchString(c.Name) {
+		return fmt.Errorf("name %q must be 1-64 letters, digits, underscores or dashes", c.Name)
+	}
+	if strings.TrimSpace(c.Description) == "" {
+		return errors.New("description is required")
+	}
+	kinds := 0
+	for _, set := range []bool{c.URL != "", len(c.Command) > 0, c.WASM != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of url, command and wasm is required")
+	}
+	switch {
+	case c.URL != "":
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http or https URL", c.URL)
+		}
+		if len(c.Env) > 0 {
+			return errors.New("env is only passed to a command or wasm")
+		}
+	case len(c.Command) > 0:
+		if !filepath.IsAbs(c.Command[0]) {
+			return fmt.Errorf("command %q must be an absolute path", c.Command[0])
+		}
+	}
+	if len(c.Headers) > 0 && c.URL == "" {
+		return errors.New("headers are only sent to a url")
+	}
+	if (c.Memory != 0 || len(c.Dirs) > 0) && c.WASM == "" {
+		return errors.New("memory and dirs only apply to wasm")
+	}
+	if c.Memory < 0 || c.Memory > 4096 {
+		return errors.New("memory must be between 1 and 4096 MB")
+	}
+	if c.WASM != "" && c.Memory == 0 {
+		c.Memory = wasmMemoryMB
+	}
+	for _, dir := range c.Dirs {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("dir %q must be an absolute path", dir)
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = pluginTimeout
+	}
+	if c.Parameters == nil {
+		c.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	return nil
+}
+
+// schema returns the JSON schema of the tool's arguments.
+func (c pluginConfig) schema() (json.RawMessage, error) {
+	return json.Marshal(c.Parameters)
+}
+
+// tool returns the function running the calls of the plugin.
+func (c pluginConfig) tool() (engine.ToolFunc, error) {
+	switch {
+	case len(c.Command) > 0:
+		return newExecTool(c).call, nil
+	case c.WASM != "":
+		t, err := newWASMTool(c)
+		if err != nil {
+			return nil, err
+		}
+		return t.call, nil
+	}
+	return newHTTPTool(c).call, nil
+}
+
+// pluginRequest is what a plugin is given for a call.
+type pluginRequest struct {
+	Tool      string          `json:"tool"`
+	Arguments json.RawMessage `json:"arguments"`
+	UserID    string          `json:"user_id,omitempty"`
+	GuildID   string          `json:"guild_id,omitempty"`
+	ChannelID string          `json:"channel_id,omitempty"`
+}
+
+// newPluginRequest returns the request for a call of name with args, made
+// for the user and place in ctx.
+func newPluginRequest(ctx context.Context, name, args string) ([]byte, error) {
+	if !json.Valid([]byte(args)) {
+		return nil, errors.New("arguments are not valid JSON")
+	}
+	req := pluginRequest{Tool: name, Arguments: json.RawMessage(args)}
+	req.UserID, _ = ctx.Value(ctxKeyUserID).(string)
+	req.GuildID, _ = ctx.Value(ctxKeyGuildID).(string)
+	if sc, ok := ctx.Value(ctxKeyMemoryScope).(memoryScope); ok {
+		req.ChannelID = sc.ChannelID
+	}
+	return json.Marshal(req)
+}
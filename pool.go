@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// workerPool runs replies on a fixed number of goroutines so that a burst
+// of messages queues up instead of starting unbounded generations. At most
+// backlog jobs wait for a worker; beyond that submit refuses new ones.
+type workerPool struct {
+	jobs     chan func()
+	rejected atomic.Int64
+}
+
+func newWorkerPool(workers, backlog int) *workerPool {
+	p := &workerPool{jobs: make(chan func(), backlog)}
+	for range max(workers, 1) {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues job for a worker. It reports false, without running job,
+// when the backlog is full.
+func (p *workerPool) submit(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		if n := p.rejected.Add(1); n == 1 || n%100 == 0 {
+			slog.Warn("worker pool full; rejecting messages", "rejected", n, "backlog", cap(p.jobs))
+		}
+		return false
+	}
+}
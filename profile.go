@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const profilePrompt = "You keep a short profile of a user for an assistant that talks with them. " +
+	"You are given the current profile, which may be empty, and summaries of the user's recent conversations. " +
+	"Rewrite the profile with three sections: Interests, Ongoing projects, and Communication style (tone, language, level of detail they like). " +
+	"Keep what still holds, update what changed, drop what is finished or outdated, and do not invent anything. " +
+	"Use short bullet points, at most 120 words in total, in the language the user writes in. Reply with only the profile."
+
+// profileEntry is the profile of one user in one namespace.
+type profileEntry struct {
+	Profile   string `json:"profile"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// profileStore keeps a model-written profile of each user, rewritten from
+// their archived conversations, in <data>/<namespace>/profiles/<hash>.json.
+// Like conversations, profiles are kept per server.
+type profileStore struct {
+	dataDir  string
+	cipher   *storage.Cipher
+	eng      *engine.Engine
+	topics   *topicStore
+	interval time.Duration
+
+	mu sync.Mutex
+	// due holds the session keys whose conversations ended since their
+	// profile was last written.
+	due map[string]bool
+}
+
+func newProfileStore(dataDir string, fc *storage.Cipher, eng *engine.Engine, topics *topicStore, interval time.Duration) *profileStore {
+	return &profileStore{
+		dataDir:  dataDir,
+		cipher:   fc,
+		eng:      eng,
+		topics:   topics,
+		interval: interval,
+		due:      make(map[string]bool),
+	}
+}
+
+func (ps *profileStore) path(key string) string {
+	ns, id := storage.SplitKey(key)
+	return filepath.Join(ps.dataDir, filepath.FromSlash(ns), "profiles", topicFile(id))
+}
+
+func (ps *profileStore) load(key string) (profileEntry, error) {
+	var p profileEntry
+	err := storage.ReadRecover(ps.path(key), ps.cipher.ReadFile, func(b []byte) error {
+		return json.Unmarshal(b, &p)
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return p, err
+}
+
+func (ps *profileStore) save(key string, p profileEntry) error {
+	path := ps.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ps.cipher.WriteFile(path, b)
+}
+
+// markdown returns the profile of key as a system prompt section, or "".
+func (ps *profileStore) markdown(key string) string {
+	p, err := ps.load(key)
+	if err != nil {
+		slog.Warn("failed to load profile", "session", hashID(key), "err", err)
+		return ""
+	}
+	if p.Profile == "" {
+		return ""
+	}
+	return "\n---\n## About the User\n" + untrustedBlock("profile", sanitizeUntrusted(p.Profile))
+}
+
+// touch marks the profile of key for a rewrite, after a conversation of
+// key was archived.
+func (ps *profileStore) touch(key string) {
+	ps.mu.Lock()
+	ps.due[key] = true
+	ps.mu.Unlock()
+}
+
+// run rewrites due profiles every interval. Conversations in threads have
+// no single user and are skipped.
+func (ps *profileStore) run(s *discordgo.Session, every time.Duration) {
+	for {
+		time.Sleep(every)
+		ps.mu.Lock()
+		keys := make([]string, 0, len(ps.due))
+		for key := range ps.due {
+			keys = append(keys, key)
+		}
+		ps.mu.Unlock()
+
+		for _, key := range keys {
+			if _, id := storage.SplitKey(key); isThread(s, id) {
+				ps.done(key)
+				continue
+			}
+			p, err := ps.load(key)
+			if err != nil {
+				slog.Warn("failed to load profile", "session", hashID(key), "err", err)
+				continue
+			}
+			if updated, err := time.Parse(time.RFC3339, p.UpdatedAt); err == nil && time.Since(updated) < ps.interval {
+				continue
+			}
+			if err := ps.rewrite(key, p); err != nil {
+				slog.Warn("failed to rewrite profile", "session", hashID(key), "err", err)
+				continue
+			}
+			ps.done(key)
+		}
+	}
+}
+
+func (ps *profileStore) done(key string) {
+	ps.mu.Lock()
+	delete(ps.due, key)
+	ps.mu.Unlock()
+}
+
+// isThread reports whether id is a thread the bot knows, rather than a user.
+func isThread(s *discordgo.Session, id string) bool {
+	ch, err := s.State.Channel(id)
+	return err == nil && ch.IsThread()
+}
+
+// rewrite has the model update p from the conversations of key archived
+// since p was written.
+func (ps *profileStore) rewrite(key string, p profileEntry) error {
+	entries, err := ps.topics.list(key)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, e := range entries {
+		if e.EndedAt <= p.UpdatedAt {
+			continue
+		}
+		fmt.Fprintf(&sb, "- %s (%s): %s\n", strings.SplitN(e.EndedAt, "T", 2)[0], strings.Join(e.Tags, ", "), e.Summary)
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	reply, _, err := ps.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: profilePrompt},
+		{Role: openai.ChatMessageRoleUser, Content: "Current profile:\n" + p.Profile + "\n\nRecent conversations:\n" + sb.String()},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return fmt.Errorf("empty profile")
+	}
+	return ps.save(key, profileEntry{Profile: reply, UpdatedAt: formatTime(time.Now())})
+}
+
+// all returns the profiles of userID by namespace.
+func (ps *profileStore) all(userID string) (map[string]string, error) {
+	paths, err := ps.paths(userID)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for ns, path := range paths {
+		var p profileEntry
+		err := storage.ReadRecover(path, ps.cipher.ReadFile, func(b []byte) error {
+			return json.Unmarshal(b, &p)
+		})
+		if err != nil {
+			return nil, err
+		}
+		out[ns] = p.Profile
+	}
+	return out, nil
+}
+
+// removeAll deletes the profiles of userID in every namespace.
+func (ps *profileStore) removeAll(userID string) error {
+	paths, err := ps.paths(userID)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := storage.RemoveFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paths returns the profile files of userID by namespace.
+func (ps *profileStore) paths(userID string) (map[string]string, error) {
+	name := topicFile(userID)
+	matches, err := filepath.Glob(filepath.Join(ps.dataDir, "guilds", "*", "profiles", name))
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	for _, m := range matches {
+		rel, _ := filepath.Rel(ps.dataDir, filepath.Dir(filepath.Dir(m)))
+		paths[filepath.ToSlash(rel)] = m
+	}
+	if dm := ps.path(scopedKey("", userID)); fileExists(dm) {
+		paths[storage.Namespace("")] = dm
+	}
+	return paths, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// busyNoticeTTL is how long a notice that a message is waiting stays up if
+// it is not cleared before.
+const busyNoticeTTL = 5 * time.Minute
+
+// errQueueFull is returned by messageQueue.enter when too many messages are
+// already waiting in a conversation.
+var errQueueFull = errors.New("queue full")
+
+// messageQueue answers the messages of each conversation one at a time, in
+// the order they arrived. Messages sent while a reply is being generated
+// wait for it, up to depth of them. With a coalesce window, a message waits
+// that long for follow-ups, and the messages that queued up behind a reply
+// are answered together as one.
+type messageQueue struct {
+	depth    int
+	coalesce time.Duration
+
+	mu     sync.Mutex
+	queues map[string]*conversationQueue
+}
+
+type conversationQueue struct {
+	// running is set while a reply is being generated.
+	running bool
+	pending []*ticket
+}
+
+// ticket is a message's place in its conversation's queue.
+type ticket struct {
+	q       *messageQueue
+	key     string
+	content string
+	ready   chan turn
+	// queued is set when the message had to wait behind a running reply.
+	queued bool
+}
+
+// turn is handed to a ticket when it is its turn. merged is set when its
+// message was answered together with an earlier one.
+type turn struct {
+	content string
+	merged  bool
+}
+
+func newMessageQueue(depth int, coalesce time.Duration) *messageQueue {
+	return &messageQueue{
+		depth:    depth,
+		coalesce: coalesce,
+		queues:   make(map[string]*conversationQueue),
+	}
+}
+
+// enter queues a message with content in the conversation key.
+func (q *messageQueue) enter(key, content string) (*ticket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := &ticket{q: q, key: key, content: content, ready: make(chan turn, 1)}
+	cq, ok := q.queues[key]
+	if !ok {
+		cq = &conversationQueue{}
+		q.queues[key] = cq
+		if q.coalesce <= 0 {
+			cq.running = true
+			t.ready <- turn{content: content}
+			return t, nil
+		}
+		cq.pending = append(cq.pending, t)
+		time.AfterFunc(q.coalesce, func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.next(key, cq)
+		})
+		return t, nil
+	}
+	// While the coalesce window of the first message is open nothing is
+	// being answered yet, and that message does not count as waiting.
+	limit := q.depth
+	if !cq.running {
+		limit++
+	}
+	if len(cq.pending) >= limit {
+		return nil, errQueueFull
+	}
+	t.queued = cq.running
+	cq.pending = append(cq.pending, t)
+	return t, nil
+}
+
+// next hands the turn to the first waiting message, merging the others
+// into it when coalescing. The caller must hold q.mu.
+func (q *messageQueue) next(key string, cq *conversationQueue) {
+	if len(cq.pending) == 0 {
+		if q.queues[key] == cq {
+			delete(q.queues, key)
+		}
+		return
+	}
+	cq.running = true
+	first := cq.pending[0]
+	if q.coalesce <= 0 {
+		cq.pending = cq.pending[1:]
+		first.ready <- turn{content: first.content}
+		return
+	}
+	contents := make([]string, len(cq.pending))
+	for i, t := range cq.pending {
+		contents[i] = t.content
+		if i > 0 {
+			t.ready <- turn{merged: true}
+		}
+	}
+	cq.pending = nil
+	first.ready <- turn{content: strings.Join(contents, "\n\n")}
+}
+
+// wait blocks until it is the message's turn and returns the text to
+// answer, which includes any messages merged into it. It reports false if
+// the message was merged into an earlier one or ctx ended first; only when
+// it reports true must done be called.
+func (t *ticket) wait(ctx context.Context) (string, bool) {
+	select {
+	case r := <-t.ready:
+		return r.content, !r.merged
+	case <-ctx.Done():
+	}
+	t.q.mu.Lock()
+	if cq := t.q.queues[t.key]; cq != nil {
+		if i := slices.Index(cq.pending, t); i >= 0 {
+			cq.pending = slices.Delete(cq.pending, i, i+1)
+			t.q.mu.Unlock()
+			return "", false
+		}
+	}
+	t.q.mu.Unlock()
+	// The turn was handed over while ctx ended.
+	r := <-t.ready
+	return r.content, !r.merged
+}
+
+// done ends the message's turn and starts the next one.
+func (t *ticket) done() {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	if cq := t.q.queues[t.key]; cq != nil {
+		cq.running = false
+		t.q.next(t.key, cq)
+	}
+}
+
+// busyNotice is the short notice posted when a message has to wait behind a
+// reply in progress. It is deleted once the message is answered, or after
+// busyNoticeTTL.
+type busyNotice struct {
+	s         MessageSender
+	channelID string
+	ids       []string
+	once      sync.Once
+	timer     *time.Timer
+}
+
+func postBusyNotice(s MessageSender, channelID string, ref *discordgo.MessageReference, loc locale) *busyNotice {
+	n := &busyNotice{s: s, channelID: channelID}
+	n.ids = sendReply(s, channelID, ref, loc.tr("Still answering your previous question…"))
+	n.timer = time.AfterFunc(busyNoticeTTL, n.clear)
+	return n
+}
+
+// clear deletes the notice. It may be called more than once, and on nil.
+func (n *busyNotice) clear() {
+	if n == nil {
+		return
+	}
+	n.once.Do(func() {
+		n.timer.Stop()
+		deleteMessages(n.s, n.channelID, n.ids)
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitRetries is how often a request refused with 429 is retried
+// after the wait the provider asked for.
+const maxRateLimitRetries = 2
+
+// maxRateLimitWait is the longest the limiter waits before a request, or
+// before retrying one; beyond that the request fails as it would without
+// pacing.
+const maxRateLimitWait = time.Minute
+
+// tokenBucket paces requests against one provider limit. It learns its
+// capacity and refill rate from the provider's x-ratelimit-* headers and
+// does not limit anything before it has seen them.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	// rate is the refill in units per second.
+	rate float64
+	last time.Time
+}
+
+// wait returns how long to wait until n units are available. n is capped
+// at the capacity so that a large request is not blocked forever.
+func (b *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	if b.capacity == 0 || b.rate == 0 {
+		return 0
+	}
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	n = min(n, b.capacity)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take removes n units, which may leave the bucket in debt.
+func (b *tokenBucket) take(n float64) {
+	if b.capacity > 0 {
+		b.tokens -= min(n, b.capacity)
+	}
+}
+
+// update sets the bucket from the provider's view: limit units per window,
+// remaining of them now, and reset until the bucket is full again.
+func (b *tokenBucket) update(now time.Time, limit, remaining float64, reset time.Duration) {
+	if limit <= 0 {
+		return
+	}
+	b.capacity = limit
+	b.tokens = remaining
+	b.last = now
+	switch {
+	case reset > 0 && remaining < limit:
+		b.rate = (limit - remaining) / reset.Seconds()
+	case b.rate == 0:
+		// Providers document their limits per minute.
+		b.rate = limit / 60
+	}
+}
+
+// rateLimit holds the request and token buckets of one API key.
+type rateLimit struct {
+	mu       sync.Mutex
+	requests tokenBucket
+	tokens   tokenBucket
+	// blockedUntil is set from Retry-After when the provider refused a
+	// request.
+	blockedUntil time.Time
+}
+
+// rateLimitTransport smooths provider calls with a client-side token bucket
+// per API key, so that bursts wait briefly instead of failing with 429.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	mu   sync.Mutex
+	keys map[[sha256.Size]byte]*rateLimit
+}
+
+func (t *rateLimitTransport) limit(req *http.Request) *rateLimit {
+	key := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.keys == nil {
+		t.keys = make(map[[sha256.Size]byte]*rateLimit)
+	}
+	rl, ok := t.keys[key]
+	if !ok {
+		rl = &rateLimit{}
+		t.keys[key] = rl
+	}
+	return rl
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rl := t.limit(req)
+	// Roughly four bytes of request per prompt token.
+	estimate := float64(max(req.ContentLength, 0)) / 4
+	for attempt := 0; ; attempt++ {
+		if err := rl.acquire(req.Context(), estimate); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		rl.observe(resp)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxRateLimitRetries || req.GetBody == nil {
+			return resp, nil
+		}
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if retryAfter > maxRateLimitWait {
+			return resp, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		slog.Info("provider rate limit hit; retrying", "path", req.URL.Path, "retry_after", retryAfter)
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+}
+
+// acquire waits until the request may be sent and takes its share of both
+// buckets.
+func (rl *rateLimit) acquire(ctx context.Context, tokens float64) error {
+	rl.mu.Lock()
+	now := time.Now()
+	wait := max(rl.requests.wait(now, 1), rl.tokens.wait(now, tokens), rl.blockedUntil.Sub(now))
+	// Taking the units before waiting keeps the requests queued behind
+	// this one from all waking up at the same moment.
+	rl.requests.take(1)
+	rl.tokens.take(tokens)
+	rl.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	if wait > time.Second {
+		slog.Debug("pacing provider request", "wait", wait)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe updates the buckets from the x-ratelimit-* headers of resp, as
+// sent by OpenAI and compatible providers, and from Retry-After on 429.
+func (rl *rateLimit) observe(resp *http.Response) {
+	h := resp.Header
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if limit, remaining, ok := rateLimitHeaders(h, "requests"); ok {
+		rl.requests.update(now, limit, remaining, parseRetryAfter(h.Get("x-ratelimit-reset-requests")))
+	}
+	if limit, remaining, ok := rateLimitHeaders(h, "tokens"); ok {
+		rl.tokens.update(now, limit, remaining, parseRetryAfter(h.Get("x-ratelimit-reset-tokens")))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retry := parseRetryAfter(h.Get("Retry-After"))
+		if retry <= 0 {
+			retry = time.Second
+		}
+		rl.blockedUntil = now.Add(retry)
+	}
+}
+
+func rateLimitHeaders(h http.Header, kind string) (limit, remaining float64, ok bool) {
+	limit, err1 := strconv.ParseFloat(h.Get("x-ratelimit-limit-"+kind), 64)
+	remaining, err2 := strconv.ParseFloat(h.Get("x-ratelimit-remaining-"+kind), 64)
+	return limit, remaining, err1 == nil && err2 == nil
+}
+
+// parseRetryAfter reads a wait given as seconds ("2", "0.5") or as a Go
+// style duration ("6m0s", "20ms"), as providers send in Retry-After and
+// x-ratelimit-reset-*. It returns 0 if s is neither.
+func parseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const reactionPrompt = "You react to chat messages with a custom emoji of the server, like a member would. " +
+	"You are given the names of the server's emojis and one message. " +
+	"Reply with only the name of the emoji that fits the message best, or \"none\" if no reaction would be natural. " +
+	"Most messages need no reaction."
+
+// reactionMinLength is the shortest message worth a model call, in runes.
+const reactionMinLength = 8
+
+// reactor adds a fitting server emoji to some messages in the channels a
+// guild enabled it for, at most once per interval in each channel.
+type reactor struct {
+	guilds   *guildStore
+	eng      *engine.Engine
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+	// emojis caches each guild's custom emojis.
+	emojis map[string]emojiCache
+}
+
+type emojiCache struct {
+	emojis  []*discordgo.Emoji
+	fetched time.Time
+}
+
+func newReactor(guilds *guildStore, eng *engine.Engine, interval time.Duration) *reactor {
+	return &reactor{
+		guilds:   guilds,
+		eng:      eng,
+		interval: interval,
+		last:     make(map[string]time.Time),
+		emojis:   make(map[string]emojiCache),
+	}
+}
+
+// consider reacts to m in the background if reactions are enabled in its
+// channel and the channel has not had one for the interval.
+func (r *reactor) consider(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.GuildID == "" || m.Author.Bot || utf8.RuneCountInString(m.Content) < reactionMinLength {
+		return
+	}
+	if !slices.Contains(r.guilds.get(m.GuildID).ReactionChannels, m.ChannelID) {
+		return
+	}
+	r.mu.Lock()
+	if time.Since(r.last[m.ChannelID]) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	// The slot is taken before the model answers, so that a burst of
+	// messages causes one call, not many.
+	r.last[m.ChannelID] = time.Now()
+	r.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		if err := r.react(ctx, s, m); err != nil {
+			slog.Warn("failed to react to message", "guild", m.GuildID, "channel", m.ChannelID, "err", err)
+		}
+	}()
+}
+
+func (r *reactor) react(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) error {
+	emojis, err := r.guildEmojis(s, m.GuildID)
+	if err != nil || len(emojis) == 0 {
+		return err
+	}
+	names := make([]string, len(emojis))
+	for i, e := range emojis {
+		names[i] = e.Name
+	}
+	reply, _, err := r.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: reactionPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: "Emojis: " + strings.Join(names, ", ") + "\n\nMessage:\n" + m.Content},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return err
+	}
+	name := strings.Trim(strings.TrimSpace(reply), ":`\"'")
+	for _, e := range emojis {
+		if strings.EqualFold(e.Name, name) {
+			return s.MessageReactionAdd(m.ChannelID, m.ID, e.APIName())
+		}
+	}
+	return nil
+}
+
+// guildEmojis returns the usable custom emojis of guildID, fetched at most
+// once an hour.
+func (r *reactor) guildEmojis(s *discordgo.Session, guildID string) ([]*discordgo.Emoji, error) {
+	r.mu.Lock()
+	c, ok := r.emojis[guildID]
+	r.mu.Unlock()
+	if ok && time.Since(c.fetched) < time.Hour {
+		return c.emojis, nil
+	}
+	all, err := s.GuildEmojis(guildID)
+	if err != nil {
+		return nil, err
+	}
+	var usable []*discordgo.Emoji
+	for _, e := range all {
+		if e.Available && len(e.Roles) == 0 {
+			usable = append(usable, e)
+		}
+	}
+	r.mu.Lock()
+	r.emojis[guildID] = emojiCache{emojis: usable, fetched: time.Now()}
+	r.mu.Unlock()
+	return usable, nil
+}
+
+// reactionsCommand turns emoji reactions on or off in the current channel.
+func reactionsCommand(guilds *guildStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "reactions",
+			Description: "Let the bot react to messages in this channel with server emojis",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "on",
+					Description: "React to some messages in this channel",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Stop reacting in this channel",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if i.GuildID == "" || !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("Changing reactions requires the Manage Server permission."))
+				return
+			}
+			on := opts[0].Name == "on"
+			err := guilds.update(i.GuildID, func(cfg *guildConfig) {
+				cfg.ReactionChannels = slices.DeleteFunc(cfg.ReactionChannels, func(id string) bool { return id == i.ChannelID })
+				if on {
+					cfg.ReactionChannels = append(cfg.ReactionChannels, i.ChannelID)
+				}
+			})
+			if err != nil {
+				slog.Error("failed to save guild config", "guild", i.GuildID, "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to save the server setting."))
+				return
+			}
+			if on {
+				respondEphemeral(s, i, loc.tr("I'll react to some messages in this channel with the server's emojis."))
+			} else {
+				respondEphemeral(s, i, loc.tr("I won't react to messages in this channel anymore."))
+			}
+		},
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+// recallResult is one hit of the recall tool.
+type recallResult struct {
+	// Source is where the hit comes from: "memory" or "conversation".
+	Source string `json:"source"`
+	// Label is the memory key with its scope, or when the archived
+	// conversation ended.
+	Label string  `json:"label"`
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// recaller searches everything the bot knows about a user in one go: the
+// memory entries visible in the conversation and the summaries of its past
+// conversations.
+type recaller struct {
+	mem    *memoryStore
+	topics *topicStore
+	// emb ranks results by embedding similarity. Without it they are ranked
+	// by how many query terms they contain.
+	emb *embedder
+}
+
+// recall returns at most limit results for query, best first.
+func (r *recaller) recall(ctx context.Context, userID, sessionKey string, sc memoryScope, query string, limit int) ([]recallResult, error) {
+	var results []recallResult
+	entries, err := r.mem.labeled(userID, sc)
+	if err != nil {
+		return nil, err
+	}
+	for label, v := range entries {
+		results = append(results, recallResult{Source: "memory", Label: label, Text: v})
+	}
+	topics, err := r.topics.list(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range topics {
+		text := e.Summary
+		if len(e.Tags) > 0 {
+			text += " (" + strings.Join(e.Tags, ", ") + ")"
+		}
+		results = append(results, recallResult{Source: "conversation", Label: e.EndedAt, Text: text})
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	ranked := false
+	if r.emb != nil {
+		if err := r.rankByEmbedding(ctx, query, results); err != nil {
+			slog.Warn("recall embedding failed; ranking by keywords", "user", hashID(userID), "err", err)
+		} else {
+			ranked = true
+		}
+	}
+	if !ranked {
+		terms := recallTerms(query)
+		kept := results[:0]
+		for _, res := range results {
+			if res.Score = termScore(terms, res.Label+" "+res.Text); res.Score > 0 {
+				kept = append(kept, res)
+			}
+		}
+		results = kept
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func (r *recaller) rankByEmbedding(ctx context.Context, query string, results []recallResult) error {
+	texts := make([]string, len(results))
+	for i, res := range results {
+		texts[i] = res.Label + ": " + res.Text
+	}
+	vecs, err := r.emb.embed(ctx, texts)
+	if err != nil {
+		return err
+	}
+	q, err := r.emb.embedTransient(ctx, []string{query})
+	if err != nil {
+		return err
+	}
+	for i := range results {
+		results[i].Score = storage.CosineSimilarity(q[0], vecs[i])
+	}
+	return nil
+}
+
+// recallTerms splits query into lowercase words. Words with characters
+// outside ASCII are split further into overlapping pairs of characters, as
+// Japanese does not separate words with spaces.
+func recallTerms(query string) []string {
+	var terms []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		runes := []rune(w)
+		if len(w) == len(runes) || len(runes) < 3 {
+			terms = append(terms, w)
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			terms = append(terms, string(runes[i:i+2]))
+		}
+	}
+	return terms
+}
+
+// termScore returns the share of terms that occur in text.
+func termScore(terms []string, text string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+	text = strings.ToLower(text)
+	n := 0
+	for _, t := range terms {
+		if strings.Contains(text, t) {
+			n++
+		}
+	}
+	return float64(n) / float64(len(terms))
+}
+
+// labeled returns the memory entries visible from sc keyed by
+// "<scope>:<key>", where scope is channel, guild or global. Like list, it
+// leaves out entries shadowed by a more specific scope.
+func (ms *memoryStore) labeled(userID string, sc memoryScope) (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	docs, err := ms.loadVisible(userID, sc)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	entries := make(map[string]string)
+	for _, ns := range sc.visible() {
+		scope, _, _ := strings.Cut(ns, ":")
+		for k, v := range docs[sc.dataNamespace(ns)][ns] {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			entries[scope+":"+k] = v
+		}
+	}
+	return entries, nil
+}
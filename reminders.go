@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const (
+	// reminderCheckInterval is how often due reminders are looked for.
+	reminderCheckInterval = 15 * time.Second
+	// maxReminders caps the pending reminders of one user.
+	maxReminders = 25
+	// maxReminderDelay is the furthest ahead a reminder can be set.
+	maxReminderDelay = 366 * 24 * time.Hour
+)
+
+// reminder is a message to send a user at a given time.
+type reminder struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// GuildID and ChannelID are where the reminder was set. The reminder is
+	// posted there with a mention, or in a DM if ChannelID is empty.
+	GuildID   string    `json:"guild_id,omitempty"`
+	ChannelID string    `json:"channel_id,omitempty"`
+	Text      string    `json:"text"`
+	Due       time.Time `json:"due"`
+	Created   time.Time `json:"created"`
+}
+
+// reminderStore keeps pending reminders in <data>/reminders.json and sends
+// them when they are due, also after a restart.
+type reminderStore struct {
+	mu        sync.Mutex
+	path      string
+	cipher    *storage.Cipher
+	reminders []*reminder
+	next      int
+}
+
+func newReminderStore(dataDir string, fc *storage.Cipher) *reminderStore {
+	rs := &reminderStore{path: filepath.Join(dataDir, "reminders.json"), cipher: fc}
+	err := storage.ReadRecover(rs.path, fc.ReadFile, func(b []byte) error {
+		rs.reminders = nil
+		return json.Unmarshal(b, &rs.reminders)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("failed to read reminders", "err", err)
+	}
+	for _, r := range rs.reminders {
+		if n, err := strconv.ParseInt(r.ID, 36, 64); err == nil {
+			rs.next = max(rs.next, int(n))
+		}
+	}
+	return rs
+}
+
+// save writes the reminders to disk. The caller must hold rs.mu.
+func (rs *reminderStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(rs.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(rs.reminders, "", "  ")
+	if err != nil {
+		return err
+	}
+	return rs.cipher.WriteFile(rs.path, b)
+}
+
+// add schedules r and returns it with its ID set.
+func (rs *reminderStore) add(r reminder) (*reminder, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := 0
+	for _, x := range rs.reminders {
+		if x.UserID == r.UserID {
+			n++
+		}
+	}
+	if n >= maxReminders {
+		return nil, fmt.Errorf("the user already has %d pending reminders; cancel some first", n)
+	}
+	rs.next++
+	r.ID = strconv.FormatInt(int64(rs.next), 36)
+	r.Created = time.Now().UTC()
+	rs.reminders = append(rs.reminders, &r)
+	return &r, rs.save()
+}
+
+// of returns the pending reminders of userID, soonest first.
+func (rs *reminderStore) of(userID string) []reminder {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var out []reminder
+	for _, r := range rs.reminders {
+		if r.UserID == userID {
+			out = append(out, *r)
+		}
+	}
+	slices.SortFunc(out, func(a, b reminder) int { return a.Due.Compare(b.Due) })
+	return out
+}
+
+// cancel removes the reminder id of userID and reports whether there was one.
+func (rs *reminderStore) cancel(userID, id string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := len(rs.reminders)
+	rs.reminders = slices.DeleteFunc(rs.reminders, func(r *reminder) bool {
+		return r.UserID == userID && r.ID == id
+	})
+	if len(rs.reminders) == n {
+		return false, nil
+	}
+	return true, rs.save()
+}
+
+// remove deletes every reminder of userID.
+func (rs *reminderStore) remove(userID string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	n := len(rs.reminders)
+	rs.reminders = slices.DeleteFunc(rs.reminders, func(r *reminder) bool { return r.UserID == userID })
+	if len(rs.reminders) == n {
+		return nil
+	}
+	return rs.save()
+}
+
+// run sends reminders as they come due. A reminder that cannot be sent is
+// dropped rather than retried forever.
+func (rs *reminderStore) run(s *discordgo.Session) {
+	for {
+		now := time.Now()
+		rs.mu.Lock()
+		var due []*reminder
+		rs.reminders = slices.DeleteFunc(rs.reminders, func(r *reminder) bool {
+			if r.Due.After(now) {
+				return false
+			}
+			due = append(due, r)
+			return true
+		})
+		if len(due) > 0 {
+			if err := rs.save(); err != nil {
+				slog.Error("failed to save reminders", "err", err)
+			}
+		}
+		rs.mu.Unlock()
+
+		for _, r := range due {
+			if err := sendReminder(s, r, now); err != nil {
+				slog.Warn("failed to send reminder", "user", hashID(r.UserID), "err", err)
+			}
+		}
+		time.Sleep(reminderCheckInterval)
+	}
+}
+
+func sendReminder(s *discordgo.Session, r *reminder, now time.Time) error {
+	text := "⏰ " + r.Text
+	if late := now.Sub(r.Due); late > time.Minute {
+		text += fmt.Sprintf("\n-# This reminder was due %s ago; I was offline.", late.Round(time.Minute))
+	}
+	if r.ChannelID != "" {
+		_, err := s.ChannelMessageSendComplex(r.ChannelID, &discordgo.MessageSend{
+			Content:         "<@" + r.UserID + "> " + text,
+			AllowedMentions: &discordgo.MessageAllowedMentions{Users: []string{r.UserID}},
+		})
+		if err == nil {
+			return nil
+		}
+		slog.Warn("failed to post reminder in channel; sending it as a DM", "channel", r.ChannelID, "err", err)
+	}
+	dm, err := s.UserChannelCreate(r.UserID)
+	if err != nil {
+		return err
+	}
+	_, err = s.ChannelMessageSend(dm.ID, text)
+	return err
+}
+
+// parseReminderTime reads when a reminder is due: a delay such as "2h30m",
+// "90m" or "1d", or a time in RFC 3339 format.
+func parseReminderTime(in, at string, now time.Time) (time.Time, error) {
+	var due time.Time
+	switch {
+	case in != "":
+		d, err := parseDelay(in)
+		if err != nil {
+			return time.Time{}, err
+		}
+		due = now.Add(d)
+	case at != "":
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q: use RFC 3339, e.g. 2025-01-31T09:00:00+09:00", at)
+		}
+		due = t
+	default:
+		return time.Time{}, fmt.Errorf("give either in or at")
+	}
+	if !due.After(now) {
+		return time.Time{}, fmt.Errorf("the time is in the past")
+	}
+	if due.Sub(now) > maxReminderDelay {
+		return time.Time{}, fmt.Errorf("reminders can be set at most a year ahead")
+	}
+	return due, nil
+}
+
+// parseDelay parses a Go duration, also accepting days ("1d", "2d12h").
+func parseDelay(s string) (time.Duration, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	var days time.Duration
+	if d, rest, ok := strings.Cut(s, "d"); ok {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, fmt.Errorf("invalid delay %q", s)
+		}
+		days, s = time.Duration(n)*24*time.Hour, rest
+	}
+	if s == "" {
+		return days, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delay %q: use e.g. 45m, 2h30m or 1d", s)
+	}
+	return days + d, nil
+}
+
+func remindersCommand(rs *reminderStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "reminders",
+			Description: "Show or cancel your reminders",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List your pending reminders",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "cancel",
+					Description: "Cancel a reminder",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "id",
+							Description: "The reminder's ID, as shown by /reminders list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			switch opts[0].Name {
+			case "list":
+				pending := rs.of(userID)
+				if len(pending) == 0 {
+					respondEphemeral(s, i, loc.tr("You have no pending reminders."))
+					return
+				}
+				var sb strings.Builder
+				for _, r := range pending {
+					where := "DM"
+					if r.ChannelID != "" {
+						where = "<#" + r.ChannelID + ">"
+					}
+					fmt.Fprintf(&sb, "`%s` <t:%d:f> (<t:%d:R>) in %s: %s\n", r.ID, r.Due.Unix(), r.Due.Unix(), where, r.Text)
+				}
+				respondEphemeral(s, i, splitMessage(sb.String(), discordLimit)[0])
+			case "cancel":
+				id := strings.TrimSpace(opts[0].Options[0].StringValue())
+				ok, err := rs.cancel(userID, id)
+				switch {
+				case err != nil:
+					respondEphemeral(s, i, loc.tr("Failed to cancel the reminder: %s", err))
+				case !ok:
+					respondEphemeral(s, i, loc.tr("You have no reminder with ID `%s`.", id))
+				default:
+					respondEphemeral(s, i, loc.tr("Cancelled reminder `%s`.", id))
+				}
+			}
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const replHelp = `Type a message to chat. A line ending in \ continues on the next line.
+/reset  start a fresh conversation
+/quit   leave (or press Ctrl-D)
+`
+
+// repl chats with the bot on stdin and stdout through the same sessions,
+// memory and tools as Discord, for trying prompts and tools without a bot
+// token. The conversation is userID's DM conversation.
+type repl struct {
+	api    *chatAPI
+	userID string
+}
+
+// run reads messages from in until EOF or /quit and writes the replies to
+// out. The prompt and tool calls go to info, so out holds only replies.
+// Ctrl-C stops the reply in progress.
+func (r *repl) run(in io.Reader, out, info io.Writer) error {
+	fmt.Fprintf(info, "Chatting as user %s. /help lists commands.\n", r.userID)
+	sc := bufio.NewScanner(in)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	var lines []string
+	for {
+		if len(lines) == 0 {
+			fmt.Fprint(info, "> ")
+		} else {
+			fmt.Fprint(info, "… ")
+		}
+		if !sc.Scan() {
+			fmt.Fprintln(info)
+			return sc.Err()
+		}
+		line := sc.Text()
+		if cont, ok := strings.CutSuffix(line, `\`); ok {
+			lines = append(lines, cont)
+			continue
+		}
+		msg := strings.TrimSpace(strings.Join(append(lines, line), "\n"))
+		lines = nil
+		switch msg {
+		case "":
+			continue
+		case "/quit", "/exit":
+			return nil
+		case "/help":
+			fmt.Fprint(info, replHelp)
+			continue
+		case "/reset":
+			key := scopedKey("", r.userID)
+			sess := r.api.store.get(key)
+			sess.mu.Lock()
+			r.api.store.reset(key, sess)
+			err := r.api.store.save(key, sess)
+			sess.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(info, "Started a fresh conversation.")
+			continue
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		start := time.Now()
+		reply, err := r.api.chat(ctx, apiChatRequest{User: r.userID, Message: msg}, func(name, arguments string) {
+			fmt.Fprintf(info, "[tool] %s %s\n", name, arguments)
+		})
+		stop()
+		if err != nil {
+			fmt.Fprintln(info, "error:", err)
+			continue
+		}
+		if reply == "" {
+			reply = pickLocale(detectLanguage(msg)).tr("(no reply)")
+		}
+		fmt.Fprintln(out, reply)
+		fmt.Fprintf(info, "(%s)\n", time.Since(start).Round(100*time.Millisecond))
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// resumePrompter asks users whether to continue a conversation that was
+// reloaded from disk after it expired, holding back their message until they
+// answer.
+type resumePrompter struct {
+	mu      sync.Mutex
+	pending map[string]*discordgo.MessageCreate
+	store   *sessionStore
+	// handle re-dispatches the held message once the user has chosen.
+	handle func(s *discordgo.Session, m *discordgo.MessageCreate)
+}
+
+func newResumePrompter(store *sessionStore) *resumePrompter {
+	return &resumePrompter{
+		pending: make(map[string]*discordgo.MessageCreate),
+		store:   store,
+	}
+}
+
+// ask holds m and posts the resume question for sessionKey in loc. If a
+// question is already pending for the session, only the held message is
+// replaced.
+func (rp *resumePrompter) ask(s *discordgo.Session, channelID string, ref *discordgo.MessageReference, sessionKey string, m *discordgo.MessageCreate, updated time.Time, loc locale) {
+	rp.mu.Lock()
+	_, asked := rp.pending[sessionKey]
+	rp.pending[sessionKey] = m
+	rp.mu.Unlock()
+	if asked {
+		return
+	}
+
+	_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		// Discord shows the relative timestamp in the reader's language.
+		Content:   loc.tr("Continue the previous conversation from %s?", fmt.Sprintf("<t:%d:R>", updated.Unix())),
+		Reference: ref,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: loc.tr("Resume"), Style: discordgo.PrimaryButton, CustomID: "resume:yes:" + sessionKey},
+				discordgo.Button{Label: loc.tr("Start fresh"), Style: discordgo.SecondaryButton, CustomID: "resume:no:" + sessionKey},
+			}},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to send message", "err", err)
+	}
+}
+
+func (rp *resumePrompter) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	id := i.MessageComponentData().CustomID
+	if !strings.HasPrefix(id, "resume:") {
+		return
+	}
+	choice, sessionKey, _ := strings.Cut(strings.TrimPrefix(id, "resume:"), ":")
+	loc := interactionLocale(i)
+
+	rp.mu.Lock()
+	m, ok := rp.pending[sessionKey]
+	if ok && m.Author.ID != interactionUserID(i) {
+		rp.mu.Unlock()
+		respondEphemeral(s, i, loc.tr("Only the person who asked can choose."))
+		return
+	}
+	delete(rp.pending, sessionKey)
+	rp.mu.Unlock()
+
+	if !ok {
+		// The question was answered already or outlived a restart, so
+		// there is no one left to check the choice against.
+		rp.update(s, i, loc.tr("This question is no longer open."))
+		return
+	}
+
+	sess := rp.store.get(sessionKey)
+	sess.mu.Lock()
+	sess.staleSince = time.Time{}
+	content := loc.tr("Resuming the previous conversation.")
+	if choice == "no" {
+		rp.store.reset(sessionKey, sess)
+		content = loc.tr("Starting a fresh conversation.")
+		if err := rp.store.save(sessionKey, sess); err != nil {
+			slog.Error("failed to save session", "session", hashID(sessionKey), "err", err)
+		}
+	}
+	sess.mu.Unlock()
+
+	rp.update(s, i, content)
+	rp.handle(s, m)
+}
+
+// update replaces the question of i with content and removes its buttons.
+func (rp *resumePrompter) update(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
+
+func humanizeAge(d time.Duration) string {
+	return humanizeDuration(d) + " ago"
+}
+
+func humanizeDuration(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute")
+	case d < 24*time.Hour:
+		return plural(int(d.Hours()), "hour")
+	default:
+		return plural(int(d.Hours()/24), "day")
+	}
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+// textCommand is a node in the "<prefix>yagi ..." command tree. Groups have
+// subs, leaves have run.
+type textCommand struct {
+	name    string
+	aliases []string
+	// args is the usage of the arguments, e.g. "<key> [value]". Each <...>
+	// is required.
+	args  string
+	help  string
+	admin bool
+	subs  []*textCommand
+	run   func(c *commandCall) string
+}
+
+// commandCall is one invocation of a leaf command.
+type commandCall struct {
+	s          *discordgo.Session
+	m          *discordgo.MessageCreate
+	sessionKey string
+	// userKey is the author's own session, which holds their preferences
+	// when the conversation is kept under a thread.
+	userKey string
+	args    []string
+	// loc is the locale to answer in.
+	loc locale
+}
+
+func (tc *textCommand) find(name string) *textCommand {
+	name = strings.ToLower(name)
+	for _, sub := range tc.subs {
+		if sub.name == name {
+			return sub
+		}
+		for _, a := range sub.aliases {
+			if a == name {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
+// commandRouter dispatches text commands addressed to the bot, so that they
+// are answered directly instead of being sent to the model.
+type commandRouter struct {
+	root    *textCommand
+	prefix  string
+	isAdmin func(userID string) bool
+	// shortcuts are top-level commands that also work without "yagi",
+	// e.g. "!topics" for "!yagi topics", but only after the prefix: a
+	// message that merely starts with "recall" is not a command.
+	shortcuts []string
+}
+
+// match reports whether content, stripped of the prefix or mention, is a
+// command, and returns its arguments. Text that came with neither is never a
+// command, so that plain DMs reach the model.
+func (r *commandRouter) match(content string, prefixed, mentioned bool) ([]string, bool) {
+	if !prefixed && !mentioned {
+		return nil, false
+	}
+	first, rest, _ := strings.Cut(content, " ")
+	first = strings.ToLower(first)
+	if first == r.root.name {
+		return splitArgs(rest), true
+	}
+	if prefixed && slices.Contains(r.shortcuts, first) {
+		return append([]string{first}, splitArgs(rest)...), true
+	}
+	return nil, false
+}
+
+// dispatch walks the tree along c.args and runs the command it ends at.
+// Stopping at a group prints the group's help.
+func (r *commandRouter) dispatch(c *commandCall) string {
+	admin := r.isAdmin(c.m.Author.ID)
+	node := r.root
+	path := []string{r.root.name}
+	args := c.args
+	for len(args) > 0 && node.subs != nil {
+		sub := node.find(args[0])
+		if sub == nil {
+			return c.loc.tr("Unknown command: `%s`", strings.Join(path, " ")+" "+args[0]) + "\n\n" + r.help(c.loc, node, path, admin)
+		}
+		if sub.admin && !admin {
+			return c.loc.tr("This command is for bot admins only.")
+		}
+		node, path, args = sub, append(path, sub.name), args[1:]
+	}
+	if node.run == nil {
+		return r.help(c.loc, node, path, admin)
+	}
+	if len(args) < strings.Count(node.args, "<") {
+		return c.loc.tr("Usage: `%s`", r.prefix+strings.Join(path, " ")+" "+node.args)
+	}
+	c.args = args
+	return node.run(c)
+}
+
+// help lists the commands under node in loc, hiding admin-only ones from
+// others.
+func (r *commandRouter) help(loc locale, node *textCommand, path []string, admin bool) string {
+	var lines []string
+	var walk func(tc *textCommand, path []string)
+	walk = func(tc *textCommand, path []string) {
+		if tc.admin && !admin {
+			return
+		}
+		if tc.run != nil {
+			usage := r.prefix + strings.Join(path, " ")
+			if tc.args != "" {
+				usage += " " + tc.args
+			}
+			line := "`" + usage + "` — " + loc.tr(tc.help)
+			if len(tc.aliases) > 0 {
+				line += " (" + loc.tr("alias") + ": " + strings.Join(tc.aliases, ", ") + ")"
+			}
+			lines = append(lines, line)
+		}
+		for _, sub := range tc.subs {
+			walk(sub, append(path[:len(path):len(path)], sub.name))
+		}
+	}
+	walk(node, path)
+	header := loc.tr("**Commands**")
+	if node.help != "" && node != r.root {
+		header = "**" + strings.Join(path, " ") + "** — " + loc.tr(node.help)
+	}
+	return header + "\n" + strings.Join(lines, "\n")
+}
+
+// splitArgs splits s at spaces, keeping "quoted strings" together.
+func splitArgs(s string) []string {
+	var args []string
+	var cur strings.Builder
+	inQuote, has := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			has = true
+		case unicode.IsSpace(r) && !inQuote:
+			if has {
+				args = append(args, cur.String())
+				cur.Reset()
+				has = false
+			}
+		default:
+			cur.WriteRune(r)
+			has = true
+		}
+	}
+	if has {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// newCommandRouter builds the bot's text commands.
+func newCommandRouter(prefix string, store *sessionStore, mem *memoryStore, topics *topicStore, checkins *checkinStore, checkinInterval time.Duration, admin *adminCommands, eng *engine.Engine, providerName string, updates *updateChecker, meetings *meetingRecorder) *commandRouter {
+	r := &commandRouter{
+		prefix:    prefix,
+		isAdmin:   admin.isAdmin,
+		shortcuts: []string{"admin", "topics", "recall", "version", "meeting"},
+	}
+	scopeOf := func(c *commandCall) memoryScope {
+		return memoryScope{GuildID: c.m.GuildID, ChannelID: c.m.ChannelID}
+	}
+
+	r.root = &textCommand{
+		name: "yagi",
+		subs: []*textCommand{
+			{
+				name:    "help",
+				aliases: []string{"?"},
+				args:    "[command]",
+				help:    "Show commands",
+				run: func(c *commandCall) string {
+					admin := r.isAdmin(c.m.Author.ID)
+					node, path := r.root, []string{r.root.name}
+					for _, a := range c.args {
+						sub := node.find(a)
+						if sub == nil || (sub.admin && !admin) {
+							break
+						}
+						node, path = sub, append(path, sub.name)
+					}
+					return r.help(c.loc, node, path, admin)
+				},
+			},
+			{
+				name:    "memory",
+				aliases: []string{"mem"},
+				help:    "What the bot remembers about you",
+				subs: []*textCommand{
+					{
+						name:    "list",
+						aliases: []string{"ls"},
+						help:    "List memories visible here",
+						run: func(c *commandCall) string {
+							m, err := mem.list(c.m.Author.ID, scopeOf(c))
+							if err != nil {
+								return c.loc.tr("Failed to read memory: %s", err)
+							}
+							if len(m) == 0 {
+								return c.loc.tr("I don't remember anything about you here.")
+							}
+							keys := make([]string, 0, len(m))
+							for k := range m {
+								keys = append(keys, k)
+							}
+							sort.Strings(keys)
+							var sb strings.Builder
+							for _, k := range keys {
+								fmt.Fprintf(&sb, "- `%s`: %s\n", k, m[k])
+							}
+							return sb.String()
+						},
+					},
+					{
+						name: "get",
+						args: "<key>",
+						help: "Show one memory",
+						run: func(c *commandCall) string {
+							v, err := mem.get(c.m.Author.ID, scopeOf(c), c.args[0])
+							switch {
+							case err != nil:
+								return c.loc.tr("Failed to read memory: %s", err)
+							case v == "":
+								return c.loc.tr("Nothing is remembered under `%s`.", c.args[0])
+							}
+							return "`" + c.args[0] + "`: " + v
+						},
+					},
+					{
+						name:    "delete",
+						aliases: []string{"rm", "forget"},
+						args:    "<key>",
+						help:    "Forget one memory",
+						run: func(c *commandCall) string {
+							if err := mem.delete(c.m.Author.ID, scopeOf(c), c.args[0]); err != nil {
+								return c.loc.tr("Failed to delete memory: %s", err)
+							}
+							return c.loc.tr("Deleted `%s`.", c.args[0])
+						},
+					},
+				},
+			},
+			{
+				name: "session",
+				help: "Your conversation with the bot",
+				subs: []*textCommand{
+					{
+						name: "show",
+						help: "Show the current conversation settings",
+						run: func(c *commandCall) string {
+							prefs := store.preferences(c.userKey)
+							sess := store.get(c.sessionKey)
+							sess.mu.Lock()
+							defer sess.mu.Unlock()
+							or := func(s, def string) string {
+								if s == "" {
+									return def
+								}
+								return s
+							}
+							return c.loc.tr("Messages: %d\nPersona: %s\nLanguage: %s",
+								len(sess.messages), or(prefs.persona, c.loc.tr("default")), or(prefs.language, c.loc.tr("auto")))
+						},
+					},
+					{
+						name:    "reset",
+						aliases: []string{"clear", "new"},
+						help:    "Forget the conversation history (settings are kept)",
+						run: func(c *commandCall) string {
+							sess := store.get(c.sessionKey)
+							sess.mu.Lock()
+							defer sess.mu.Unlock()
+							store.reset(c.sessionKey, sess)
+							if err := store.save(c.sessionKey, sess); err != nil {
+								slog.Error("failed to save session", "session", hashID(c.sessionKey), "err", err)
+								return c.loc.tr("Failed to reset the conversation: %s", err)
+							}
+							return c.loc.tr("The conversation has been reset.")
+						},
+					},
+				},
+			},
+			{
+				name: "topics",
+				help: "List the topics of past conversations",
+				run: func(c *commandCall) string {
+					entries, err := topics.list(c.sessionKey)
+					if err != nil {
+						return c.loc.tr("Failed to read topics: %s", err)
+					}
+					if len(entries) == 0 {
+						return c.loc.tr("No past conversations yet.")
+					}
+					var sb strings.Builder
+					for i, e := range entries {
+						if i == 20 {
+							sb.WriteString(c.loc.tr("…and %d more", len(entries)-i) + "\n")
+							break
+						}
+						date, _, _ := strings.Cut(e.EndedAt, "T")
+						fmt.Fprintf(&sb, "- %s: %s\n", date, strings.Join(e.Tags, ", "))
+					}
+					return sb.String()
+				},
+			},
+			{
+				name: "recall",
+				args: "<topic>",
+				help: "Bring a past conversation back into the current one",
+				run: func(c *commandCall) string {
+					query := strings.TrimSpace(strings.Join(c.args, " "))
+					if query == "" {
+						return c.loc.tr("Usage: `%s`", prefix+"yagi recall <topic>")
+					}
+					e, err := topics.find(c.sessionKey, query)
+					if err != nil {
+						return c.loc.tr("Failed to read topics: %s", err)
+					}
+					if e == nil {
+						return c.loc.tr("No past conversation about that. Try `%s`.", prefix+"topics")
+					}
+					sess := store.get(c.sessionKey)
+					sess.mu.Lock()
+					defer sess.mu.Unlock()
+					sess.staleSince = time.Time{}
+					if len(sess.messages) == 0 {
+						sess.started = time.Now()
+					}
+					sess.messages = append(sess.messages, recallMessage(e))
+					if err := store.save(c.sessionKey, sess); err != nil {
+						slog.Error("failed to save session", "session", hashID(c.sessionKey), "err", err)
+						return c.loc.tr("Failed to recall the conversation: %s", err)
+					}
+					return c.loc.tr("Recalled (%s):\n> %s", strings.Join(e.Tags, ", "), e.Summary)
+				},
+			},
+			{
+				name: "checkin",
+				help: "Follow-up DMs about things you told the bot",
+				subs: []*textCommand{
+					{
+						name: "on",
+						help: "Let the bot DM you to follow up on your plans",
+						run: func(c *commandCall) string {
+							if err := checkins.setEnabled(c.m.Author.ID, true); err != nil {
+								return c.loc.tr("Failed to save: %s", err)
+							}
+							return checkinStatus(c.loc, checkins.get(c.m.Author.ID), checkinInterval)
+						},
+					},
+					{
+						name:    "off",
+						aliases: []string{"stop"},
+						help:    "Stop follow-up DMs",
+						run: func(c *commandCall) string {
+							if err := checkins.setEnabled(c.m.Author.ID, false); err != nil {
+								return c.loc.tr("Failed to save: %s", err)
+							}
+							return c.loc.tr("Check-ins are off. I won't DM you on my own anymore.")
+						},
+					},
+				},
+			},
+			{
+				name: "model",
+				help: "The model the bot uses",
+				subs: []*textCommand{
+					{
+						name: "show",
+						help: "Show the current model",
+						run: func(c *commandCall) string {
+							return c.loc.tr("Model: `%s`", providerName+"/"+eng.Model())
+						},
+					},
+					{
+						name:  "set",
+						args:  "<model>",
+						help:  "Switch to another model of the same provider",
+						admin: true,
+						run: func(c *commandCall) string {
+							name := c.args[0]
+							if p, n, ok := strings.Cut(name, "/"); ok {
+								if p != providerName {
+									return c.loc.tr("Only models of `%s` can be selected at runtime.", providerName)
+								}
+								name = n
+							}
+							eng.SetModel(name)
+							slog.Info("model changed", "model", providerName+"/"+name, "user", hashID(c.m.Author.ID))
+							return c.loc.tr("Model set to `%s`.", providerName+"/"+name)
+						},
+					},
+				},
+			},
+			meetingCommand(meetings),
+			{
+				name: "version",
+				help: "Show the bot version and whether an update is available",
+				run: func(c *commandCall) string {
+					return updates.status()
+				},
+			},
+			{
+				name:  "admin",
+				args:  "<command>",
+				help:  "Maintenance commands (see `admin help`)",
+				admin: true,
+				run: func(c *commandCall) string {
+					return admin.handle(c.args)
+				},
+			},
+		},
+	}
+	return r
+}
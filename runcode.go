@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codeOutputMax bounds what is kept of the stdout and of the stderr of a
+// snippet.
+const codeOutputMax = 8 << 10
+
+// codeLanguage is a language runCode can run, with its container image and
+// the command reading the snippet from stdin.
+type codeLanguage struct {
+	image string
+	cmd   []string
+	// piston is the name of the language in a Piston API.
+	piston string
+}
+
+var codeLanguages = map[string]codeLanguage{
+	"python":     {image: "python:3.13-alpine", cmd: []string{"python3", "-"}, piston: "python"},
+	"javascript": {image: "node:22-alpine", cmd: []string{"node", "-"}, piston: "javascript"},
+}
+
+// codeResult is the outcome of a snippet.
+type codeResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	TimedOut bool
+}
+
+// codeSandbox runs snippets for runCode, either in throwaway containers of
+// a local runtime (docker or podman, optionally with a runtime such as
+// gVisor's runsc) or through a Piston-compatible execution API. Containers
+// get no network, a read-only root, a small /tmp, limited memory, CPU and
+// processes, and an unprivileged user.
+type codeSandbox struct {
+	// engine is the container CLI, or "" for the API at url.
+	engine  string
+	runtime string
+	url     string
+	timeout time.Duration
+	memory  int // MB
+	client  *http.Client
+}
+
+// newCodeSandbox returns the sandbox for the -code-sandbox value kind:
+// docker, podman or the URL of a Piston API.
+func newCodeSandbox(kind, runtime string, timeout time.Duration, memory int) (*codeSandbox, error) {
+	cs := &codeSandbox{runtime: runtime, timeout: timeout, memory: memory}
+	switch {
+	case kind == "docker" || kind == "podman":
+		if _, err := exec.LookPath(kind); err != nil {
+			return nil, err
+		}
+		cs.engine = kind
+	case strings.HasPrefix(kind, "http://") || strings.HasPrefix(kind, "https://"):
+		if runtime != "" {
+			return nil, errors.New("-code-runtime only applies to docker and podman")
+		}
+		cs.url = strings.TrimSuffix(kind, "/")
+		cs.client = &http.Client{Timeout: timeout + 10*time.Second}
+	default:
+		return nil, fmt.Errorf("unknown sandbox %q: use docker, podman or the URL of a Piston API", kind)
+	}
+	return cs, nil
+}
+
+// pull fetches the container images, so that the first snippets do not
+// spend their time limit on it.
+func (cs *codeSandbox) pull() {
+	if cs.engine == "" {
+		return
+	}
+	for _, lang := range codeLanguages {
+		if out, err := exec.Command(cs.engine, "pull", lang.image).CombinedOutput(); err != nil {
+			slog.Warn("failed to pull code image", "image", lang.image, "err", err, "output", truncateRunes(strings.TrimSpace(string(out)), 200))
+		}
+	}
+}
+
+func (cs *codeSandbox) run(ctx context.Context, lang codeLanguage, code string) (codeResult, error) {
+	if cs.engine == "" {
+		return cs.runPiston(ctx, lang, code)
+	}
+	return cs.runContainer(ctx, lang, code)
+}
+
+func (cs *codeSandbox) runContainer(ctx context.Context, lang codeLanguage, code string) (codeResult, error) {
+	name := "yagi-run-" + newRequestID()
+	args := []string{"run", "--rm", "-i", "--name", name,
+		"--network", "none",
+		"--read-only",
+		"--tmpfs", "/tmp:rw,size=16m",
+		"--memory", strconv.Itoa(cs.memory) + "m",
+		"--memory-swap", strconv.Itoa(cs.memory) + "m",
+		"--cpus", "1",
+		"--pids-limit", "64",
+		"--cap-drop", "ALL",
+		"--security-opt", "no-new-privileges",
+		"--user", "65534:65534",
+		"--workdir", "/tmp",
+	}
+	if cs.runtime != "" {
+		args = append(args, "--runtime", cs.runtime)
+	}
+	args = append(args, lang.image)
+	args = append(args, lang.cmd...)
+
+	runCtx, cancel := context.WithTimeout(ctx, cs.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(runCtx, cs.engine, args...)
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Stdin = strings.NewReader(code)
+	stdout := &cappedBuffer{max: codeOutputMax}
+	stderr := &cappedBuffer{max: codeOutputMax}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	// The caps may have cut a character in two.
+	res := codeResult{Stdout: strings.ToValidUTF8(stdout.String(), ""), Stderr: strings.ToValidUTF8(stderr.String(), "")}
+	if runCtx.Err() != nil {
+		// Killing the CLI leaves the container running.
+		kill := exec.Command(cs.engine, "kill", name)
+		if out, err := kill.CombinedOutput(); err != nil {
+			slog.Warn("failed to kill code container", "container", name, "err", err, "output", strings.TrimSpace(string(out)))
+		}
+		res.TimedOut = true
+		return res, nil
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// The CLI exits with 125 and more when the container could not run.
+		if exit.ExitCode() >= 125 {
+			return res, fmt.Errorf("sandbox failed: %s", truncateRunes(strings.TrimSpace(res.Stderr), 200))
+		}
+		res.ExitCode = exit.ExitCode()
+		return res, nil
+	}
+	return res, err
+}
+
+// runPiston runs code through the execute endpoint of a Piston API.
+func (cs *codeSandbox) runPiston(ctx context.Context, lang codeLanguage, code string) (codeResult, error) {
+	body, err := json.Marshal(map[string]any{
+		"language":         lang.piston,
+		"version":          "*",
+		"files":            []map[string]string{{"content": code}},
+		"run_timeout":      cs.timeout.Milliseconds(),
+		"run_memory_limit": cs.memory << 20,
+	})
+	if err != nil {
+		return codeResult{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.url+"/execute", bytes.NewReader(body))
+	if err != nil {
+		return codeResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion())
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return codeResult{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4*codeOutputMax))
+	if err != nil {
+		return codeResult{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return codeResult{}, fmt.Errorf("sandbox returned %s: %s", resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	var out struct {
+		Run struct {
+			Stdout string `json:"stdout"`
+			Stderr string `json:"stderr"`
+			Code   *int   `json:"code"`
+			Signal string `json:"signal"`
+		} `json:"run"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return codeResult{}, err
+	}
+	res := codeResult{
+		Stdout:   truncateRunes(out.Run.Stdout, codeOutputMax),
+		Stderr:   truncateRunes(out.Run.Stderr, codeOutputMax),
+		TimedOut: out.Run.Signal == "SIGKILL",
+	}
+	if out.Run.Code != nil {
+		res.ExitCode = *out.Run.Code
+	}
+	return res, nil
+}
+
+// tool is the runCode tool.
+func (cs *codeSandbox) tool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Language string `json:"language"`
+		Code     string `json:"code"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	lang, ok := codeLanguages[strings.ToLower(p.Language)]
+	if !ok {
+		return "", fmt.Errorf("unsupported language %q: use python or javascript", p.Language)
+	}
+	if strings.TrimSpace(p.Code) == "" {
+		return "", errors.New("code is empty")
+	}
+	res, err := cs.run(ctx, lang, p.Code)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if res.TimedOut {
+		fmt.Fprintf(&sb, "Stopped after %s.\n", cs.timeout)
+	} else {
+		fmt.Fprintf(&sb, "Exit code %d.\n", res.ExitCode)
+	}
+	if res.Stdout != "" {
+		fmt.Fprintf(&sb, "stdout:\n%s\n", res.Stdout)
+	}
+	if res.Stderr != "" {
+		fmt.Fprintf(&sb, "stderr:\n%s\n", res.Stderr)
+	}
+	if res.Stdout == "" && res.Stderr == "" && !res.TimedOut {
+		sb.WriteString("No output. Print the results you need.\n")
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+const ctxKeyGeneration contextKey = "generation"
+
+// paramRange is the range an operator allows users to set a generation
+// parameter in. A range that is not set means users may not change it.
+type paramRange struct {
+	min, max float64
+	set      bool
+}
+
+// parseParamRange parses "min-max", or "" for a parameter users may not
+// set.
+func parseParamRange(s string) (paramRange, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return paramRange{}, nil
+	}
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		return paramRange{}, fmt.Errorf("invalid range %q (use min-max)", s)
+	}
+	min, err := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+	if err != nil {
+		return paramRange{}, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	max, err := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+	if err != nil {
+		return paramRange{}, fmt.Errorf("invalid range %q: %w", s, err)
+	}
+	if min > max {
+		return paramRange{}, fmt.Errorf("invalid range %q: min is above max", s)
+	}
+	return paramRange{min: min, max: max, set: true}, nil
+}
+
+func (r paramRange) contains(v float64) bool {
+	return r.set && v >= r.min && v <= r.max
+}
+
+func (r paramRange) clamp(v float64) float64 {
+	return min(max(v, r.min), r.max)
+}
+
+func (r paramRange) String() string {
+	return strconv.FormatFloat(r.min, 'f', -1, 64) + "–" + strconv.FormatFloat(r.max, 'f', -1, 64)
+}
+
+// generationLimits are the ranges users may set generation parameters in
+// with /settings.
+type generationLimits struct {
+	temperature, topP, maxTokens paramRange
+}
+
+// apply returns g with the parameters the limits no longer allow dropped
+// or brought into range, or nil if none is left.
+func (l generationLimits) apply(g *storage.GenerationSettings) *storage.GenerationSettings {
+	if g == nil {
+		return nil
+	}
+	out := storage.GenerationSettings{}
+	if g.Temperature != nil && l.temperature.set {
+		t := float32(l.temperature.clamp(float64(*g.Temperature)))
+		out.Temperature = &t
+	}
+	if g.TopP != nil && l.topP.set {
+		p := float32(l.topP.clamp(float64(*g.TopP)))
+		out.TopP = &p
+	}
+	if g.MaxTokens > 0 && l.maxTokens.set {
+		out.MaxTokens = int(l.maxTokens.clamp(float64(g.MaxTokens)))
+	}
+	if out == (storage.GenerationSettings{}) {
+		return nil
+	}
+	return &out
+}
+
+// withGeneration makes the chat completion requests made with ctx use g.
+func withGeneration(ctx context.Context, g *storage.GenerationSettings) context.Context {
+	if g == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyGeneration, g)
+}
+
+// generationTransport adds the generation parameters in the context of a
+// chat completion request to its body.
+type generationTransport struct {
+	base http.RoundTripper
+}
+
+func (t *generationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	g, _ := req.Context().Value(ctxKeyGeneration).(*storage.GenerationSettings)
+	if g == nil || req.Method != http.MethodPost || req.Body == nil || !strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		return t.base.RoundTrip(req)
+	}
+	data, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err == nil {
+		set := func(name string, v any) {
+			if b, err := json.Marshal(v); err == nil {
+				body[name] = b
+			}
+		}
+		if g.Temperature != nil {
+			set("temperature", *g.Temperature)
+		}
+		if g.TopP != nil {
+			set("top_p", *g.TopP)
+		}
+		if g.MaxTokens > 0 {
+			set("max_tokens", g.MaxTokens)
+		}
+		if b, err := json.Marshal(body); err == nil {
+			data = b
+		}
+	}
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+	return t.base.RoundTrip(r)
+}
+
+// describeSettings lists the settings of sess in loc. The caller must
+// hold sess.mu.
+func describeSettings(loc locale, sess *userSession) string {
+	var sb strings.Builder
+	g := sess.generation
+	if g == nil {
+		g = &storage.GenerationSettings{}
+	}
+	line := func(name, value string) {
+		if value == "" {
+			value = loc.tr("default")
+		}
+		fmt.Fprintf(&sb, "- %s: %s\n", loc.tr(name), value)
+	}
+	if g.Temperature != nil {
+		line("Temperature", strconv.FormatFloat(float64(*g.Temperature), 'f', -1, 32))
+	} else {
+		line("Temperature", "")
+	}
+	if g.TopP != nil {
+		line("Top P", strconv.FormatFloat(float64(*g.TopP), 'f', -1, 32))
+	} else {
+		line("Top P", "")
+	}
+	if g.MaxTokens > 0 {
+		line("Max tokens", strconv.Itoa(g.MaxTokens))
+	} else {
+		line("Max tokens", "")
+	}
+	lang := sess.language
+	if lang == "" {
+		lang = loc.tr("auto")
+	}
+	line("Language", lang)
+	return sb.String()
+}
+
+// settingsCommand lets users choose the sampling parameters and reply
+// language of their conversation, within limits.
+func settingsCommand(store *sessionStore, limits generationLimits) *slashCommand {
+	var setOpts []*discordgo.ApplicationCommandOption
+	number := func(typ discordgo.ApplicationCommandOptionType, name, desc string, r paramRange) {
+		if !r.set {
+			return
+		}
+		lo := r.min
+		setOpts = append(setOpts, &discordgo.ApplicationCommandOption{
+			Type:        typ,
+			Name:        name,
+			Description: fmt.Sprintf("%s (%s)", desc, r),
+			MinValue:    &lo,
+			MaxValue:    r.max,
+		})
+	}
+	number(discordgo.ApplicationCommandOptionNumber, "temperature", "Randomness of replies", limits.temperature)
+	number(discordgo.ApplicationCommandOptionNumber, "top_p", "Share of likely words considered", limits.topP)
+	number(discordgo.ApplicationCommandOptionInteger, "max_tokens", "Longest reply, in tokens", limits.maxTokens)
+	setOpts = append(setOpts, &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "language",
+		Description: "Language to reply in, e.g. English, or auto",
+	})
+
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "settings",
+			Description: "Choose how the bot generates your replies",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show your settings",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Change one or more settings",
+					Options:     setOpts,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reset",
+					Description: "Go back to the defaults",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			key := scopedKey(i.GuildID, userID)
+			sess := store.get(key)
+			sess.mu.Lock()
+			defer sess.mu.Unlock()
+
+			switch opts[0].Name {
+			case "show":
+				respondEphemeral(s, i, loc.tr("Your settings:")+"\n"+describeSettings(loc, sess))
+				return
+			case "reset":
+				sess.generation, sess.language = nil, ""
+			case "set":
+				if len(opts[0].Options) == 0 {
+					respondEphemeral(s, i, loc.tr("Give at least one setting to change."))
+					return
+				}
+				g := storage.GenerationSettings{}
+				if sess.generation != nil {
+					g = *sess.generation
+				}
+				lang := sess.language
+				for _, o := range opts[0].Options {
+					var r paramRange
+					var v float64
+					switch o.Name {
+					case "temperature":
+						r, v = limits.temperature, o.FloatValue()
+						t := float32(v)
+						g.Temperature = &t
+					case "top_p":
+						r, v = limits.topP, o.FloatValue()
+						p := float32(v)
+						g.TopP = &p
+					case "max_tokens":
+						r, v = limits.maxTokens, float64(o.IntValue())
+						g.MaxTokens = int(o.IntValue())
+					case "language":
+						lang = strings.TrimSpace(o.StringValue())
+						if strings.EqualFold(lang, "auto") {
+							lang = ""
+						}
+						continue
+					}
+					if !r.contains(v) {
+						respondEphemeral(s, i, loc.tr("%s must be within %s.", o.Name, r))
+						return
+					}
+				}
+				sess.generation, sess.language = &g, lang
+				if g == (storage.GenerationSettings{}) {
+					sess.generation = nil
+				}
+			}
+			if err := store.save(key, sess); err != nil {
+				slog.Error("failed to save session", "user", hashID(userID), "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to save your settings."))
+				return
+			}
+			respondEphemeral(s, i, loc.tr("Your settings:")+"\n"+describeSettings(loc, sess))
+		},
+	}
+}
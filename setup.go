@@ -0,0 +1,388 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	setupStepChannels = iota
+	setupStepPersona
+	setupStepLanguage
+	setupStepTools
+	setupStepQuota
+	setupStepConfirm
+
+	setupExpiry = 30 * time.Minute
+
+	// setupNone is the select value for "no persona" / "auto language",
+	// since select options cannot have empty values.
+	setupNone = "-"
+)
+
+var setupLanguages = []string{"English", "Japanese", "Chinese", "Korean", "Spanish", "French", "German", "Portuguese"}
+
+var setupQuotas = []int{0, 10, 20, 50, 100, 200}
+
+type setupDraft struct {
+	guildID   string
+	guildName string
+	step      int
+	cfg       guildConfig
+	channels  []*discordgo.Channel
+	started   time.Time
+	// loc is the locale the wizard talks to the manager in.
+	loc locale
+}
+
+// setupWizard walks a server manager through the guild config in DMs, one
+// select menu per step, and saves the result at the end.
+type setupWizard struct {
+	mu       sync.Mutex
+	drafts   map[string]*setupDraft
+	guilds   *guildStore
+	personas *personaStore
+	tools    *toolRegistry
+}
+
+func newSetupWizard(guilds *guildStore, personas *personaStore, tools *toolRegistry) *setupWizard {
+	return &setupWizard{
+		drafts:   make(map[string]*setupDraft),
+		guilds:   guilds,
+		personas: personas,
+		tools:    tools,
+	}
+}
+
+func (w *setupWizard) command() *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "yagi",
+			Description: "Bot configuration",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "setup",
+					Description: "Configure the bot for this server (sent to you in DMs)",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "system-prompt",
+					Description: "Turn the identity prompt on or off for this server",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Send the identity or persona prompt with each request",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if i.GuildID == "" || !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("Run this in a server where you have the Manage Server permission."))
+				return
+			}
+			switch opts[0].Name {
+			case "setup":
+				w.start(s, i)
+			case "system-prompt":
+				enabled := opts[0].Options[0].BoolValue()
+				if err := w.guilds.update(i.GuildID, func(c *guildConfig) { c.NoSystemPrompt = !enabled }); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to save: %s", err))
+					return
+				}
+				if enabled {
+					respondEphemeral(s, i, loc.tr("The identity prompt is now sent in this server."))
+				} else {
+					respondEphemeral(s, i, loc.tr("The identity prompt is no longer sent in this server. Memory and language hints still are."))
+				}
+			}
+		},
+	}
+}
+
+func (w *setupWizard) start(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	loc := interactionLocale(i)
+	userID := interactionUserID(i)
+	d := &setupDraft{
+		guildID: i.GuildID,
+		cfg:     w.guilds.get(i.GuildID),
+		started: time.Now(),
+		loc:     loc,
+	}
+	if g, err := s.State.Guild(i.GuildID); err == nil {
+		d.guildName = g.Name
+	} else if g, err := s.Guild(i.GuildID); err == nil {
+		d.guildName = g.Name
+	}
+	if chans, err := s.GuildChannels(i.GuildID); err == nil {
+		for _, c := range chans {
+			if c.Type == discordgo.ChannelTypeGuildText || c.Type == discordgo.ChannelTypeGuildForum || c.Type == discordgo.ChannelTypeGuildNews {
+				d.channels = append(d.channels, c)
+			}
+		}
+		if len(d.channels) > 25 {
+			d.channels = d.channels[:25]
+		}
+	}
+
+	dm, err := s.UserChannelCreate(userID)
+	if err != nil {
+		respondEphemeral(s, i, loc.tr("I could not open a DM with you. Please allow DMs from server members."))
+		return
+	}
+	content, components := w.render(d)
+	if _, err := s.ChannelMessageSendComplex(dm.ID, &discordgo.MessageSend{
+		Content:    content,
+		Components: components,
+	}); err != nil {
+		respondEphemeral(s, i, loc.tr("I could not send you a DM. Please allow DMs from server members."))
+		return
+	}
+
+	w.mu.Lock()
+	w.drafts[userID] = d
+	w.mu.Unlock()
+	respondEphemeral(s, i, loc.tr("I sent you a DM to continue the setup."))
+}
+
+func (w *setupWizard) render(d *setupDraft) (string, []discordgo.MessageComponent) {
+	loc := d.loc
+	title := loc.tr("**Setup for %s** — step %d/%d", d.guildName, d.step+1, setupStepConfirm+1) + "\n"
+	next := discordgo.Button{Label: loc.tr("Skip"), Style: discordgo.SecondaryButton, CustomID: "setup:next"}
+	cancel := discordgo.Button{Label: loc.tr("Cancel"), Style: discordgo.DangerButton, CustomID: "setup:cancel"}
+	zero := 0
+
+	var prompt string
+	var menu discordgo.SelectMenu
+	switch d.step {
+	case setupStepChannels:
+		prompt = loc.tr("Which channels may the bot answer in? Select none to allow all channels.")
+		menu = discordgo.SelectMenu{MinValues: &zero, MaxValues: max(1, len(d.channels))}
+		for _, c := range d.channels {
+			menu.Options = append(menu.Options, discordgo.SelectMenuOption{
+				Label:   "#" + c.Name,
+				Value:   c.ID,
+				Default: slices.Contains(d.cfg.Channels, c.ID),
+			})
+		}
+		if len(menu.Options) == 0 {
+			prompt += "\n" + loc.tr("(No channels found.)")
+			menu.Options = []discordgo.SelectMenuOption{{Label: loc.tr("All channels"), Value: setupNone}}
+		}
+	case setupStepPersona:
+		prompt = loc.tr("Which persona should members get by default?")
+		menu.Options = []discordgo.SelectMenuOption{{Label: loc.tr("Default identity"), Value: setupNone, Default: d.cfg.Persona == ""}}
+		names, _ := w.personas.list()
+		for _, n := range names {
+			if len(menu.Options) == 25 {
+				break
+			}
+			menu.Options = append(menu.Options, discordgo.SelectMenuOption{Label: n, Value: n, Default: d.cfg.Persona == n})
+		}
+	case setupStepLanguage:
+		prompt = loc.tr("Which language should the bot reply in by default?")
+		menu.Options = []discordgo.SelectMenuOption{{Label: loc.tr("Auto-detect"), Value: setupNone, Default: d.cfg.Language == ""}}
+		for _, l := range setupLanguages {
+			menu.Options = append(menu.Options, discordgo.SelectMenuOption{Label: l, Value: l, Default: d.cfg.Language == l})
+		}
+	case setupStepTools:
+		prompt = loc.tr("Which tools may the bot use? Unselected tools are disabled.")
+		names := w.shownTools()
+		menu = discordgo.SelectMenu{MinValues: &zero, MaxValues: max(1, len(names))}
+		for _, n := range names {
+			menu.Options = append(menu.Options, discordgo.SelectMenuOption{
+				Label:   n,
+				Value:   n,
+				Default: !slices.Contains(d.cfg.DisabledTools, n),
+			})
+		}
+	case setupStepQuota:
+		prompt = loc.tr("How many messages may each member send per day?")
+		for _, q := range setupQuotas {
+			label := strconv.Itoa(q)
+			if q == 0 {
+				label = loc.tr("Unlimited")
+			}
+			menu.Options = append(menu.Options, discordgo.SelectMenuOption{Label: label, Value: strconv.Itoa(q), Default: d.cfg.DailyQuota == q})
+		}
+	default:
+		return title + loc.tr("Review and save:") + "\n" + w.summary(d), []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: loc.tr("Save"), Style: discordgo.SuccessButton, CustomID: "setup:save"},
+				cancel,
+			}},
+		}
+	}
+
+	menu.CustomID = "setup:select"
+	menu.Placeholder = loc.tr("Choose…")
+	return title + prompt, []discordgo.MessageComponent{
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{menu}},
+		discordgo.ActionsRow{Components: []discordgo.MessageComponent{next, cancel}},
+	}
+}
+
+func (w *setupWizard) summary(d *setupDraft) string {
+	loc := d.loc
+	var sb strings.Builder
+	channels := loc.tr("all")
+	if len(d.cfg.Channels) > 0 {
+		var names []string
+		for _, id := range d.cfg.Channels {
+			names = append(names, "<#"+id+">")
+		}
+		channels = strings.Join(names, " ")
+	}
+	persona := d.cfg.Persona
+	if persona == "" {
+		persona = loc.tr("default identity")
+	}
+	language := d.cfg.Language
+	if language == "" {
+		language = loc.tr("auto-detect")
+	}
+	disabled := loc.tr("none")
+	if len(d.cfg.DisabledTools) > 0 {
+		disabled = strings.Join(d.cfg.DisabledTools, ", ")
+	}
+	quota := loc.tr("unlimited")
+	if d.cfg.DailyQuota > 0 {
+		quota = loc.tr("%d messages per member per day", d.cfg.DailyQuota)
+	}
+	sb.WriteString(loc.tr("- Channels: %s\n- Persona: %s\n- Language: %s\n- Disabled tools: %s\n- Quota: %s",
+		channels, persona, language, disabled, quota) + "\n")
+	return sb.String()
+}
+
+func (w *setupWizard) handleComponent(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent {
+		return
+	}
+	data := i.MessageComponentData()
+	if !strings.HasPrefix(data.CustomID, "setup:") {
+		return
+	}
+	userID := interactionUserID(i)
+
+	w.mu.Lock()
+	d, ok := w.drafts[userID]
+	if ok && time.Since(d.started) > setupExpiry {
+		delete(w.drafts, userID)
+		ok = false
+	}
+	if !ok {
+		w.mu.Unlock()
+		respondEphemeral(s, i, interactionLocale(i).tr("This setup session has expired. Run `/yagi setup` again."))
+		return
+	}
+	loc := d.loc
+
+	var done string
+	switch data.CustomID {
+	case "setup:select":
+		w.apply(d, data.Values)
+		d.step++
+	case "setup:next":
+		d.step++
+	case "setup:cancel":
+		delete(w.drafts, userID)
+		done = loc.tr("Setup cancelled. Nothing was changed.")
+	case "setup:save":
+		delete(w.drafts, userID)
+		cfg := d.cfg
+		err := w.guilds.update(d.guildID, func(c *guildConfig) {
+			c.Channels = cfg.Channels
+			c.Persona = cfg.Persona
+			c.Language = cfg.Language
+			c.DisabledTools = cfg.DisabledTools
+			c.DailyQuota = cfg.DailyQuota
+		})
+		if err != nil {
+			slog.Error("failed to save guild config", "guild", d.guildID, "err", err)
+			done = loc.tr("Failed to save the configuration: %s", err)
+		} else {
+			done = loc.tr("Configuration saved for %s:", d.guildName) + "\n" + w.summary(d)
+		}
+	}
+	var content string
+	var components []discordgo.MessageComponent
+	if done != "" {
+		content, components = done, []discordgo.MessageComponent{}
+	} else {
+		content, components = w.render(d)
+	}
+	w.mu.Unlock()
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: components,
+		},
+	})
+	if err != nil {
+		slog.Error("failed to respond to interaction", "err", err)
+	}
+}
+
+// apply stores the values chosen in the current step's select menu.
+func (w *setupWizard) apply(d *setupDraft, values []string) {
+	first := ""
+	if len(values) > 0 && values[0] != setupNone {
+		first = values[0]
+	}
+	switch d.step {
+	case setupStepChannels:
+		d.cfg.Channels = nil
+		for _, v := range values {
+			if v != setupNone {
+				d.cfg.Channels = append(d.cfg.Channels, v)
+			}
+		}
+	case setupStepPersona:
+		d.cfg.Persona = first
+	case setupStepLanguage:
+		d.cfg.Language = first
+	case setupStepTools:
+		shown := w.shownTools()
+		var disabled []string
+		for _, n := range d.cfg.DisabledTools {
+			if !slices.Contains(shown, n) {
+				disabled = append(disabled, n)
+			}
+		}
+		for _, n := range shown {
+			if !slices.Contains(values, n) {
+				disabled = append(disabled, n)
+			}
+		}
+		d.cfg.DisabledTools = disabled
+	case setupStepQuota:
+		d.cfg.DailyQuota, _ = strconv.Atoi(first)
+	}
+}
+
+// shownTools returns the tools listed in the tools step, limited to what fits
+// in one select menu. Tools beyond that keep their current setting.
+func (w *setupWizard) shownTools() []string {
+	names := w.tools.names(nil)
+	if len(names) > 25 {
+		names = names[:25]
+	}
+	return names
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// workTracker counts running units of work, such as message handlers, so
+// that shutdown can stop new work and wait for the rest. The zero value is
+// ready to use.
+type workTracker struct {
+	mu     sync.Mutex
+	closed bool
+	n      int
+	idle   chan struct{}
+}
+
+// begin registers a unit of work and reports whether it may run; after
+// close it may not. Each successful begin must be paired with end.
+func (w *workTracker) begin() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.n++
+	return true
+}
+
+func (w *workTracker) end() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.n--
+	if w.n == 0 && w.idle != nil {
+		close(w.idle)
+		w.idle = nil
+	}
+}
+
+// close refuses new work and waits up to timeout for running work to end.
+// It reports whether everything finished in time.
+func (w *workTracker) close(timeout time.Duration) bool {
+	w.mu.Lock()
+	w.closed = true
+	if w.n == 0 {
+		w.mu.Unlock()
+		return true
+	}
+	if w.idle == nil {
+		w.idle = make(chan struct{})
+	}
+	idle := w.idle
+	w.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// flush saves every in-memory session with unsaved changes and returns how
+// many were written.
+func (s *sessionStore) flush() (int, error) {
+	s.mu.Lock()
+	sessions := make(map[string]*userSession, len(s.sessions))
+	for key, sess := range s.sessions {
+		sessions[key] = sess
+	}
+	s.mu.Unlock()
+
+	n := 0
+	var errs []error
+	for key, sess := range sessions {
+		sess.mu.Lock()
+		if sess.dirty {
+			if err := s.save(key, sess); err != nil {
+				errs = append(errs, err)
+			} else {
+				n++
+			}
+		}
+		sess.mu.Unlock()
+	}
+	return n, errors.Join(errs...)
+}
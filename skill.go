@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const skillPrompt = "You route chat requests to a specialist. Classify the user's message as one of: " +
+	"coding (writing, reviewing or debugging code, or technical how-tos), translation (translating or correcting text between languages), " +
+	"search (looking up facts, or what was said or saved before) or chat (anything else, including small talk). " +
+	"Reply with only the one word."
+
+// skillInputChars bounds the part of the message that is classified.
+const skillInputChars = 1000
+
+// skills are the request types with their system prompt variant and tools.
+// A nil tools list keeps every tool; an empty one offers none.
+var skills = map[string]struct {
+	prompt string
+	tools  []string
+}{
+	"coding": {
+		prompt: "This is a programming request. Answer like a senior engineer: give working code in fenced code blocks with the language named, " +
+			"explain only what is not obvious, and point out pitfalls and edge cases.",
+		tools: []string{"getMemoryEntry", "listMemoryEntries", "recall"},
+	},
+	"translation": {
+		prompt: "This is a translation request. Translate faithfully and naturally, keeping the tone, formatting and meaning. " +
+			"Reply with the translation only, adding a short note just when something cannot be carried over.",
+		tools: []string{},
+	},
+	"search": {
+		prompt: "This is a lookup request. Check memory and past conversations with your tools before answering, answer directly, " +
+			"and say plainly when you do not know rather than guessing.",
+		tools: []string{"getMemoryEntry", "listMemoryEntries", "recall"},
+	},
+	"chat": {
+		prompt: "This is casual conversation. Keep replies short, friendly and natural.",
+	},
+}
+
+// skillRouter classifies requests into skills with a short call to a small
+// model, so that replies get a system prompt and tools suited to the task.
+type skillRouter struct {
+	eng *engine.Engine
+}
+
+// classify returns the skill of content, or "" if it could not be told.
+func (sr *skillRouter) classify(ctx context.Context, content string) string {
+	if r := []rune(content); len(r) > skillInputChars {
+		content = string(r[:skillInputChars])
+	}
+	if strings.TrimSpace(content) == "" {
+		return ""
+	}
+	reply, _, err := sr.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: skillPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: content},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return ""
+	}
+	skill := strings.Trim(strings.ToLower(strings.TrimSpace(reply)), ".\"'")
+	if _, ok := skills[skill]; !ok {
+		return ""
+	}
+	return skill
+}
+
+// skillHint returns the system prompt addition for skill, or "" for none.
+func skillHint(skill string) string {
+	if sk, ok := skills[skill]; ok {
+		return "\n---\n" + sk.prompt + "\n"
+	}
+	return ""
+}
+
+// skillTools narrows names, the tools picked for a request, to those of
+// skill. A nil names stands for all of registered.
+func skillTools(skill string, names, registered []string) []string {
+	sk, ok := skills[skill]
+	if !ok || sk.tools == nil {
+		return names
+	}
+	if names == nil {
+		names = registered
+	}
+	out := []string{}
+	for _, n := range names {
+		if slices.Contains(sk.tools, n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedMagic starts every encrypted file, followed by the GCM nonce and
+// the sealed content.
+var encryptedMagic = []byte("YAGIENC1")
+
+// Cipher encrypts stored documents with AES-256-GCM. A nil *Cipher stores
+// them as plain JSON.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// LoadCipher returns a cipher for the key given directly or in keyFile, as
+// base64 of 32 bytes (a key file may also hold the 32 raw bytes). With
+// neither set it returns nil.
+func LoadCipher(key, keyFile string) (*Cipher, error) {
+	var raw []byte
+	switch {
+	case key != "":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+		}
+		raw = b
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			raw = b
+		} else {
+			raw = data
+		}
+	default:
+		return nil, nil
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// IsEncrypted reports whether data was written by Seal.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// Seal encrypts data. Without a cipher it is returned unchanged.
+func (c *Cipher) Seal(data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, encryptedMagic...)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, data, nil), nil
+}
+
+// Open decrypts data written by Seal. Plain data is returned unchanged so
+// that existing files stay readable after encryption is turned on.
+func (c *Cipher) Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("file is encrypted; set -encryption-key or -encryption-key-file")
+	}
+	data = data[len(encryptedMagic):]
+	n := c.aead.NonceSize()
+	if len(data) < n {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	return c.aead.Open(nil, data[:n], data[n:], nil)
+}
+
+// ReadFile reads and decrypts path.
+func (c *Cipher) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(data)
+}
+
+// WriteFile encrypts data and writes it to path atomically.
+func (c *Cipher) WriteFile(path string, data []byte) error {
+	data, err := c.Seal(data)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0600)
+}
+
+// MigrateEncrypt encrypts every plain file in the given subdirectories of
+// dataDir in place, backups included, and returns how many files were
+// converted.
+func MigrateEncrypt(dataDir string, c *Cipher, subdirs ...string) (int, error) {
+	if c == nil {
+		return 0, errors.New("migrate-encrypt needs -encryption-key or -encryption-key-file")
+	}
+	converted := 0
+	for _, sub := range subdirs {
+		paths, err := filepath.Glob(filepath.Join(dataDir, sub, "*.json"))
+		if err != nil {
+			return converted, err
+		}
+		backups, err := filepath.Glob(filepath.Join(dataDir, sub, "*.json"+BackupSuffix))
+		if err != nil {
+			return converted, err
+		}
+		for _, path := range append(paths, backups...) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return converted, err
+			}
+			if IsEncrypted(data) {
+				continue
+			}
+			sealed, err := c.Seal(data)
+			if err != nil {
+				return converted, err
+			}
+			tmp := path + ".tmp"
+			if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+				return converted, err
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				os.Remove(tmp)
+				return converted, err
+			}
+			converted++
+		}
+	}
+	return converted, nil
+}
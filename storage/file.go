@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BackupSuffix names the copy of the previous version kept next to a file
+// written by WriteFileAtomic.
+const BackupSuffix = ".bak"
+
+// WriteFileAtomic writes data to a temporary file in the same directory,
+// syncs it and renames it over path, so a crash leaves either the old or the
+// new content but never a torn file. The previous version is kept as
+// path+".bak" for ReadRecover.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	backup := path + BackupSuffix
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to remove backup", "path", backup, "err", err)
+	}
+	if err := os.Link(path, backup); err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to keep backup", "path", path, "err", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// ReadRecover reads path with read and hands the content to parse. If
+// the file is missing or cannot be read or parsed, the backup kept by
+// WriteFileAtomic is tried instead. When neither exists the error satisfies
+// os.IsNotExist.
+func ReadRecover(path string, read func(string) ([]byte, error), parse func([]byte) error) error {
+	data, err := read(path)
+	if err == nil {
+		if err = parse(data); err == nil {
+			return nil
+		}
+	}
+
+	backup := path + BackupSuffix
+	data, berr := read(backup)
+	if berr != nil {
+		if os.IsNotExist(berr) {
+			return err
+		}
+		return errors.Join(err, berr)
+	}
+	if berr := parse(data); berr != nil {
+		return errors.Join(err, berr)
+	}
+	if !os.IsNotExist(err) {
+		slog.Warn("recovered from backup", "path", path, "err", err)
+	}
+	return nil
+}
+
+// RemoveFile deletes path and its backup. Missing files are not an error.
+func RemoveFile(path string) error {
+	if err := os.Remove(path + BackupSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// FileBlobs stores blobs as files under a directory, written atomically
+// with a backup of the previous version.
+type FileBlobs struct {
+	dir string
+	fs  FS
+}
+
+// NewFileBlobs returns a store rooted at dir.
+func NewFileBlobs(dir string) *FileBlobs {
+	return NewFileBlobsFS(dir, OSFS{})
+}
+
+// NewFileBlobsFS returns a store rooted at dir in fsys.
+func NewFileBlobsFS(dir string, fsys FS) *FileBlobs {
+	return &FileBlobs{dir: dir, fs: fsys}
+}
+
+func (fb *FileBlobs) path(key string) string {
+	return filepath.Join(fb.dir, filepath.FromSlash(key))
+}
+
+func (fb *FileBlobs) Get(key string) ([]byte, error) {
+	return fb.fs.ReadFile(fb.path(key))
+}
+
+// Put writes data to the file for key. Files do not expire, so ttl is
+// ignored.
+func (fb *FileBlobs) Put(key string, data []byte, ttl time.Duration) error {
+	path := fb.path(key)
+	if err := fb.fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return fb.fs.WriteFile(path, data, 0600)
+}
+
+func (fb *FileBlobs) Delete(key string) error {
+	return fb.fs.Remove(fb.path(key))
+}
+
+func (fb *FileBlobs) List(prefix string) ([]string, error) {
+	root := fb.path(prefix)
+	var keys []string
+	err := fb.fs.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		rel, err := filepath.Rel(fb.dir, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
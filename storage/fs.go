@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FS is the file system the file-based stores write to.
+type FS interface {
+	ReadFile(path string) ([]byte, error)
+	// WriteFile replaces path with data as WriteFileAtomic does.
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	// Remove deletes path and its backup as RemoveFile does.
+	Remove(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	WalkDir(root string, fn fs.WalkDirFunc) error
+}
+
+// OSFS is the operating system's file system.
+type OSFS struct{}
+
+func (OSFS) ReadFile(path string) ([]byte, error) { return os.ReadFile(path) }
+
+func (OSFS) WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomic(path, data, perm)
+}
+
+func (OSFS) Remove(path string) error { return RemoveFile(path) }
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (OSFS) WalkDir(root string, fn fs.WalkDirFunc) error { return filepath.WalkDir(root, fn) }
+
+// MemFS keeps files in memory, for ephemeral runs and tests. Directories
+// exist implicitly, and WalkDir visits files only, in lexical order.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string][]byte)}
+}
+
+func (m *MemFS) ReadFile(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(path)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(data), nil
+}
+
+func (m *MemFS) WriteFile(path string, data []byte, _ os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filepath.Clean(path)] = slices.Clone(data)
+	return nil
+}
+
+func (m *MemFS) Remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, filepath.Clean(path))
+	return nil
+}
+
+func (m *MemFS) MkdirAll(string, os.FileMode) error { return nil }
+
+func (m *MemFS) WalkDir(root string, fn fs.WalkDirFunc) error {
+	root = filepath.Clean(root)
+	m.mu.Lock()
+	var paths []string
+	for p := range m.files {
+		if p == root || strings.HasPrefix(p, root+string(filepath.Separator)) {
+			paths = append(paths, p)
+		}
+	}
+	m.mu.Unlock()
+	if len(paths) == 0 {
+		err := fn(root, nil, &fs.PathError{Op: "lstat", Path: root, Err: fs.ErrNotExist})
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		if err := fn(p, memEntry(filepath.Base(p)), nil); err != nil {
+			if err == fs.SkipDir || err == fs.SkipAll {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// memEntry is a file visited by MemFS.WalkDir.
+type memEntry string
+
+func (e memEntry) Name() string               { return string(e) }
+func (memEntry) IsDir() bool                  { return false }
+func (memEntry) Type() fs.FileMode            { return 0 }
+func (e memEntry) Info() (fs.FileInfo, error) { return memInfo(e), nil }
+
+type memInfo string
+
+func (i memInfo) Name() string     { return string(i) }
+func (memInfo) Size() int64        { return 0 }
+func (memInfo) Mode() fs.FileMode  { return 0600 }
+func (memInfo) ModTime() time.Time { return time.Time{} }
+func (memInfo) IsDir() bool        { return false }
+func (memInfo) Sys() any           { return nil }
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemBlobs keeps blobs in process memory. Nothing survives a restart, which
+// suits tests and throwaway instances.
+type MemBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewMemBlobs() *MemBlobs {
+	return &MemBlobs{blobs: make(map[string][]byte)}
+}
+
+func (mb *MemBlobs) Get(key string) ([]byte, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	data, ok := mb.blobs[key]
+	if !ok {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// Put stores a copy of data. Entries do not expire, so ttl is ignored.
+func (mb *MemBlobs) Put(key string, data []byte, ttl time.Duration) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (mb *MemBlobs) Delete(key string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.blobs, key)
+	return nil
+}
+
+func (mb *MemBlobs) List(prefix string) ([]string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	var keys []string
+	for key := range mb.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
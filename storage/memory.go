@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// globalNamespace holds memory entries that are visible everywhere. Files
+// written before namespaces existed are read into it.
+const globalNamespace = "global"
+
+// MemoryOwner identifies one stored memory document.
+type MemoryOwner struct {
+	// Namespace is the data namespace (see Namespace), or empty for a
+	// document stored before namespaces existed.
+	Namespace string
+	UserID    string
+}
+
+// MemoryStore persists each user's memory as memory namespace -> key ->
+// value, in one document per data namespace the entries belong to.
+type MemoryStore interface {
+	// Load returns the memory of userID stored in ns, empty if there is
+	// none.
+	Load(ns, userID string) (map[string]map[string]string, error)
+	// Save replaces the memory of userID in ns. Empty memory namespaces are
+	// dropped, and the document is deleted when nothing is left.
+	Save(ns, userID string, m map[string]map[string]string) error
+	Delete(ns, userID string) error
+	// Owners lists every stored document.
+	Owners() ([]MemoryOwner, error)
+}
+
+// blobMemory stores each document as JSON in a Blobs backend, under
+// <namespace>/memory/<userID>.json.
+type blobMemory struct {
+	blobs  Blobs
+	cipher *Cipher
+}
+
+// NewMemoryStore returns a MemoryStore on b, encrypting with c.
+func NewMemoryStore(b Blobs, c *Cipher) MemoryStore {
+	return &blobMemory{blobs: b, cipher: c}
+}
+
+func memoryKey(ns, userID string) string {
+	return docKey(ns, "memory", userID+".json")
+}
+
+func (bm *blobMemory) Load(ns, userID string) (map[string]map[string]string, error) {
+	var m map[string]map[string]string
+	err := ReadRecover(memoryKey(ns, userID), readBlob(bm.blobs, bm.cipher), func(data []byte) error {
+		m = nil
+		if err := json.Unmarshal(data, &m); err == nil {
+			return nil
+		}
+		var legacy map[string]string
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+		m = map[string]map[string]string{globalNamespace: legacy}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if m == nil {
+		m = map[string]map[string]string{}
+	}
+	return m, nil
+}
+
+func (bm *blobMemory) Save(ns, userID string, m map[string]map[string]string) error {
+	for name, entries := range m {
+		if len(entries) == 0 {
+			delete(m, name)
+		}
+	}
+	if len(m) == 0 {
+		return bm.Delete(ns, userID)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	b, err = bm.cipher.Seal(b)
+	if err != nil {
+		return err
+	}
+	return bm.blobs.Put(memoryKey(ns, userID), b, 0)
+}
+
+func (bm *blobMemory) Delete(ns, userID string) error {
+	return bm.blobs.Delete(memoryKey(ns, userID))
+}
+
+func (bm *blobMemory) Owners() ([]MemoryOwner, error) {
+	var owners []MemoryOwner
+	for _, prefix := range []string{"dm/memory", "guilds", "memory"} {
+		keys, err := bm.blobs.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			rest, name, ok := strings.Cut(k, "memory/")
+			if !ok || strings.Contains(name, "/") || (rest != "" && !strings.HasSuffix(rest, "/")) {
+				continue
+			}
+			owners = append(owners, MemoryOwner{
+				Namespace: strings.TrimSuffix(rest, "/"),
+				UserID:    strings.TrimSuffix(name, ".json"),
+			})
+		}
+	}
+	return owners, nil
+}
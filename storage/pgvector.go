@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const pgSchema = `
+CREATE EXTENSION IF NOT EXISTS vector;
+CREATE TABLE IF NOT EXISTS yagi_vectors (
+	collection text NOT NULL,
+	id text NOT NULL,
+	hash text NOT NULL,
+	embedding vector NOT NULL,
+	PRIMARY KEY (collection, id)
+)`
+
+// PgVectors stores vectors in PostgreSQL using the pgvector extension.
+type PgVectors struct {
+	pool *pgxpool.Pool
+}
+
+// NewPgVectors connects to the database at url and creates the table if
+// needed. The role must be allowed to create the vector extension unless it
+// is already installed.
+func NewPgVectors(url string) (*PgVectors, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, pgSchema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &PgVectors{pool: pool}, nil
+}
+
+func (pv *PgVectors) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+// pgVector formats v in pgvector's text representation.
+func pgVector(v []float32) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, f := range v {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatFloat(float64(f), 'g', -1, 32))
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+func (pv *PgVectors) Hashes(collection string) (map[string]string, error) {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	rows, err := pv.pool.Query(ctx, `SELECT id, hash FROM yagi_vectors WHERE collection = $1`, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+func (pv *PgVectors) Upsert(collection string, vecs []Vector) error {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	tx, err := pv.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for _, v := range vecs {
+		_, err := tx.Exec(ctx, `INSERT INTO yagi_vectors (collection, id, hash, embedding) VALUES ($1, $2, $3, $4::vector)
+			ON CONFLICT (collection, id) DO UPDATE SET hash = EXCLUDED.hash, embedding = EXCLUDED.embedding`,
+			collection, v.ID, v.Hash, pgVector(v.Values))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (pv *PgVectors) Delete(collection string, ids []string) error {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	_, err := pv.pool.Exec(ctx, `DELETE FROM yagi_vectors WHERE collection = $1 AND id = ANY($2)`, collection, ids)
+	return err
+}
+
+func (pv *PgVectors) Search(collection string, query []float32, k int) ([]Match, error) {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	rows, err := pv.pool.Query(ctx, `SELECT id, 1 - (embedding <=> $2::vector) FROM yagi_vectors
+		WHERE collection = $1 ORDER BY embedding <=> $2::vector LIMIT $3`, collection, pgVector(query), k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []Match
+	for rows.Next() {
+		var m Match
+		if err := rows.Scan(&m.ID, &m.Score); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+func (pv *PgVectors) Drop(collection string) error {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	_, err := pv.pool.Exec(ctx, `DELETE FROM yagi_vectors WHERE collection = $1`, collection)
+	return err
+}
+
+func (pv *PgVectors) DropNamespace(ns string) error {
+	ctx, cancel := pv.ctx()
+	defer cancel()
+	_, err := pv.pool.Exec(ctx, `DELETE FROM yagi_vectors WHERE starts_with(collection, $1)`, ns+"/")
+	return err
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qdrantCollection is the Qdrant collection holding all of the bot's
+// vectors. Our collections are kept apart by a payload field.
+const qdrantCollection = "yagi_vectors"
+
+// QdrantVectors stores vectors on a Qdrant server through its REST API.
+type QdrantVectors struct {
+	base   string
+	apiKey string
+	client *http.Client
+
+	mu    sync.Mutex
+	ready bool
+}
+
+// NewQdrantVectors returns a store on the Qdrant server at base, such as
+// http://localhost:6333, and checks that it answers.
+func NewQdrantVectors(base, apiKey string) (*QdrantVectors, error) {
+	if _, err := url.Parse(base); err != nil || base == "" {
+		return nil, fmt.Errorf("invalid Qdrant URL: %q", base)
+	}
+	qv := &QdrantVectors{
+		base:   strings.TrimSuffix(base, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if _, err := qv.do(http.MethodGet, "/collections", nil); err != nil {
+		return nil, err
+	}
+	return qv, nil
+}
+
+// qdrantNotFound is returned by do for a 404 response.
+type qdrantNotFound struct{ path string }
+
+func (e *qdrantNotFound) Error() string { return "qdrant: not found: " + e.path }
+
+// do sends a request and returns the "result" field of the response.
+func (qv *QdrantVectors) do(method, path string, body any) (json.RawMessage, error) {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, qv.base+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if qv.apiKey != "" {
+		req.Header.Set("api-key", qv.apiKey)
+	}
+	resp, err := qv.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 32<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &qdrantNotFound{path: path}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("qdrant: %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out.Result, nil
+}
+
+// pointID derives a stable point UUID from a collection and vector ID, as
+// Qdrant only accepts UUIDs and integers.
+func pointID(collection, id string) string {
+	h := sha256.Sum256([]byte(collection + "\x00" + id))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// matchFilter selects the points whose payload field has value.
+func matchFilter(field, value string) map[string]any {
+	return map[string]any{
+		"must": []any{map[string]any{"key": field, "match": map[string]any{"value": value}}},
+	}
+}
+
+// ensure creates the Qdrant collection for vectors of size dims unless it
+// exists.
+func (qv *QdrantVectors) ensure(dims int) error {
+	qv.mu.Lock()
+	defer qv.mu.Unlock()
+	if qv.ready {
+		return nil
+	}
+	path := "/collections/" + qdrantCollection
+	_, err := qv.do(http.MethodGet, path, nil)
+	if _, ok := err.(*qdrantNotFound); ok {
+		_, err = qv.do(http.MethodPut, path, map[string]any{
+			"vectors": map[string]any{"size": dims, "distance": "Cosine"},
+		})
+		for _, field := range []string{"collection", "namespace"} {
+			if err == nil {
+				_, err = qv.do(http.MethodPut, path+"/index", map[string]any{
+					"field_name": field, "field_schema": "keyword",
+				})
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	qv.ready = true
+	return nil
+}
+
+type qdrantPoint struct {
+	ID      any     `json:"id"`
+	Score   float64 `json:"score"`
+	Payload struct {
+		ID   string `json:"id"`
+		Hash string `json:"hash"`
+	} `json:"payload"`
+}
+
+func (qv *QdrantVectors) Hashes(collection string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	var offset any
+	for {
+		req := map[string]any{"filter": matchFilter("collection", collection), "limit": 256, "with_payload": true, "with_vector": false}
+		if offset != nil {
+			req["offset"] = offset
+		}
+		res, err := qv.do(http.MethodPost, "/collections/"+qdrantCollection+"/points/scroll", req)
+		if _, ok := err.(*qdrantNotFound); ok {
+			return hashes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Points []qdrantPoint `json:"points"`
+			Next   any           `json:"next_page_offset"`
+		}
+		if err := json.Unmarshal(res, &page); err != nil {
+			return nil, err
+		}
+		for _, p := range page.Points {
+			hashes[p.Payload.ID] = p.Payload.Hash
+		}
+		if page.Next == nil {
+			return hashes, nil
+		}
+		offset = page.Next
+	}
+}
+
+func (qv *QdrantVectors) Upsert(collection string, vecs []Vector) error {
+	if len(vecs) == 0 {
+		return nil
+	}
+	if err := qv.ensure(len(vecs[0].Values)); err != nil {
+		return err
+	}
+	ns, _ := SplitKey(collection)
+	points := make([]map[string]any, len(vecs))
+	for i, v := range vecs {
+		points[i] = map[string]any{
+			"id":      pointID(collection, v.ID),
+			"vector":  v.Values,
+			"payload": map[string]any{"collection": collection, "namespace": ns, "id": v.ID, "hash": v.Hash},
+		}
+	}
+	_, err := qv.do(http.MethodPut, "/collections/"+qdrantCollection+"/points?wait=true", map[string]any{"points": points})
+	return err
+}
+
+func (qv *QdrantVectors) Delete(collection string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	points := make([]string, len(ids))
+	for i, id := range ids {
+		points[i] = pointID(collection, id)
+	}
+	return qv.delete(map[string]any{"points": points})
+}
+
+func (qv *QdrantVectors) delete(req map[string]any) error {
+	_, err := qv.do(http.MethodPost, "/collections/"+qdrantCollection+"/points/delete?wait=true", req)
+	if _, ok := err.(*qdrantNotFound); ok {
+		return nil
+	}
+	return err
+}
+
+func (qv *QdrantVectors) Search(collection string, query []float32, k int) ([]Match, error) {
+	res, err := qv.do(http.MethodPost, "/collections/"+qdrantCollection+"/points/search", map[string]any{
+		"vector":       query,
+		"limit":        k,
+		"filter":       matchFilter("collection", collection),
+		"with_payload": true,
+	})
+	if _, ok := err.(*qdrantNotFound); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var points []qdrantPoint
+	if err := json.Unmarshal(res, &points); err != nil {
+		return nil, err
+	}
+	matches := make([]Match, len(points))
+	for i, p := range points {
+		matches[i] = Match{ID: p.Payload.ID, Score: p.Score}
+	}
+	return matches, nil
+}
+
+func (qv *QdrantVectors) Drop(collection string) error {
+	return qv.delete(map[string]any{"filter": matchFilter("collection", collection)})
+}
+
+func (qv *QdrantVectors) DropNamespace(ns string) error {
+	return qv.delete(map[string]any{"filter": matchFilter("namespace", ns)})
+}
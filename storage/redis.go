@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces the bot's keys in a shared Redis database.
+const redisKeyPrefix = "yagi:"
+
+// RedisBlobs stores blobs as Redis strings so several bot instances, or a
+// container without a persistent disk, can share state.
+type RedisBlobs struct {
+	client *redis.Client
+}
+
+// NewRedisBlobs connects to the Redis server at url and checks that it
+// answers.
+func NewRedisBlobs(url string) (*RedisBlobs, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &RedisBlobs{client: client}, nil
+}
+
+func (rb *RedisBlobs) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func (rb *RedisBlobs) Get(key string) ([]byte, error) {
+	ctx, cancel := rb.ctx()
+	defer cancel()
+	data, err := rb.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return data, err
+}
+
+func (rb *RedisBlobs) Put(key string, data []byte, ttl time.Duration) error {
+	ctx, cancel := rb.ctx()
+	defer cancel()
+	return rb.client.Set(ctx, redisKeyPrefix+key, data, ttl).Err()
+}
+
+func (rb *RedisBlobs) Delete(key string) error {
+	ctx, cancel := rb.ctx()
+	defer cancel()
+	return rb.client.Del(ctx, redisKeyPrefix+key).Err()
+}
+
+func (rb *RedisBlobs) List(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	var keys []string
+	iter := rb.client.Scan(ctx, 0, redisKeyPrefix+prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), redisKeyPrefix))
+	}
+	return keys, iter.Err()
+}
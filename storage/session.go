@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// SessionData is the persisted form of a conversation.
+type SessionData struct {
+	// UserID is the session key, "<namespace>/<id>" where id is a user or
+	// thread ID.
+	UserID       string                         `json:"user_id"`
+	UpdatedAt    string                         `json:"updated_at"`
+	StartedAt    string                         `json:"started_at,omitempty"`
+	Persona      string                         `json:"persona,omitempty"`
+	Language     string                         `json:"language,omitempty"`
+	DualLanguage string                         `json:"dual_language,omitempty"`
+	Generation   *GenerationSettings            `json:"generation,omitempty"`
+	Messages     []openai.ChatCompletionMessage `json:"messages"`
+	// Turns links Discord messages to the exchanges they belong to, so that
+	// deleting a message can remove its exchange.
+	Turns []TurnRef `json:"turns,omitempty"`
+	// InProgress holds the tool calls of a reply that was still being
+	// generated when the conversation was saved. It is empty once the reply
+	// has been stored.
+	InProgress []openai.ChatCompletionMessage `json:"in_progress,omitempty"`
+	// Checkpoints are named copies of the conversation to go back to.
+	Checkpoints []Checkpoint `json:"checkpoints,omitempty"`
+}
+
+// GenerationSettings are sampling parameters the user chose with
+// /settings. Unset ones are left to the provider.
+type GenerationSettings struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+}
+
+// Checkpoint is a conversation as it was when the user saved it.
+type Checkpoint struct {
+	Name      string                         `json:"name"`
+	CreatedAt string                         `json:"created_at"`
+	StartedAt string                         `json:"started_at,omitempty"`
+	Messages  []openai.ChatCompletionMessage `json:"messages"`
+}
+
+// TurnRef ties one exchange of a conversation, a user message and the
+// reply to it, to the Discord messages it was made of.
+type TurnRef struct {
+	MessageID string   `json:"message_id"`
+	ReplyIDs  []string `json:"reply_ids,omitempty"`
+	// Hash identifies the user message among the conversation's messages.
+	Hash string `json:"hash"`
+	// At is when the reply was sent and Model the provider/model that
+	// wrote it.
+	At    string `json:"at,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+// SessionStore persists conversations by namespaced session key (see
+// SplitKey).
+type SessionStore interface {
+	// Load returns the stored conversation of key, or nil if there is none.
+	Load(key string) (*SessionData, error)
+	Save(key string, sd *SessionData) error
+	Delete(key string) error
+	// All returns every stored conversation. Unreadable ones are logged and
+	// skipped.
+	All() ([]*SessionData, error)
+}
+
+// blobSessions stores each conversation as a JSON document in a Blobs
+// backend, under <namespace>/sessions/.
+type blobSessions struct {
+	blobs  Blobs
+	cipher *Cipher
+	ttl    time.Duration
+
+	// claimed holds the keys whose conversation was found in the legacy
+	// location, which is removed once it has been saved in the namespace.
+	mu      sync.Mutex
+	claimed map[string]bool
+}
+
+// NewSessionStore returns a SessionStore on b, encrypting with c. ttl is
+// passed to the backend with each save.
+func NewSessionStore(b Blobs, c *Cipher, ttl time.Duration) SessionStore {
+	return &blobSessions{blobs: b, cipher: c, ttl: ttl, claimed: make(map[string]bool)}
+}
+
+func sessionKey(key string) string {
+	ns, id := SplitKey(key)
+	h := sha256.Sum256([]byte(id))
+	return docKey(ns, "sessions", fmt.Sprintf("%x.json", h[:16]))
+}
+
+func (bs *blobSessions) read(key string) (*SessionData, error) {
+	var sd SessionData
+	err := ReadRecover(key, readBlob(bs.blobs, bs.cipher), func(data []byte) error {
+		sd = SessionData{}
+		return json.Unmarshal(data, &sd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sd, nil
+}
+
+// Load reads the conversation of key. A conversation stored before
+// namespaces existed is picked up by the first namespace asking for its ID.
+func (bs *blobSessions) Load(key string) (*SessionData, error) {
+	sd, err := bs.read(sessionKey(key))
+	if os.IsNotExist(err) {
+		ns, id := SplitKey(key)
+		if ns == "" {
+			return nil, nil
+		}
+		sd, err = bs.read(sessionKey(id))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err == nil {
+			sd.UserID = key
+			bs.mu.Lock()
+			bs.claimed[key] = true
+			bs.mu.Unlock()
+		}
+	}
+	return sd, err
+}
+
+// dropLegacy deletes the legacy copy of key if Load returned it.
+func (bs *blobSessions) dropLegacy(key string) error {
+	bs.mu.Lock()
+	claimed := bs.claimed[key]
+	delete(bs.claimed, key)
+	bs.mu.Unlock()
+	if !claimed {
+		return nil
+	}
+	_, id := SplitKey(key)
+	return bs.blobs.Delete(sessionKey(id))
+}
+
+func (bs *blobSessions) Save(key string, sd *SessionData) error {
+	data, err := json.MarshalIndent(sd, "", "  ")
+	if err != nil {
+		return err
+	}
+	data, err = bs.cipher.Seal(data)
+	if err != nil {
+		return err
+	}
+	if err := bs.blobs.Put(sessionKey(key), data, bs.ttl); err != nil {
+		return err
+	}
+	return bs.dropLegacy(key)
+}
+
+func (bs *blobSessions) Delete(key string) error {
+	if err := bs.blobs.Delete(sessionKey(key)); err != nil {
+		return err
+	}
+	return bs.dropLegacy(key)
+}
+
+func (bs *blobSessions) All() ([]*SessionData, error) {
+	var keys []string
+	for _, prefix := range []string{"dm/sessions", "guilds", "sessions"} {
+		k, err := bs.blobs.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+	var all []*SessionData
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "sessions/") && !strings.Contains(key, "/sessions/") {
+			continue
+		}
+		sd, err := bs.read(key)
+		if err != nil {
+			slog.Error("failed to read session", "key", key, "err", err)
+			continue
+		}
+		// Legacy documents hold the bare ID, which is also how Delete
+		// finds them.
+		all = append(all, sd)
+	}
+	return all, nil
+}
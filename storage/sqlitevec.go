@@ -0,0 +1,119 @@
+//go:build sqlite_vec
+
+package storage
+
+import (
+	"database/sql"
+
+	sqlite_vec "github.com/asg017/sqlite-vec-go-bindings/cgo"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS vectors (
+	collection TEXT NOT NULL,
+	id TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	embedding BLOB NOT NULL,
+	PRIMARY KEY (collection, id)
+)`
+
+// SQLiteVectors stores vectors in a SQLite database and searches them with
+// the sqlite-vec extension. It needs cgo and the sqlite_vec build tag.
+type SQLiteVectors struct {
+	db *sql.DB
+}
+
+func NewSQLiteVectors(path string) (*SQLiteVectors, error) {
+	sqlite_vec.Auto()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteVectors{db: db}, nil
+}
+
+func (sv *SQLiteVectors) Hashes(collection string) (map[string]string, error) {
+	rows, err := sv.db.Query(`SELECT id, hash FROM vectors WHERE collection = ?`, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+func (sv *SQLiteVectors) Upsert(collection string, vecs []Vector) error {
+	tx, err := sv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, v := range vecs {
+		blob, err := sqlite_vec.SerializeFloat32(v.Values)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO vectors (collection, id, hash, embedding) VALUES (?, ?, ?, ?)`,
+			collection, v.ID, v.Hash, blob); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (sv *SQLiteVectors) Delete(collection string, ids []string) error {
+	tx, err := sv.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM vectors WHERE collection = ? AND id = ?`, collection, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (sv *SQLiteVectors) Search(collection string, query []float32, k int) ([]Match, error) {
+	blob, err := sqlite_vec.SerializeFloat32(query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sv.db.Query(`SELECT id, 1 - vec_distance_cosine(embedding, ?) AS score FROM vectors
+		WHERE collection = ? ORDER BY score DESC LIMIT ?`, blob, collection, k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var matches []Match
+	for rows.Next() {
+		var m Match
+		if err := rows.Scan(&m.ID, &m.Score); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+func (sv *SQLiteVectors) Drop(collection string) error {
+	_, err := sv.db.Exec(`DELETE FROM vectors WHERE collection = ?`, collection)
+	return err
+}
+
+func (sv *SQLiteVectors) DropNamespace(ns string) error {
+	_, err := sv.db.Exec(`DELETE FROM vectors WHERE substr(collection, 1, length(?1)) = ?1`, ns+"/")
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite_vec
+
+package storage
+
+import "errors"
+
+// NewSQLiteVectors is only available in builds with the sqlite_vec tag,
+// which needs cgo.
+func NewSQLiteVectors(path string) (VectorStore, error) {
+	return nil, errors.New("this build has no SQLite vector store; rebuild with -tags sqlite_vec")
+}
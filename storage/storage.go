@@ -0,0 +1,117 @@
+// Package storage persists the bot's conversations and memory. Documents are
+// kept in a Blobs backend, a flat key-value store that may be the data
+// directory, Redis or process memory, and are optionally encrypted with a
+// Cipher. SessionStore and MemoryStore put typed documents on top of it.
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Blobs persists documents under slash separated keys such as
+// "sessions/<hash>.json". Get returns an error satisfying os.IsNotExist for
+// missing keys.
+type Blobs interface {
+	Get(key string) ([]byte, error)
+	// Put stores data under key. A positive ttl lets the backend expire the
+	// key; backends without expiry ignore it.
+	Put(key string, data []byte, ttl time.Duration) error
+	Delete(key string) error
+	// List returns the keys under prefix at any depth, without backups.
+	List(prefix string) ([]string, error)
+}
+
+// Namespace returns the data namespace of guildID: "guilds/<guildID>", or
+// "dm" for direct messages. Everything stored about a guild lives under its
+// namespace, so the guild's footprint can be removed in one go.
+func Namespace(guildID string) string {
+	if guildID == "" {
+		return "dm"
+	}
+	return "guilds/" + guildID
+}
+
+// Namespaces returns the namespaces that have data in b.
+func Namespaces(b Blobs) ([]string, error) {
+	keys, err := b.List("guilds")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{"dm": true}
+	nss := []string{"dm"}
+	for _, k := range keys {
+		parts := strings.SplitN(k, "/", 3)
+		if len(parts) < 3 {
+			continue
+		}
+		if ns := parts[0] + "/" + parts[1]; !seen[ns] {
+			seen[ns] = true
+			nss = append(nss, ns)
+		}
+	}
+	return nss, nil
+}
+
+// DeleteNamespace removes every key under ns and returns how many there
+// were.
+func DeleteNamespace(b Blobs, ns string) (int, error) {
+	keys, err := b.List(ns)
+	if err != nil {
+		return 0, err
+	}
+	for i, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// SplitKey splits a namespaced key "<namespace>/<id>" into its parts. Keys
+// without a namespace were written before namespaces existed and return an
+// empty namespace.
+func SplitKey(key string) (ns, id string) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// docKey returns the key of the document name of the given kind in ns, or
+// in the legacy location shared by all guilds if ns is empty.
+func docKey(ns, kind, name string) string {
+	if ns == "" {
+		return kind + "/" + name
+	}
+	return ns + "/" + kind + "/" + name
+}
+
+// Open returns the backend described by spec: "" or "file" for files in
+// dataDir, "memory" for a store that lives only as long as the process, or
+// a redis:// or rediss:// URL.
+func Open(spec, dataDir string) (Blobs, error) {
+	switch {
+	case spec == "" || spec == "file":
+		return NewFileBlobs(dataDir), nil
+	case spec == "memory":
+		return NewMemBlobs(), nil
+	case strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://"):
+		return NewRedisBlobs(spec)
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s (use file, memory or a redis:// URL)", spec)
+}
+
+// readBlob returns a reader for ReadRecover that gets keys from b and
+// decrypts them with c.
+func readBlob(b Blobs, c *Cipher) func(key string) ([]byte, error) {
+	return func(key string) ([]byte, error) {
+		data, err := b.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return c.Open(data)
+	}
+}
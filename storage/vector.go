@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Vector is an embedding stored under an ID. Hash identifies the content it
+// was computed from, so callers can tell when it is outdated.
+type Vector struct {
+	ID     string
+	Hash   string
+	Values []float32
+}
+
+// Match is a search result.
+type Match struct {
+	ID    string
+	Score float64
+}
+
+// VectorStore keeps embeddings in named collections and finds the nearest
+// ones by cosine similarity. Collection names are namespaced keys (see
+// SplitKey).
+type VectorStore interface {
+	// Hashes returns the content hash of every vector in collection by ID.
+	Hashes(collection string) (map[string]string, error)
+	Upsert(collection string, vecs []Vector) error
+	Delete(collection string, ids []string) error
+	// Search returns up to k vectors of collection closest to query, best
+	// first.
+	Search(collection string, query []float32, k int) ([]Match, error)
+	// Drop deletes collection and everything in it.
+	Drop(collection string) error
+	// DropNamespace deletes every collection in ns.
+	DropNamespace(ns string) error
+}
+
+// VectorOptions configures the optional vector store backends.
+type VectorOptions struct {
+	// QdrantAPIKey is sent to Qdrant servers that require one.
+	QdrantAPIKey string
+}
+
+// OpenVectors returns the vector store described by spec: "" or "file" for
+// JSON files in dir searched by brute force, "qdrant:<url>" for a Qdrant
+// server, a postgres:// URL for PostgreSQL with pgvector, or
+// "sqlite:<path>" for SQLite with sqlite-vec.
+func OpenVectors(spec, dir string, opts VectorOptions) (VectorStore, error) {
+	switch {
+	case spec == "" || spec == "file":
+		return NewFlatVectors(dir), nil
+	case strings.HasPrefix(spec, "qdrant:"):
+		return NewQdrantVectors(strings.TrimPrefix(spec, "qdrant:"), opts.QdrantAPIKey)
+	case strings.HasPrefix(spec, "postgres://") || strings.HasPrefix(spec, "postgresql://"):
+		return NewPgVectors(spec)
+	case strings.HasPrefix(spec, "sqlite:"):
+		return NewSQLiteVectors(strings.TrimPrefix(spec, "sqlite:"))
+	}
+	return nil, fmt.Errorf("unknown vector store: %s (use file, qdrant:<url>, a postgres:// URL or sqlite:<path>)", spec)
+}
+
+type flatVector struct {
+	Hash   string    `json:"hash"`
+	Vector []float32 `json:"vector"`
+}
+
+// FlatVectors stores each collection as a JSON file in a directory and
+// searches it by comparing the query with every vector. That is fast enough
+// for the few hundred entries a user's memory holds.
+type FlatVectors struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewFlatVectors(dir string) *FlatVectors {
+	return &FlatVectors{dir: dir}
+}
+
+func (fv *FlatVectors) path(collection string) string {
+	return filepath.Join(fv.dir, filepath.FromSlash(collection)+".json")
+}
+
+func (fv *FlatVectors) load(collection string) (map[string]flatVector, error) {
+	data, err := os.ReadFile(fv.path(collection))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]flatVector{}, nil
+		}
+		return nil, err
+	}
+	var vecs map[string]flatVector
+	if err := json.Unmarshal(data, &vecs); err != nil {
+		return nil, err
+	}
+	if vecs == nil {
+		vecs = map[string]flatVector{}
+	}
+	return vecs, nil
+}
+
+func (fv *FlatVectors) save(collection string, vecs map[string]flatVector) error {
+	if len(vecs) == 0 {
+		return RemoveFile(fv.path(collection))
+	}
+	if err := os.MkdirAll(filepath.Dir(fv.path(collection)), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(vecs)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(fv.path(collection), b, 0600)
+}
+
+func (fv *FlatVectors) Hashes(collection string) (map[string]string, error) {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	vecs, err := fv.load(collection)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string, len(vecs))
+	for id, v := range vecs {
+		hashes[id] = v.Hash
+	}
+	return hashes, nil
+}
+
+func (fv *FlatVectors) Upsert(collection string, add []Vector) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	vecs, err := fv.load(collection)
+	if err != nil {
+		return err
+	}
+	for _, v := range add {
+		vecs[v.ID] = flatVector{Hash: v.Hash, Vector: v.Values}
+	}
+	return fv.save(collection, vecs)
+}
+
+func (fv *FlatVectors) Delete(collection string, ids []string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	vecs, err := fv.load(collection)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		delete(vecs, id)
+	}
+	return fv.save(collection, vecs)
+}
+
+func (fv *FlatVectors) Search(collection string, query []float32, k int) ([]Match, error) {
+	fv.mu.Lock()
+	vecs, err := fv.load(collection)
+	fv.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]Match, 0, len(vecs))
+	for id, v := range vecs {
+		matches = append(matches, Match{ID: id, Score: CosineSimilarity(query, v.Vector)})
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	return matches[:min(k, len(matches))], nil
+}
+
+func (fv *FlatVectors) Drop(collection string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	return RemoveFile(fv.path(collection))
+}
+
+func (fv *FlatVectors) DropNamespace(ns string) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	return os.RemoveAll(filepath.Join(fv.dir, filepath.FromSlash(ns)))
+}
+
+// CosineSimilarity returns the cosine of the angle between a and b, or 0
+// if they differ in length or either is zero.
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// summaryMaxMessages bounds the history summarized from a picked message;
+	// summaryMaxChunks bounds the parts of summaryChunkChars it is split into.
+	// Beyond them the newest messages are kept.
+	summaryMaxMessages = 500
+	summaryChunkChars  = 20000
+	summaryMaxChunks   = 8
+
+	summaryPrompt = "Summarize the following chat channel history for someone catching up. " +
+		"Use these sections: **Participants** (who took part, one line each on their part), **Topics** (short bullet points), " +
+		"**Decisions** and **Action items** (with who is on it, if said). Leave out sections with nothing in them. " +
+		"Write in the language most of the messages are in."
+
+	chunkPrompt = "The following is one part of a longer chat channel history. " +
+		"Write compact notes on it for a later summary: who said what that matters, decisions, open questions and action items with their owners. " +
+		"Reply with only the notes."
+)
+
+// channelHistory fetches the messages of channelID from the message fromID,
+// included, to now, oldest first. It stops at summaryMaxMessages; truncated
+// reports whether messages were left out.
+func channelHistory(s *discordgo.Session, channelID, fromID string) (msgs []*discordgo.Message, truncated bool, err error) {
+	first, err := s.ChannelMessage(channelID, fromID)
+	if err != nil {
+		return nil, false, err
+	}
+	msgs = append(msgs, first)
+	after := fromID
+	for len(msgs) < summaryMaxMessages {
+		page, err := s.ChannelMessages(channelID, 100, "", after, "")
+		if err != nil {
+			return nil, false, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		// Discord returns the newest first.
+		slices.SortFunc(page, func(a, b *discordgo.Message) int { return a.Timestamp.Compare(b.Timestamp) })
+		msgs = append(msgs, page...)
+		after = page[len(page)-1].ID
+		if len(page) < 100 {
+			return msgs, false, nil
+		}
+	}
+	if len(msgs) > summaryMaxMessages {
+		msgs = msgs[:summaryMaxMessages]
+	}
+	return msgs, len(msgs) >= summaryMaxMessages, nil
+}
+
+// recentHistory fetches up to limit of the latest messages of channelID,
+// stopping at the first one older than since if it is set. They are
+// returned oldest first.
+func recentHistory(s *discordgo.Session, channelID string, limit int, since time.Time) ([]*discordgo.Message, error) {
+	var msgs []*discordgo.Message
+	before := ""
+	for len(msgs) < limit {
+		page, err := s.ChannelMessages(channelID, min(100, limit-len(msgs)), before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			if !since.IsZero() && m.Timestamp.Before(since) {
+				slices.Reverse(msgs)
+				return msgs, nil
+			}
+			msgs = append(msgs, m)
+		}
+		if len(page) < 100 {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+// transcriptLines renders msgs as "name: text" lines. Messages without text
+// are skipped.
+func transcriptLines(msgs []*discordgo.Message) []string {
+	var lines []string
+	for _, m := range msgs {
+		content := strings.TrimSpace(m.Content)
+		if content == "" || m.Author == nil {
+			continue
+		}
+		lines = append(lines, m.Author.Username+": "+content)
+	}
+	return lines
+}
+
+// chunkLines splits lines into chunks of about size bytes. A line longer
+// than size gets a chunk of its own.
+func chunkLines(lines []string, size int) []string {
+	var chunks []string
+	var sb strings.Builder
+	for _, line := range lines {
+		if sb.Len() > 0 && sb.Len()+len(line) > size {
+			chunks = append(chunks, sb.String())
+			sb.Reset()
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	if sb.Len() > 0 {
+		chunks = append(chunks, sb.String())
+	}
+	return chunks
+}
+
+// summarizeHistory asks the model for a structured summary of msgs. Long
+// histories are split into chunks that are summarized first and then
+// combined. It notes when the history had to be cut.
+func summarizeHistory(ctx context.Context, eng *engine.Engine, msgs []*discordgo.Message, truncated bool) (string, error) {
+	chunks := chunkLines(transcriptLines(msgs), summaryChunkChars)
+	if len(chunks) == 0 {
+		return "", fmt.Errorf("no messages with text to summarize")
+	}
+	if len(chunks) > summaryMaxChunks {
+		chunks = chunks[len(chunks)-summaryMaxChunks:]
+		truncated = true
+	}
+	input := chunks[0]
+	if len(chunks) > 1 {
+		var sb strings.Builder
+		for n, chunk := range chunks {
+			notes, err := complete(ctx, eng, chunkPrompt, chunk)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&sb, "Notes on part %d of %d:\n%s\n\n", n+1, len(chunks), notes)
+		}
+		input = sb.String()
+	}
+	reply, err := complete(ctx, eng, summaryPrompt, input)
+	if err != nil {
+		return "", err
+	}
+	if truncated {
+		reply = "-# Only the most recent messages were summarized.\n" + reply
+	}
+	return reply, nil
+}
+
+// complete sends a single system and user message to eng and returns the
+// trimmed reply.
+func complete(ctx context.Context, eng *engine.Engine, system, user string) (string, error) {
+	reply, _, err := eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: system},
+		{Role: openai.ChatMessageRoleUser, Content: user},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+	return reply, nil
+}
+
+// summarizeFromHereCommand is the message context menu entry that summarizes
+// the channel from the picked message to now, visible only to the user.
+func summarizeFromHereCommand(eng *engine.Engine, guilds *guildStore, quotas *quotaTracker) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Type: discordgo.MessageApplicationCommand,
+			Name: "Summarize from here",
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			userID := interactionUserID(i)
+			if !quotas.allow(i.GuildID, userID, guilds.get(i.GuildID).DailyQuota) {
+				respondEphemeral(s, i, loc.tr("You have reached today's usage limit. Please try again tomorrow."))
+				return
+			}
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+			})
+			if err != nil {
+				slog.Error("failed to respond to interaction", "err", err)
+				return
+			}
+
+			msgs, truncated, err := channelHistory(s, i.ChannelID, i.ApplicationCommandData().TargetID)
+			if err != nil {
+				slog.Warn("failed to read channel history", "channel", i.ChannelID, "err", err)
+				followup(s, i, loc.tr("I could not read the messages in this channel."))
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			ctx = context.WithValue(ctx, ctxKeyGuildID, i.GuildID)
+			summary, err := summarizeHistory(ctx, eng, msgs, truncated)
+			if err != nil {
+				slog.Error("failed to summarize channel", "channel", i.ChannelID, "err", err)
+				followup(s, i, loc.tr("Failed to summarize: %s", err))
+				return
+			}
+			followup(s, i, summary)
+		},
+	}
+}
+
+// summarizeCommand summarizes the latest messages of the current channel,
+// by count or by age, visible only to the user.
+func summarizeCommand(eng *engine.Engine, guilds *guildStore, quotas *quotaTracker) *slashCommand {
+	one := 1.0
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "summarize",
+			Description: "Summarize the latest messages of this channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "messages",
+					Description: "How many of the latest messages (default: 100)",
+					MinValue:    &one,
+					MaxValue:    1000,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "hours",
+					Description: "Only messages from the last this many hours",
+					MinValue:    &one,
+					MaxValue:    168,
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			limit, hours := 100, 0
+			for _, o := range i.ApplicationCommandData().Options {
+				switch o.Name {
+				case "messages":
+					limit = int(o.IntValue())
+				case "hours":
+					hours = int(o.IntValue())
+				}
+			}
+			if hours > 0 && !hasOption(i, "messages") {
+				limit = 1000
+			}
+			if i.Member != nil && i.Member.Permissions&discordgo.PermissionReadMessageHistory == 0 {
+				respondEphemeral(s, i, loc.tr("You need the Read Message History permission in this channel."))
+				return
+			}
+			if i.GuildID != "" {
+				perms, err := s.State.UserChannelPermissions(s.State.User.ID, i.ChannelID)
+				if err == nil && perms&(discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory) != discordgo.PermissionViewChannel|discordgo.PermissionReadMessageHistory {
+					respondEphemeral(s, i, loc.tr("I need the View Channel and Read Message History permissions in this channel."))
+					return
+				}
+			}
+			userID := interactionUserID(i)
+			if !quotas.allow(i.GuildID, userID, guilds.get(i.GuildID).DailyQuota) {
+				respondEphemeral(s, i, loc.tr("You have reached today's usage limit. Please try again tomorrow."))
+				return
+			}
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+			})
+			if err != nil {
+				slog.Error("failed to respond to interaction", "err", err)
+				return
+			}
+
+			var since time.Time
+			if hours > 0 {
+				since = time.Now().Add(-time.Duration(hours) * time.Hour)
+			}
+			msgs, err := recentHistory(s, i.ChannelID, limit, since)
+			if err != nil {
+				slog.Warn("failed to read channel history", "channel", i.ChannelID, "err", err)
+				followup(s, i, loc.tr("I could not read the messages in this channel."))
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			defer cancel()
+			ctx = context.WithValue(ctx, ctxKeyGuildID, i.GuildID)
+			summary, err := summarizeHistory(ctx, eng, msgs, false)
+			if err != nil {
+				slog.Error("failed to summarize channel", "channel", i.ChannelID, "err", err)
+				followup(s, i, loc.tr("Failed to summarize: %s", err))
+				return
+			}
+			followup(s, i, loc.tr("-# Summary of %d messages", len(msgs))+"\n"+summary)
+		},
+	}
+}
+
+func hasOption(i *discordgo.InteractionCreate, name string) bool {
+	for _, o := range i.ApplicationCommandData().Options {
+		if o.Name == name {
+			return true
+		}
+	}
+	return false
+}
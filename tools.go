@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/yagi-agent/yagi/engine"
+)
+
+type toolDef struct {
+	name        string
+	description string
+	parameters  json.RawMessage
+	fn          engine.ToolFunc
+	safe        bool
+	// untrusted tools return content written by users or fetched from
+	// elsewhere, which is quoted as such (see untrustedTool).
+	untrusted bool
+	keywords  []string
+}
+
+// toolRegistry collects the bot's tools so that engines can be built with
+// all of them or with only the subset relevant to a message.
+type toolRegistry struct {
+	tools []*toolDef
+	// dynamic, if set, returns tools that may change at run time, such as
+	// those of hook scripts. They cannot replace registered tools.
+	dynamic func() []*toolDef
+	// audit, if set, records every call of the tools.
+	audit *toolAudit
+	// confirm, if set, decides which tools need the user's approval.
+	confirm *toolConfirmer
+	// disabled are tools, or patterns of them, the operator turned off
+	// everywhere. They are registered but never offered.
+	disabled []string
+}
+
+func newToolRegistry() *toolRegistry {
+	return &toolRegistry{}
+}
+
+// register adds a tool. Its name and description words are used as keywords
+// for relevance selection; hint can add more.
+func (r *toolRegistry) register(name, description string, parameters json.RawMessage, fn engine.ToolFunc, safe bool) {
+	t := &toolDef{
+		name:        name,
+		description: description,
+		parameters:  parameters,
+		fn:          tracedTool(name, fn),
+		safe:        safe,
+	}
+	t.keywords = append(t.keywords, keywordsOf(snakeCase(name))...)
+	t.keywords = append(t.keywords, keywordsOf(description)...)
+	r.tools = append(r.tools, t)
+}
+
+// hint adds extra keywords (in any language) that make a tool relevant.
+func (r *toolRegistry) hint(name string, keywords ...string) {
+	for _, t := range r.tools {
+		if t.name == name {
+			for _, k := range keywords {
+				t.keywords = append(t.keywords, strings.ToLower(k))
+			}
+		}
+	}
+}
+
+// untrusted marks the named tools as returning untrusted content.
+func (r *toolRegistry) untrusted(names ...string) {
+	for _, t := range r.tools {
+		if slices.Contains(names, t.name) {
+			t.untrusted = true
+		}
+	}
+}
+
+// all returns the registered tools followed by the dynamic ones, without
+// those disabled everywhere.
+func (r *toolRegistry) all() []*toolDef {
+	all := slices.Clone(r.tools)
+	if r.dynamic != nil {
+		for _, t := range r.dynamic() {
+			if !slices.ContainsFunc(all, func(x *toolDef) bool { return x.name == t.name }) {
+				all = append(all, t)
+			}
+		}
+	}
+	return slices.DeleteFunc(all, func(t *toolDef) bool { return toolDisabled(r.disabled, t.name) })
+}
+
+// toolDisabled reports whether name is one of disabled, or matches one of
+// its patterns.
+func toolDisabled(disabled []string, name string) bool {
+	for _, d := range disabled {
+		if ok, _ := path.Match(d, name); ok || d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownTools returns the entries of patterns that match no registered
+// or dynamic tool.
+func (r *toolRegistry) unknownTools(patterns []string) []string {
+	known := r.tools
+	if r.dynamic != nil {
+		known = slices.Concat(known, r.dynamic())
+	}
+	var unknown []string
+	for _, p := range patterns {
+		if !slices.ContainsFunc(known, func(t *toolDef) bool { return toolDisabled([]string{p}, t.name) }) {
+			unknown = append(unknown, p)
+		}
+	}
+	return unknown
+}
+
+// names returns the names of all offered tools except those in disabled.
+func (r *toolRegistry) names(disabled []string) []string {
+	names := []string{}
+	for _, t := range r.all() {
+		if !toolDisabled(disabled, t.name) {
+			names = append(names, t.name)
+		}
+	}
+	return names
+}
+
+// newEngine builds an engine with the given tools, or with every registered
+// tool if names is nil.
+func (r *toolRegistry) newEngine(cfg engine.Config, names []string) *engine.Engine {
+	eng := engine.New(cfg)
+	var allowed map[string]bool
+	if names != nil {
+		allowed = make(map[string]bool, len(names))
+		for _, n := range names {
+			allowed[n] = true
+		}
+	}
+	for _, t := range r.all() {
+		if allowed != nil && !allowed[t.name] {
+			continue
+		}
+		fn := r.audit.wrap(t.name, t.fn)
+		if t.untrusted {
+			fn = untrustedTool(t.name, fn)
+		}
+		// The engine asks its approver about tools that are not safe.
+		safe := t.safe && !r.confirm.needs(t.name)
+		eng.RegisterTool(t.name, t.description, t.parameters, autosavedTool(t.name, fn), safe)
+	}
+	return eng
+}
+
+// relevant returns the names of at most max tools whose keywords occur in
+// message, best matches first. It never returns nil, so the result can be
+// passed to newEngine to mean "only these".
+func (r *toolRegistry) relevant(message string, max int) []string {
+	message = strings.ToLower(message)
+	type scored struct {
+		name  string
+		score int
+	}
+	var matches []scored
+	for _, t := range r.all() {
+		score := 0
+		for _, k := range t.keywords {
+			if strings.Contains(message, k) {
+				score++
+			}
+		}
+		if score > 0 {
+			matches = append(matches, scored{t.name, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+
+	names := []string{}
+	for _, m := range matches {
+		if max > 0 && len(names) >= max {
+			break
+		}
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// toolStopwords are too common to signal that a tool is relevant.
+var toolStopwords = map[string]bool{
+	"the": true, "this": true, "that": true, "when": true, "with": true, "from": true,
+	"use": true, "all": true, "and": true, "for": true, "information": true, "entry": true,
+	"entries": true, "wants": true, "user": true, "something": true,
+}
+
+func keywordsOf(s string) []string {
+	var kw []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) >= 4 && !toolStopwords[w] {
+			kw = append(kw, w)
+		}
+	}
+	return kw
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// toolsCommand lets server managers turn tools off in the whole server or
+// in single channels, such as memory writes in public channels.
+func toolsCommand(tools *toolRegistry, guilds *guildStore) *slashCommand {
+	toolOptions := []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "tool",
+			Description: "Tool name, or a pattern such as *MemoryEntry",
+			Required:    true,
+		},
+		{
+			Type:         discordgo.ApplicationCommandOptionChannel,
+			Name:         "channel",
+			Description:  "Only in this channel and its threads (default: the whole server)",
+			ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildForum, discordgo.ChannelTypeGuildNews},
+		},
+	}
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "tools",
+			Description: "Choose which tools the bot may use in this server",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List the tools and where they are disabled",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop offering a tool to the model",
+					Options:     toolOptions,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "enable",
+					Description: "Offer a disabled tool again",
+					Options:     toolOptions,
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if i.GuildID == "" || !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("Run this in a server where you have the Manage Server permission."))
+				return
+			}
+			if opts[0].Name == "list" {
+				respondEphemeral(s, i, describeTools(loc, tools, guilds.get(i.GuildID)))
+				return
+			}
+
+			var tool, channel string
+			for _, o := range opts[0].Options {
+				switch o.Name {
+				case "tool":
+					tool = strings.TrimSpace(o.StringValue())
+				case "channel":
+					channel = o.ChannelValue(nil).ID
+				}
+			}
+			if len(tools.unknownTools([]string{tool})) > 0 {
+				respondEphemeral(s, i, loc.tr("No tool matches `%s`. `/tools list` shows them.", tool))
+				return
+			}
+			disable := opts[0].Name == "disable"
+			err := guilds.update(i.GuildID, func(cfg *guildConfig) {
+				list := cfg.DisabledTools
+				if channel != "" {
+					list = cfg.ChannelDisabledTools[channel]
+				}
+				list = slices.DeleteFunc(slices.Clone(list), func(t string) bool { return t == tool })
+				if disable {
+					list = append(list, tool)
+				}
+				if channel == "" {
+					cfg.DisabledTools = list
+					return
+				}
+				if cfg.ChannelDisabledTools == nil {
+					cfg.ChannelDisabledTools = make(map[string][]string)
+				}
+				cfg.ChannelDisabledTools[channel] = list
+				if len(list) == 0 {
+					delete(cfg.ChannelDisabledTools, channel)
+				}
+			})
+			if err != nil {
+				slog.Error("failed to save guild config", "guild", i.GuildID, "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to save the server setting."))
+				return
+			}
+			where := loc.tr("in this server")
+			if channel != "" {
+				where = loc.tr("in <#%s>", channel)
+			}
+			msg := loc.tr("`%s` is no longer offered %s.", tool, where)
+			if !disable {
+				msg = loc.tr("`%s` is offered %s again, unless a server-wide setting or the operator disables it.", tool, where)
+			}
+			respondEphemeral(s, i, msg)
+		},
+	}
+}
+
+// describeTools lists the tools offered in cfg's guild and where they are
+// disabled.
+func describeTools(loc locale, tools *toolRegistry, cfg guildConfig) string {
+	var sb strings.Builder
+	sb.WriteString(loc.tr("Tools:") + "\n")
+	for _, name := range tools.names(nil) {
+		var off []string
+		if toolDisabled(cfg.DisabledTools, name) {
+			off = append(off, loc.tr("the whole server"))
+		}
+		channels := make([]string, 0, len(cfg.ChannelDisabledTools))
+		for ch := range cfg.ChannelDisabledTools {
+			channels = append(channels, ch)
+		}
+		slices.Sort(channels)
+		for _, ch := range channels {
+			if toolDisabled(cfg.ChannelDisabledTools[ch], name) {
+				off = append(off, "<#"+ch+">")
+			}
+		}
+		if len(off) == 0 {
+			fmt.Fprintf(&sb, "- `%s`\n", name)
+		} else {
+			sb.WriteString(loc.tr("- `%s`: disabled in %s", name, strings.Join(off, ", ")) + "\n")
+		}
+	}
+	return sb.String()
+}
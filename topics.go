@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const topicPrompt = "Summarize the following conversation between a user and an assistant for later recall. " +
+	"Reply with only a JSON object of the form {\"summary\": \"...\", \"tags\": [\"...\"]}: " +
+	"the summary is two or three sentences covering what was discussed and decided, " +
+	"and tags are one to five short lowercase topic labels. Write the summary in the language of the conversation."
+
+// topicEntry describes one archived conversation.
+type topicEntry struct {
+	StartedAt string   `json:"started_at"`
+	EndedAt   string   `json:"ended_at"`
+	Tags      []string `json:"tags"`
+	Summary   string   `json:"summary"`
+	// Messages is the conversation length when it was summarized, so an
+	// unchanged conversation is not summarized again.
+	Messages int `json:"messages"`
+}
+
+// topicStore archives a tagged summary of each finished conversation in
+// <data>/<namespace>/topics/<hash>.json, one file per session key.
+type topicStore struct {
+	mu      sync.Mutex
+	dataDir string
+	cipher  *storage.Cipher
+	eng     *engine.Engine
+}
+
+func newTopicStore(dataDir string, fc *storage.Cipher, eng *engine.Engine) *topicStore {
+	return &topicStore{dataDir: dataDir, cipher: fc, eng: eng}
+}
+
+func topicFile(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("%x.json", h[:16])
+}
+
+func (ts *topicStore) path(key string) string {
+	ns, id := storage.SplitKey(key)
+	return filepath.Join(ts.dataDir, filepath.FromSlash(ns), "topics", topicFile(id))
+}
+
+// legacyPath is where the archive of key was kept before data namespaces
+// existed. The first namespace to load it takes it over.
+func (ts *topicStore) legacyPath(key string) string {
+	_, id := storage.SplitKey(key)
+	return filepath.Join(ts.dataDir, "topics", topicFile(id))
+}
+
+func (ts *topicStore) read(path string) ([]topicEntry, error) {
+	var entries []topicEntry
+	err := storage.ReadRecover(path, ts.cipher.ReadFile, func(b []byte) error {
+		entries = nil
+		return json.Unmarshal(b, &entries)
+	})
+	return entries, err
+}
+
+func (ts *topicStore) load(key string) ([]topicEntry, error) {
+	entries, err := ts.read(ts.path(key))
+	if os.IsNotExist(err) {
+		entries, err = ts.read(ts.legacyPath(key))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (ts *topicStore) save(key string, entries []topicEntry) error {
+	path := ts.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ts.cipher.WriteFile(path, b); err != nil {
+		return err
+	}
+	if legacy := ts.legacyPath(key); legacy != path {
+		return storage.RemoveFile(legacy)
+	}
+	return nil
+}
+
+// list returns the archived conversations of key, newest first.
+func (ts *topicStore) list(key string) ([]topicEntry, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	entries, err := ts.load(key)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].EndedAt > entries[j].EndedAt })
+	return entries, nil
+}
+
+// paths returns the archive files of id in every namespace.
+func (ts *topicStore) paths(id string) ([]string, error) {
+	name := topicFile(id)
+	paths, err := filepath.Glob(filepath.Join(ts.dataDir, "guilds", "*", "topics", name))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range []string{filepath.Join(ts.dataDir, "dm", "topics", name), filepath.Join(ts.dataDir, "topics", name)} {
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// all returns the archived conversations of id, a user or thread ID, in
+// every namespace, newest first.
+func (ts *topicStore) all(id string) ([]topicEntry, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	paths, err := ts.paths(id)
+	if err != nil {
+		return nil, err
+	}
+	var all []topicEntry
+	for _, p := range paths {
+		entries, err := ts.read(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		all = append(all, entries...)
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].EndedAt > all[j].EndedAt })
+	return all, nil
+}
+
+// removeAll deletes the archives of id in every namespace.
+func (ts *topicStore) removeAll(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	paths, err := ts.paths(id)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := storage.RemoveFile(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive summarizes a finished conversation and stores it with its tags.
+// It is used as sessionStore.onEnd.
+func (ts *topicStore) archive(key string, started time.Time, msgs []openai.ChatCompletionMessage) {
+	startedAt := formatTime(started)
+	ts.mu.Lock()
+	entries, err := ts.load(key)
+	ts.mu.Unlock()
+	if err != nil {
+		slog.Error("failed to load topics", "session", hashID(key), "err", err)
+		return
+	}
+	for _, e := range entries {
+		if e.StartedAt == startedAt && e.Messages == len(msgs) {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	summary, tags, err := ts.summarize(ctx, msgs)
+	if err != nil {
+		slog.Warn("failed to summarize conversation", "session", hashID(key), "err", err)
+		return
+	}
+
+	entry := topicEntry{
+		StartedAt: startedAt,
+		EndedAt:   formatTime(time.Now()),
+		Tags:      tags,
+		Summary:   summary,
+		Messages:  len(msgs),
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	entries, err = ts.load(key)
+	if err != nil {
+		slog.Error("failed to load topics", "session", hashID(key), "err", err)
+		return
+	}
+	replaced := false
+	for i, e := range entries {
+		if e.StartedAt == startedAt {
+			entries[i], replaced = entry, true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+	if err := ts.save(key, entries); err != nil {
+		slog.Error("failed to save topics", "session", hashID(key), "err", err)
+	}
+}
+
+func (ts *topicStore) summarize(ctx context.Context, msgs []openai.ChatCompletionMessage) (string, []string, error) {
+	var sb strings.Builder
+	for _, m := range msgs {
+		if (m.Role != openai.ChatMessageRoleUser && m.Role != openai.ChatMessageRoleAssistant) || m.Content == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", m.Role, m.Content)
+	}
+	reply, _, err := ts.eng.Chat(ctx, []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: topicPrompt},
+		{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+	}, engine.ChatOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Models sometimes wrap the JSON in prose or a code fence.
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return "", nil, fmt.Errorf("no JSON object in summary: %q", reply)
+	}
+	var out struct {
+		Summary string   `json:"summary"`
+		Tags    []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &out); err != nil {
+		return "", nil, err
+	}
+	for i, t := range out.Tags {
+		out.Tags[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	return strings.TrimSpace(out.Summary), out.Tags, nil
+}
+
+// find returns the most recent archived conversation whose tags or summary
+// match query. Tag matches win over summary matches.
+func (ts *topicStore) find(key, query string) (*topicEntry, error) {
+	entries, err := ts.list(key)
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		// An empty query would match every entry.
+		return nil, nil
+	}
+	for _, e := range entries {
+		for _, t := range e.Tags {
+			if strings.Contains(t, query) {
+				return &e, nil
+			}
+		}
+	}
+	for _, e := range entries {
+		if strings.Contains(strings.ToLower(e.Summary), query) {
+			return &e, nil
+		}
+	}
+	return nil, nil
+}
+
+// recallMessage is added to the current conversation to bring an archived
+// one back into context.
+func recallMessage(e *topicEntry) openai.ChatCompletionMessage {
+	date := e.StartedAt
+	if date == "" {
+		date = e.EndedAt
+	}
+	date, _, _ = strings.Cut(date, "T")
+	return openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: fmt.Sprintf("[Recalled from an earlier conversation on %s about %s]\n%s", date, strings.Join(e.Tags, ", "), e.Summary),
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yagi-agent/yagi/engine"
+)
+
+// tracer creates the spans of the message pipeline. Until setupTracing
+// installs an exporter it is a no-op.
+var tracer = otel.Tracer("github.com/yagi-agent/yagi-discord-bot")
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, a collector URL
+// such as http://localhost:4318; "/v1/traces" is added when it has no path.
+// The standard OTEL_* environment variables (headers, sampler, resource
+// attributes) apply as well. The returned function flushes pending spans.
+func setupTracing(ctx context.Context, endpoint, version string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceName("yagi-discord-bot"),
+			semconv.ServiceVersion(version),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedTool wraps a tool so that each call is a span under the LLM call
+// that requested it.
+func tracedTool(name string, fn engine.ToolFunc) engine.ToolFunc {
+	return func(ctx context.Context, args string) (string, error) {
+		ctx, span := tracer.Start(ctx, "tool "+name, trace.WithAttributes(attribute.String("tool.name", name)))
+		out, err := fn(ctx, args)
+		endSpan(span, err)
+		return out, err
+	}
+}
+
+// tracingTransport puts each provider request in a span, so the time spent
+// in every round of the tool loop shows up separately.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "provider "+req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.ServerAddress(req.URL.Hostname()),
+			semconv.URLPath(req.URL.Path),
+		),
+	)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	// Streamed responses last until the body is closed.
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
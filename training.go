@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/yagi-agent/yagi-discord-bot/storage"
+)
+
+type trainingConsent struct {
+	Enabled bool      `json:"enabled"`
+	Since   time.Time `json:"since,omitzero"`
+}
+
+// trainingStore keeps which users agreed to their conversations being
+// exported for fine-tuning, in <data>/training.json.
+type trainingStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*trainingConsent
+}
+
+func newTrainingStore(dataDir string) *trainingStore {
+	ts := &trainingStore{
+		path:  filepath.Join(dataDir, "training.json"),
+		users: make(map[string]*trainingConsent),
+	}
+	data, err := os.ReadFile(ts.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read training consent", "err", err)
+		}
+		return ts
+	}
+	if err := json.Unmarshal(data, &ts.users); err != nil {
+		slog.Error("failed to parse training consent", "err", err)
+	}
+	return ts
+}
+
+// save writes the store to disk. The caller must hold ts.mu.
+func (ts *trainingStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(ts.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ts.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(ts.path, b, 0600)
+}
+
+func (ts *trainingStore) get(userID string) trainingConsent {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if c, ok := ts.users[userID]; ok {
+		return *c
+	}
+	return trainingConsent{}
+}
+
+func (ts *trainingStore) setEnabled(userID string, enabled bool) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !enabled {
+		if _, ok := ts.users[userID]; !ok {
+			return nil
+		}
+		delete(ts.users, userID)
+		return ts.save()
+	}
+	if c, ok := ts.users[userID]; ok && c.Enabled {
+		return nil
+	}
+	ts.users[userID] = &trainingConsent{Enabled: true, Since: time.Now().UTC()}
+	return ts.save()
+}
+
+func trainingCommand(ts *trainingStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "training",
+			Description: "Allow your conversations to be used to fine-tune the bot's persona",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "on",
+					Description: "Allow the operator to use your anonymized conversations for fine-tuning",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Withdraw your permission",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "status",
+					Description: "Show whether your conversations may be used",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			userID := interactionUserID(i)
+			switch opts[0].Name {
+			case "on", "off":
+				if err := ts.setEnabled(userID, opts[0].Name == "on"); err != nil {
+					respondEphemeral(s, i, loc.tr("Failed to save: %s", err))
+					return
+				}
+			}
+			if ts.get(userID).Enabled {
+				respondEphemeral(s, i, loc.tr("Your stored conversations with the bot, with IDs, emails and phone numbers removed, may be exported by the operator to fine-tune its persona. Turn this off with `/training off`; exports made before that are not recalled."))
+			} else {
+				respondEphemeral(s, i, loc.tr("Your conversations are not used for fine-tuning. Turn this on with `/training on`."))
+			}
+		},
+	}
+}
+
+var (
+	anonUser    = regexp.MustCompile(`<@!?\d+>`)
+	anonRole    = regexp.MustCompile(`<@&\d+>`)
+	anonChannel = regexp.MustCompile(`<#\d+>`)
+	anonEmoji   = regexp.MustCompile(`<a?(:\w+:)\d+>`)
+	anonEmail   = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	anonPhone   = regexp.MustCompile(`\+?\d[\d -]{7,}\d`)
+	anonID      = regexp.MustCompile(`\b\d{17,20}\b`)
+)
+
+// anonymize replaces Discord mentions and IDs, email addresses and phone
+// numbers in s with placeholders. Names written out in the text are left
+// as they are.
+func anonymize(s string) string {
+	s = anonUser.ReplaceAllString(s, "@user")
+	s = anonRole.ReplaceAllString(s, "@role")
+	s = anonChannel.ReplaceAllString(s, "#channel")
+	s = anonEmoji.ReplaceAllString(s, "$1")
+	s = anonEmail.ReplaceAllString(s, "[email]")
+	s = anonID.ReplaceAllString(s, "[id]")
+	s = anonPhone.ReplaceAllString(s, "[phone]")
+	return s
+}
+
+type trainingMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// trainingTurns returns the user and assistant text of msgs, anonymized,
+// with consecutive messages of the same role joined so that the turns
+// alternate. Tool calls and their results are left out. The turns start
+// with the user and end with the assistant, or are empty.
+func trainingTurns(msgs []openai.ChatCompletionMessage) []trainingMessage {
+	var turns []trainingMessage
+	for _, m := range msgs {
+		if m.Role != openai.ChatMessageRoleUser && m.Role != openai.ChatMessageRoleAssistant {
+			continue
+		}
+		text := m.Content
+		for _, part := range m.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				text += part.Text
+			}
+		}
+		text = strings.TrimSpace(anonymize(text))
+		if text == "" {
+			continue
+		}
+		if len(turns) == 0 && m.Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		if n := len(turns); n > 0 && turns[n-1].Role == m.Role {
+			turns[n-1].Content += "\n\n" + text
+			continue
+		}
+		turns = append(turns, trainingMessage{Role: m.Role, Content: text})
+	}
+	if n := len(turns); n > 0 && turns[n-1].Role == openai.ChatMessageRoleUser {
+		turns = turns[:n-1]
+	}
+	return turns
+}
+
+// exportTraining writes one JSONL fine-tuning example per stored
+// conversation of a user who opted in with /training on, and returns how
+// many were written. format is "openai" (a messages list with the system
+// prompt first) or "anthropic" (the system prompt in its own field).
+// Conversations in threads are left out since they mix several users.
+func exportTraining(w io.Writer, persist storage.SessionStore, consent *trainingStore, guilds *guildStore, personas *personaStore, identity, format string) (int, error) {
+	if format != "openai" && format != "anthropic" {
+		return 0, fmt.Errorf("unknown format %q (use openai or anthropic)", format)
+	}
+	all, err := persist.All()
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	for _, sd := range all {
+		ns, id := storage.SplitKey(sd.UserID)
+		if !consent.get(id).Enabled {
+			continue
+		}
+		turns := trainingTurns(sd.Messages)
+		if len(turns) == 0 {
+			continue
+		}
+
+		guildID, _ := strings.CutPrefix(ns, "guilds/")
+		if ns == storage.Namespace("") {
+			guildID = ""
+		}
+		gcfg := guilds.get(guildID)
+		system, _ := basePrompt(identity, sd.Persona, gcfg, personas)
+
+		var example any
+		if format == "openai" {
+			msgs := turns
+			if system != "" {
+				msgs = append([]trainingMessage{{Role: openai.ChatMessageRoleSystem, Content: system}}, turns...)
+			}
+			example = map[string]any{"messages": msgs}
+		} else {
+			ex := map[string]any{"messages": turns}
+			if system != "" {
+				ex["system"] = system
+			}
+			example = ex
+		}
+		if err := enc.Encode(example); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
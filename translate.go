@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const translatePrompt = "You translate chat messages into %[1]s. " +
+	"Reply with only the translation, keeping the tone, emoji, user and channel mentions, links, markdown and code blocks as they are. " +
+	"If the message is already in %[1]s, or has nothing to translate, such as only links, emoji, code or names, reply with exactly NONE."
+
+// translator posts a translation of every message in the channels a guild
+// turned translation on for, as a reply to the message. Each message is
+// translated on its own, without the channel's history or the bot's
+// persona.
+type translator struct {
+	guilds *guildStore
+	eng    *engine.Engine
+}
+
+func newTranslator(guilds *guildStore, eng *engine.Engine) *translator {
+	return &translator{guilds: guilds, eng: eng}
+}
+
+// consider translates m in the background if its channel has translation
+// on and m is not already in the channel's language.
+func (t *translator) consider(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.GuildID == "" || m.Author.Bot || m.WebhookID != "" || strings.TrimSpace(m.Content) == "" {
+		return
+	}
+	lang := t.guilds.get(m.GuildID).TranslateChannels[m.ChannelID]
+	if lang == "" || strings.EqualFold(detectLanguage(m.Content), lang) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		ctx = context.WithValue(ctx, ctxKeyGuildID, m.GuildID)
+		if err := t.translate(ctx, s, m, lang); err != nil {
+			slog.Warn("failed to translate message", "guild", m.GuildID, "channel", m.ChannelID, "err", err)
+		}
+	}()
+}
+
+func (t *translator) translate(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate, lang string) error {
+	reply, err := complete(ctx, t.eng, fmt.Sprintf(translatePrompt, lang), m.Content)
+	if err != nil {
+		return err
+	}
+	if reply == "NONE" || strings.EqualFold(reply, strings.TrimSpace(m.Content)) {
+		return nil
+	}
+	ref := m.Reference()
+	for _, part := range splitMessage(reply, discordLimit) {
+		// Translations repeat what members wrote, so they must not ping
+		// anyone again.
+		_, err := s.ChannelMessageSendComplex(m.ChannelID, &discordgo.MessageSend{
+			Content:         part,
+			Reference:       ref,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			return err
+		}
+		ref = nil
+	}
+	return nil
+}
+
+// translateCommand turns translation on or off in the current channel.
+func translateCommand(guilds *guildStore) *slashCommand {
+	return &slashCommand{
+		def: &discordgo.ApplicationCommand{
+			Name:        "translate",
+			Description: "Translate every message in this channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "on",
+					Description: "Reply to every message in this channel with a translation",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "language",
+							Description: "Language to translate into, e.g. English",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "off",
+					Description: "Stop translating in this channel",
+				},
+			},
+		},
+		handler: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			loc := interactionLocale(i)
+			opts := i.ApplicationCommandData().Options
+			if len(opts) == 0 {
+				return
+			}
+			if i.GuildID == "" || !canManageGuild(i) {
+				respondEphemeral(s, i, loc.tr("Changing translation requires the Manage Server permission."))
+				return
+			}
+			lang := ""
+			if opts[0].Name == "on" {
+				for _, o := range opts[0].Options {
+					if o.Name == "language" {
+						lang = strings.TrimSpace(o.StringValue())
+					}
+				}
+				if lang == "" {
+					respondEphemeral(s, i, loc.tr("Name the language to translate into."))
+					return
+				}
+			}
+			err := guilds.update(i.GuildID, func(cfg *guildConfig) {
+				if lang == "" {
+					delete(cfg.TranslateChannels, i.ChannelID)
+					return
+				}
+				if cfg.TranslateChannels == nil {
+					cfg.TranslateChannels = make(map[string]string)
+				}
+				cfg.TranslateChannels[i.ChannelID] = lang
+			})
+			if err != nil {
+				slog.Error("failed to save guild config", "guild", i.GuildID, "err", err)
+				respondEphemeral(s, i, loc.tr("Failed to save the server setting."))
+				return
+			}
+			if lang != "" {
+				respondEphemeral(s, i, loc.tr("I'll reply to every message in this channel with a translation into %s.", lang))
+			} else {
+				respondEphemeral(s, i, loc.tr("I won't translate messages in this channel anymore."))
+			}
+		},
+	}
+}
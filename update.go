@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// version is the release this binary was built from, set with
+// -ldflags "-X main.version=v1.2.3". Builds with go install fall back to the
+// module version.
+var version = "dev"
+
+const releasesURL = "https://api.github.com/repos/yagi-agent/yagi-discord-bot/releases/latest"
+
+func currentVersion() string {
+	if version != "dev" {
+		return version
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	return version
+}
+
+// parseVersion splits "v1.2.3" into its numbers. Pre-release and build
+// suffixes are ignored.
+func parseVersion(v string) ([3]int, bool) {
+	var n [3]int
+	v = strings.TrimPrefix(v, "v")
+	v, _, _ = strings.Cut(v, "-")
+	v, _, _ = strings.Cut(v, "+")
+	parts := strings.Split(v, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return n, false
+	}
+	for i, p := range parts {
+		x, err := strconv.Atoi(p)
+		if err != nil {
+			return n, false
+		}
+		n[i] = x
+	}
+	return n, true
+}
+
+// newerVersion reports whether latest is a higher release than current.
+func newerVersion(latest, current string) bool {
+	l, ok1 := parseVersion(latest)
+	c, ok2 := parseVersion(current)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+// updateChecker periodically asks GitHub for the latest release and tells
+// the operator when it is newer than the running version.
+type updateChecker struct {
+	current string
+	// notify lists the users to DM about a new release.
+	notify []string
+	client *http.Client
+
+	mu       sync.Mutex
+	latest   string
+	url      string
+	notified string
+}
+
+func newUpdateChecker(notify []string) *updateChecker {
+	return &updateChecker{
+		current: currentVersion(),
+		notify:  notify,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (uc *updateChecker) run(s *discordgo.Session, every time.Duration) {
+	if _, ok := parseVersion(uc.current); !ok {
+		slog.Info("update check disabled for development build", "version", uc.current)
+		return
+	}
+	for {
+		if err := uc.check(s); err != nil {
+			slog.Warn("update check failed", "err", err)
+		}
+		time.Sleep(every)
+	}
+}
+
+func (uc *updateChecker) check(s *discordgo.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := uc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	var rel struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return err
+	}
+
+	uc.mu.Lock()
+	uc.latest, uc.url = rel.TagName, rel.HTMLURL
+	announce := newerVersion(rel.TagName, uc.current) && uc.notified != rel.TagName
+	if announce {
+		uc.notified = rel.TagName
+	}
+	uc.mu.Unlock()
+	if !announce {
+		return nil
+	}
+
+	msg := fmt.Sprintf("yagi-discord-bot %s is available (running %s): %s", rel.TagName, uc.current, rel.HTMLURL)
+	slog.Info("newer release available", "version", rel.TagName, "running", uc.current, "url", rel.HTMLURL)
+	for _, userID := range uc.notify {
+		dm, err := s.UserChannelCreate(userID)
+		if err == nil {
+			_, err = s.ChannelMessageSend(dm.ID, msg)
+		}
+		if err != nil {
+			slog.Warn("failed to send update notice", "user", hashID(userID), "err", err)
+		}
+	}
+	return nil
+}
+
+// status describes the running version and, if known, a newer release.
+func (uc *updateChecker) status() string {
+	msg := "yagi-discord-bot " + uc.current
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if newerVersion(uc.latest, uc.current) {
+		msg += fmt.Sprintf(" — update available: %s (<%s>)", uc.latest, uc.url)
+	}
+	return msg
+}
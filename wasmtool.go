@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmMemoryMB is the memory limit of a WASM plugin without its own.
+const wasmMemoryMB = 64
+
+// wasmTool runs a plugin's WASM module, built for WASI, in a sandbox for
+// each call. It speaks the protocol of execTool over stdin and stdout, and
+// sees no files but its read-only Dirs, no network and no environment but
+// its Env. It is stopped when it runs past its timeout or memory limit.
+type wasmTool struct {
+	cfg     pluginConfig
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+}
+
+// newWASMTool compiles the module of cfg.
+func newWASMTool(cfg pluginConfig) (*wasmTool, error) {
+	code, err := os.ReadFile(cfg.WASM)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	rc := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(cfg.Memory) << 4). // 64 KiB pages
+		WithCloseOnContextDone(true)
+	r := wazero.NewRuntimeWithConfig(ctx, rc)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	mod, err := r.CompileModule(ctx, code)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("compile %s: %w", cfg.WASM, err)
+	}
+	return &wasmTool{cfg: cfg, runtime: r, module: mod}, nil
+}
+
+func (t *wasmTool) call(ctx context.Context, args string) (string, error) {
+	req, err := newPluginRequest(ctx, t.cfg.Name, args)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.Timeout)
+	defer cancel()
+	stdout := &cappedBuffer{max: pluginMaxResult}
+	stderr := &cappedBuffer{max: execStderrMax}
+	fsc := wazero.NewFSConfig()
+	for _, dir := range t.cfg.Dirs {
+		fsc = fsc.WithReadOnlyDirMount(dir, dir)
+	}
+	mc := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(t.cfg.Name).
+		WithStdin(bytes.NewReader(append(req, '\n'))).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithFSConfig(fsc).
+		WithSysWalltime().
+		WithSysNanotime()
+	for k, v := range t.cfg.Env {
+		mc = mc.WithEnv(k, v)
+	}
+	mod, err := t.runtime.InstantiateModule(ctx, t.module, mc)
+	if mod != nil {
+		mod.Close(context.Background())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s did not finish within %s", t.cfg.Name, t.cfg.Timeout)
+	}
+	var exit *sys.ExitError
+	if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 0) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", fmt.Errorf("%s failed: %w", t.cfg.Name, err)
+		}
+		return "", fmt.Errorf("%s failed: %w: %s", t.cfg.Name, err, truncateRunes(msg, 200))
+	}
+	return decodeExecResponse(t.cfg.Name, stdout)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// watchdogWindow is how many samples the leak check looks back over.
+const watchdogWindow = 60
+
+// resourceSample is one reading of the process's resource usage.
+type resourceSample struct {
+	goroutines int
+	openFDs    int // -1 where it cannot be counted
+	heapBytes  uint64
+}
+
+// leakRule flags a resource as leaking when the lowest reading of the most
+// recent quarter of the window exceeds the lowest reading of the oldest
+// quarter by both ratio and min. Taking minimums keeps bursts of activity
+// from looking like growth.
+type leakRule struct {
+	name  string
+	value func(resourceSample) float64
+	ratio float64
+	min   float64
+}
+
+var leakRules = []leakRule{
+	{"goroutines", func(s resourceSample) float64 { return float64(s.goroutines) }, 1.5, 50},
+	{"open file descriptors", func(s resourceSample) float64 { return float64(s.openFDs) }, 1.5, 20},
+	{"heap size", func(s resourceSample) float64 { return float64(s.heapBytes) }, 1.5, 64 << 20},
+}
+
+// watchdog samples goroutines, open file descriptors and heap size, warns
+// in the log when one of them keeps growing, and serves the latest numbers
+// as Prometheus metrics.
+type watchdog struct {
+	mu       sync.Mutex
+	samples  []resourceSample
+	warned   map[string]time.Time
+	warnings int
+}
+
+func newWatchdog() *watchdog {
+	return &watchdog{warned: make(map[string]time.Time)}
+}
+
+func (wd *watchdog) run(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	wd.sample()
+	for range ticker.C {
+		wd.sample()
+	}
+}
+
+func (wd *watchdog) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := resourceSample{
+		goroutines: runtime.NumGoroutine(),
+		openFDs:    countOpenFDs(),
+		heapBytes:  ms.HeapAlloc,
+	}
+
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.samples = append(wd.samples, s)
+	if len(wd.samples) > watchdogWindow {
+		wd.samples = wd.samples[len(wd.samples)-watchdogWindow:]
+	}
+	if len(wd.samples) < watchdogWindow {
+		return
+	}
+	q := watchdogWindow / 4
+	now := time.Now()
+	for _, r := range leakRules {
+		oldest, recent := wd.lowest(r, wd.samples[:q]), wd.lowest(r, wd.samples[len(wd.samples)-q:])
+		if oldest < 0 || recent < oldest*r.ratio || recent-oldest < r.min {
+			continue
+		}
+		if now.Sub(wd.warned[r.name]) < time.Hour {
+			continue
+		}
+		wd.warned[r.name] = now
+		wd.warnings++
+		slog.Warn("possible leak: resource keeps growing", "resource", r.name, "from", oldest, "to", recent, "samples", len(wd.samples))
+	}
+}
+
+func (wd *watchdog) lowest(r leakRule, samples []resourceSample) float64 {
+	vals := make([]float64, len(samples))
+	for i, s := range samples {
+		vals[i] = r.value(s)
+	}
+	return slices.Min(vals)
+}
+
+// countOpenFDs returns the number of open file descriptors, or -1 on
+// systems without /proc.
+func countOpenFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	// One entry is the descriptor used to read the directory.
+	return len(entries) - 1
+}
+
+// ServeHTTP writes the latest sample in the Prometheus text format.
+func (wd *watchdog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wd.mu.Lock()
+	var s resourceSample
+	if len(wd.samples) > 0 {
+		s = wd.samples[len(wd.samples)-1]
+	}
+	warnings := wd.warnings
+	wd.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP yagi_goroutines Number of goroutines.\n# TYPE yagi_goroutines gauge\nyagi_goroutines %d\n", s.goroutines)
+	if s.openFDs >= 0 {
+		fmt.Fprintf(w, "# HELP yagi_open_fds Number of open file descriptors.\n# TYPE yagi_open_fds gauge\nyagi_open_fds %d\n", s.openFDs)
+	}
+	fmt.Fprintf(w, "# HELP yagi_heap_bytes Bytes of allocated heap objects.\n# TYPE yagi_heap_bytes gauge\nyagi_heap_bytes %d\n", s.heapBytes)
+	fmt.Fprintf(w, "# HELP yagi_leak_warnings_total Sustained growth warnings logged by the watchdog.\n# TYPE yagi_leak_warnings_total counter\nyagi_leak_warnings_total %d\n", warnings)
+}
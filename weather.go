@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weatherClient answers getWeather with an Open-Meteo compatible forecast
+// API and geocoding API, which need no key.
+type weatherClient struct {
+	forecastURL  string
+	geocodingURL string
+	client       *http.Client
+}
+
+func newWeatherClient(forecastURL, geocodingURL string) *weatherClient {
+	return &weatherClient{
+		forecastURL:  strings.TrimSuffix(forecastURL, "/"),
+		geocodingURL: strings.TrimSuffix(geocodingURL, "/"),
+		client:       &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// place is a geocoded location.
+type place struct {
+	Name      string  `json:"name"`
+	Admin1    string  `json:"admin1"`
+	Country   string  `json:"country"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (p place) String() string {
+	parts := []string{p.Name}
+	if p.Admin1 != "" && p.Admin1 != p.Name {
+		parts = append(parts, p.Admin1)
+	}
+	if p.Country != "" {
+		parts = append(parts, p.Country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (wc *weatherClient) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion())
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("weather service returned %s: %s", resp.Status, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// geocode finds the place best matching name, such as "Osaka" or "Paris,
+// Texas". Text after a comma narrows down the matches by region or
+// country.
+func (wc *weatherClient) geocode(ctx context.Context, name string) (place, error) {
+	city, region, _ := strings.Cut(name, ",")
+	q := url.Values{"name": {strings.TrimSpace(city)}, "count": {"10"}, "language": {"en"}, "format": {"json"}}
+	var res struct {
+		Results []place `json:"results"`
+	}
+	if err := wc.getJSON(ctx, wc.geocodingURL+"/search?"+q.Encode(), &res); err != nil {
+		return place{}, err
+	}
+	if len(res.Results) == 0 {
+		return place{}, fmt.Errorf("no place called %q was found", name)
+	}
+	if region = strings.ToLower(strings.TrimSpace(region)); region != "" {
+		for _, p := range res.Results {
+			if strings.Contains(strings.ToLower(p.Admin1+" "+p.Country), region) {
+				return p, nil
+			}
+		}
+	}
+	return res.Results[0], nil
+}
+
+// forecast is the part of an Open-Meteo forecast getWeather reports.
+type forecast struct {
+	Timezone string `json:"timezone"`
+	Current  struct {
+		Time          string  `json:"time"`
+		Temperature   float64 `json:"temperature_2m"`
+		Apparent      float64 `json:"apparent_temperature"`
+		Humidity      float64 `json:"relative_humidity_2m"`
+		Precipitation float64 `json:"precipitation"`
+		WeatherCode   int     `json:"weather_code"`
+		WindSpeed     float64 `json:"wind_speed_10m"`
+	} `json:"current"`
+	CurrentUnits map[string]string `json:"current_units"`
+	Daily        struct {
+		Time             []string  `json:"time"`
+		WeatherCode      []int     `json:"weather_code"`
+		TemperatureMax   []float64 `json:"temperature_2m_max"`
+		TemperatureMin   []float64 `json:"temperature_2m_min"`
+		Precipitation    []float64 `json:"precipitation_sum"`
+		PrecipitationMax []*int    `json:"precipitation_probability_max"`
+		WindSpeedMax     []float64 `json:"wind_speed_10m_max"`
+	} `json:"daily"`
+}
+
+func (wc *weatherClient) tool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Location string `json:"location"`
+		Days     int    `json:"days"`
+		Units    string `json:"units"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Location) == "" {
+		return "", errors.New("location is required")
+	}
+	if p.Days <= 0 {
+		p.Days = 3
+	}
+	p.Days = min(p.Days, 16)
+	pl, err := wc.geocode(ctx, p.Location)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"latitude":      {strconv.FormatFloat(pl.Latitude, 'f', 4, 64)},
+		"longitude":     {strconv.FormatFloat(pl.Longitude, 'f', 4, 64)},
+		"current":       {"temperature_2m,apparent_temperature,relative_humidity_2m,precipitation,weather_code,wind_speed_10m"},
+		"daily":         {"weather_code,temperature_2m_max,temperature_2m_min,precipitation_sum,precipitation_probability_max,wind_speed_10m_max"},
+		"timezone":      {"auto"},
+		"forecast_days": {strconv.Itoa(p.Days)},
+	}
+	if p.Units == "imperial" {
+		q.Set("temperature_unit", "fahrenheit")
+		q.Set("wind_speed_unit", "mph")
+		q.Set("precipitation_unit", "inch")
+	}
+	var f forecast
+	if err := wc.getJSON(ctx, wc.forecastURL+"/forecast?"+q.Encode(), &f); err != nil {
+		return "", err
+	}
+	return describeForecast(pl, f), nil
+}
+
+func describeForecast(pl place, f forecast) string {
+	temp, wind, rain := f.CurrentUnits["temperature_2m"], f.CurrentUnits["wind_speed_10m"], f.CurrentUnits["precipitation"]
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%.2f, %.2f), local time zone %s\n", pl, pl.Latitude, pl.Longitude, f.Timezone)
+	c := f.Current
+	fmt.Fprintf(&sb, "Now (%s local): %s, %.1f%s (feels like %.1f%s), humidity %.0f%%, wind %.0f %s",
+		strings.Replace(c.Time, "T", " ", 1), weatherDescription(c.WeatherCode), c.Temperature, temp, c.Apparent, temp, c.Humidity, c.WindSpeed, wind)
+	if c.Precipitation > 0 {
+		fmt.Fprintf(&sb, ", precipitation %.1f %s", c.Precipitation, rain)
+	}
+	sb.WriteString("\nForecast:\n")
+	d := f.Daily
+	for i, day := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TemperatureMax) || i >= len(d.TemperatureMin) {
+			break
+		}
+		label := day
+		if t, err := time.Parse(time.DateOnly, day); err == nil {
+			label = t.Format("2006-01-02 (Mon)")
+		}
+		fmt.Fprintf(&sb, "- %s: %s, %.0f–%.0f%s", label, weatherDescription(d.WeatherCode[i]), d.TemperatureMin[i], d.TemperatureMax[i], temp)
+		if i < len(d.Precipitation) && d.Precipitation[i] > 0 {
+			fmt.Fprintf(&sb, ", precipitation %.1f %s", d.Precipitation[i], rain)
+		}
+		if i < len(d.PrecipitationMax) && d.PrecipitationMax[i] != nil {
+			fmt.Fprintf(&sb, ", chance of precipitation %d%%", *d.PrecipitationMax[i])
+		}
+		if i < len(d.WindSpeedMax) {
+			fmt.Fprintf(&sb, ", wind up to %.0f %s", d.WindSpeedMax[i], wind)
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// weatherDescription names a WMO weather code.
+func weatherDescription(code int) string {
+	switch code {
+	case 0:
+		return "clear sky"
+	case 1:
+		return "mainly clear"
+	case 2:
+		return "partly cloudy"
+	case 3:
+		return "overcast"
+	case 45, 48:
+		return "fog"
+	case 51, 53, 55:
+		return "drizzle"
+	case 56, 57:
+		return "freezing drizzle"
+	case 61:
+		return "light rain"
+	case 63:
+		return "rain"
+	case 65:
+		return "heavy rain"
+	case 66, 67:
+		return "freezing rain"
+	case 71:
+		return "light snow"
+	case 73:
+		return "snow"
+	case 75:
+		return "heavy snow"
+	case 77:
+		return "snow grains"
+	case 80, 81:
+		return "rain showers"
+	case 82:
+		return "violent rain showers"
+	case 85, 86:
+		return "snow showers"
+	case 95:
+		return "thunderstorm"
+	case 96, 99:
+		return "thunderstorm with hail"
+	}
+	return fmt.Sprintf("weather code %d", code)
+}
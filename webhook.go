@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/yagi-agent/yagi/engine"
+)
+
+const (
+	// webhookMaxBody bounds the size of an event payload.
+	webhookMaxBody = 10 << 20
+	// webhookMaxCommits is how many commits of a push are described.
+	webhookMaxCommits = 20
+
+	webhookPrompt = "You announce GitHub activity in a Discord channel. Write a short, human-readable summary of the event below: " +
+		"what changed and why it matters, in two to four sentences or a few bullet points. " +
+		"Do not repeat the links. Reply with only the summary."
+)
+
+// githubWebhook receives GitHub webhook events, summarizes pushes, pull
+// requests and issues with the model and posts them to the channel mapped
+// to their repository.
+type githubWebhook struct {
+	secret []byte
+	// routes maps "owner/repo", "owner/*" or "*" to a channel ID.
+	routes  map[string]string
+	eng     *engine.Engine
+	replies *outbox
+	s       *discordgo.Session
+}
+
+// parseWebhookRoutes parses "owner/repo=channelID" pairs separated by
+// commas. "owner/*" matches the repositories of an owner, "*" any.
+func parseWebhookRoutes(s string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		repo, channelID, ok := strings.Cut(pair, "=")
+		repo, channelID = strings.ToLower(strings.TrimSpace(repo)), strings.TrimSpace(channelID)
+		if !ok || repo == "" || channelID == "" || (repo != "*" && !strings.Contains(repo, "/")) {
+			return nil, fmt.Errorf("invalid route %q: use owner/repo=channelID", pair)
+		}
+		routes[repo] = channelID
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no routes given")
+	}
+	return routes, nil
+}
+
+// route returns the channel for the repository fullName, or "".
+func (wh *githubWebhook) route(fullName string) string {
+	fullName = strings.ToLower(fullName)
+	if ch, ok := wh.routes[fullName]; ok {
+		return ch
+	}
+	owner, _, _ := strings.Cut(fullName, "/")
+	if ch, ok := wh.routes[owner+"/*"]; ok {
+		return ch
+	}
+	return wh.routes["*"]
+}
+
+// verify checks the X-Hub-Signature-256 header against body.
+func (wh *githubWebhook) verify(body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// ServeHTTP accepts an event and handles it in the background, since GitHub
+// gives up on deliveries that take more than ten seconds.
+func (wh *githubWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, webhookMaxBody+1))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > webhookMaxBody {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !wh.verify(body, r.Header.Get("X-Hub-Signature-256")) {
+		slog.Warn("rejected webhook with a bad signature", "remote", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	event, delivery := r.Header.Get("X-GitHub-Event"), r.Header.Get("X-GitHub-Delivery")
+	if event == "ping" {
+		fmt.Fprintln(w, "pong")
+		return
+	}
+	var ev githubEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	log := slog.With("event", event, "delivery", delivery, "repo", ev.Repository.FullName)
+	channelID := wh.route(ev.Repository.FullName)
+	if channelID == "" {
+		log.Info("no channel for webhook repository")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	facts, link := ev.describe(event)
+	if facts == "" {
+		log.Debug("ignored webhook event", "action", ev.Action)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	go wh.post(log, channelID, facts, link)
+}
+
+// post summarizes an event described by facts and posts it with link.
+func (wh *githubWebhook) post(log *slog.Logger, channelID, facts, link string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if ch, err := channel(wh.s, channelID); err == nil {
+		ctx = context.WithValue(ctx, ctxKeyGuildID, ch.GuildID)
+	}
+	headline, _, _ := strings.Cut(facts, "\n")
+	summary, err := complete(ctx, wh.eng, webhookPrompt, facts)
+	if err != nil {
+		log.Warn("failed to summarize webhook event; posting it as is", "err", err)
+		summary = strings.TrimSpace(strings.TrimPrefix(facts, headline))
+	}
+	content := "**" + headline + "**"
+	if link != "" {
+		content += "\n<" + link + ">"
+	}
+	if summary != "" {
+		content += "\n" + summary
+	}
+	wh.replies.send(wh.s, channelID, nil, content)
+	log.Info("posted webhook event", "channel", channelID)
+}
+
+// githubEvent holds the fields of push, pull_request and issues payloads
+// that are described.
+type githubEvent struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender githubUser `json:"sender"`
+
+	// push
+	Ref     string `json:"ref"`
+	Compare string `json:"compare"`
+	Forced  bool   `json:"forced"`
+	Deleted bool   `json:"deleted"`
+	Commits []struct {
+		Message string `json:"message"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+
+	PullRequest *struct {
+		githubIssue
+		Merged bool `json:"merged"`
+		Draft  bool `json:"draft"`
+		Base   struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		Head struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	} `json:"pull_request"`
+	Issue *githubIssue `json:"issue"`
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+type githubIssue struct {
+	Number  int        `json:"number"`
+	Title   string     `json:"title"`
+	Body    string     `json:"body"`
+	HTMLURL string     `json:"html_url"`
+	User    githubUser `json:"user"`
+	Labels  []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+// describe renders the event as plain facts for the model, headline first,
+// and returns the link to it. Events not worth a post yield "".
+func (ev *githubEvent) describe(event string) (string, string) {
+	repo := ev.Repository.FullName
+	var sb strings.Builder
+	switch event {
+	case "push":
+		branch := strings.TrimPrefix(strings.TrimPrefix(ev.Ref, "refs/heads/"), "refs/tags/")
+		if ev.Deleted || len(ev.Commits) == 0 {
+			return "", ""
+		}
+		fmt.Fprintf(&sb, "%s pushed %d commit(s) to %s on %s", ev.Sender.Login, len(ev.Commits), branch, repo)
+		if ev.Forced {
+			sb.WriteString(" (force-push)")
+		}
+		sb.WriteString("\n")
+		for i, c := range ev.Commits {
+			if i == webhookMaxCommits {
+				fmt.Fprintf(&sb, "… and %d more commits\n", len(ev.Commits)-i)
+				break
+			}
+			fmt.Fprintf(&sb, "- %s (%s)\n", strings.TrimSpace(c.Message), c.Author.Name)
+		}
+		return sb.String(), ev.Compare
+	case "pull_request":
+		pr := ev.PullRequest
+		if pr == nil {
+			return "", ""
+		}
+		action := ev.Action
+		switch action {
+		case "opened", "reopened", "ready_for_review":
+		case "closed":
+			if pr.Merged {
+				action = "merged"
+			}
+		default:
+			return "", ""
+		}
+		fmt.Fprintf(&sb, "%s %s pull request #%d in %s: %s\n", ev.Sender.Login, action, pr.Number, repo, pr.Title)
+		fmt.Fprintf(&sb, "Author: %s. Branch %s into %s.", pr.User.Login, pr.Head.Ref, pr.Base.Ref)
+		if pr.Draft {
+			sb.WriteString(" Draft.")
+		}
+		writeIssueDetails(&sb, &pr.githubIssue)
+		return sb.String(), pr.HTMLURL
+	case "issues":
+		is := ev.Issue
+		if is == nil {
+			return "", ""
+		}
+		switch ev.Action {
+		case "opened", "closed", "reopened":
+		default:
+			return "", ""
+		}
+		fmt.Fprintf(&sb, "%s %s issue #%d in %s: %s\n", ev.Sender.Login, ev.Action, is.Number, repo, is.Title)
+		fmt.Fprintf(&sb, "Author: %s.", is.User.Login)
+		writeIssueDetails(&sb, is)
+		return sb.String(), is.HTMLURL
+	}
+	return "", ""
+}
+
+// writeIssueDetails adds the labels and the start of the description.
+func writeIssueDetails(sb *strings.Builder, is *githubIssue) {
+	if len(is.Labels) > 0 {
+		names := make([]string, len(is.Labels))
+		for i, l := range is.Labels {
+			names[i] = l.Name
+		}
+		sb.WriteString(" Labels: " + strings.Join(names, ", ") + ".")
+	}
+	if body := []rune(strings.TrimSpace(is.Body)); len(body) > 0 {
+		if len(body) > 4000 {
+			body = append(body[:4000], '…')
+		}
+		sb.WriteString("\n\n" + string(body))
+	}
+	sb.WriteString("\n")
+}
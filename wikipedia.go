@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// wikipediaExtractChars bounds the article text returned to the model.
+const wikipediaExtractChars = 4000
+
+var wikiLangRe = regexp.MustCompile(`^[a-z][a-z-]{1,11}$`)
+
+// wikipedia answers lookupWikipedia with the MediaWiki API of each
+// language's Wikipedia.
+type wikipedia struct {
+	// baseURL is the API URL with %s for the language.
+	baseURL string
+	client  *http.Client
+}
+
+func newWikipedia() *wikipedia {
+	return &wikipedia{baseURL: "https://%s.wikipedia.org/w/api.php", client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+func (w *wikipedia) get(ctx context.Context, lang string, q url.Values, v any) error {
+	q.Set("format", "json")
+	q.Set("formatversion", "2")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(w.baseURL, lang)+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	// Wikimedia asks API clients to identify themselves.
+	req.Header.Set("User-Agent", "yagi-discord-bot/"+currentVersion()+" (https://github.com/yagi-agent/yagi-discord-bot)")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 2<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Wikipedia returned %s", resp.Status)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// search returns the titles of the articles best matching query.
+func (w *wikipedia) search(ctx context.Context, lang, query string) ([]string, error) {
+	var res struct {
+		Query struct {
+			Search []struct {
+				Title string `json:"title"`
+			} `json:"search"`
+		} `json:"query"`
+	}
+	q := url.Values{"action": {"query"}, "list": {"search"}, "srsearch": {query}, "srlimit": {"5"}}
+	if err := w.get(ctx, lang, q, &res); err != nil {
+		return nil, err
+	}
+	titles := make([]string, len(res.Query.Search))
+	for i, s := range res.Query.Search {
+		titles[i] = s.Title
+	}
+	return titles, nil
+}
+
+// wikiPage is the plain-text extract of an article.
+type wikiPage struct {
+	Title   string `json:"title"`
+	Extract string `json:"extract"`
+	URL     string `json:"fullurl"`
+	Missing bool   `json:"missing"`
+}
+
+// page returns the extract of the article title, its introduction only
+// unless full.
+func (w *wikipedia) page(ctx context.Context, lang, title string, full bool) (wikiPage, error) {
+	var res struct {
+		Query struct {
+			Pages []wikiPage `json:"pages"`
+		} `json:"query"`
+	}
+	q := url.Values{
+		"action":      {"query"},
+		"prop":        {"extracts|info"},
+		"inprop":      {"url"},
+		"explaintext": {"1"},
+		"redirects":   {"1"},
+		"titles":      {title},
+	}
+	if !full {
+		q.Set("exintro", "1")
+	}
+	if err := w.get(ctx, lang, q, &res); err != nil {
+		return wikiPage{}, err
+	}
+	if len(res.Query.Pages) == 0 || res.Query.Pages[0].Missing {
+		return wikiPage{}, fmt.Errorf("no article called %q", title)
+	}
+	return res.Query.Pages[0], nil
+}
+
+func (w *wikipedia) tool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Query    string `json:"query"`
+		Language string `json:"language"`
+		Full     bool   `json:"full"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(p.Query) == "" {
+		return "", errors.New("query is required")
+	}
+	lang := strings.ToLower(strings.TrimSpace(p.Language))
+	if lang == "" {
+		lang = "en"
+	}
+	if !wikiLangRe.MatchString(lang) {
+		return "", fmt.Errorf("invalid language code %q", p.Language)
+	}
+	titles, err := w.search(ctx, lang, p.Query)
+	if err != nil {
+		return "", err
+	}
+	if len(titles) == 0 && lang != "en" {
+		// Many topics only have an article in English.
+		lang = "en"
+		if titles, err = w.search(ctx, lang, p.Query); err != nil {
+			return "", err
+		}
+	}
+	if len(titles) == 0 {
+		return fmt.Sprintf("No Wikipedia article matches %q.", p.Query), nil
+	}
+	pg, err := w.page(ctx, lang, titles[0], p.Full)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s (%s.wikipedia.org)\n%s\n\n%s", pg.Title, lang, pg.URL, truncateRunes(strings.TrimSpace(pg.Extract), wikipediaExtractChars))
+	if len(titles) > 1 {
+		fmt.Fprintf(&sb, "\n\nOther matching articles: %s", strings.Join(titles[1:], "; "))
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// transcriptChunkChars is the size of the parts a transcript is returned
+// in, small enough for the model to read one at a time.
+const transcriptChunkChars = 6000
+
+var youTubeIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// youTubeID returns the video ID of a YouTube URL, or s itself if it is an
+// ID.
+func youTubeID(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if youTubeIDRe.MatchString(s) {
+		return s, true
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", false
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(u.Hostname(), "www."), "m.")
+	var id string
+	switch host {
+	case "youtu.be":
+		id = strings.Trim(u.Path, "/")
+	case "youtube.com", "music.youtube.com", "youtube-nocookie.com":
+		if v := u.Query().Get("v"); v != "" {
+			id = v
+		} else if parts := strings.Split(strings.Trim(u.Path, "/"), "/"); len(parts) == 2 {
+			switch parts[0] {
+			case "shorts", "embed", "live", "v":
+				id = parts[1]
+			}
+		}
+	}
+	return id, youTubeIDRe.MatchString(id)
+}
+
+// youTube fetches the captions of videos, as the YouTube web player does.
+type youTube struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newYouTube() *youTube {
+	return &youTube{baseURL: "https://www.youtube.com", client: &http.Client{Timeout: 20 * time.Second}}
+}
+
+// captionTrack is one language of a video's captions.
+type captionTrack struct {
+	BaseURL      string `json:"baseUrl"`
+	LanguageCode string `json:"languageCode"`
+	Kind         string `json:"kind"`
+	Name         struct {
+		SimpleText string `json:"simpleText"`
+	} `json:"name"`
+}
+
+// videoInfo is the part of a video's player response
+// getYouTubeTranscript uses.
+type videoInfo struct {
+	PlayabilityStatus struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	} `json:"playabilityStatus"`
+	VideoDetails struct {
+		Title         string `json:"title"`
+		Author        string `json:"author"`
+		LengthSeconds string `json:"lengthSeconds"`
+	} `json:"videoDetails"`
+	Captions struct {
+		Renderer struct {
+			Tracks []captionTrack `json:"captionTracks"`
+		} `json:"playerCaptionsTracklistRenderer"`
+	} `json:"captions"`
+}
+
+func (yt *youTube) get(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; yagi-discord-bot/"+currentVersion()+")")
+	req.Header.Set("Accept-Language", "en")
+	// Skip the cookie consent page shown in the EU.
+	req.AddCookie(&http.Cookie{Name: "CONSENT", Value: "YES+1"})
+	resp, err := yt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("YouTube returned %s", resp.Status)
+	}
+	return data, nil
+}
+
+// info reads the player response embedded in the watch page of id.
+func (yt *youTube) info(ctx context.Context, id string) (videoInfo, error) {
+	var info videoInfo
+	page, err := yt.get(ctx, yt.baseURL+"/watch?v="+id)
+	if err != nil {
+		return info, err
+	}
+	const marker = "ytInitialPlayerResponse = "
+	i := bytes.Index(page, []byte(marker))
+	if i < 0 {
+		return info, errors.New("could not read the video page")
+	}
+	dec := json.NewDecoder(bytes.NewReader(page[i+len(marker):]))
+	if err := dec.Decode(&info); err != nil {
+		return info, fmt.Errorf("could not read the video page: %w", err)
+	}
+	if s := info.PlayabilityStatus.Status; s != "OK" && s != "" {
+		return info, fmt.Errorf("the video is not available: %s", cmp.Or(info.PlayabilityStatus.Reason, s))
+	}
+	return info, nil
+}
+
+// pickTrack chooses the captions in lang, preferring those written by
+// people over automatic ones, then English, then the first track.
+func pickTrack(tracks []captionTrack, lang string) captionTrack {
+	best, bestScore := tracks[0], -1
+	for _, t := range tracks {
+		score := 0
+		switch {
+		case lang != "" && strings.EqualFold(t.LanguageCode, lang), lang != "" && strings.HasPrefix(strings.ToLower(t.LanguageCode), strings.ToLower(lang)+"-"):
+			score = 4
+		case strings.HasPrefix(t.LanguageCode, "en"):
+			score = 2
+		}
+		if t.Kind != "asr" {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+	return best
+}
+
+// transcript fetches track as lines of text prefixed with their start
+// time.
+func (yt *youTube) transcript(ctx context.Context, track captionTrack) ([]string, error) {
+	data, err := yt.get(ctx, track.BaseURL+"&fmt=json3")
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Events []struct {
+			StartMs int64 `json:"tStartMs"`
+			Segs    []struct {
+				UTF8 string `json:"utf8"`
+			} `json:"segs"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("could not read the captions: %w", err)
+	}
+	var lines []string
+	for _, ev := range res.Events {
+		var sb strings.Builder
+		for _, s := range ev.Segs {
+			sb.WriteString(s.UTF8)
+		}
+		text := strings.Join(strings.Fields(html.UnescapeString(sb.String())), " ")
+		if text == "" {
+			continue
+		}
+		d := time.Duration(ev.StartMs) * time.Millisecond
+		lines = append(lines, fmt.Sprintf("[%s] %s", formatOffset(d), text))
+	}
+	return lines, nil
+}
+
+func (yt *youTube) tool(ctx context.Context, args string) (string, error) {
+	var p struct {
+		Video    string `json:"video"`
+		Language string `json:"language"`
+		Part     int    `json:"part"`
+	}
+	if err := json.Unmarshal([]byte(args), &p); err != nil {
+		return "", err
+	}
+	id, ok := youTubeID(p.Video)
+	if !ok {
+		return "", fmt.Errorf("%q is not a YouTube video link", p.Video)
+	}
+	info, err := yt.info(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	tracks := info.Captions.Renderer.Tracks
+	if len(tracks) == 0 {
+		return "", errors.New("the video has no captions")
+	}
+	track := pickTrack(tracks, p.Language)
+	lines, err := yt.transcript(ctx, track)
+	if err != nil {
+		return "", err
+	}
+	chunks := chunkLines(lines, transcriptChunkChars)
+	if len(chunks) == 0 {
+		return "", errors.New("the captions are empty")
+	}
+	part := max(p.Part, 1)
+	if part > len(chunks) {
+		return "", fmt.Errorf("the transcript only has %d parts", len(chunks))
+	}
+
+	var sb strings.Builder
+	v := info.VideoDetails
+	fmt.Fprintf(&sb, "%q by %s", v.Title, v.Author)
+	var secs int
+	if _, err := fmt.Sscan(v.LengthSeconds, &secs); err == nil && secs > 0 {
+		fmt.Fprintf(&sb, " (%s)", formatOffset(time.Duration(secs)*time.Second))
+	}
+	kind := "captions"
+	if track.Kind == "asr" {
+		kind = "automatic captions"
+	}
+	fmt.Fprintf(&sb, "\nTranscript from the %s in %s, part %d of %d:\n\n%s", kind, cmp.Or(track.Name.SimpleText, track.LanguageCode), part, len(chunks), strings.TrimSpace(chunks[part-1]))
+	if part < len(chunks) {
+		fmt.Fprintf(&sb, "\n\n(Call again with part %d for the rest.)", part+1)
+	}
+	return sb.String(), nil
+}